@@ -30,6 +30,7 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/uukuguy/kds/haystack"
 	"os"
 )
 
@@ -58,6 +59,8 @@ func init() {
 
 	//Persistent Flags which will work for this command and all subcommands.
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.kds.yaml)")
+	RootCmd.PersistentFlags().String("master-key-file", "", "Master key file to encrypt volume data, 32 bytes raw or in hex. Also master_key_file in config file.")
+	viper.BindPFlag("master_key_file", RootCmd.PersistentFlags().Lookup("master-key-file"))
 
 	// Local flags, which will only run when this action is called directly.
 	RootCmd.Flags().BoolP("vmodule", "v", false, "glog vmodule. -v=1 for debug.")
@@ -85,6 +88,21 @@ func initConfig() {
 
 }
 
+// -------- loadMasterKey() --------
+// Master key from the key file of viper key master_key_file, nil if not configured.
+func loadMasterKey() []byte {
+	filename := viper.GetString("master_key_file")
+	if filename == "" {
+		return nil
+	}
+	key, err := haystack.LoadMasterKey(filename)
+	if err != nil {
+		fmt.Printf("Load master key failed. %v\n", err)
+		os.Exit(-1)
+	}
+	return key
+}
+
 // -------- execute_rootCmd() --------
 func execute_rootCmd(cmd *cobra.Command, args []string) {
 	fmt.Println("Execute rootCmd.")
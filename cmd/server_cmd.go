@@ -30,11 +30,14 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/uukuguy/kds/haystack"
 	"github.com/uukuguy/kds/server"
 	"github.com/uukuguy/kds/utils"
 	"net/http"
 	"runtime"
 	"strconv"
+	"time"
 )
 
 // -------- serverCmd *cobra.Command --------
@@ -48,7 +51,10 @@ var serverCmd = &cobra.Command{
 var server_name = server.SERVER_DEFAULT_NAME
 var server_ip = server.SERVER_DEFAULT_IP
 var server_port = server.SERVER_DEFAULT_PORT
-var store_dir = server.SERVER_DEFAULT_STOREDIR
+var store_dirs []string
+var store_config = haystack.NewConfig()
+var compact_threshold float64
+var volume_ttl string
 
 // -------- init() --------
 func init() {
@@ -59,10 +65,58 @@ func init() {
 		&server_ip, "ip", server.SERVER_DEFAULT_IP, "Server IP.")
 	serverCmd.PersistentFlags().IntVar(
 		&server_port, "port", server.SERVER_DEFAULT_PORT, "Server port.")
-	serverCmd.PersistentFlags().StringVar(
-		&store_dir, "dir", server.SERVER_DEFAULT_STOREDIR, "Store Dir.")
+	serverCmd.PersistentFlags().StringSliceVar(
+		&store_dirs, "dir", []string{server.SERVER_DEFAULT_STOREDIR}, "Store dirs, one per disk, each as dir or dir:capacity, e.g. /data1:4T,/data2:4T.")
 	serverCmd.PersistentFlags().StringVar(
 		&server_name, "name", server.SERVER_DEFAULT_NAME, "Server Name.")
+	serverCmd.PersistentFlags().String("admin-token", "", "Token required in header "+server.ADMIN_TOKEN_HEADER+" by the admin API, empty to disable it. Also admin_token in config file or ADMIN_TOKEN.")
+	viper.BindPFlag("admin_token", serverCmd.PersistentFlags().Lookup("admin-token"))
+	serverCmd.PersistentFlags().Float64Var(
+		&compact_threshold, "compact-threshold", haystack.COMPACT_DEFAULT_THRESHOLD, "Outdated data rate to compact volume automatically. 0 to disable.")
+	serverCmd.PersistentFlags().Uint64Var(
+		&store_config.CompactMinSize, "compact-minsize", haystack.COMPACT_DEFAULT_MINSIZE, "Minimal outdated bytes to compact volume automatically.")
+	serverCmd.PersistentFlags().Uint64Var(
+		&store_config.VolumeMaxSize, "volume-maxsize", haystack.VOLUME_DEFAULT_MAXSIZE, "Seal volume and roll over to a new one beyond the data file size.")
+	serverCmd.PersistentFlags().Uint64Var(
+		&store_config.NeedleMaxSize, "needle-maxsize", haystack.NEEDLE_DEFAULT_MAXSIZE, "Max data bytes of an uploaded needle.")
+	serverCmd.PersistentFlags().Uint64Var(
+		&store_config.ChunkSize, "chunk-size", haystack.CHUNK_DEFAULT_SIZE, "Split larger uploads into chunk needles of the size.")
+	serverCmd.PersistentFlags().Uint64Var(
+		&store_config.ObjectMaxSize, "object-maxsize", haystack.OBJECT_DEFAULT_MAXSIZE, "Max data bytes of an uploaded object.")
+	serverCmd.PersistentFlags().Uint64Var(
+		&store_config.CheckpointEntries, "checkpoint-entries", haystack.CHECKPOINT_DEFAULT_ENTRIES, "Write index checkpoint every so many index entries. 0 to disable.")
+	serverCmd.PersistentFlags().StringVar(
+		&store_config.IndexMode, "index-mode", haystack.INDEX_MODE_MEMORY, "Index mode of new volumes: memory or disk.")
+	serverCmd.PersistentFlags().StringVar(
+		&store_config.Collection, "collection", "", "Collection name recorded in new volumes.")
+	serverCmd.PersistentFlags().StringVar(
+		&store_config.Replication, "replication", "", "Replication setting recorded in new volumes.")
+	serverCmd.PersistentFlags().StringVar(
+		&volume_ttl, "volume-ttl", "", "Default TTL of needles in new volumes, e.g. 3600, 12h or 7d.")
+	serverCmd.PersistentFlags().StringVar(
+		&store_config.VolumeCodec, "volume-codec", "", "Compress all needles uploaded to new volumes with the codec, e.g. gzip.")
+	serverCmd.PersistentFlags().StringSliceVar(
+		&store_config.CompressTypes, "compress-types", nil, "Compress uploaded needles of the content types or prefixes, e.g. text/,application/json.")
+	serverCmd.PersistentFlags().StringVar(
+		&store_config.CompressCodec, "compress-codec", haystack.COMPRESS_DEFAULT_CODEC, "Codec to compress needles of --compress-types.")
+	serverCmd.PersistentFlags().StringSliceVar(
+		&store_config.EcDirs, "ec-dirs", nil, "Directories of erasure coding shards of volumes.")
+	serverCmd.PersistentFlags().BoolVar(
+		&store_config.Dedup, "dedup", false, "Store identical uploads once, later copies reference the first.")
+	serverCmd.PersistentFlags().StringVar(
+		&store_config.ColdDir, "cold-dir", "", "Cold tier directory to move rarely read sealed volumes to. Empty to disable tiering.")
+	serverCmd.PersistentFlags().Float64Var(
+		&store_config.TierDemoteRate, "tier-demote-rate", haystack.TIER_DEFAULT_DEMOTE_RATE, "Move sealed volumes read less than so many times per second to the cold tier.")
+	serverCmd.PersistentFlags().Float64Var(
+		&store_config.TierPromoteRate, "tier-promote-rate", haystack.TIER_DEFAULT_PROMOTE_RATE, "Move cold volumes read more than so many times per second back.")
+	serverCmd.PersistentFlags().DurationVar(
+		&store_config.TierColdAfter, "tier-cold-after", haystack.TIER_DEFAULT_COLD_AFTER, "How long the read rate stays below the demote rate before moving a volume to the cold tier.")
+	serverCmd.PersistentFlags().StringVar(
+		&store_config.SyncPolicy, "sync-policy", haystack.SYNC_POLICY_ALWAYS, "When to fsync writes: always, interval or bytes.")
+	serverCmd.PersistentFlags().DurationVar(
+		&store_config.SyncInterval, "sync-interval", haystack.SYNC_DEFAULT_INTERVAL, "Fsync interval of sync policy interval.")
+	serverCmd.PersistentFlags().Uint64Var(
+		&store_config.SyncBytes, "sync-bytes", haystack.SYNC_DEFAULT_BYTES, "Unsynced bytes to fsync of sync policy bytes.")
 
 	// Local flags, which will only run when this action is called directly.
 	serverCmd.Flags().IntP("vmodule", "v", 0, "glog vmodule. -v=1 for debug.")
@@ -84,17 +138,39 @@ func setRateLimitHandler(handler http.Handler) http.Handler {
 	//}
 }
 
+// -------- parseDisks() --------
+func parseDisks() (disks []*haystack.Disk) {
+	for _, spec := range store_dirs {
+		disk, err := haystack.ParseDisk(spec)
+		if err != nil {
+			utils.FatalIf(err, "Invalid store dir.")
+		}
+		disks = append(disks, disk)
+	}
+	return
+}
+
 // -------- execute_serverCmd() --------
 func execute_serverCmd(cmd *cobra.Command, args []string) {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	utils.LogInfof("Kleine Dateien Stack - Server...")
 
+	store_config.CompactThreshold = float32(compact_threshold)
+
 	var ss *server.StackServer
 	var err error
-	if ss, err = server.NewStackServer(server_ip, server_port, store_dir); err != nil {
+	var ttl uint32
+	if ttl, err = haystack.ParseTTL(volume_ttl); err != nil {
+		utils.FatalIf(err, "Invalid volume TTL.")
+	}
+	store_config.VolumeTTL = time.Duration(ttl) * time.Second
+	store_config.MasterKey = loadMasterKey()
+	if ss, err = server.NewStackServer(server_ip, server_port, parseDisks(), store_config); err != nil {
+		utils.FatalIf(err, "Failed to init kds store.", "store_dirs:", store_dirs)
 	}
 	defer ss.Close()
+	ss.SetAdminToken(viper.GetString("admin_token"))
 
 	ss.ListenAndServe()
 }
@@ -110,7 +186,20 @@ func execute_serverCmd_Mux(cmd *cobra.Command, args []string) {
 	root_router := router.NewRoute().PathPrefix("/").Subrouter()
 	bucket_router := root_router.PathPrefix("/{bucket}").Subrouter()
 
-	object_handlers := server.ObjectHandlers{}
+	store_config.CompactThreshold = float32(compact_threshold)
+	if ttl, err := haystack.ParseTTL(volume_ttl); err != nil {
+		utils.FatalIf(err, "Invalid volume TTL.")
+	} else {
+		store_config.VolumeTTL = time.Duration(ttl) * time.Second
+	}
+	store_config.MasterKey = loadMasterKey()
+	store := haystack.NewDiskStore(parseDisks(), store_config)
+	if err := store.Init(); err != nil {
+		utils.FatalIf(err, "Failed to init kds store.", "store_dirs:", store_dirs)
+	}
+	defer store.Close()
+
+	object_handlers := server.ObjectHandlers{Store: store}
 	bucket_router.Methods("GET").Path("/{object:.+}").HandlerFunc(object_handlers.Handle_GetObject)
 	bucket_router.Methods("PUT").Path("/{object:.+}").HandlerFunc(object_handlers.Handle_PutObject)
 	bucket_router.Methods("DELETE").Path("/{object:.+}").HandlerFunc(object_handlers.Handle_DeleteObject)
@@ -0,0 +1,274 @@
+/**
+# *　　　　 ┏┓　　 　┏┓+ +
+# *　　　　┏┛┻━━━━━━━┛┻━━┓　 + +
+# *　　　　┃　　　　　　 ┃
+# *　　　　┃━　　━　　 　┃ ++ + + +
+# *　　　 ████━████      ┃+
+# *　　　　┃　　　　　　 ┃ +
+# *　　　　┃　┻　　　    ┃
+# *　　　　┃　　　　　　 ┃ + +
+# *　　　　┗━━━┓　　 　┏━┛
+# *　　　　　　┃　　 　┃
+# *　　　　　　┃　　 　┃ + + + +
+# *　　　　　　┃　　 　┃　　　Code is far away from bug
+# *　　　　　　┃　　 　┃　　　with the animal protecting
+# *　　　　　　┃　　 　┃
+# *　　　　　　┃　　 　┃ + 　　　神兽保佑,代码无bug
+# *　　　　　　┃　　 　┃
+# *　　　　　　┃　　 　┃　　+
+# *　　　　　　┃　 　　┗━━━━━━━┓ + +
+# *　　　　　　┃ 　　　　　　　┣┓
+# *　　　　　　┃ 　　　　　　　┏┛
+# *　　　　　　┗━━┓┓┏━━━━━┳┓┏━━┛ + + + +
+# *　　　　　　　 ┃┫┫　   ┃┫┫
+# *　　　　　　　 ┗┻┛　   ┗┻┛+ + + +
+# */
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/uukuguy/kds/haystack"
+	"github.com/uukuguy/kds/server"
+	"github.com/uukuguy/kds/utils"
+	"os"
+)
+
+// -------- volumeCmd *cobra.Command --------
+var volumeCmd = &cobra.Command{
+	Use:   "volume",
+	Short: "Volume maintenance.",
+	Long:  "Offline maintenance tools for volumes in kds store. Stop the server before using them.",
+	Run:   nil,
+}
+
+// -------- volumeReindexCmd *cobra.Command --------
+var volumeReindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild volume index from data file.",
+	Long:  "Scan all needles in the volume data file and rebuild the index file.",
+	Run:   execute_volumeReindexCmd,
+}
+
+// -------- volumeSealCmd *cobra.Command --------
+var volumeSealCmd = &cobra.Command{
+	Use:   "seal",
+	Short: "Seal volume read-only.",
+	Long:  "Mark the volume read-only. Store writes new needles to another volume.",
+	Run:   execute_volumeSealCmd,
+}
+
+// -------- volumeMigrateCmd *cobra.Command --------
+var volumeMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade volume to the latest format.",
+	Long:  "Rewrite live needles of the volume in the latest format. The volume is replaced in place, or copied to --dest leaving the original unchanged.",
+	Run:   execute_volumeMigrateCmd,
+}
+
+// -------- volumeRekeyCmd *cobra.Command --------
+var volumeRekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Rotate volume data key.",
+	Long:  "Re-encrypt live needles of the volume with a new data key wrapped by the master key. To rotate the master key, pass the current one with --old-master-key-file and the new one with --master-key-file.",
+	Run:   execute_volumeRekeyCmd,
+}
+
+// -------- volumeEcEncodeCmd *cobra.Command --------
+var volumeEcEncodeCmd = &cobra.Command{
+	Use:   "ec-encode",
+	Short: "Erasure code sealed volume.",
+	Long:  "Split the data file of a sealed volume into data and parity shards spread across --ec-dirs, then remove the data file. Reads are served from the shards.",
+	Run:   execute_volumeEcEncodeCmd,
+}
+
+// -------- volumeEcDecodeCmd *cobra.Command --------
+var volumeEcDecodeCmd = &cobra.Command{
+	Use:   "ec-decode",
+	Short: "Restore erasure coded volume.",
+	Long:  "Rebuild the data file of an erasure coded volume from its shards, then remove the shards.",
+	Run:   execute_volumeEcDecodeCmd,
+}
+
+var volume_dir = server.SERVER_DEFAULT_STOREDIR
+var volume_vid int
+var volume_dest string
+var volume_old_master_key_file string
+var volume_ec_dirs []string
+var volume_data_shards int
+var volume_parity_shards int
+
+// -------- init() --------
+func init() {
+	RootCmd.AddCommand(volumeCmd)
+	volumeCmd.AddCommand(volumeReindexCmd)
+	volumeCmd.AddCommand(volumeSealCmd)
+	volumeCmd.AddCommand(volumeMigrateCmd)
+	volumeCmd.AddCommand(volumeRekeyCmd)
+	volumeCmd.AddCommand(volumeEcEncodeCmd)
+	volumeCmd.AddCommand(volumeEcDecodeCmd)
+
+	//Persistent Flags which will work for this command and all subcommands.
+	volumeCmd.PersistentFlags().StringVar(
+		&volume_dir, "dir", server.SERVER_DEFAULT_STOREDIR, "Store Dir.")
+	volumeCmd.PersistentFlags().IntVar(
+		&volume_vid, "vid", -1, "Volume id.")
+	volumeCmd.PersistentFlags().StringSliceVar(
+		&volume_ec_dirs, "ec-dirs", nil, "Directories of erasure coding shards.")
+	volumeMigrateCmd.Flags().StringVar(
+		&volume_dest, "dest", "", "Write the migrated volume to the dir instead of replacing it in place.")
+	volumeEcEncodeCmd.Flags().IntVar(
+		&volume_data_shards, "data-shards", haystack.EC_DEFAULT_DATA_SHARDS, "Number of data shards.")
+	volumeEcEncodeCmd.Flags().IntVar(
+		&volume_parity_shards, "parity-shards", haystack.EC_DEFAULT_PARITY_SHARDS, "Number of parity shards, up to which missing shards can be reconstructed.")
+	volumeRekeyCmd.Flags().StringVar(
+		&volume_old_master_key_file, "old-master-key-file", "", "Current master key file when rotating the master key.")
+}
+
+// -------- checkVolumeFlags() --------
+func checkVolumeFlags() {
+	if volume_vid < 0 {
+		fmt.Println("Volume id is required. Use --vid.")
+		os.Exit(-1)
+	}
+	if !utils.FileExist(fmt.Sprintf("%s/%d.dat", volume_dir, volume_vid)) && !utils.FileExist(fmt.Sprintf("%s/%d%s", volume_dir, volume_vid, haystack.ECMETA_EXT)) {
+		fmt.Printf("Volume %d not exist in %s.\n", volume_vid, volume_dir)
+		os.Exit(-1)
+	}
+}
+
+// -------- volumeConfig() --------
+func volumeConfig() *haystack.Config {
+	config := haystack.NewConfig()
+	config.MasterKey = loadMasterKey()
+	config.EcDirs = volume_ec_dirs
+	return config
+}
+
+// -------- execute_volumeReindexCmd() --------
+func execute_volumeReindexCmd(cmd *cobra.Command, args []string) {
+	checkVolumeFlags()
+
+	volume := haystack.NewVolume(int32(volume_vid), volume_dir, volumeConfig())
+	if err := volume.Reindex(); err != nil {
+		fmt.Printf("Reindex volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+	defer volume.Close()
+
+	fmt.Printf("Reindex volume %d done.\n%s\n", volume_vid, volume.String())
+}
+
+// -------- execute_volumeSealCmd() --------
+func execute_volumeSealCmd(cmd *cobra.Command, args []string) {
+	checkVolumeFlags()
+
+	volume := haystack.NewVolume(int32(volume_vid), volume_dir, volumeConfig())
+	if err := volume.Init(); err != nil {
+		fmt.Printf("Open volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+	defer volume.Close()
+
+	if err := volume.Seal(); err != nil {
+		fmt.Printf("Seal volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("Volume %d sealed.\n", volume_vid)
+}
+
+// -------- execute_volumeMigrateCmd() --------
+func execute_volumeMigrateCmd(cmd *cobra.Command, args []string) {
+	checkVolumeFlags()
+
+	volume := haystack.NewVolume(int32(volume_vid), volume_dir, volumeConfig())
+	if err := volume.Init(); err != nil {
+		fmt.Printf("Open volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+	defer volume.Close()
+
+	if err := volume.Migrate(volume_dest); err != nil {
+		fmt.Printf("Migrate volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+
+	if volume_dest == "" {
+		fmt.Printf("Volume %d migrated.\n%s\n", volume_vid, volume.String())
+	} else {
+		fmt.Printf("Volume %d migrated to %s.\n", volume_vid, volume_dest)
+	}
+}
+
+// -------- execute_volumeRekeyCmd() --------
+func execute_volumeRekeyCmd(cmd *cobra.Command, args []string) {
+	checkVolumeFlags()
+
+	config := volumeConfig()
+	master := config.MasterKey
+	if master == nil {
+		fmt.Println("Master key is required. Use --master-key-file.")
+		os.Exit(-1)
+	}
+	if volume_old_master_key_file != "" {
+		var err error
+		if config.MasterKey, err = haystack.LoadMasterKey(volume_old_master_key_file); err != nil {
+			fmt.Printf("Load old master key failed. %v\n", err)
+			os.Exit(-1)
+		}
+	}
+
+	volume := haystack.NewVolume(int32(volume_vid), volume_dir, config)
+	if err := volume.Init(); err != nil {
+		fmt.Printf("Open volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+	defer volume.Close()
+
+	if err := volume.Rekey(master); err != nil {
+		fmt.Printf("Rekey volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("Volume %d rekeyed.\n%s\n", volume_vid, volume.String())
+}
+
+// -------- execute_volumeEcEncodeCmd() --------
+func execute_volumeEcEncodeCmd(cmd *cobra.Command, args []string) {
+	checkVolumeFlags()
+
+	volume := haystack.NewVolume(int32(volume_vid), volume_dir, volumeConfig())
+	if err := volume.Init(); err != nil {
+		fmt.Printf("Open volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+	defer volume.Close()
+
+	if err := volume.EcEncode(volume_ec_dirs, volume_data_shards, volume_parity_shards); err != nil {
+		fmt.Printf("Erasure code volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("Volume %d erasure coded to %d+%d shards.\n", volume_vid, volume_data_shards, volume_parity_shards)
+}
+
+// -------- execute_volumeEcDecodeCmd() --------
+func execute_volumeEcDecodeCmd(cmd *cobra.Command, args []string) {
+	checkVolumeFlags()
+
+	volume := haystack.NewVolume(int32(volume_vid), volume_dir, volumeConfig())
+	if err := volume.Init(); err != nil {
+		fmt.Printf("Open volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+	defer volume.Close()
+
+	if err := volume.EcDecode(); err != nil {
+		fmt.Printf("Decode volume %d failed. %v\n", volume_vid, err)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("Volume %d decoded.\n%s\n", volume_vid, volume.String())
+}
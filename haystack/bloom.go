@@ -0,0 +1,57 @@
+package haystack
+
+const (
+	// 每个key 10位、7个哈希函数时误判率约1%。
+	BLOOM_BITS_PER_KEY = 10
+	BLOOM_HASHES       = 7
+)
+
+// **************** bloomFilter ****************
+// 磁盘索引前的布隆过滤器，不存在的key大多无需查找磁盘上的索引表。
+// 由hashKey()的高低32位做双重哈希得到BLOOM_HASHES个位置。
+type bloomFilter struct {
+	bits  []uint64
+	nbits uint64
+}
+
+// -------- newBloomFilter() --------
+func newBloomFilter(keys int) *bloomFilter {
+	nbits := uint64(keys) * BLOOM_BITS_PER_KEY
+	if nbits < 64 {
+		nbits = 64
+	}
+	words := (nbits + 63) / 64
+	return &bloomFilter{
+		bits:  make([]uint64, words),
+		nbits: words * 64,
+	}
+}
+
+// -------- add() --------
+func (this *bloomFilter) add(key int64) {
+	h := hashKey(key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := uint64(0); i < BLOOM_HASHES; i++ {
+		bit := (h1 + i*h2) % this.nbits
+		this.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// -------- mayContain() --------
+// false means key was never added.
+func (this *bloomFilter) mayContain(key int64) bool {
+	h := hashKey(key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := uint64(0); i < BLOOM_HASHES; i++ {
+		bit := (h1 + i*h2) % this.nbits
+		if this.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// -------- memoryUsage() --------
+func (this *bloomFilter) memoryUsage() uint64 {
+	return uint64(cap(this.bits)) * 8
+}
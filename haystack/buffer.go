@@ -0,0 +1,47 @@
+package haystack
+
+import (
+	"sync"
+)
+
+const (
+	// 读缓冲按2的幂分级复用：4KB ~ 16MB，更大的直接分配。
+	READBUFFER_MIN_SHIFT = 12
+	READBUFFER_MAX_SHIFT = 24
+)
+
+var readBufferPools [READBUFFER_MAX_SHIFT - READBUFFER_MIN_SHIFT + 1]sync.Pool
+
+// -------- readBufferClass() --------
+// Index of the smallest pool whose buffers hold size bytes, -1 if too large.
+func readBufferClass(size int) int {
+	for shift := READBUFFER_MIN_SHIFT; shift <= READBUFFER_MAX_SHIFT; shift++ {
+		if size <= 1<<uint(shift) {
+			return shift - READBUFFER_MIN_SHIFT
+		}
+	}
+	return -1
+}
+
+// -------- getReadBuffer() --------
+// Get a buffer of len size from pools. Return it with putReadBuffer().
+func getReadBuffer(size int) []byte {
+	class := readBufferClass(size)
+	if class < 0 {
+		return make([]byte, size)
+	}
+	if p, ok := readBufferPools[class].Get().(*[]byte); ok {
+		return (*p)[:size]
+	}
+	return make([]byte, size, 1<<uint(class+READBUFFER_MIN_SHIFT))
+}
+
+// -------- putReadBuffer() --------
+func putReadBuffer(buf []byte) {
+	class := readBufferClass(cap(buf))
+	if class < 0 || cap(buf) != 1<<uint(class+READBUFFER_MIN_SHIFT) {
+		return
+	}
+	buf = buf[:cap(buf)]
+	readBufferPools[class].Put(&buf)
+}
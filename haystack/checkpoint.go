@@ -0,0 +1,394 @@
+package haystack
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/uukuguy/kds/utils"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 索引检查点：按key排序的有效索引项快照，头部记录其覆盖到的.idx文件偏移。
+// 启动时加载检查点后只需重放该偏移之后的索引项；检查点损坏或与索引文件
+// 不一致时完整重放索引文件。磁盘索引模式下检查点文件同时是mmap的索引表。
+//
+// 文件格式（大端）：
+//
+//	magic(4) version(1) padding(3)
+//	idx_offset(8) count(8) data_end(8) total_size(8) outdated_size(8)
+//	outdated_keys(4) reserved(4)
+//	last_entry(16)   .idx中idx_offset之前的最后一个索引项，用于确认索引文件未被替换。
+//	checksum(4) padding(4)   crc32 of entries followed by header[:72].
+//	count * (key(8) region(8))
+const (
+	CHECKPOINT_EXT         = ".ckp"
+	CHECKPOINT_TMP_EXT     = ".tmp"
+	CHECKPOINT_HEADER_SIZE = 80
+	CHECKPOINT_VERSION     = 2
+
+	checkpointIdxOffsetOffset    = 8
+	checkpointCountOffset        = 16
+	checkpointDataEndOffset      = 24
+	checkpointTotalSizeOffset    = 32
+	checkpointOutdatedSizeOffset = 40
+	checkpointOutdatedKeysOffset = 48
+	checkpointLastEntryOffset    = 56
+	checkpointChecksumOffset     = 72
+)
+
+var checkpointMagic = []byte{0x83, 0x84, 0x43, 0x4b}
+
+// -------- getCheckpointFileName() --------
+// 压缩生成的索引文件的检查点随索引文件一起替换，见Volume.Compact()。
+func (this *Index) getCheckpointFileName() string {
+	ext := CHECKPOINT_EXT
+	if this.ext == COMPACT_INDEXFILE_EXT {
+		ext = COMPACT_CHECKPOINT_EXT
+	}
+	return fmt.Sprintf("%s/%d%s", this.Dir, this.vid, ext)
+}
+
+// -------- removeCheckpoint() --------
+func (this *Index) removeCheckpoint() {
+	os.Remove(this.getCheckpointFileName())
+	this.checkpointed = 0
+}
+
+// -------- readLastEntry() --------
+// The 16 bytes index entry just before offset.
+func (this *Index) readLastEntry(offset uint64) (buf []byte, err error) {
+	buf = make([]byte, INDEX_ENTRY_SIZE)
+	_, err = this.idxFile.ReadAt(buf, int64(offset-INDEX_ENTRY_SIZE))
+	return
+}
+
+// -------- checkpointSnapshot() --------
+// Snapshot live entries and stats for writeCheckpoint(). Caller holds the
+// volume lock, so that entries and offset are consistent.
+func (this *Index) checkpointSnapshot() (header []byte, entries func(fn func(key int64, value uint64) bool), err error) {
+	if header, err = this.checkpointHeader(); err != nil {
+		return
+	}
+	entries = this.indices.Snapshot()
+	return
+}
+
+// -------- checkpointHeader() --------
+// Header of a checkpoint covering the whole index file, from stats of the
+// index. count and checksum are filled in when the checkpoint is committed.
+func (this *Index) checkpointHeader() (header []byte, err error) {
+	offset := this.FileSize
+	header = make([]byte, CHECKPOINT_HEADER_SIZE)
+	copy(header, checkpointMagic)
+	header[len(checkpointMagic)] = CHECKPOINT_VERSION
+	utils.BigEndian.PutUint64(header[checkpointIdxOffsetOffset:], offset)
+	utils.BigEndian.PutUint64(header[checkpointDataEndOffset:], this.data_end)
+	utils.BigEndian.PutUint64(header[checkpointTotalSizeOffset:], this.total_size)
+	utils.BigEndian.PutUint64(header[checkpointOutdatedSizeOffset:], atomic.LoadUint64(&this.outdated_size))
+	utils.BigEndian.PutUint32(header[checkpointOutdatedKeysOffset:], atomic.LoadUint32(&this.outdated_keys))
+	if offset > this.superblock.Size() {
+		var last []byte
+		if last, err = this.readLastEntry(offset); err != nil {
+			return
+		}
+		copy(header[checkpointLastEntryOffset:], last)
+	}
+	return
+}
+
+// -------- checkpointChecksum() --------
+// 校验和先覆盖索引项再覆盖头部，写检查点时可以边写索引项边计算，最后回填头部。
+func checkpointChecksum(body uint32, header []byte) uint32 {
+	return crc32.Update(body, crc32Table, header[:checkpointChecksumOffset])
+}
+
+// -------- writeCheckpoint() --------
+// Write entries in ascending key order to the checkpoint file atomically.
+// Index entries before idx_offset of the header have to be synced already.
+// Return the number of entries written.
+func (this *Index) writeCheckpoint(header []byte, entries func(fn func(key int64, value uint64) bool)) (count uint64, err error) {
+	var ckp *checkpointWriter
+	if ckp, err = this.newCheckpointWriter(); err != nil {
+		return
+	}
+	entries(func(key int64, value uint64) bool {
+		err = ckp.add(key, value)
+		return err == nil
+	})
+	if err != nil {
+		ckp.abort()
+		return
+	}
+	err = ckp.commit(header)
+	return ckp.count, err
+}
+
+// **************** checkpointWriter ****************
+// checkpointWriter writes entries in ascending key order to a temporary file,
+// which replaces the checkpoint file on commit(). Entries are not kept in
+// memory, so a checkpoint can be written while they are produced, e.g. by
+// compaction of a disk index.
+type checkpointWriter struct {
+	index    *Index
+	name     string
+	file     *os.File
+	writer   *bufio.Writer
+	buf      []byte
+	checksum uint32
+	count    uint64
+	last     int64
+}
+
+// -------- newCheckpointWriter() --------
+func (this *Index) newCheckpointWriter() (ckp *checkpointWriter, err error) {
+	name := this.getCheckpointFileName() + CHECKPOINT_TMP_EXT
+	var file *os.File
+	if file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		utils.LogErrorf(err, "Index.newCheckpointWriter() open file %s failed.", name)
+		return
+	}
+	ckp = &checkpointWriter{
+		index:  this,
+		name:   name,
+		file:   file,
+		writer: bufio.NewWriterSize(file, 1024*1024),
+		buf:    make([]byte, INDEX_ENTRY_SIZE),
+	}
+	// 先写占位头部，commit()时回填。
+	if _, err = ckp.writer.Write(make([]byte, CHECKPOINT_HEADER_SIZE)); err != nil {
+		ckp.abort()
+		return nil, err
+	}
+	return
+}
+
+// -------- add() --------
+func (this *checkpointWriter) add(key int64, value uint64) (err error) {
+	if this.count > 0 && key <= this.last {
+		return fmt.Errorf("Checkpoint entries not sorted at key %d.", key)
+	}
+	utils.BigEndian.PutInt64(this.buf[0:8], key)
+	utils.BigEndian.PutUint64(this.buf[8:16], value)
+	this.checksum = crc32.Update(this.checksum, crc32Table, this.buf)
+	if _, err = this.writer.Write(this.buf); err != nil {
+		return
+	}
+	this.count++
+	this.last = key
+	return
+}
+
+// -------- commit() --------
+// Fill in count and checksum of header, then sync and rename the file to the
+// checkpoint file. Index entries before idx_offset of the header have to be
+// synced already.
+func (this *checkpointWriter) commit(header []byte) (err error) {
+	defer func() {
+		if err != nil {
+			this.abort()
+		}
+	}()
+	if err = this.writer.Flush(); err != nil {
+		return
+	}
+	utils.BigEndian.PutUint64(header[checkpointCountOffset:], this.count)
+	utils.BigEndian.PutUint32(header[checkpointChecksumOffset:], checkpointChecksum(this.checksum, header))
+	if _, err = this.file.WriteAt(header, 0); err != nil {
+		return
+	}
+	if err = this.file.Sync(); err != nil {
+		return
+	}
+	this.file.Close()
+	this.file = nil
+
+	if err = os.Rename(this.name, this.index.getCheckpointFileName()); err != nil {
+		utils.LogErrorf(err, "Index.writeCheckpoint() rename %s failed.", this.name)
+		os.Remove(this.name)
+		return
+	}
+	atomic.StoreUint64(&this.index.checkpointed, utils.BigEndian.Uint64(header[checkpointIdxOffsetOffset:]))
+	return
+}
+
+// -------- abort() --------
+func (this *checkpointWriter) abort() {
+	if this.file != nil {
+		this.file.Close()
+		this.file = nil
+		os.Remove(this.name)
+	}
+}
+
+// -------- readCheckpointHeader() --------
+// Read and validate the header against the index file, return the index file
+// offset covered and the number of entries.
+func (this *Index) readCheckpointHeader(reader io.Reader) (header []byte, offset uint64, count uint64, err error) {
+	header = make([]byte, CHECKPOINT_HEADER_SIZE)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if !bytes.Equal(header[:len(checkpointMagic)], checkpointMagic) || header[len(checkpointMagic)] != CHECKPOINT_VERSION {
+		err = fmt.Errorf("Checkpoint magic or version not match.")
+		return
+	}
+
+	offset = utils.BigEndian.Uint64(header[checkpointIdxOffsetOffset:])
+	start := this.superblock.Size()
+	if offset < start || offset > this.FileSize || (offset-start)%INDEX_ENTRY_SIZE != 0 {
+		err = fmt.Errorf("Checkpoint covers index offset %d, index file size %d.", offset, this.FileSize)
+		return
+	}
+	if offset > start {
+		var last []byte
+		if last, err = this.readLastEntry(offset); err != nil {
+			return
+		}
+		if !bytes.Equal(last, header[checkpointLastEntryOffset:checkpointLastEntryOffset+INDEX_ENTRY_SIZE]) {
+			err = fmt.Errorf("Checkpoint does not match index file.")
+			return
+		}
+	}
+
+	count = utils.BigEndian.Uint64(header[checkpointCountOffset:])
+	if count > uint64(INDEXFILE_MAXSIZE)/INDEX_ENTRY_SIZE {
+		err = fmt.Errorf("Checkpoint entry count %d too large.", count)
+		return
+	}
+	return
+}
+
+// -------- applyCheckpointHeader() --------
+func (this *Index) applyCheckpointHeader(header []byte) {
+	this.data_end = utils.BigEndian.Uint64(header[checkpointDataEndOffset:])
+	this.total_size = utils.BigEndian.Uint64(header[checkpointTotalSizeOffset:])
+	this.outdated_size = utils.BigEndian.Uint64(header[checkpointOutdatedSizeOffset:])
+	this.outdated_keys = utils.BigEndian.Uint32(header[checkpointOutdatedKeysOffset:])
+	this.checkpointed = utils.BigEndian.Uint64(header[checkpointIdxOffsetOffset:])
+}
+
+// -------- loadCheckpoint() --------
+// Load entries and stats from checkpoint file, return the index file offset
+// covered by it. On error indices are partially filled, caller has to reset.
+func (this *Index) loadCheckpoint() (offset uint64, err error) {
+	var file *os.File
+	if file, err = os.Open(this.getCheckpointFileName()); err != nil {
+		return
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	var header []byte
+	var count uint64
+	if header, offset, count, err = this.readCheckpointHeader(reader); err != nil {
+		return
+	}
+
+	// 检查点按key排序，直接构建有序数组。
+	indices := newSortedNeedleMap(int(count))
+	this.indices = indices
+	var checksum uint32
+	buf := make([]byte, INDEX_ENTRY_SIZE)
+	for i := uint64(0); i < count; i++ {
+		if _, err = io.ReadFull(reader, buf); err != nil {
+			return
+		}
+		checksum = crc32.Update(checksum, crc32Table, buf)
+		indices.appendSorted(utils.BigEndian.Int64(buf[0:8]), utils.BigEndian.Uint64(buf[8:16]))
+	}
+	if checkpointChecksum(checksum, header) != utils.BigEndian.Uint32(header[checkpointChecksumOffset:]) {
+		err = fmt.Errorf("Checkpoint checksum not match.")
+		return
+	}
+
+	this.applyCheckpointHeader(header)
+
+	return
+}
+
+// -------- checkpoint() --------
+// Sync the volume and write a checkpoint of its index. Reads are not blocked
+// while the snapshot is taken, compaction waits until the checkpoint is done.
+func (this *Volume) checkpoint() (err error) {
+	this.ckpLock.Lock()
+	defer this.ckpLock.Unlock()
+
+	this.rwlock.RLock()
+	index := this.index
+	if index.idxFile == nil || atomic.LoadUint64(&index.checkpointed) == index.FileSize {
+		this.rwlock.RUnlock()
+		return
+	}
+	var header []byte
+	var entries func(fn func(key int64, value uint64) bool)
+	if err = this.syncFiles(); err == nil {
+		header, entries, err = index.checkpointSnapshot()
+	}
+	this.rwlock.RUnlock()
+	if err != nil {
+		utils.LogErrorf(err, "Volume %d checkpoint snapshot failed.", this.Id)
+		return
+	}
+
+	start := time.Now()
+	var count uint64
+	if count, err = index.writeCheckpoint(header, entries); err != nil {
+		utils.LogErrorf(err, "Volume %d write checkpoint failed.", this.Id)
+		return
+	}
+
+	// 磁盘索引换用新的检查点，内存中只保留其后追加的索引项。
+	if index.disk_mode {
+		this.rwlock.Lock()
+		if this.index == index {
+			err = index.loadIndices()
+		}
+		this.rwlock.Unlock()
+		if err != nil {
+			utils.LogErrorf(err, "Volume %d reload disk index failed.", this.Id)
+			return
+		}
+	}
+	utils.LogInfof("Volume %d checkpoint done in %v. %d entries.", this.Id, time.Since(start), count)
+
+	return
+}
+
+// -------- needCheckpoint() --------
+// Caller holds the volume lock.
+func (this *Volume) needCheckpoint() bool {
+	entries := this.checkpointEntries()
+	if entries == 0 {
+		return false
+	}
+	index := this.index
+	checkpointed := atomic.LoadUint64(&index.checkpointed)
+	if start := index.superblock.Size(); checkpointed < start {
+		checkpointed = start
+	}
+	return (index.FileSize-checkpointed)/INDEX_ENTRY_SIZE >= entries
+}
+
+// -------- checkpointEntries() --------
+// 磁盘索引依赖检查点，Config.CheckpointEntries为0时仍使用默认值。
+func (this *Volume) checkpointEntries() uint64 {
+	if this.config.CheckpointEntries == 0 && this.index.disk_mode {
+		return CHECKPOINT_DEFAULT_ENTRIES
+	}
+	return this.config.CheckpointEntries
+}
+
+// -------- checkpointBackground() --------
+func (this *Volume) checkpointBackground() {
+	if !atomic.CompareAndSwapInt32(&this.checkpointing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&this.checkpointing, 0)
+		this.checkpoint()
+	}()
+}
@@ -0,0 +1,211 @@
+package haystack
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"github.com/uukuguy/kds/utils"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	// 重建检查点时每段在内存中合并的key数，每段约占内存50MB。
+	CHECKPOINT_SORT_RUN_KEYS = 1 << 20
+	// 重建检查点时有序段的临时文件。
+	CHECKPOINT_RUN_EXT = ".run"
+)
+
+// -------- rebuildCheckpoint() --------
+// 没有可用的检查点时按索引文件外部排序重建：分段读入索引项，每段按key合并后
+// 排序写入临时文件，再多路归并写入检查点。内存只与一段的key数有关，与卷中key
+// 的总数无关。Stats of the index are recomputed as replayEntries() does.
+// Caller has reset indices and synced the index file.
+func (this *Index) rebuildCheckpoint(run_keys int) (count uint64, err error) {
+	var runs []*os.File
+	defer func() {
+		for _, run := range runs {
+			run.Close()
+		}
+	}()
+
+	// 段内覆盖或删除的项直接计入过时统计，段内第一次出现的key在归并时与之前的段比较。
+	run := newHashNeedleMap(0)
+	flush := func() error {
+		file, e := this.writeSortedRun(len(runs), run.sortedEntries())
+		if e != nil {
+			return e
+		}
+		runs = append(runs, file)
+		run = newHashNeedleMap(0)
+		return nil
+	}
+	err = this.walkEntries(this.superblock.Size(), func(key int64, region NeedleRegion) error {
+		this.updateDataEnd(region)
+		value := needleMapDeleted
+		if !region.IsTombstone() {
+			value = this.encodeRegion(region)
+			this.total_size += uint64(region.Size)
+		}
+		if old, ok := run.Set(key, value); ok && old != needleMapDeleted {
+			atomic.AddUint32(&this.outdated_keys, 1)
+			atomic.AddUint64(&this.outdated_size, uint64(this.decodeRegion(old).Size))
+		}
+		if run.Len() >= run_keys {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && run.Len() > 0 {
+		err = flush()
+	}
+	if err != nil {
+		return
+	}
+
+	var ckp *checkpointWriter
+	if ckp, err = this.newCheckpointWriter(); err != nil {
+		return
+	}
+	var header []byte
+	if err = this.mergeRuns(runs, ckp); err == nil {
+		header, err = this.checkpointHeader()
+	}
+	if err != nil {
+		ckp.abort()
+		return
+	}
+	err = ckp.commit(header)
+	return ckp.count, err
+}
+
+// -------- writeSortedRun() --------
+// Write entries sorted by key to a temporary file, which is read from the
+// beginning by mergeRuns().
+func (this *Index) writeSortedRun(n int, entries []needleMapEntry) (file *os.File, err error) {
+	name := fmt.Sprintf("%s%s%d", this.getCheckpointFileName(), CHECKPOINT_RUN_EXT, n)
+	if file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		utils.LogErrorf(err, "Index.writeSortedRun() open file %s failed.", name)
+		return
+	}
+	// 打开后即删除，中断时不留下临时文件。
+	os.Remove(name)
+
+	writer := bufio.NewWriterSize(file, 1024*1024)
+	buf := make([]byte, INDEX_ENTRY_SIZE)
+	for _, entry := range entries {
+		utils.BigEndian.PutInt64(buf[0:8], entry.key)
+		utils.BigEndian.PutUint64(buf[8:16], entry.value)
+		if _, err = writer.Write(buf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		utils.LogErrorf(err, "Index.writeSortedRun() write file %s failed.", name)
+		file.Close()
+		file = nil
+	}
+	return
+}
+
+// -------- mergeRuns() --------
+// 多路归并有序段：同一key按段的先后依次生效，覆盖或删除之前段中仍有效的值时
+// 计入过时统计，最后仍有效的值写入检查点。
+func (this *Index) mergeRuns(runs []*os.File, ckp *checkpointWriter) (err error) {
+	buf := make([]byte, INDEX_ENTRY_SIZE)
+	runHeap := make(sortRunHeap, 0, len(runs))
+	for n, file := range runs {
+		run := &sortRun{reader: bufio.NewReaderSize(file, 64*1024), n: n}
+		var ok bool
+		if ok, err = run.next(buf); err != nil {
+			return
+		}
+		if ok {
+			runHeap = append(runHeap, run)
+		}
+	}
+	heap.Init(&runHeap)
+
+	for runHeap.Len() > 0 {
+		key := runHeap[0].entry.key
+		var live uint64
+		for runHeap.Len() > 0 && runHeap[0].entry.key == key {
+			run := runHeap[0]
+			if live != 0 {
+				atomic.AddUint32(&this.outdated_keys, 1)
+				atomic.AddUint64(&this.outdated_size, uint64(this.decodeRegion(live).Size))
+			}
+			live = run.entry.value
+			if live == needleMapDeleted {
+				live = 0
+			}
+			var ok bool
+			if ok, err = run.next(buf); err != nil {
+				return
+			}
+			if ok {
+				heap.Fix(&runHeap, 0)
+			} else {
+				heap.Pop(&runHeap)
+			}
+		}
+		if live != 0 {
+			if err = ckp.add(key, live); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// **************** sortRun ****************
+type sortRun struct {
+	reader *bufio.Reader
+	n      int // order of the run in index file.
+	entry  needleMapEntry
+}
+
+// -------- next() --------
+func (this *sortRun) next(buf []byte) (ok bool, err error) {
+	if _, err = io.ReadFull(this.reader, buf); err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	}
+	this.entry = needleMapEntry{utils.BigEndian.Int64(buf[0:8]), utils.BigEndian.Uint64(buf[8:16])}
+	return true, nil
+}
+
+// **************** sortRunHeap ****************
+// 按key排序，key相同时按段的先后。
+type sortRunHeap []*sortRun
+
+func (this sortRunHeap) Len() int { return len(this) }
+
+func (this sortRunHeap) Less(i, j int) bool {
+	if this[i].entry.key != this[j].entry.key {
+		return this[i].entry.key < this[j].entry.key
+	}
+	return this[i].n < this[j].n
+}
+
+func (this sortRunHeap) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+
+func (this *sortRunHeap) Push(x interface{}) {
+	*this = append(*this, x.(*sortRun))
+}
+
+func (this *sortRunHeap) Pop() interface{} {
+	old := *this
+	run := old[len(old)-1]
+	*this = old[:len(old)-1]
+	return run
+}
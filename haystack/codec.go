@@ -0,0 +1,159 @@
+package haystack
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// needle数据可以压缩保存，codec记录在Needle.Flags的第2、3位，Size和Checksum
+// 对应压缩后的数据。codec的名字即HTTP Content-Encoding。
+const (
+	CODEC_NONE = 0
+	CODEC_GZIP = 1
+
+	flagNeedleCodecShift = 2
+	flagNeedleCodecMask  = 0x03 << flagNeedleCodecShift
+
+	// 小于该字节数的数据不压缩。
+	COMPRESS_MINSIZE = 128
+)
+
+// **************** Codec ****************
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	NewReader(reader io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[byte]Codec{
+	CODEC_GZIP: gzipCodec{},
+}
+
+// ======== GetCodec() ========
+// nil for CODEC_NONE or unknown codecs.
+func GetCodec(codec byte) Codec {
+	return codecs[codec]
+}
+
+// ======== ParseCodec() ========
+// Codec of name, "" and "none" are CODEC_NONE.
+func ParseCodec(name string) (byte, error) {
+	if name == "" || name == "none" {
+		return CODEC_NONE, nil
+	}
+	for codec, c := range codecs {
+		if c.Name() == name {
+			return codec, nil
+		}
+	}
+	return CODEC_NONE, fmt.Errorf("Unknown codec \"%s\".", name)
+}
+
+// **************** gzipCodec ****************
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) NewReader(reader io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(reader)
+}
+
+// ======== Codec() ========
+func (needle *Needle) Codec() byte {
+	return (needle.Flags & flagNeedleCodecMask) >> flagNeedleCodecShift
+}
+
+// ======== Compress() ========
+// Compress needle data with codec, unless the data is too small or does not
+// shrink. Return whether the data is compressed.
+func (needle *Needle) Compress(codec byte) (compressed bool, err error) {
+	c := GetCodec(codec)
+	if c == nil || needle.Codec() != CODEC_NONE || needle.IsManifest() || len(needle.Data) < COMPRESS_MINSIZE {
+		return
+	}
+	var data []byte
+	if data, err = c.Compress(needle.Data); err != nil || len(data) >= len(needle.Data) {
+		return
+	}
+	needle.Data = data
+	needle.Size = uint32(len(data))
+	needle.Checksum = crc32.Checksum(data, crc32Table)
+	needle.Flags = needle.Flags&^flagNeedleCodecMask | codec<<flagNeedleCodecShift
+	return true, nil
+}
+
+// ======== Decompressed() ========
+// Original data of the needle loaded with data.
+func (needle *Needle) Decompressed() (data []byte, err error) {
+	if needle.Codec() == CODEC_NONE {
+		return needle.Data, nil
+	}
+	var reader io.ReadCloser
+	if reader, err = NewDecompressReader(needle.Codec(), bytes.NewReader(needle.Data)); err != nil {
+		return
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// ======== NewDecompressReader() ========
+func NewDecompressReader(codec byte, reader io.Reader) (io.ReadCloser, error) {
+	c := GetCodec(codec)
+	if c == nil {
+		return nil, fmt.Errorf("Unknown codec %d.", codec)
+	}
+	return c.NewReader(reader)
+}
+
+// ======== CompressNeedle() ========
+// 按压缩策略压缩上传的needle：卷的超级块指定了codec时压缩写入该卷的needle；
+// 否则Content-Type匹配Config.CompressTypes时使用Config.CompressCodec。
+// 大对象的chunk不压缩。
+func (this *Store) CompressNeedle(vid int32, needle *Needle) (err error) {
+	codec, _ := ParseCodec(this.Config.VolumeCodec)
+	if volume, ok := this.GetVolume(vid); ok {
+		codec = volume.Codec()
+	}
+	if codec == CODEC_NONE && matchContentType(needle.Mime, this.Config.CompressTypes) {
+		codec, _ = ParseCodec(this.Config.CompressCodec)
+	}
+	_, err = needle.Compress(codec)
+	return
+}
+
+// -------- matchContentType() --------
+// types are full content types, or prefixes ending with "/" like "text/".
+func matchContentType(content_type string, types []string) bool {
+	if i := strings.IndexByte(content_type, ';'); i >= 0 {
+		content_type = content_type[:i]
+	}
+	content_type = strings.ToLower(strings.TrimSpace(content_type))
+	if content_type == "" {
+		return false
+	}
+	for _, t := range types {
+		if t == content_type || strings.HasSuffix(t, "/") && strings.HasPrefix(content_type, t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,309 @@
+package haystack
+
+import (
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	COMPACT_DATAFILE_EXT  = ".dat.compact"
+	COMPACT_INDEXFILE_EXT = ".idx.compact"
+	// 压缩生成的索引文件的检查点。
+	COMPACT_CHECKPOINT_EXT = ".ckp.compact"
+
+	// 两次自动压缩之间的最小间隔（秒），避免压缩失败时反复触发。
+	COMPACT_AUTO_INTERVAL = 10 * 60
+)
+
+// -------- newCompactData() --------
+func newCompactData(vid int32, store_dir string) (data *Data) {
+	data = NewData(vid, store_dir)
+	data.ext = COMPACT_DATAFILE_EXT
+	return
+}
+
+// -------- newCompactIndex() --------
+func newCompactIndex(vid int32, store_dir string) (index *Index) {
+	index = NewIndex(vid, store_dir)
+	index.ext = COMPACT_INDEXFILE_EXT
+	return
+}
+
+// ======== Compact() ========
+// 在线压缩卷：把有效needle复制到新的数据/索引文件，复制期间写入照常进行；
+// 最后在写锁内补齐压缩期间追加的索引项，再原子地替换原文件。
+func (this *Volume) Compact() (err error) {
+	if !atomic.CompareAndSwapInt32(&this.compacting, 0, 1) {
+		return errors.ErrVolumeCompacting
+	}
+	defer atomic.StoreInt32(&this.compacting, 0)
+	if this.IsErasureCoded() {
+		return errors.ErrVolumeReadOnly
+	}
+	atomic.StoreInt64(&this.compacted_at, time.Now().Unix())
+
+	start := time.Now()
+	utils.LogInfof("Volume %d compaction started.", this.Id)
+
+	data := newCompactData(this.Id, this.Dir)
+	index := newCompactIndex(this.Id, this.Dir)
+	data.remove()
+	index.remove()
+
+	// 检查点加载时会重新映射旧的磁盘索引，复制期间逐项读取它，整个压缩过程持有检查点锁。
+	this.ckpLock.Lock()
+	defer this.ckpLock.Unlock()
+
+	swapped := false
+	defer func() {
+		if !swapped {
+			data.Close()
+			index.Close()
+			data.remove()
+			index.remove()
+			os.Remove(index.getCheckpointFileName())
+		}
+	}()
+
+	// 原样复制needle，压缩后的卷沿用原来的超级块（needle格式、索引模式和元数据）。
+	this.rwlock.RLock()
+	data.superblock = this.data.superblock.clone()
+	data.superblock.Flags &= superblockFlagDiskIndex
+	index.data_version = data.superblock.needleVersion()
+	index.data_start = data.superblock.Size()
+	index.disk_mode = data.superblock.IsDiskIndex()
+	this.rwlock.RUnlock()
+	if err = data.Init(); err != nil {
+		return
+	}
+	if err = index.Init(); err != nil {
+		return
+	}
+
+	// Snapshot live needles. Later writes are appended after idx_offset.
+	this.rwlock.RLock()
+	old_data := this.data
+	old_index := this.index
+	entries := old_index.snapshotEntries()
+	idx_offset := old_index.FileSize
+	this.rwlock.RUnlock()
+
+	// 磁盘索引按key顺序复制，复制的索引项直接写入新的检查点，不在内存中建立索引。
+	if index.disk_mode {
+		if err = index.streamCheckpoint(); err != nil {
+			return
+		}
+	}
+	// 过期的needle不再复制。
+	now := time.Now().Unix()
+	entries(func(entry IndexEntry) bool {
+		if err = copyNeedle(old_data, data, index, entry, now); err != nil {
+			utils.LogErrorf(err, "Volume %d compaction copy needle failed. key:%d", this.Id, entry.Key)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return
+	}
+	if err = data.flushFile(); err != nil {
+		return
+	}
+	// 复制的索引项即新索引文件的检查点，随索引文件一起替换，重新打开卷时只需
+	// 重放其后补齐的索引项。内存索引写入失败时重新打开卷重放整个索引文件。
+	if index.disk_mode {
+		if err = index.finishCheckpoint(); err != nil {
+			utils.LogErrorf(err, "Volume %d compaction write checkpoint failed.", this.Id)
+			return
+		}
+	} else {
+		if err = index.flushFile(); err != nil {
+			return
+		}
+		if header, ckp_entries, e := index.checkpointSnapshot(); e != nil {
+			utils.LogWarnf(e, "Volume %d compaction checkpoint snapshot failed.", this.Id)
+		} else if _, e = index.writeCheckpoint(header, ckp_entries); e != nil {
+			utils.LogWarnf(e, "Volume %d compaction write checkpoint failed.", this.Id)
+		}
+	}
+
+	this.rwlock.Lock()
+	defer this.rwlock.Unlock()
+
+	// Replay index entries appended while copying.
+	err = old_index.walkEntries(idx_offset, func(key int64, region NeedleRegion) error {
+		if region.IsTombstone() {
+			if _, exist := index.GetNeedleRegion(key); !exist {
+				return nil
+			}
+			return appendTombstone(data, index, key)
+		}
+		return copyNeedle(old_data, data, index, IndexEntry{key, region}, now)
+	})
+	if err != nil {
+		utils.LogErrorf(err, "Volume %d compaction replay index tail failed.", this.Id)
+		return
+	}
+	// 封存状态随数据文件一起保留。
+	if old_data.superblock.IsSealed() {
+		if err = data.seal(); err != nil {
+			return
+		}
+	}
+
+	// 卷按数据文件最后写入时间整体过期，压缩不改变该时间。
+	modified, modified_err := old_data.modTime()
+
+	data.Close()
+	index.Close()
+	old_data.Close()
+	old_index.Close()
+	old_index.removeCheckpoint()
+
+	// 先替换数据文件再替换索引文件，中断时由recoverCompaction()完成剩余步骤。
+	if err = os.Rename(data.getDataFileName(), old_data.getDataFileName()); err != nil {
+		utils.LogErrorf(err, "Volume %d compaction rename data file failed.", this.Id)
+	} else {
+		swapped = true
+		// 压缩后的数据文件在热存储，冷存储中原来的数据文件不再使用。
+		if old_data.cold != "" {
+			os.Remove(old_data.cold)
+		}
+		if modified_err == nil {
+			os.Chtimes(old_data.getDataFileName(), modified, modified)
+		}
+		if err = os.Rename(index.getIndexFileName(), old_index.getIndexFileName()); err != nil {
+			utils.LogErrorf(err, "Volume %d compaction rename index file failed.", this.Id)
+		} else {
+			renameCompactCheckpoint(index, old_index)
+		}
+	}
+
+	if e := this.reopen(); e != nil {
+		utils.LogErrorf(e, "Volume %d reopen after compaction failed.", this.Id)
+		if err == nil {
+			err = e
+		}
+		return
+	}
+
+	utils.LogInfof("Volume %d compaction done in %v. %d needles, data file %d -> %d bytes.",
+		this.Id, time.Since(start), this.index.indices.Len(), old_data.FileSize, this.data.FileSize)
+
+	return
+}
+
+// -------- reopen() --------
+// Reopen data and index files of the volume. Caller holds the write lock.
+func (this *Volume) reopen() (err error) {
+	this.data = NewData(this.Id, this.Dir)
+	this.index = NewIndex(this.Id, this.Dir)
+	return this.Init()
+}
+
+// -------- recoverCompaction() --------
+// 处理压缩中断留下的文件：数据文件已替换而索引文件未替换时完成替换，否则丢弃压缩文件。
+func (this *Volume) recoverCompaction() (err error) {
+	data := newCompactData(this.Id, this.Dir)
+	index := newCompactIndex(this.Id, this.Dir)
+	compact_data_exist := utils.FileExist(data.getDataFileName())
+	compact_index_exist := utils.FileExist(index.getIndexFileName())
+	compact_ckp_exist := utils.FileExist(index.getCheckpointFileName())
+
+	if compact_data_exist {
+		utils.LogInfof("Volume %d discard interrupted compaction.", this.Id)
+		data.remove()
+		if compact_index_exist {
+			index.remove()
+		}
+		if compact_ckp_exist {
+			os.Remove(index.getCheckpointFileName())
+		}
+		return
+	}
+	old_index := NewIndex(this.Id, this.Dir)
+	if compact_index_exist {
+		utils.LogInfof("Volume %d finish interrupted compaction. rename %s", this.Id, index.getIndexFileName())
+		if err = os.Rename(index.getIndexFileName(), old_index.getIndexFileName()); err != nil {
+			utils.LogErrorf(err, "Volume %d rename compacted index file failed.", this.Id)
+			return
+		}
+	}
+	// 检查点头部记录了索引文件的最后一项，不匹配时加载索引会忽略它。
+	if compact_ckp_exist {
+		renameCompactCheckpoint(index, old_index)
+	}
+	return
+}
+
+// -------- renameCompactCheckpoint() --------
+// Replace checkpoint of the old index file with the one written by compaction.
+func renameCompactCheckpoint(index *Index, old_index *Index) {
+	if err := os.Rename(index.getCheckpointFileName(), old_index.getCheckpointFileName()); err != nil {
+		utils.LogWarnf(err, "Volume %d rename compacted checkpoint failed.", index.vid)
+		os.Remove(index.getCheckpointFileName())
+	}
+}
+
+// -------- needCompaction() --------
+// Caller holds the volume lock.
+func (this *Volume) needCompaction() bool {
+	if this.config.CompactThreshold <= 0 || atomic.LoadInt32(&this.compacting) != 0 {
+		return false
+	}
+	if time.Now().Unix()-atomic.LoadInt64(&this.compacted_at) < COMPACT_AUTO_INTERVAL {
+		return false
+	}
+	return this.index.outdated_size >= this.config.CompactMinSize &&
+		this.index.getOutdatedSizeRate() >= this.config.CompactThreshold
+}
+
+// -------- compactBackground() --------
+func (this *Volume) compactBackground() {
+	go func() {
+		if err := this.Compact(); err != nil && err != errors.ErrVolumeCompacting {
+			utils.LogErrorf(err, "Volume %d background compaction failed.", this.Id)
+		}
+	}()
+}
+
+// -------- copyNeedle() --------
+// Copy the raw needle in entry.Region from src to the end of dst data and index.
+// Needles expired at now are skipped, and an earlier copy of the key deleted.
+func copyNeedle(src *Data, dst *Data, dst_index *Index, entry IndexEntry, now int64) (err error) {
+	var buf []byte
+	if buf, err = src.readRegion(entry.Region); err != nil {
+		return
+	}
+	defer putReadBuffer(buf)
+	if src.needleExpired(buf, now) {
+		if _, exist := dst_index.GetNeedleRegion(entry.Key); exist {
+			err = appendTombstone(dst, dst_index, entry.Key)
+		}
+		return
+	}
+
+	var region NeedleRegion
+	if region, err = dst.appendBuffer(buf); err != nil {
+		return
+	}
+	err = dst_index.appendEntry(IndexEntry{entry.Key, region})
+	return
+}
+
+// -------- appendTombstone() --------
+func appendTombstone(dst *Data, dst_index *Index, key int64) (err error) {
+	tombstone := NewTombstoneNeedle(key, 0)
+	defer tombstone.Close()
+	tombstone.FillBuffer()
+
+	var region NeedleRegion
+	if region, err = dst.appendBuffer(tombstone.Buffer()); err != nil {
+		return
+	}
+	region.Size = 0
+	err = dst_index.appendEntry(IndexEntry{key, region})
+	return
+}
@@ -1 +1,187 @@
 package haystack
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// 过期数据（被覆盖或删除的needle）占数据总量的比例超过该值时自动压缩卷。
+	COMPACT_DEFAULT_THRESHOLD = 0.5
+	// 过期数据量小于该值时不自动压缩，避免频繁压缩小卷。
+	COMPACT_DEFAULT_MINSIZE = 64 * 1024 * 1024
+
+	// 写入持久化策略，决定何时fsync以及写入何时应答。
+	// always:   每批写入fsync后才应答。
+	// interval: 写入文件后即应答，每SyncInterval至少fsync一次。
+	// bytes:    写入文件后即应答，未fsync的数据达到SyncBytes时fsync。
+	SYNC_POLICY_ALWAYS   = "always"
+	SYNC_POLICY_INTERVAL = "interval"
+	SYNC_POLICY_BYTES    = "bytes"
+
+	// 数据文件超过该大小后封存卷，Store自动换到新卷写入。
+	VOLUME_DEFAULT_MAXSIZE = DATAFILE_MAXSIZE
+
+	// 单个needle数据的默认上限与可配置的最大值。旧格式索引的卷只能写入不超过16MB的needle。
+	NEEDLE_DEFAULT_MAXSIZE = 128 * 1024 * 1024
+	NEEDLE_MAXSIZE         = 1024 * 1024 * 1024
+
+	// 超过ChunkSize的对象拆分为多个chunk needle，由manifest needle记录。
+	// 默认chunk小于16MB，旧格式索引的卷也能写入。
+	CHUNK_DEFAULT_SIZE     = 8 * 1024 * 1024
+	OBJECT_DEFAULT_MAXSIZE = 64 * 1024 * 1024 * 1024
+
+	// 距上次检查点追加的索引项超过该值时写新的索引检查点。
+	CHECKPOINT_DEFAULT_ENTRIES = 1024 * 1024
+
+	// 新建卷的索引模式，记录在数据文件超级块中，之后打开卷时不再改变。
+	// memory: 全部索引在内存中。
+	// disk:   索引表在磁盘上mmap，内存中只有布隆过滤器和最近的变化，适合索引超过内存的卷。
+	INDEX_MODE_MEMORY = "memory"
+	INDEX_MODE_DISK   = "disk"
+
+	// 按Content-Type压缩needle时默认使用的codec。
+	COMPRESS_DEFAULT_CODEC = "gzip"
+
+	SYNC_DEFAULT_INTERVAL = 100 * time.Millisecond
+	SYNC_DEFAULT_BYTES    = 4 * 1024 * 1024
+)
+
+// **************** Config ****************
+type Config struct {
+	// Outdated size rate to trigger volume compaction automatically.
+	// 0 disables automatic compaction.
+	CompactThreshold float32
+	// Minimal outdated bytes before automatic compaction.
+	CompactMinSize uint64
+
+	// Seal volume once data file grows beyond the size, up to DATAFILE_WIDE_MAXSIZE.
+	// Volumes created before version3 are sealed at DATAFILE_MAXSIZE anyway.
+	VolumeMaxSize uint64
+
+	// Max data bytes of a needle accepted for upload, up to NEEDLE_MAXSIZE.
+	NeedleMaxSize uint64
+
+	// Objects larger than ChunkSize are written as chunk needles of ChunkSize
+	// and a manifest needle. ChunkSize is up to NeedleMaxSize.
+	ChunkSize uint64
+	// Max data bytes of an object accepted for upload.
+	ObjectMaxSize uint64
+
+	// Write index checkpoint every so many index entries. 0 disables checkpoints
+	// of memory index volumes.
+	CheckpointEntries uint64
+
+	// One of INDEX_MODE_*, for volumes created from now on.
+	IndexMode string
+
+	// Collection name and replication setting recorded in superblocks of
+	// volumes created from now on.
+	Collection  string
+	Replication string
+
+	// Default TTL of needles in volumes created from now on, which also caps
+	// TTL of needles in them. 0 for never.
+	VolumeTTL time.Duration
+
+	// Codec name of needles uploaded to volumes created from now on, "" for
+	// none. Otherwise needles of content types in CompressTypes, full types or
+	// prefixes like "text/", are compressed with CompressCodec.
+	VolumeCodec   string
+	CompressTypes []string
+	CompressCodec string
+
+	// Master key to wrap data keys of volumes created from now on, and to
+	// unwrap those of encrypted volumes. Empty for no encryption.
+	MasterKey []byte
+
+	// Directories of erasure coding shards, searched besides the store dir.
+	// See Volume.EcEncode().
+	EcDirs []string
+
+	// Store identical uploaded needles once, see Store.WriteDedupNeedle().
+	Dedup bool
+
+	// Directory of the cold tier, "" to disable tiering. Sealed volumes read
+	// less than TierDemoteRate times per second for TierColdAfter are moved
+	// there, and moved back once read more than TierPromoteRate times per
+	// second. See Store.TierVolumes().
+	ColdDir         string
+	TierDemoteRate  float64
+	TierPromoteRate float64
+	TierColdAfter   time.Duration
+
+	// One of SYNC_POLICY_*.
+	SyncPolicy   string
+	SyncInterval time.Duration
+	SyncBytes    uint64
+}
+
+// ======== NewConfig() ========
+func NewConfig() *Config {
+	return &Config{
+		CompactThreshold:  COMPACT_DEFAULT_THRESHOLD,
+		CompactMinSize:    COMPACT_DEFAULT_MINSIZE,
+		VolumeMaxSize:     VOLUME_DEFAULT_MAXSIZE,
+		NeedleMaxSize:     NEEDLE_DEFAULT_MAXSIZE,
+		ChunkSize:         CHUNK_DEFAULT_SIZE,
+		ObjectMaxSize:     OBJECT_DEFAULT_MAXSIZE,
+		CheckpointEntries: CHECKPOINT_DEFAULT_ENTRIES,
+		IndexMode:         INDEX_MODE_MEMORY,
+		CompressCodec:     COMPRESS_DEFAULT_CODEC,
+		TierDemoteRate:    TIER_DEFAULT_DEMOTE_RATE,
+		TierPromoteRate:   TIER_DEFAULT_PROMOTE_RATE,
+		TierColdAfter:     TIER_DEFAULT_COLD_AFTER,
+		SyncPolicy:        SYNC_POLICY_ALWAYS,
+		SyncInterval:      SYNC_DEFAULT_INTERVAL,
+		SyncBytes:         SYNC_DEFAULT_BYTES,
+	}
+}
+
+// ======== Validate() ========
+func (this *Config) Validate() (err error) {
+	if this.VolumeMaxSize == 0 || this.VolumeMaxSize > DATAFILE_WIDE_MAXSIZE {
+		return fmt.Errorf("Volume max size must be in (0, %d], got %d.", uint64(DATAFILE_WIDE_MAXSIZE), this.VolumeMaxSize)
+	}
+	if this.NeedleMaxSize == 0 || this.NeedleMaxSize > NEEDLE_MAXSIZE {
+		return fmt.Errorf("Needle max size must be in (0, %d], got %d.", NEEDLE_MAXSIZE, this.NeedleMaxSize)
+	}
+	if this.ChunkSize == 0 || this.ChunkSize > this.NeedleMaxSize {
+		return fmt.Errorf("Chunk size must be in (0, %d], got %d.", this.NeedleMaxSize, this.ChunkSize)
+	}
+	if this.ObjectMaxSize < this.ChunkSize {
+		return fmt.Errorf("Object max size must be at least chunk size %d, got %d.", this.ChunkSize, this.ObjectMaxSize)
+	}
+	if len(this.Collection) > 255 || len(this.Replication) > 255 {
+		return fmt.Errorf("Collection and replication must be at most 255 bytes.")
+	}
+	if this.VolumeTTL < 0 || this.VolumeTTL%time.Second != 0 || this.VolumeTTL/time.Second > math.MaxUint32 {
+		return fmt.Errorf("Volume TTL must be whole seconds up to %d, got %v.", uint32(math.MaxUint32), this.VolumeTTL)
+	}
+	if _, err = ParseCodec(this.VolumeCodec); err != nil {
+		return
+	}
+	if _, err = ParseCodec(this.CompressCodec); err != nil {
+		return
+	}
+	if len(this.MasterKey) != 0 && len(this.MasterKey) != MASTER_KEY_SIZE {
+		return fmt.Errorf("Master key must be %d bytes, got %d.", MASTER_KEY_SIZE, len(this.MasterKey))
+	}
+	if this.ColdDir != "" && (this.TierDemoteRate < 0 || this.TierPromoteRate < this.TierDemoteRate || this.TierColdAfter < 0) {
+		return fmt.Errorf("Tier promote rate must be at least demote rate %v, got %v.", this.TierDemoteRate, this.TierPromoteRate)
+	}
+	if this.IndexMode != INDEX_MODE_MEMORY && this.IndexMode != INDEX_MODE_DISK {
+		return fmt.Errorf("Unknown index mode \"%s\".", this.IndexMode)
+	}
+	switch this.SyncPolicy {
+	case SYNC_POLICY_ALWAYS, SYNC_POLICY_BYTES:
+	case SYNC_POLICY_INTERVAL:
+		if this.SyncInterval <= 0 {
+			err = fmt.Errorf("Sync interval must be positive, got %v.", this.SyncInterval)
+		}
+	default:
+		err = fmt.Errorf("Unknown sync policy \"%s\".", this.SyncPolicy)
+	}
+	return
+}
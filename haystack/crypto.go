@@ -0,0 +1,266 @@
+package haystack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// 卷数据静态加密：每个卷有随机生成的AES-256数据密钥，由主密钥AES-GCM加密后
+// 保存在超级块中（仅version4）。needle数据以数据密钥AES-GCM加密，写为
+// nonce(12) + 密文 + tag(16)，key和cookie作为附加数据，密文不能挪作其它needle。
+// needle头部、元数据和尾部保持明文，Size和Checksum对应加密后的数据，
+// 索引加载、恢复和压缩不需要密钥。
+const (
+	MASTER_KEY_SIZE = 32
+	DATA_KEY_SIZE   = 32
+
+	flagNeedleEncrypted = 0x10
+)
+
+// **************** needleCipher ****************
+type needleCipher struct {
+	aead cipher.AEAD
+}
+
+// -------- newNeedleCipher() --------
+func newNeedleCipher(key []byte) (*needleCipher, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &needleCipher{aead: aead}, nil
+}
+
+// -------- openDataKey() --------
+// Cipher of the data key wrapped by master.
+func openDataKey(master []byte, wrapped []byte) (*needleCipher, error) {
+	key, err := unwrapKey(master, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newNeedleCipher(key)
+}
+
+// -------- newDataKey() --------
+// A random data key, its cipher and the key wrapped by master.
+func newDataKey(master []byte) (c *needleCipher, wrapped []byte, err error) {
+	key := make([]byte, DATA_KEY_SIZE)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return
+	}
+	if wrapped, err = wrapKey(master, key); err != nil {
+		return
+	}
+	c, err = newNeedleCipher(key)
+	return
+}
+
+// -------- newGCM() --------
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// -------- wrapKey() --------
+func wrapKey(master []byte, key []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// -------- unwrapKey() --------
+func unwrapKey(master []byte, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("Wrapped data key too short.")
+	}
+	nonce := wrapped[:aead.NonceSize()]
+	key, err := aead.Open(nil, nonce, wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unwrap data key failed, wrong master key?")
+	}
+	return key, nil
+}
+
+// -------- additionalData() --------
+func additionalData(needle *Needle) []byte {
+	ad := make([]byte, 12)
+	binary.BigEndian.PutUint64(ad, uint64(needle.Key))
+	binary.BigEndian.PutUint32(ad[8:], uint32(needle.Cookie))
+	return ad
+}
+
+// -------- seal() --------
+// Encrypted copy of needle, needle itself is unchanged.
+func (this *needleCipher) seal(needle *Needle) (sealed *Needle, err error) {
+	nonce := make([]byte, this.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+	copied := *needle
+	sealed = &copied
+	sealed.Data = this.aead.Seal(nonce, nonce, needle.Data, additionalData(needle))
+	sealed.Size = uint32(len(sealed.Data))
+	sealed.Checksum = crc32.Checksum(sealed.Data, crc32Table)
+	sealed.Flags |= flagNeedleEncrypted
+	return
+}
+
+// -------- open() --------
+// Decrypt needle data in place. The checksum is of the plaintext afterwards.
+func (this *needleCipher) open(needle *Needle) (err error) {
+	n := this.aead.NonceSize()
+	if len(needle.Data) < n {
+		return errors.ErrNeedleCorrupted
+	}
+	var data []byte
+	if data, err = this.aead.Open(nil, needle.Data[:n], needle.Data[n:], additionalData(needle)); err != nil {
+		utils.LogErrorf(err, "Decrypt needle failed. key:%d", needle.Key)
+		return errors.ErrNeedleCorrupted
+	}
+	needle.Data = data
+	needle.Size = uint32(len(data))
+	needle.Checksum = crc32.Checksum(data, crc32Table)
+	needle.Flags &^= flagNeedleEncrypted
+	return
+}
+
+// ======== IsEncrypted() ========
+func (needle *Needle) IsEncrypted() bool {
+	return needle.Flags&flagNeedleEncrypted != 0
+}
+
+// ======== LoadMasterKey() ========
+// Master key file holds MASTER_KEY_SIZE raw bytes, or them in hex.
+func LoadMasterKey(filename string) (key []byte, err error) {
+	var buf []byte
+	if buf, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+	if len(buf) == MASTER_KEY_SIZE {
+		return buf, nil
+	}
+	if key, err = hex.DecodeString(string(bytes.TrimSpace(buf))); err != nil || len(key) != MASTER_KEY_SIZE {
+		return nil, fmt.Errorf("Master key file %s must hold %d bytes, raw or in hex.", filename, MASTER_KEY_SIZE)
+	}
+	return
+}
+
+// ======== Rekey() ========
+// 更换卷的数据密钥：生成新的数据密钥，全部有效needle解密后用新密钥重新加密，
+// 原地替换卷，新密钥由master加密保存在超级块中，之后卷使用master打开。
+// 更换主密钥时以原主密钥打开卷，master为新的主密钥。未加密的卷由此开始加密。
+func (this *Volume) Rekey(master []byte) (err error) {
+	if len(master) != MASTER_KEY_SIZE {
+		return fmt.Errorf("Master key must be %d bytes.", MASTER_KEY_SIZE)
+	}
+
+	new_cipher, wrapped, err := newDataKey(master)
+	if err != nil {
+		return
+	}
+
+	// 重写期间写入照常进行，只在准备和替换时取写锁，见rewrite()。
+	this.rwlock.Lock()
+	if this.data.superblock.Version < version4 {
+		this.rwlock.Unlock()
+		return fmt.Errorf("Volume %d is version %d, migrate it before rekey.", this.Id, this.data.superblock.Version)
+	}
+	old_cipher := this.cipher
+	superblock := this.data.superblock.clone()
+	superblock.DataKey = wrapped
+	// 重新打开卷时新旧主密钥都可用，替换中途失败时仍能打开原来的卷。
+	this.master_keys = append([][]byte{master}, this.master_keys...)
+	this.rwlock.Unlock()
+
+	var needles int
+	needles, _, err = this.rewrite("", superblock, func(needle *Needle) (*Needle, error) {
+		if needle.IsEncrypted() {
+			if old_cipher == nil {
+				return nil, fmt.Errorf("Needle %d is encrypted but volume %d has no data key.", needle.Key, this.Id)
+			}
+			if err := old_cipher.open(needle); err != nil {
+				return nil, err
+			}
+		}
+		return new_cipher.seal(needle)
+	})
+	if err == nil {
+		utils.LogInfof("Volume %d rekeyed. %d needles.", this.Id, needles)
+	}
+	return
+}
+
+// -------- openCipher() --------
+// Cipher of the volume data key, nil for plaintext volumes.
+func (this *Volume) openCipher() (c *needleCipher, err error) {
+	wrapped := this.data.superblock.DataKey
+	if wrapped == nil {
+		return
+	}
+	if len(this.master_keys) == 0 {
+		return nil, fmt.Errorf("Volume %d is encrypted, master key required.", this.Id)
+	}
+	for _, master := range this.master_keys {
+		if c, err = openDataKey(master, wrapped); err == nil {
+			return
+		}
+	}
+	return nil, fmt.Errorf("Volume %d data key can not be unwrapped by the master key.", this.Id)
+}
+
+// -------- decryptNeedle() --------
+// Decrypt needle loaded with data in place, plaintext needles are unchanged.
+// Caller holds the read lock.
+func (this *Volume) decryptNeedle(needle *Needle) error {
+	if !needle.IsEncrypted() {
+		return nil
+	}
+	if this.cipher == nil {
+		utils.LogErrorf(errors.ErrNeedleCorrupted, "Needle is encrypted but volume %d has no data key. key:%d", this.Id, needle.Key)
+		return errors.ErrNeedleCorrupted
+	}
+	return this.cipher.open(needle)
+}
+
+// -------- openEncryptedNeedle() --------
+// GCM只能整体校验，加密needle的数据读入内存解密后再读取。
+// Caller holds the read lock.
+func (this *Volume) openEncryptedNeedle(region NeedleRegion, needle *Needle) (reader *NeedleReader, err error) {
+	needle.Data = make([]byte, needle.Size)
+	offset := int64(region.GetOffset()) + int64(needle.DataOffset())
+	if _, err = this.data.reader.ReadAt(needle.Data, offset); err != nil {
+		utils.LogErrorf(err, "Volume %d read encrypted needle failed. key:%d", this.Id, needle.Key)
+		return
+	}
+	if crc32.Checksum(needle.Data, crc32Table) != needle.Checksum {
+		utils.LogErrorf(errors.ErrNeedleCorrupted, "Volume %d encrypted needle checksum not match. key:%d", this.Id, needle.Key)
+		return nil, errors.ErrNeedleCorrupted
+	}
+	if err = this.decryptNeedle(needle); err != nil {
+		return
+	}
+	return newMemoryNeedleReader(needle), nil
+}
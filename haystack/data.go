@@ -1,32 +1,50 @@
 package haystack
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
+	"github.com/uukuguy/kds/store/errors"
 	"github.com/uukuguy/kds/utils"
+	"io"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 )
 
 const (
-	// 一个卷（volume）数据文件大小最大32GB。
-	DATAFILE_MAXSIZE        = 4 * 1024 * 1024 * 1024 * NEEDLE_PADDINGSIZE
-	DATAFILE_MAXOFFSET      = 4*1024*1024*1024 - 1 // 4294967295
-	DATAFILE_MAX_CACHEWRITE = 1
+	// 一个卷（volume）数据文件大小最大32GB，新建数据文件时预分配该大小。
+	DATAFILE_MAXSIZE   = 4 * 1024 * 1024 * 1024 * NEEDLE_PADDINGSIZE
+	DATAFILE_MAXOFFSET = 4*1024*1024*1024 - 1 // 4294967295
+	// version3起索引项使用36位对齐偏移，数据文件最大512GB。
+	DATAFILE_WIDE_MAXSIZE = 1 << 36 * NEEDLE_PADDINGSIZE
+
+	DATAFILE_EXT = ".dat"
 )
 
+// **************** dataReader ****************
+// 数据文件的读取端。纠删码卷没有数据文件，由ecShards从各分片读取。
+type dataReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
 // **************** Data ****************
 type Data struct {
 	vid           int32
-	reader        *os.File
+	reader        dataReader
 	writer        *os.File
 	superblock    *SuperBlock
 	Dir           string
+	ext           string
 	FileSize      uint64
 	syncedSize    uint64
 	AlignedOffset uint64 // FileSize / NEEDLE_PADDINGSIZE
 	closed        bool
-	cache_writed  int32
+	refs          int32 // NeedleReaders streaming from reader.
+	refLock       sync.Mutex
+	shards        *ecShards // erasure coded volume, read only.
+	cold          string    // data file in the cold tier the data file links to.
 }
 
 // ======== String() ========
@@ -41,7 +59,6 @@ FileSize:             %d
 syncedSize:           %d
 AlignedOffset:        %d
 closed:               %v
-cache_writed:         %d
 -----------------------------
 `,
 		this.vid,
@@ -50,7 +67,6 @@ cache_writed:         %d
 		this.syncedSize,
 		this.AlignedOffset,
 		this.closed,
-		this.cache_writed,
 	)
 }
 
@@ -59,6 +75,7 @@ func NewData(vid int32, store_dir string) (data *Data) {
 	data = &Data{
 		vid:        vid,
 		Dir:        store_dir,
+		ext:        DATAFILE_EXT,
 		superblock: NewSuperBlock(),
 		closed:     false,
 		FileSize:   0,
@@ -70,20 +87,30 @@ func NewData(vid int32, store_dir string) (data *Data) {
 
 // ======== Init() ========
 func (this *Data) Init() (err error) {
+	if this.shards != nil {
+		return this.initShards()
+	}
+
 	dataFileName := this.getDataFileName()
 	if this.writer, err = os.OpenFile(dataFileName, os.O_WRONLY|os.O_CREATE|O_NOATIME, 0664); err != nil {
 		utils.LogErrorf(err, "os.OpenFile(\"%s\")", dataFileName)
 		this.Close()
 		return
 	}
-	if this.reader, err = os.OpenFile(dataFileName, os.O_RDONLY|O_NOATIME, 0664); err != nil {
+	var reader *os.File
+	if reader, err = os.OpenFile(dataFileName, os.O_RDONLY|O_NOATIME, 0664); err != nil {
 		utils.LogErrorf(err, "os.OpenFile(\"%s\")", dataFileName)
 		this.Close()
 		return
 	}
+	this.reader = reader
+	// 冷存储卷的数据文件是指向冷存储目录的符号链接，见Volume.Demote()。
+	if target, e := os.Readlink(dataFileName); e == nil {
+		this.cold = target
+	}
 
 	var filesize uint64
-	if filesize, err = utils.GetFileSize(this.reader); err != nil {
+	if filesize, err = utils.GetFileSize(reader); err != nil {
 		return
 	}
 
@@ -96,7 +123,6 @@ func (this *Data) Init() (err error) {
 		if err = this.writeSuperBlock(); err != nil {
 			return
 		}
-		this.FileSize = SUPERBLOCK_SIZE
 		this.syncedSize = this.FileSize
 	} else {
 		if err = this.loadSuperBlock(); err != nil {
@@ -108,6 +134,12 @@ func (this *Data) Init() (err error) {
 		this.writer.Seek(int64(this.FileSize), os.SEEK_SET)
 	}
 
+	// needle的读取是随机的，关闭内核预读。
+	if err = Fadvise(reader.Fd(), 0, 0, POSIX_FADV_RANDOM); err != nil {
+		utils.LogWarnf(err, "Data.Init() Fadvise() failed. vid:%d Dir:%s", this.vid, this.Dir)
+		err = nil
+	}
+
 	return
 }
 
@@ -118,22 +150,21 @@ func (this *Data) writeSuperBlock() (err error) {
 	var writedSize uint64
 	if writedSize, err = this.superblock.WriteToFile(this.writer); err == nil {
 		this.FileSize = writedSize
-		this.AlignedOffset = SUPERBLOCK_SIZE / NEEDLE_PADDINGSIZE
+		this.AlignedOffset = writedSize / NEEDLE_PADDINGSIZE
 	}
 	return
 }
 
 // -------- loadSuperBlock() --------
 func (this *Data) loadSuperBlock() (err error) {
-	this.reader.Seek(0, os.SEEK_SET)
-	err = this.superblock.ReadFromFile(this.reader)
+	err = this.superblock.ReadFromFile(io.NewSectionReader(this.reader, 0, SUPERBLOCK_MAXSIZE))
 	return
 }
 
 // -------- getFileSize() --------
 func (this *Data) getFileSize() (filesize int64, err error) {
 	var stat os.FileInfo
-	if stat, err = this.reader.Stat(); err != nil {
+	if stat, err = os.Stat(this.getDataFileName()); err != nil {
 		utils.LogErrorf(err, "")
 		return 0, err
 	}
@@ -141,26 +172,31 @@ func (this *Data) getFileSize() (filesize int64, err error) {
 	return filesize, nil
 }
 
+// -------- modTime() --------
+// Time of the last write to data file.
+func (this *Data) modTime() (modified time.Time, err error) {
+	var stat os.FileInfo
+	if stat, err = os.Stat(this.getDataFileName()); err == nil {
+		modified = stat.ModTime()
+	}
+	return
+}
+
 // -------- getDataFileName() --------
 func (this *Data) getDataFileName() string {
-	return this.Dir + "/" + strconv.Itoa(int(this.vid)) + ".dat"
+	return this.Dir + "/" + strconv.Itoa(int(this.vid)) + this.ext
 }
 
 // -------- flushFile() --------
-// Change
-//    this.cache_writed
+// Sync bytes appended since last flush to disk. Change
 //    this.syncedSize
 //
-func (this *Data) flushFile(force bool) (err error) {
+func (this *Data) flushFile() (err error) {
 	var (
 		fd     uintptr
 		offset uint64
 		size   uint64
 	)
-	if this.cache_writed++; !force && this.cache_writed < DATAFILE_MAX_CACHEWRITE {
-		return
-	}
-	this.cache_writed = 0
 	offset = this.syncedSize
 	size = this.FileSize - this.syncedSize
 	if size == 0 {
@@ -187,53 +223,290 @@ func (this *Data) flushFile(force bool) (err error) {
 // ======== Close() ========
 func (this *Data) Close() {
 	if this.writer != nil {
-		if err := this.flushFile(true); err != nil {
+		if err := this.flushFile(); err != nil {
 		}
 		if err := this.writer.Sync(); err != nil {
 		}
 		if err := this.writer.Close(); err != nil {
 		}
+		this.writer = nil
 	}
+
+	// 仍有NeedleReader在读取时，读文件句柄在最后一个release()时关闭。
+	this.refLock.Lock()
+	this.closed = true
+	if this.refs == 0 {
+		this.closeReader()
+	}
+	this.refLock.Unlock()
+}
+
+// -------- closeReader() --------
+func (this *Data) closeReader() {
 	if this.reader != nil {
 		if err := this.reader.Close(); err != nil {
 		}
+		this.reader = nil
+	}
+}
+
+// -------- acquire() --------
+// Hold the reader file open until release(), even if Data is closed meanwhile
+// (e.g. swapped out by compaction).
+func (this *Data) acquire() bool {
+	this.refLock.Lock()
+	defer this.refLock.Unlock()
+	if this.closed {
+		return false
+	}
+	this.refs++
+	return true
+}
+
+// -------- release() --------
+func (this *Data) release() {
+	this.refLock.Lock()
+	defer this.refLock.Unlock()
+	if this.refs--; this.refs == 0 && this.closed {
+		this.closeReader()
 	}
-	this.closed = true
 }
 
 // ======== AppendNeedle() ========
-// Keep write needles to the end of data file.
+// Keep write needles to the end of data file. The file is not synced, see
+// flushFile().
 func (this *Data) AppendNeedle(needle *Needle) (region NeedleRegion, err error) {
-
-	if DATAFILE_MAXSIZE-uint64(needle.WriteSize) < this.FileSize {
-		err = fmt.Errorf("No more free space in data file.")
+	if err = needle.SetVersion(this.superblock.needleVersion()); err != nil {
 		return
 	}
 	needle.FillBuffer()
-	if _, err = this.writer.Write(needle.Buffer()); err == nil {
-		region.AlignedOffset = this.AlignedOffset
-		region.Size = needle.WriteSize
-		this.AlignedOffset += uint64(needle.AlignedSize)
-		this.FileSize += uint64(needle.WriteSize)
-		if err = this.flushFile(false); err != nil {
-			this.FileSize -= uint64(needle.WriteSize)
+	return this.appendBuffer(needle.Buffer())
+}
+
+// -------- appendNeedles() --------
+// Append needles with a single write. Either all or none of them are appended.
+func (this *Data) appendNeedles(needles []*Needle) (regions []NeedleRegion, err error) {
+	if len(needles) == 1 {
+		var region NeedleRegion
+		if region, err = this.AppendNeedle(needles[0]); err == nil {
+			regions = []NeedleRegion{region}
+		}
+		return
+	}
+
+	var total int
+	for _, needle := range needles {
+		if err = needle.SetVersion(this.superblock.needleVersion()); err != nil {
 			return
 		}
-	} else {
+		needle.FillBuffer()
+		total += int(needle.WriteSize)
+	}
+	buf := getReadBuffer(total)
+	defer putReadBuffer(buf)
+
+	pos := 0
+	for _, needle := range needles {
+		pos += copy(buf[pos:], needle.Buffer())
+	}
+
+	var region NeedleRegion
+	if region, err = this.appendBuffer(buf); err != nil {
 		return
 	}
+	regions = make([]NeedleRegion, len(needles))
+	offset := region.AlignedOffset
+	for i, needle := range needles {
+		regions[i] = NeedleRegion{AlignedOffset: offset, Size: needle.WriteSize}
+		offset += uint64(needle.WriteSize / NEEDLE_PADDINGSIZE)
+	}
 
 	return
 }
 
+// -------- appendBuffer() --------
+// Append an aligned needle buffer to the end of data file without flushing.
+func (this *Data) appendBuffer(buf []byte) (region NeedleRegion, err error) {
+	size := uint64(len(buf))
+	if this.maxSize()-size < this.FileSize {
+		err = errors.ErrDataNomoreSpace
+		return
+	}
+	if _, err = this.writer.Write(buf); err != nil {
+		// 丢弃部分写入的数据，保持文件末尾与FileSize一致。
+		this.truncate(this.FileSize)
+		return
+	}
+	region.AlignedOffset = this.AlignedOffset
+	region.Size = uint32(size)
+	this.AlignedOffset += size / NEEDLE_PADDINGSIZE
+	this.FileSize += size
+
+	return
+}
+
+// -------- maxSize() --------
+func (this *Data) maxSize() uint64 {
+	if this.superblock.Version >= version3 {
+		return DATAFILE_WIDE_MAXSIZE
+	}
+	return DATAFILE_MAXSIZE
+}
+
+// -------- readRegion() --------
+// Read the whole needle buffer in region. Safe for concurrent use with appends.
+// buf comes from read buffer pools, return it with putReadBuffer() when done.
+func (this *Data) readRegion(region NeedleRegion) (buf []byte, err error) {
+	buf = getReadBuffer(int(region.Size))
+	if _, err = this.reader.ReadAt(buf, int64(region.GetOffset())); err != nil {
+		utils.LogErrorf(err, "Data.readRegion() failed. vid:%d region:%+v", this.vid, region)
+	}
+	return
+}
+
+// -------- scanNeedles() --------
+// Scan needles from offset to the end of data file. fn is called for every
+// complete needle whose header magic, size, footer magic and checksum are
+// valid. A needle with intact header and footer but bad data (e.g. checksum
+// mismatch) is skipped. Scanning stops at a needle whose header or footer is
+// broken, or at a torn tail: an incomplete header or a needle reaching beyond
+// the file size. end is the offset where scanning stopped, torn is true only
+// for a torn tail, the bytes after end can be dropped then.
+func (this *Data) scanNeedles(offset uint64, fn func(needle *Needle, region NeedleRegion) error) (end uint64, torn bool, err error) {
+	end = offset
+	version := this.superblock.needleVersion()
+	header_size := uint64(needleHeaderSize(version))
+	header := make([]byte, header_size)
+	for end < this.FileSize {
+		if end+header_size > this.FileSize {
+			utils.LogWarnf(nil, "Data.scanNeedles() incomplete header. vid:%d offset:%d", this.vid, end)
+			torn = true
+			break
+		}
+		if _, err = this.reader.ReadAt(header, int64(end)); err != nil {
+			return
+		}
+		if !bytes.Equal(header[NEEDLE_MAGIC_OFFSET:NEEDLE_COOKIE_OfFSET], headerMagic) {
+			utils.LogErrorf(errors.ErrNeedleCorrupted, "Data.scanNeedles() wrong header magic. vid:%d offset:%d", this.vid, end)
+			break
+		}
+		var meta_size uint32
+		if version >= version2 {
+			meta_size = utils.BigEndian.Uint32(header[NEEDLE_META_SIZE_OFFSET:NEEDLE_V2_HEADER_SIZE])
+		}
+		write_size := needleWriteSize(version, meta_size, utils.BigEndian.Uint32(header[NEEDLE_SIZE_OFFSET:NEEDLE_DATA_OFFSET]))
+		if end+write_size > this.FileSize {
+			utils.LogWarnf(nil, "Data.scanNeedles() incomplete needle. vid:%d offset:%d size:%d", this.vid, end, write_size)
+			torn = true
+			break
+		}
+
+		region := NeedleRegion{AlignedOffset: end / NEEDLE_PADDINGSIZE, Size: uint32(write_size)}
+		var buf []byte
+		if buf, err = this.readRegion(region); err != nil {
+			return
+		}
+		needle := new(Needle)
+		if err = needle.BuildFrom(version, buf); err != nil {
+			// 头尾完整而数据损坏的needle跳过，之后的needle照常扫描。
+			intact := hasFooterMagic(version, buf)
+			putReadBuffer(buf)
+			if !intact {
+				utils.LogErrorf(err, "Data.scanNeedles() broken needle. vid:%d offset:%d", this.vid, end)
+				err = nil
+				break
+			}
+			utils.LogErrorf(err, "Data.scanNeedles() corrupted needle skipped. vid:%d offset:%d key:%d", this.vid, end, needle.Key)
+			err = nil
+			end += write_size
+			continue
+		}
+		putReadBuffer(buf)
+
+		if err = fn(needle, region); err != nil {
+			return
+		}
+		end += write_size
+	}
+
+	return
+}
+
+// -------- hasFooterMagic() --------
+// The needle in buf has a valid header and footer magic where its header
+// says, whatever its data is.
+func hasFooterMagic(version byte, buf []byte) bool {
+	needle := new(Needle)
+	if needle.buildHeaderFrom(version, buf) != nil {
+		return false
+	}
+	offset := uint64(needle.DataOffset()) + uint64(needle.Size) + NEEDLE_MAGIC_OFFSET
+	if offset+NEEDLE_MAGIC_SIZE > uint64(len(buf)) {
+		return false
+	}
+	return bytes.Equal(buf[offset:offset+NEEDLE_MAGIC_SIZE], footerMagic)
+}
+
+// -------- seal() --------
+// Persist the sealed flag in superblock of data file.
+func (this *Data) seal() (err error) {
+	flags := this.superblock.Flags | superblockFlagSealed
+	if _, err = this.writer.WriteAt([]byte{flags}, SUPERBLOCK_FLAGS_OFFSET); err != nil {
+		utils.LogErrorf(err, "Data.seal() failed. vid:%d", this.vid)
+		return
+	}
+	if err = Fdatasync(this.writer.Fd()); err != nil {
+		utils.LogErrorf(err, "Data.seal() Fdatasync() failed. vid:%d", this.vid)
+		return
+	}
+	this.superblock.Flags = flags
+	return
+}
+
+// -------- truncate() --------
+// Drop bytes after size, e.g. a torn needle at the end of data file.
+func (this *Data) truncate(size uint64) (err error) {
+	if err = this.writer.Truncate(int64(size)); err != nil {
+		utils.LogErrorf(err, "Data.truncate() failed. vid:%d size:%d", this.vid, size)
+		return
+	}
+	this.FileSize = size
+	if this.syncedSize > size {
+		this.syncedSize = size
+	}
+	this.AlignedOffset = size / NEEDLE_PADDINGSIZE
+	_, err = this.writer.Seek(int64(size), os.SEEK_SET)
+	return
+}
+
+// -------- remove() --------
+func (this *Data) remove() error {
+	if this.shards != nil {
+		return this.shards.remove()
+	}
+	if this.cold != "" {
+		if err := os.Remove(this.cold); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(this.getDataFileName())
+}
+
 // ======== UpdateNeedle() ========
 func (this *Data) UpdateNeedle(needle *Needle) (region NeedleRegion, err error) {
 	return NeedleRegion{}, nil
 }
 
 // ======== DeleteNeedle() ========
-func (this *Data) DeleteNeedle(needle *Needle) (err error) {
-	return nil
+// Append a tombstone needle to the end of data file. The needle is turned into
+// a tombstone (no data, flagNeedleDeleted) before writing.
+func (this *Data) DeleteNeedle(needle *Needle) (region NeedleRegion, err error) {
+	needle.Renew(0)
+	needle.Flags = flagNeedleDeleted
+	needle.Data = nil
+	needle.Checksum = 0
+
+	return this.AppendNeedle(needle)
 }
 
 // ======== FindNeedle() ========
@@ -244,26 +517,68 @@ func (this *Data) FindNeedle(key int64) (needle *Needle, err error) {
 	return needle, nil
 }
 
+// ======== GetNeedleHeader() ========
+// Read only the needle header and metadata in region, needle.Data is not loaded.
+func (this *Data) GetNeedleHeader(region NeedleRegion) (needle *Needle, err error) {
+	version := this.superblock.needleVersion()
+	buf := make([]byte, needleHeaderSize(version))
+	if _, err = this.reader.ReadAt(buf, int64(region.GetOffset())); err != nil {
+		utils.LogErrorf(err, "Data.GetNeedleHeader() failed. vid:%d region:%+v", this.vid, region)
+		return
+	}
+	needle = new(Needle)
+	if err = needle.buildHeaderFrom(version, buf); err != nil || needle.MetaSize == 0 {
+		return
+	}
+
+	meta := make([]byte, needle.MetaSize)
+	if _, err = this.reader.ReadAt(meta, int64(region.GetOffset()+uint64(needle.HeaderSize()))); err != nil {
+		utils.LogErrorf(err, "Data.GetNeedleHeader() read metadata failed. vid:%d region:%+v", this.vid, region)
+		return
+	}
+	err = needle.decodeMeta(meta)
+	return
+}
+
+// -------- getNeedleFooter() --------
+// Read footer magic and checksum of needle whose header is already loaded.
+func (this *Data) getNeedleFooter(region NeedleRegion, needle *Needle) (err error) {
+	buf := make([]byte, NEEDLE_FOOTER_SIZE)
+	offset := region.GetOffset() + uint64(needle.DataOffset()) + uint64(needle.Size)
+	if _, err = this.reader.ReadAt(buf, int64(offset)); err != nil {
+		utils.LogErrorf(err, "Data.getNeedleFooter() failed. vid:%d region:%+v", this.vid, region)
+		return
+	}
+	needle.FooterMagic = buf[NEEDLE_MAGIC_OFFSET:NEEDLE_CHECKSUM_OFFSET]
+	needle.Checksum = utils.BigEndian.Uint32(buf[NEEDLE_CHECKSUM_OFFSET:NEEDLE_PADDING_OFFSET])
+	if !bytes.Equal(needle.FooterMagic, footerMagic) {
+		err = errors.ErrNeedleCorrupted
+		utils.LogErrorf(err, "Needle footer magic is wrong. vid:%d key:%d", this.vid, needle.Key)
+	}
+	return
+}
+
+// ======== GetNeedle() ========
+// 使用pread（ReadAt）按偏移读取，不改变共享文件句柄的读写位置，
+// 多个goroutine可以并发读取同一个数据文件。
 func (this *Data) GetNeedle(key int64, region NeedleRegion) (needle *Needle, err error) {
-	offset := region.GetOffset()
-	this.reader.Seek(int64(offset), os.SEEK_SET)
-	utils.LogDebugf("reader.Seek() offset=%d region:%+v", offset, region)
-	reader := bufio.NewReaderSize(this.reader, int(region.Size))
-	var buf []byte
-	if buf, err = reader.Peek(int(region.Size)); err != nil {
+	buf := getReadBuffer(int(region.Size))
+	defer putReadBuffer(buf)
+
+	if _, err = this.reader.ReadAt(buf, int64(region.GetOffset())); err != nil {
+		utils.LogErrorf(err, "Data.GetNeedle() failed. vid:%d key:%d region:%+v", this.vid, key, region)
 		return
 	}
-	//reader.Discard(int(region.Size))
 
+	// BuildFrom() copies needle data out of buf.
 	needle = new(Needle)
-	if err = needle.BuildFrom(buf); err != nil {
+	if err = needle.BuildFrom(this.superblock.needleVersion(), buf); err != nil {
 		return
 	}
-	var n uint32 = 16
-	if needle.Size < n {
-		n = needle.Size
+	if needle.IsDeleted() {
+		err = errors.ErrNeedleNotExist
+		return
 	}
-	utils.LogDebugf("needle.Data(len=%d): %#v...", needle.Size, needle.Data[:n])
 
 	return
 }
@@ -27,18 +27,25 @@
 package haystack
 
 import (
-	"fmt"
 	"testing"
 )
 
-func TestData(t *testing.T) {
-	np := NeedlePosition{1, 32}
-	value := np.to_int64()
-	fmt.Println("np.to_int64() value=", value)
-
-	np0 := NeedlePosition{}
-	np0.from_int64(value)
-	if np0.Offset != 1 || np0.Size != 32 {
-		t.Errorf("NeedlePosition.from_int64() failed. np0.Offset=%d np0.Size=%d", np0.Offset, np0.Size)
+func TestNeedleRegion(t *testing.T) {
+	for _, version := range []byte{version2, version3} {
+		index := NewIndex(1, "")
+		index.superblock.Version = version
+		regions := []NeedleRegion{
+			{1, 32},
+			{1, 0},
+			{DATAFILE_MAXSIZE/NEEDLE_PADDINGSIZE - 1, uint32(index.maxRegionSize())},
+		}
+		if version >= version3 {
+			regions = append(regions, NeedleRegion{DATAFILE_WIDE_MAXSIZE/NEEDLE_PADDINGSIZE - 1, REGION_WIDE_MAXSIZE})
+		}
+		for _, region := range regions {
+			if got := index.decodeRegion(index.encodeRegion(region)); got != region {
+				t.Errorf("version %d region %+v decoded as %+v", version, region, got)
+			}
+		}
 	}
 }
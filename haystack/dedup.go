@@ -0,0 +1,471 @@
+package haystack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// 内容去重：开启Config.Dedup后，上传的needle按数据（压缩后）和codec计算SHA-256，
+// 在Store的去重表中查找hash -> (vid, key, cookie)。数据只以随机key/cookie保存一份
+// 数据needle，上传的key写成引用needle（Flags带flagNeedleReference），读取时
+// 透明地转到数据needle，元数据沿用引用needle。去重表记录每个数据needle的引用数，
+// 删除引用needle后引用数减一，减到0时删除数据needle，之后由压缩回收空间。
+//
+// 去重表保存在第一个数据目录的dedup.tbl中，每次修改追加一条记录（最后一条有效）：
+//
+//	hash(32) vid(4) key(8) cookie(4) size(4) refs(4) crc(4)
+//
+// 写入引用needle之前先增加引用数，删除引用needle之后才减少，中断时数据needle
+// 只会多留，不会被提前删除。带TTL的needle和卷不去重，避免过期时引用数无法维护。
+const (
+	DEDUP_TABLE_FILE  = "dedup.tbl"
+	DEDUP_HASH_SIZE   = sha256.Size
+	DEDUP_RECORD_SIZE = DEDUP_HASH_SIZE + 28
+
+	// 小于该值的needle不去重，引用needle并不更小。
+	DEDUP_MINSIZE = 256
+
+	// 引用needle的数据：version(1) padding(3) vid(4) key(8) cookie(4) size(4) hash(32)
+	REFERENCE_VERSION = 1
+	REFERENCE_SIZE    = 24 + DEDUP_HASH_SIZE
+
+	// 数据是Reference，内容在其指向的数据needle中。
+	flagNeedleReference = 0x20
+)
+
+// **************** Reference ****************
+type Reference struct {
+	Vid    int32
+	Key    int64
+	Cookie int32
+	Size   uint32
+	Hash   [DEDUP_HASH_SIZE]byte
+}
+
+// ======== Marshal() ========
+func (this *Reference) Marshal() []byte {
+	buf := make([]byte, REFERENCE_SIZE)
+	buf[0] = REFERENCE_VERSION
+	utils.BigEndian.PutInt32(buf[4:], this.Vid)
+	utils.BigEndian.PutInt64(buf[8:], this.Key)
+	utils.BigEndian.PutInt32(buf[16:], this.Cookie)
+	utils.BigEndian.PutUint32(buf[20:], this.Size)
+	copy(buf[24:], this.Hash[:])
+	return buf
+}
+
+// ======== UnmarshalReference() ========
+func UnmarshalReference(buf []byte) (ref *Reference, err error) {
+	if len(buf) != REFERENCE_SIZE || buf[0] != REFERENCE_VERSION {
+		return nil, fmt.Errorf("Reference version not match.")
+	}
+	ref = &Reference{
+		Vid:    utils.BigEndian.Int32(buf[4:]),
+		Key:    utils.BigEndian.Int64(buf[8:]),
+		Cookie: utils.BigEndian.Int32(buf[16:]),
+		Size:   utils.BigEndian.Uint32(buf[20:]),
+	}
+	copy(ref.Hash[:], buf[24:])
+	return
+}
+
+// ======== IsReference() ========
+func (needle *Needle) IsReference() bool {
+	return needle.Flags&flagNeedleReference != 0
+}
+
+// -------- readReference() --------
+// Read and verify the reference from a reference needle.
+func readReference(reader *NeedleReader) (ref *Reference, err error) {
+	if _, err = reader.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	var buf []byte
+	if buf, err = ioutil.ReadAll(reader); err != nil {
+		return
+	}
+	if ref, err = UnmarshalReference(buf); err != nil {
+		utils.LogErrorf(err, "Reference of needle %d is invalid.", reader.Needle.Key)
+		err = errors.ErrNeedleCorrupted
+	}
+	return
+}
+
+// -------- dedupHash() --------
+func dedupHash(needle *Needle) (hash [DEDUP_HASH_SIZE]byte) {
+	h := sha256.New()
+	h.Write([]byte{needle.Codec()})
+	h.Write(needle.Data)
+	copy(hash[:], h.Sum(nil))
+	return
+}
+
+// **************** dedupEntry ****************
+type dedupEntry struct {
+	Vid    int32
+	Key    int64
+	Cookie int32
+	Size   uint32
+	Refs   uint32
+}
+
+// **************** dedupTable ****************
+type dedupTable struct {
+	lock    sync.Mutex // 保护entries和文件，锁内不调用Store的方法。
+	file    *os.File
+	entries map[[DEDUP_HASH_SIZE]byte]*dedupEntry
+	records int
+}
+
+// -------- openDedupTable() --------
+// Load the table in dir. Records after a torn one are dropped, and the file
+// is rewritten when most records are outdated.
+func openDedupTable(dir string) (table *dedupTable, err error) {
+	name := dir + "/" + DEDUP_TABLE_FILE
+	table = &dedupTable{
+		entries: make(map[[DEDUP_HASH_SIZE]byte]*dedupEntry),
+	}
+	var buf []byte
+	if buf, err = ioutil.ReadFile(name); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	valid := 0
+	for ; valid+DEDUP_RECORD_SIZE <= len(buf); valid += DEDUP_RECORD_SIZE {
+		hash, entry, ok := decodeDedupRecord(buf[valid : valid+DEDUP_RECORD_SIZE])
+		if !ok {
+			utils.LogWarnf(nil, "Dedup table %s has a torn record at %d, dropped.", name, valid)
+			break
+		}
+		if entry.Refs == 0 {
+			delete(table.entries, hash)
+		} else {
+			table.entries[hash] = entry
+		}
+		table.records++
+	}
+
+	if valid == len(buf) && table.records <= 2*len(table.entries)+1024 {
+		if table.file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0664); err != nil {
+			return nil, err
+		}
+		return
+	}
+	if err = table.rewrite(name); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// -------- rewrite() --------
+// Write the live entries to a new table file.
+func (this *dedupTable) rewrite(name string) (err error) {
+	tmp := name + ".tmp"
+	var file *os.File
+	if file, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	for hash, entry := range this.entries {
+		buf.Write(encodeDedupRecord(hash, entry))
+	}
+	if _, err = file.Write(buf.Bytes()); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	this.records = len(this.entries)
+	this.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0664)
+	return
+}
+
+// -------- put() --------
+// Persist the entry of hash, refs 0 removes it. Caller holds the lock.
+func (this *dedupTable) put(hash [DEDUP_HASH_SIZE]byte, entry *dedupEntry) (err error) {
+	if this.file == nil {
+		return fmt.Errorf("Dedup table closed.")
+	}
+	if _, err = this.file.Write(encodeDedupRecord(hash, entry)); err != nil {
+		return
+	}
+	if err = this.file.Sync(); err != nil {
+		return
+	}
+	this.records++
+	if entry.Refs == 0 {
+		delete(this.entries, hash)
+	} else {
+		this.entries[hash] = entry
+	}
+	return
+}
+
+// -------- close() --------
+func (this *dedupTable) close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.file != nil {
+		this.file.Close()
+		this.file = nil
+	}
+}
+
+// -------- encodeDedupRecord() --------
+func encodeDedupRecord(hash [DEDUP_HASH_SIZE]byte, entry *dedupEntry) []byte {
+	buf := make([]byte, DEDUP_RECORD_SIZE)
+	copy(buf, hash[:])
+	pos := DEDUP_HASH_SIZE
+	utils.BigEndian.PutInt32(buf[pos:], entry.Vid)
+	utils.BigEndian.PutInt64(buf[pos+4:], entry.Key)
+	utils.BigEndian.PutInt32(buf[pos+12:], entry.Cookie)
+	utils.BigEndian.PutUint32(buf[pos+16:], entry.Size)
+	utils.BigEndian.PutUint32(buf[pos+20:], entry.Refs)
+	utils.BigEndian.PutUint32(buf[pos+24:], crc32.Checksum(buf[:pos+24], crc32Table))
+	return buf
+}
+
+// -------- decodeDedupRecord() --------
+func decodeDedupRecord(buf []byte) (hash [DEDUP_HASH_SIZE]byte, entry *dedupEntry, ok bool) {
+	pos := DEDUP_HASH_SIZE
+	if utils.BigEndian.Uint32(buf[pos+24:]) != crc32.Checksum(buf[:pos+24], crc32Table) {
+		return
+	}
+	copy(hash[:], buf)
+	entry = &dedupEntry{
+		Vid:    utils.BigEndian.Int32(buf[pos:]),
+		Key:    utils.BigEndian.Int64(buf[pos+4:]),
+		Cookie: utils.BigEndian.Int32(buf[pos+12:]),
+		Size:   utils.BigEndian.Uint32(buf[pos+16:]),
+		Refs:   utils.BigEndian.Uint32(buf[pos+20:]),
+	}
+	return hash, entry, true
+}
+
+// ======== WriteDedupNeedle() ========
+// 与WriteNeedle()相同，开启去重时相同内容只保存一份数据needle，needle写成
+// 引用needle，dup表示内容已经存在。needle本身不变。
+func (this *Store) WriteDedupNeedle(vid int32, needle *Needle) (used int32, dup bool, err error) {
+	used, err = this.replaceNeedle(vid, needle.Key, func() (int32, error) {
+		if !this.dedupable(vid, needle) {
+			return this.WriteNeedle(vid, needle)
+		}
+		var used int32
+		var err error
+		used, dup, err = this.writeDedup(vid, needle)
+		return used, err
+	})
+	return
+}
+
+// -------- writeDedup() --------
+// 在去重表锁内查找并预先增加引用数，数据needle和引用needle都在锁外写入，
+// 去重表锁内不调用Store的方法。
+func (this *Store) writeDedup(vid int32, needle *Needle) (used int32, dup bool, err error) {
+	table := this.dedup
+	hash := dedupHash(needle)
+
+	var entry *dedupEntry
+	if entry, err = table.reserve(hash, needle.Size); err != nil {
+		return
+	}
+	if entry != nil {
+		if _, ok := this.GetVolume(entry.Vid); ok {
+			dup = true
+		} else {
+			// 数据needle所在的卷暂时不可用，不去重，去重表中的项保持不变。
+			utils.LogWarnf(this.volumeErr(entry.Vid), "Data needle of content unavailable, not deduped. vid:%d key:%d", entry.Vid, entry.Key)
+			this.releaseReference(&Reference{Vid: entry.Vid, Key: entry.Key, Hash: hash})
+			used, err = this.WriteNeedle(vid, needle)
+			return
+		}
+	} else {
+		blob := NewNeedle(RandomKey(), RandomCookie(), needle.Size)
+		blob.Data = needle.Data
+		blob.Checksum = needle.Checksum
+		blob.Flags = needle.Flags & flagNeedleCodecMask
+		var blob_vid int32
+		if blob_vid, err = this.WriteNeedle(vid, blob); err != nil {
+			return
+		}
+		entry = &dedupEntry{Vid: blob_vid, Key: blob.Key, Cookie: blob.Cookie, Size: blob.Size}
+		var added *dedupEntry
+		if added, err = table.add(hash, entry); err != nil || added != entry {
+			// 同样的内容已由并发写入保存，使用它的数据needle。
+			this.deleteBlob(entry)
+			if err != nil {
+				utils.LogErrorf(err, "Dedup table put failed.")
+				return
+			}
+			entry, dup = added, true
+		}
+	}
+
+	ref := &Reference{Vid: entry.Vid, Key: entry.Key, Cookie: entry.Cookie, Size: entry.Size, Hash: hash}
+	data := ref.Marshal()
+	ref_needle := NewNeedle(needle.Key, needle.Cookie, uint32(len(data)))
+	if _, err = ref_needle.ReadFrom(bytes.NewReader(data)); err == nil {
+		ref_needle.Flags = flagNeedleReference
+		ref_needle.MTime = needle.MTime
+		ref_needle.Name = needle.Name
+		ref_needle.Mime = needle.Mime
+		ref_needle.Meta = needle.Meta
+		used, err = this.WriteNeedle(vid, ref_needle)
+	}
+	if err != nil {
+		this.releaseReference(ref)
+	}
+	return
+}
+
+// -------- reserve() --------
+// Add a reference to the entry of hash and persist it before the reference
+// needle is written. nil if there is no entry of the content.
+func (this *dedupTable) reserve(hash [DEDUP_HASH_SIZE]byte, size uint32) (reserved *dedupEntry, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.entries[hash]
+	if !ok || entry.Size != size {
+		return
+	}
+	added := *entry
+	added.Refs++
+	if err = this.put(hash, &added); err != nil {
+		utils.LogErrorf(err, "Dedup table put failed.")
+		return
+	}
+	return &added, nil
+}
+
+// -------- add() --------
+// Add the entry of a new data needle with one reference. If the content is
+// already in the table, add a reference to the existing entry and return it.
+func (this *dedupTable) add(hash [DEDUP_HASH_SIZE]byte, entry *dedupEntry) (added *dedupEntry, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	added = entry
+	if existing, ok := this.entries[hash]; ok && existing.Size == entry.Size {
+		updated := *existing
+		added = &updated
+	}
+	added.Refs++
+	if err = this.put(hash, added); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// -------- release() --------
+// Drop a reference to the data needle. Return the entry when its last
+// reference is dropped, the data needle is to be deleted then.
+func (this *dedupTable) release(ref *Reference) (released *dedupEntry, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.entries[ref.Hash]
+	if !ok || entry.Vid != ref.Vid || entry.Key != ref.Key || entry.Refs == 0 {
+		utils.LogWarnf(nil, "Data needle of reference not in dedup table. vid:%d key:%d", ref.Vid, ref.Key)
+		return
+	}
+	updated := *entry
+	updated.Refs--
+	if err = this.put(ref.Hash, &updated); err != nil {
+		return
+	}
+	if updated.Refs == 0 {
+		released = &updated
+	}
+	return
+}
+
+// -------- dedupable() --------
+func (this *Store) dedupable(vid int32, needle *Needle) bool {
+	if this.dedup == nil || needle.Size < DEDUP_MINSIZE || needle.Flags&^flagNeedleCodecMask != 0 {
+		return false
+	}
+	if needle.TTL != 0 || this.Config.VolumeTTL != 0 {
+		return false
+	}
+	if volume, ok := this.GetVolume(vid); ok {
+		volume.rwlock.RLock()
+		defer volume.rwlock.RUnlock()
+		return volume.data.superblock.TTL == 0
+	}
+	return true
+}
+
+// -------- releaseReference() --------
+// Drop a reference to the data needle, delete it with the last reference.
+func (this *Store) releaseReference(ref *Reference) {
+	if this.dedup == nil {
+		utils.LogWarnf(nil, "Dedup disabled, data needle of reference kept. vid:%d key:%d", ref.Vid, ref.Key)
+		return
+	}
+	released, err := this.dedup.release(ref)
+	if err != nil {
+		utils.LogErrorf(err, "Dedup table put failed, data needle kept. vid:%d key:%d", ref.Vid, ref.Key)
+		return
+	}
+	if released != nil {
+		this.deleteBlob(released)
+	}
+}
+
+// -------- deleteBlob() --------
+func (this *Store) deleteBlob(entry *dedupEntry) {
+	volume, ok := this.GetVolume(entry.Vid)
+	if !ok {
+		utils.LogWarnf(this.volumeErr(entry.Vid), "Data needle kept. vid:%d key:%d", entry.Vid, entry.Key)
+		return
+	}
+	if err := volume.DeleteNeedle(entry.Key, entry.Cookie); err != nil {
+		utils.LogWarnf(err, "Delete data needle failed. vid:%d key:%d", entry.Vid, entry.Key)
+	}
+}
+
+// ======== OpenReference() ========
+// Open the data needle of a reference needle for streaming, with metadata
+// of the reference needle. reader is not closed.
+func (this *Store) OpenReference(reader *NeedleReader) (blob *NeedleReader, err error) {
+	var ref *Reference
+	if ref, err = readReference(reader); err != nil {
+		return
+	}
+	volume, ok := this.GetVolume(ref.Vid)
+	if !ok {
+		utils.LogErrorf(this.volumeErr(ref.Vid), "Data needle of needle %d lost. vid:%d", reader.Needle.Key, ref.Vid)
+		return nil, errors.ErrNeedleCorrupted
+	}
+	if blob, err = volume.OpenNeedle(ref.Key, ref.Cookie); err != nil {
+		utils.LogErrorf(err, "Open data needle of needle %d failed. vid:%d key:%d", reader.Needle.Key, ref.Vid, ref.Key)
+		if err == errors.ErrNeedleNotExist || err == errors.ErrNeedleCookieNotMatch {
+			err = errors.ErrNeedleCorrupted
+		}
+		return
+	}
+	if blob.Needle.Size != ref.Size {
+		blob.Close()
+		return nil, errors.ErrNeedleCorrupted
+	}
+	blob.Needle.MTime = reader.Needle.MTime
+	blob.Needle.Name = reader.Needle.Name
+	blob.Needle.Mime = reader.Needle.Mime
+	blob.Needle.Meta = reader.Needle.Meta
+	blob.Needle.TTL = reader.Needle.TTL
+	return
+}
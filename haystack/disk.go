@@ -0,0 +1,258 @@
+package haystack
+
+import (
+	"fmt"
+	"github.com/uukuguy/kds/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Store的每个数据目录对应一块磁盘，各自统计容量和剩余空间。新卷放在剩余空间
+// 最多的磁盘上。磁盘目录不可访问时标记为故障，只有该磁盘上的卷下线，其它磁盘照常服务。
+
+const (
+	// 每个磁盘上记录Store新建过的最大vid，见Store.createVolume()。
+	DISK_VIDMARK_FILE = "vid.mark"
+)
+
+// **************** Disk ****************
+type Disk struct {
+	Dir string
+	// Bytes volumes on the disk may take, 0 for the whole file system.
+	Capacity uint64
+
+	lock sync.RWMutex
+	err  error // not nil once the disk failed.
+}
+
+// **************** DiskStat ****************
+type DiskStat struct {
+	Dir      string `json:"dir"`
+	Capacity uint64 `json:"capacity"`
+	Volumes  int    `json:"volumes"`
+	Faulty   int    `json:"faulty"`
+	Cold     int    `json:"cold"`
+	// Bytes of volume data files not in the cold tier, and bytes unsealed volumes may still grow
+	// by up to Config.VolumeMaxSize.
+	Used     uint64 `json:"used"`
+	Reserved uint64 `json:"reserved"`
+	// Bytes left for new volumes, the less of capacity left and free space
+	// of the file system.
+	Free  uint64 `json:"free"`
+	Error string `json:"error,omitempty"`
+}
+
+// ======== NewDisk() ========
+func NewDisk(dir string, capacity uint64) *Disk {
+	return &Disk{
+		Dir:      dir,
+		Capacity: capacity,
+	}
+}
+
+// ======== ParseDisk() ========
+// Parse "dir" or "dir:capacity", capacity in bytes or with unit K, M, G, T,
+// e.g. "/data1:4T".
+func ParseDisk(spec string) (disk *Disk, err error) {
+	dir, capacity := spec, uint64(0)
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		dir = spec[:i]
+		if capacity, err = parseBytes(spec[i+1:]); err != nil || capacity == 0 {
+			return nil, fmt.Errorf("Invalid disk capacity \"%s\".", spec)
+		}
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("Invalid disk \"%s\".", spec)
+	}
+	return NewDisk(dir, capacity), nil
+}
+
+// -------- parseBytes() --------
+func parseBytes(s string) (n uint64, err error) {
+	units := map[byte]uint64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	unit := uint64(1)
+	if s != "" {
+		if u, ok := units[s[len(s)-1]]; ok {
+			s, unit = s[:len(s)-1], u
+		}
+	}
+	if n, err = strconv.ParseUint(s, 10, 64); err != nil {
+		return
+	}
+	return n * unit, nil
+}
+
+// ======== Err() ========
+// Error the disk failed with, nil for healthy disks.
+func (this *Disk) Err() error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.err
+}
+
+// -------- fail() --------
+func (this *Disk) fail(err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.err == nil {
+		utils.LogErrorf(err, "Disk %s failed, its volumes are offline.", this.Dir)
+		this.err = err
+	}
+}
+
+// -------- init() --------
+// Make the dir and check it is writable.
+func (this *Disk) init() (err error) {
+	if err = os.MkdirAll(this.Dir, os.ModeDir|0755); err == nil {
+		err = this.check()
+	}
+	if err != nil {
+		this.fail(err)
+	}
+	return
+}
+
+// -------- check() --------
+// Probe the disk by writing a file.
+func (this *Disk) check() (err error) {
+	var file *os.File
+	if file, err = ioutil.TempFile(this.Dir, ".kds_probe"); err != nil {
+		return
+	}
+	_, err = file.Write([]byte("kds"))
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	os.Remove(file.Name())
+	return
+}
+
+// -------- readVidMark() --------
+// The vid mark on the disk, 0 if there is none or it can not be read.
+func (this *Disk) readVidMark() int32 {
+	buf, err := ioutil.ReadFile(filepath.Join(this.Dir, DISK_VIDMARK_FILE))
+	if err != nil {
+		return 0
+	}
+	vid, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 32)
+	if err != nil {
+		utils.LogWarnf(err, "Invalid vid mark on disk %s.", this.Dir)
+		return 0
+	}
+	return int32(vid)
+}
+
+// -------- writeVidMark() --------
+func (this *Disk) writeVidMark(vid int32) (err error) {
+	name := filepath.Join(this.Dir, DISK_VIDMARK_FILE)
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, []byte(strconv.Itoa(int(vid))+"\n"), 0644); err == nil {
+		err = os.Rename(tmp, name)
+	}
+	return
+}
+
+// -------- freeSpace() --------
+// Free bytes of the file system for unprivileged users.
+func (this *Disk) freeSpace() (free uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(this.Dir, &stat); err == nil {
+		free = uint64(stat.Bavail) * uint64(stat.Bsize)
+	}
+	return
+}
+
+// ======== DiskStats() ========
+func (this *Store) DiskStats() []DiskStat {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.diskStats()
+}
+
+// -------- diskStats() --------
+// Caller holds the lock.
+func (this *Store) diskStats() (stats []DiskStat) {
+	stats = make([]DiskStat, len(this.Disks))
+	for i, disk := range this.Disks {
+		stat := &stats[i]
+		stat.Dir = disk.Dir
+		stat.Capacity = disk.Capacity
+		if err := disk.Err(); err != nil {
+			stat.Error = err.Error()
+		}
+
+		dir := filepath.Clean(disk.Dir)
+		for _, faulty := range this.faulty {
+			if filepath.Clean(faulty.Dir) == dir {
+				stat.Faulty++
+			}
+		}
+		for _, volume := range this.Volumes {
+			if filepath.Clean(volume.Dir) != dir {
+				continue
+			}
+			stat.Volumes++
+			if volume.IsCold() {
+				stat.Cold++
+				continue
+			}
+			size := volume.DataSize()
+			stat.Used += size
+			if !volume.IsSealed() && size < this.Config.VolumeMaxSize {
+				stat.Reserved += this.Config.VolumeMaxSize - size
+			}
+		}
+		if stat.Error != "" {
+			continue
+		}
+		free, err := disk.freeSpace()
+		if err != nil {
+			stat.Error = err.Error()
+			continue
+		}
+		stat.Free = free
+		if disk.Capacity > 0 {
+			left := uint64(0)
+			if disk.Capacity > stat.Used+stat.Reserved {
+				left = disk.Capacity - stat.Used - stat.Reserved
+			}
+			if left < stat.Free {
+				stat.Free = left
+			}
+		}
+	}
+	return
+}
+
+// -------- placeDisks() --------
+// Healthy disks to place a new volume, the least loaded first: more free
+// space, then fewer volumes. Caller holds the lock.
+func (this *Store) placeDisks() (disks []*Disk) {
+	stats := this.diskStats()
+	index := make([]int, 0, len(stats))
+	for i := range stats {
+		if stats[i].Error == "" && stats[i].Free > 0 {
+			index = append(index, i)
+		}
+	}
+	sort.SliceStable(index, func(a, b int) bool {
+		sa, sb := &stats[index[a]], &stats[index[b]]
+		if sa.Free != sb.Free {
+			return sa.Free > sb.Free
+		}
+		return sa.Volumes < sb.Volumes
+	})
+	for _, i := range index {
+		disks = append(disks, this.Disks[i])
+	}
+	return
+}
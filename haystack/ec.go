@@ -0,0 +1,460 @@
+package haystack
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 纠删码：封存的卷可以转为k个数据分片和m个校验分片，分片文件按序号轮流放在
+// Config.EcDirs各目录中，原数据文件删除，索引文件和纠删码元数据文件保留在卷目录。
+// 数据文件按EC_BLOCK_SIZE分块，第r行的k个块依次是k个数据分片的第r块，同一行
+// 计算m个校验块，最后一行不足的部分补0。读取时按偏移找到数据分片直接读取，
+// 分片缺失或读取失败时由同一行任意k个分片重建。纠删码卷只读，不能删除needle和压缩。
+const (
+	EC_DEFAULT_DATA_SHARDS   = 10
+	EC_DEFAULT_PARITY_SHARDS = 4
+	EC_BLOCK_SIZE            = 1024 * 1024
+
+	// 纠删码元数据文件：magic(4) version(1) k(1) m(1) padding(1)
+	// block size(4) data file size(8) crc32(4)
+	ECMETA_EXT      = ".ecx"
+	ECMETA_SIZE     = 24
+	ecMetaVersion   = 1
+	ecShardExtFmt   = ".ec%02d"
+	ecMaxShardCount = 256
+)
+
+var ecMetaMagic = []byte{0x83, 0x84, 0x45, 0x43}
+
+// **************** ecShards ****************
+// ecShards reads the original data file from the shards, reconstructing
+// blocks of missing or unreadable data shards.
+type ecShards struct {
+	vid        int32
+	dir        string
+	k          int
+	m          int
+	block_size int64
+	size       int64 // original data file size.
+	files      []*os.File
+	names      []string
+	encoder    reedsolomon.Encoder
+}
+
+// -------- ecMetaFileName() --------
+func ecMetaFileName(dir string, vid int32) string {
+	return dir + "/" + strconv.Itoa(int(vid)) + ECMETA_EXT
+}
+
+// -------- ecShardFileName() --------
+func ecShardFileName(dir string, vid int32, shard int) string {
+	return dir + "/" + strconv.Itoa(int(vid)) + fmt.Sprintf(ecShardExtFmt, shard)
+}
+
+// -------- isEcVolume() --------
+// Erasure coded volumes have metadata file but no data file.
+func isEcVolume(dir string, vid int32) bool {
+	return utils.FileExist(ecMetaFileName(dir, vid)) && !utils.FileExist(NewData(vid, dir).getDataFileName())
+}
+
+// -------- openEcShards() --------
+// Open shards of volume vid found in dir or dirs. At least k shards are required.
+func openEcShards(vid int32, dir string, dirs []string) (this *ecShards, err error) {
+	this = &ecShards{vid: vid, dir: dir}
+	if err = this.readMeta(); err != nil {
+		return nil, err
+	}
+	if this.encoder, err = reedsolomon.New(this.k, this.m); err != nil {
+		return nil, err
+	}
+
+	this.files = make([]*os.File, this.k+this.m)
+	this.names = make([]string, this.k+this.m)
+	present := 0
+	for i := range this.files {
+		for _, d := range append([]string{dir}, dirs...) {
+			name := ecShardFileName(d, vid, i)
+			if file, e := os.OpenFile(name, os.O_RDONLY|O_NOATIME, 0664); e == nil {
+				this.files[i], this.names[i] = file, name
+				present++
+				break
+			}
+		}
+	}
+	if present < this.k {
+		this.Close()
+		return nil, fmt.Errorf("Volume %d has only %d of %d shards, %d required.", vid, present, this.k+this.m, this.k)
+	}
+	if present < this.k+this.m {
+		utils.LogWarnf(nil, "Volume %d has %d of %d shards, missing blocks are reconstructed on read.", vid, present, this.k+this.m)
+	}
+	return
+}
+
+// -------- readMeta() --------
+func (this *ecShards) readMeta() (err error) {
+	var buf []byte
+	if buf, err = ioutil.ReadFile(ecMetaFileName(this.dir, this.vid)); err != nil {
+		return
+	}
+	if len(buf) != ECMETA_SIZE || !bytes.Equal(buf[:4], ecMetaMagic) || buf[4] != ecMetaVersion ||
+		crc32.Checksum(buf[:ECMETA_SIZE-4], crc32Table) != utils.BigEndian.Uint32(buf[ECMETA_SIZE-4:]) {
+		return fmt.Errorf("Volume %d erasure coding metadata corrupted.", this.vid)
+	}
+	this.k = int(buf[5])
+	this.m = int(buf[6])
+	this.block_size = int64(utils.BigEndian.Uint32(buf[8:]))
+	this.size = int64(utils.BigEndian.Uint64(buf[12:]))
+	return
+}
+
+// -------- writeMeta() --------
+func (this *ecShards) writeMeta() (err error) {
+	buf := make([]byte, ECMETA_SIZE)
+	copy(buf, ecMetaMagic)
+	buf[4] = ecMetaVersion
+	buf[5] = byte(this.k)
+	buf[6] = byte(this.m)
+	utils.BigEndian.PutUint32(buf[8:], uint32(this.block_size))
+	utils.BigEndian.PutUint64(buf[12:], uint64(this.size))
+	utils.BigEndian.PutUint32(buf[ECMETA_SIZE-4:], crc32.Checksum(buf[:ECMETA_SIZE-4], crc32Table))
+
+	var file *os.File
+	if file, err = os.Create(ecMetaFileName(this.dir, this.vid)); err != nil {
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(buf); err == nil {
+		err = file.Sync()
+	}
+	return
+}
+
+// ======== ReadAt() ========
+func (this *ecShards) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= this.size {
+		return 0, io.EOF
+	}
+	if rest := this.size - off; int64(len(p)) > rest {
+		p = p[:rest]
+		err = io.EOF
+	}
+	for n < len(p) {
+		pos := off + int64(n)
+		block := pos / this.block_size
+		in := pos % this.block_size
+		size := int(this.block_size - in)
+		if size > len(p)-n {
+			size = len(p) - n
+		}
+		if e := this.readBlock(p[n:n+size], block/int64(this.k), int(block%int64(this.k)), in); e != nil {
+			return n, e
+		}
+		n += size
+	}
+	return
+}
+
+// -------- readBlock() --------
+// Read p from offset in of the block of data shard col in row.
+func (this *ecShards) readBlock(p []byte, row int64, col int, in int64) (err error) {
+	if file := this.files[col]; file != nil {
+		if _, err = file.ReadAt(p, row*this.block_size+in); err == nil {
+			return
+		}
+		utils.LogWarnf(err, "Volume %d read shard %d failed, reconstruct it.", this.vid, col)
+	}
+	var shards [][]byte
+	if shards, err = this.reconstruct(row); err != nil {
+		return
+	}
+	copy(p, shards[col][in:])
+	return
+}
+
+// -------- reconstruct() --------
+// Data blocks of row rebuilt from any k readable shards.
+func (this *ecShards) reconstruct(row int64) (shards [][]byte, err error) {
+	shards = make([][]byte, this.k+this.m)
+	present := 0
+	for i, file := range this.files {
+		if file == nil || present == this.k {
+			continue
+		}
+		block := make([]byte, this.block_size)
+		if _, e := file.ReadAt(block, row*this.block_size); e != nil {
+			utils.LogWarnf(e, "Volume %d read shard %d failed.", this.vid, i)
+			continue
+		}
+		shards[i] = block
+		present++
+	}
+	if err = this.encoder.ReconstructData(shards); err != nil {
+		utils.LogErrorf(err, "Volume %d reconstruct row %d failed.", this.vid, row)
+		err = errors.ErrNeedleCorrupted
+	}
+	return
+}
+
+// ======== Close() ========
+func (this *ecShards) Close() error {
+	for i, file := range this.files {
+		if file != nil {
+			file.Close()
+			this.files[i] = nil
+		}
+	}
+	return nil
+}
+
+// -------- remove() --------
+// Delete shard files found when opened and the metadata file.
+func (this *ecShards) remove() (err error) {
+	for _, name := range this.names {
+		if name != "" {
+			if e := os.Remove(name); e != nil && !os.IsNotExist(e) {
+				err = e
+			}
+		}
+	}
+	if e := os.Remove(ecMetaFileName(this.dir, this.vid)); e != nil && !os.IsNotExist(e) {
+		err = e
+	}
+	return
+}
+
+// -------- initShards() --------
+// Init erasure coded data, read only.
+func (this *Data) initShards() (err error) {
+	this.reader = this.shards
+	this.FileSize = uint64(this.shards.size)
+	this.syncedSize = this.FileSize
+	this.AlignedOffset = this.FileSize / NEEDLE_PADDINGSIZE
+	if err = this.loadSuperBlock(); err != nil {
+		return
+	}
+	if !this.superblock.IsSealed() {
+		err = fmt.Errorf("Erasure coded volume %d is not sealed.", this.vid)
+	}
+	return
+}
+
+// ======== IsErasureCoded() ========
+func (this *Volume) IsErasureCoded() bool {
+	this.rwlock.RLock()
+	defer this.rwlock.RUnlock()
+
+	return this.data.shards != nil
+}
+
+// ======== EcEncode() ========
+// 把封存的卷转为k个数据分片和m个校验分片，分片轮流放在dirs各目录中，dirs为空时
+// 放在卷目录。完成后删除数据文件，卷从分片读取。封存的卷只追加删除needle的墓碑，
+// 编码期间照常读取和删除，最后在写锁内编码期间追加的部分并换用分片。
+func (this *Volume) EcEncode(dirs []string, k int, m int) (err error) {
+	if k < 1 || m < 1 || k+m > ecMaxShardCount {
+		return fmt.Errorf("Invalid erasure coding %d+%d, at most %d shards.", k, m, ecMaxShardCount)
+	}
+	if len(dirs) == 0 {
+		dirs = []string{this.Dir}
+	}
+	if !atomic.CompareAndSwapInt32(&this.compacting, 0, 1) {
+		return errors.ErrVolumeCompacting
+	}
+	defer atomic.StoreInt32(&this.compacting, 0)
+	// 与压缩相同，关闭卷时等待编码完成。
+	this.ckpLock.Lock()
+	defer this.ckpLock.Unlock()
+
+	this.rwlock.RLock()
+	data := this.data
+	if data.shards != nil {
+		err = fmt.Errorf("Volume %d is already erasure coded.", this.Id)
+	} else if !data.superblock.IsSealed() {
+		err = fmt.Errorf("Volume %d is not sealed.", this.Id)
+	} else if data.cold != "" {
+		// 冷存储卷的数据文件不在卷目录，先升级再编码。
+		err = fmt.Errorf("Volume %d is in the cold tier, promote it first.", this.Id)
+	} else {
+		err = this.syncFiles()
+	}
+	size := data.FileSize
+	this.rwlock.RUnlock()
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	shards := &ecShards{
+		vid:        this.Id,
+		dir:        this.Dir,
+		k:          k,
+		m:          m,
+		block_size: EC_BLOCK_SIZE,
+		size:       int64(size),
+		files:      make([]*os.File, k+m),
+		names:      make([]string, k+m),
+	}
+	done := false
+	defer func() {
+		shards.Close()
+		if !done {
+			shards.remove()
+		}
+	}()
+	if shards.encoder, err = reedsolomon.New(k, m); err != nil {
+		return
+	}
+	for i := range shards.files {
+		shards.names[i] = ecShardFileName(dirs[i%len(dirs)], this.Id, i)
+		if shards.files[i], err = os.Create(shards.names[i]); err != nil {
+			return
+		}
+	}
+	if err = shards.encode(data.reader, 0); err != nil {
+		return
+	}
+
+	this.rwlock.Lock()
+	defer this.rwlock.Unlock()
+
+	// 编码期间追加的墓碑从其所在的行开始重新编码。
+	if err = data.flushFile(); err != nil {
+		return
+	}
+	if data.FileSize > size {
+		shards.size = int64(data.FileSize)
+		if err = shards.encode(data.reader, int64(size)/(int64(k)*shards.block_size)); err != nil {
+			return
+		}
+	}
+	for _, file := range shards.files {
+		if err = file.Sync(); err != nil {
+			return
+		}
+	}
+	if err = shards.writeMeta(); err != nil {
+		return
+	}
+	done = true
+
+	// 元数据文件写入后删除数据文件，之前中断时卷仍使用数据文件。
+	this.data.Close()
+	this.index.Close()
+	if err = this.data.remove(); err != nil {
+		utils.LogErrorf(err, "Volume %d remove data file after erasure coding failed.", this.Id)
+	}
+	// 分片所在目录可能不在Config.EcDirs中，之后重新打开卷时需要配置。
+	this.data = NewData(this.Id, this.Dir)
+	this.index = NewIndex(this.Id, this.Dir)
+	var e error
+	if this.data.shards, e = openEcShards(this.Id, this.Dir, dirs); e == nil {
+		e = this.Init()
+	}
+	if e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		utils.LogInfof("Volume %d erasure coded to %d+%d shards in %v. data file %d bytes.",
+			this.Id, k, m, time.Since(start), shards.size)
+	}
+	return
+}
+
+// -------- encode() --------
+// Encode rows of reader from row to the end of the data, writing the blocks
+// at their offsets in the shard files.
+func (this *ecShards) encode(reader io.ReaderAt, row int64) (err error) {
+	data := make([]byte, int64(this.k)*this.block_size)
+	blocks := make([][]byte, this.k+this.m)
+	for i := this.k; i < this.k+this.m; i++ {
+		blocks[i] = make([]byte, this.block_size)
+	}
+	for offset := row * int64(len(data)); offset < this.size; offset += int64(len(data)) {
+		for i := range data {
+			data[i] = 0
+		}
+		if _, err = reader.ReadAt(data, offset); err != nil && err != io.EOF {
+			return
+		}
+		for i := 0; i < this.k; i++ {
+			blocks[i] = data[int64(i)*this.block_size : int64(i+1)*this.block_size]
+		}
+		if err = this.encoder.Encode(blocks); err != nil {
+			return
+		}
+		for i, file := range this.files {
+			if _, err = file.WriteAt(blocks[i], offset/int64(this.k)); err != nil {
+				return
+			}
+		}
+	}
+	return nil
+}
+
+// ======== EcDecode() ========
+// 由分片（必要时重建）恢复数据文件，之后删除分片和纠删码元数据文件。纠删码卷
+// 只读，恢复期间照常读取，只在换用数据文件时取写锁。
+func (this *Volume) EcDecode() (err error) {
+	if !atomic.CompareAndSwapInt32(&this.compacting, 0, 1) {
+		return errors.ErrVolumeCompacting
+	}
+	defer atomic.StoreInt32(&this.compacting, 0)
+	// 与压缩相同，关闭卷时等待恢复完成。
+	this.ckpLock.Lock()
+	defer this.ckpLock.Unlock()
+
+	this.rwlock.RLock()
+	shards := this.data.shards
+	name := this.data.getDataFileName()
+	this.rwlock.RUnlock()
+	if shards == nil {
+		return fmt.Errorf("Volume %d is not erasure coded.", this.Id)
+	}
+
+	start := time.Now()
+	tmp := name + ".tmp"
+	var file *os.File
+	if file, err = os.Create(tmp); err != nil {
+		return
+	}
+	if _, err = io.Copy(file, io.NewSectionReader(shards, 0, shards.size)); err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+
+	this.rwlock.Lock()
+	defer this.rwlock.Unlock()
+
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	// 数据文件存在时卷不再使用分片。
+	this.data.Close()
+	this.index.Close()
+	if err = shards.remove(); err != nil {
+		utils.LogErrorf(err, "Volume %d remove shards after decoding failed.", this.Id)
+	}
+	if e := this.reopen(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		utils.LogInfof("Volume %d decoded from shards in %v. data file %d bytes.", this.Id, time.Since(start), shards.size)
+	}
+	return
+}
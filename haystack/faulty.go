@@ -0,0 +1,155 @@
+package haystack
+
+import (
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"sort"
+	"time"
+)
+
+// 加载失败的卷标记为故障卷，记录错误后不再提供服务，读写返回
+// errors.ErrVolumeFaulty，也不会在原位置新建同id的卷。故障卷可以按需重试加载，
+// 或根据数据文件重建索引修复，成功后恢复服务。
+
+// **************** FaultyVolume ****************
+type FaultyVolume struct {
+	Id      int32     `json:"id"`
+	Dir     string    `json:"dir"`
+	Error   string    `json:"error"`
+	Since   time.Time `json:"since"`
+	Retries int       `json:"retries"`
+
+	recovering bool // being opened by recoverFaulty().
+}
+
+// -------- setFaulty() --------
+// Caller holds the lock.
+func (this *Store) setFaulty(vid int32, dir string, err error) {
+	utils.LogErrorf(err, "Volume %d in %s is faulty.", vid, dir)
+	if faulty, ok := this.faulty[vid]; ok {
+		faulty.Error = err.Error()
+		faulty.Retries++
+		return
+	}
+	this.faulty[vid] = &FaultyVolume{
+		Id:    vid,
+		Dir:   dir,
+		Error: err.Error(),
+		Since: time.Now(),
+	}
+}
+
+// -------- volumeDir() --------
+// Dir of volume vid, loaded or faulty. Caller holds the lock.
+func (this *Store) volumeDir(vid int32) (string, bool) {
+	if volume, ok := this.Volumes[vid]; ok {
+		return volume.Dir, true
+	}
+	if faulty, ok := this.faulty[vid]; ok {
+		return faulty.Dir, true
+	}
+	return "", false
+}
+
+// ======== FaultyVolumes() ========
+// Faulty volumes sorted by id.
+func (this *Store) FaultyVolumes() (volumes []FaultyVolume) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	volumes = make([]FaultyVolume, 0, len(this.faulty))
+	for _, faulty := range this.faulty {
+		volumes = append(volumes, *faulty)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Id < volumes[j].Id
+	})
+	return
+}
+
+// ======== IsFaulty() ========
+func (this *Store) IsFaulty(vid int32) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	_, ok := this.faulty[vid]
+	return ok
+}
+
+// -------- volumeErr() --------
+// Error of volume vid not in service.
+func (this *Store) volumeErr(vid int32) error {
+	if this.IsFaulty(vid) {
+		return errors.ErrVolumeFaulty
+	}
+	return errors.ErrVolumeNotExist
+}
+
+// ======== RetryVolume() ========
+// 重新加载故障卷，用于磁盘或文件问题排除之后。
+func (this *Store) RetryVolume(vid int32) (volume *Volume, err error) {
+	return this.recoverFaulty(vid, "retry", (*Volume).Init)
+}
+
+// ======== RepairVolume() ========
+// 根据数据文件重建故障卷的索引后加载，用于索引文件损坏。
+func (this *Store) RepairVolume(vid int32) (volume *Volume, err error) {
+	return this.recoverFaulty(vid, "repair", (*Volume).Reindex)
+}
+
+// ======== RetryFaultyVolumes() ========
+// Retry all faulty volumes, return the number of volumes recovered.
+func (this *Store) RetryFaultyVolumes() (recovered int) {
+	for _, faulty := range this.FaultyVolumes() {
+		if _, err := this.RetryVolume(faulty.Id); err == nil {
+			recovered++
+		}
+	}
+	return
+}
+
+// -------- recoverFaulty() --------
+// 卷在Store锁外打开或重建索引，成功后才加入Store，期间其它卷照常服务。
+func (this *Store) recoverFaulty(vid int32, action string, open func(*Volume) error) (volume *Volume, err error) {
+	this.lock.Lock()
+	faulty, ok := this.faulty[vid]
+	if !ok {
+		volume, ok = this.Volumes[vid]
+		this.lock.Unlock()
+		if ok {
+			utils.LogInfof("Volume %d is not faulty, %s skipped.", vid, action)
+			return volume, nil
+		}
+		return nil, errors.ErrVolumeNotExist
+	}
+	if faulty.recovering {
+		this.lock.Unlock()
+		return nil, fmt.Errorf("Volume %d is being recovered.", vid)
+	}
+	faulty.recovering = true
+	dir := faulty.Dir
+	this.lock.Unlock()
+
+	volume = NewVolume(vid, dir, this.Config)
+	err = open(volume)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	faulty.recovering = false
+	if this.faulty[vid] != faulty {
+		// Store关闭了。
+		volume.Close()
+		return nil, errors.ErrVolumeNotExist
+	}
+	if err != nil {
+		volume.Close()
+		this.setFaulty(vid, dir, err)
+		return nil, err
+	}
+	delete(this.faulty, vid)
+	this.Volumes[vid] = volume
+	utils.LogInfof("Volume %d in %s recovered by %s.", vid, dir, action)
+	return
+}
@@ -7,21 +7,25 @@ import (
 	"github.com/uukuguy/kds/utils"
 	"io"
 	"os"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
-type needle_indices_t map[int64]uint64 // needle id -> offset << 32 | size
-
 const (
 	// 一个卷（volume）最多3200万(33,554,432)个needle, 536,870,912 bytes。If 100KB per file, max data file size is 3.4TB.
-	INDEXFILE_MAXSIZE        = int64((unsafe.Sizeof(int64(0)) + unsafe.Sizeof(int64(0))) * 32 * 1024 * 1024)
-	INDEX_ENTRY_SIZE         = 16
-	INDEXFILE_MAX_CACHEWRITE = 1
+	INDEXFILE_MAXSIZE = int64((unsafe.Sizeof(int64(0)) + unsafe.Sizeof(int64(0))) * 32 * 1024 * 1024)
+	INDEX_ENTRY_SIZE  = 16
+
+	INDEXFILE_EXT = ".idx"
 )
 
 // **************** NeedleRegion ****************
+// 索引项中的needle位置。索引文件超级块版本低于version3时按旧格式编码（见
+// to_uint64()），version3起按宽格式编码（见to_uint64_wide()）。
 type NeedleRegion struct {
 	// use late 40 bits.
 	// Single data file max size is
@@ -31,16 +35,33 @@ type NeedleRegion struct {
 	Size uint32
 }
 
+const (
+	// 宽格式：36位对齐偏移（数据文件最大512GB）和28位对齐大小（needle最大2GB）。
+	REGION_WIDE_SIZE_BITS = 28
+
+	REGION_MAXSIZE      = 1<<24 - NEEDLE_PADDINGSIZE
+	REGION_WIDE_MAXSIZE = (1<<REGION_WIDE_SIZE_BITS - 1) * NEEDLE_PADDINGSIZE
+)
+
 func (this *NeedleRegion) to_uint64() (v64 uint64) {
 	v64 = this.AlignedOffset<<24 + uint64(this.Size)
-	utils.LogDebugf("AlignedOffset:%x Size:%x -> v64:%x", this.AlignedOffset, this.Size, v64)
 	return
 }
 
 func (this *NeedleRegion) from_uint64(v64 uint64) {
 	this.AlignedOffset = v64 >> 24
 	this.Size = uint32(v64 & 0x00FFFFFF)
-	utils.LogDebugf("v64:%x -> AlignedOffset:%x Size:%x", v64, this.AlignedOffset, this.Size)
+}
+
+// Size is aligned, stored in NEEDLE_PADDINGSIZE units.
+func (this *NeedleRegion) to_uint64_wide() (v64 uint64) {
+	v64 = this.AlignedOffset<<REGION_WIDE_SIZE_BITS | uint64(this.Size/NEEDLE_PADDINGSIZE)
+	return
+}
+
+func (this *NeedleRegion) from_uint64_wide(v64 uint64) {
+	this.AlignedOffset = v64 >> REGION_WIDE_SIZE_BITS
+	this.Size = uint32(v64&(1<<REGION_WIDE_SIZE_BITS-1)) * NEEDLE_PADDINGSIZE
 }
 
 func (this *NeedleRegion) GetOffset() uint64 {
@@ -51,6 +72,14 @@ func (this *NeedleRegion) GetSize() uint32 {
 	return this.Size
 }
 
+// 索引项中Size为0表示该key已被删除（指向数据文件中的删除标记needle）。
+func (this *NeedleRegion) IsTombstone() bool {
+	return this.Size == 0
+}
+
+// walkEntries()的回调返回errStopWalk提前结束遍历。
+var errStopWalk = fmt.Errorf("stop walking index entries")
+
 type IndexEntry struct {
 	Key    int64
 	Region NeedleRegion
@@ -60,53 +89,106 @@ type IndexEntry struct {
 type Index struct {
 	vid          int32
 	Dir          string
+	ext          string
 	idxFile      *os.File
-	indices      needle_indices_t
+	indices      NeedleMap // needle id -> encodeRegion()
 	superblock   *SuperBlock
 	closed       bool
 	FileSize     uint64
 	syncedSize   uint64
-	cache_writed uint32
 	//outdated_regions []NeedleRegion
 	outdated_keys uint32
 	outdated_size uint64
 	total_size    uint64
+	data_end      uint64            // end offset in data file of the last indexed needle.
+	checkpointed  uint64            // index file offset covered by the latest checkpoint.
+	disk_mode     bool              // indices is a diskNeedleMap over the checkpoint file.
+	streaming     *checkpointWriter // appended entries go to the checkpoint being written instead of indices, see streamCheckpoint().
+	data_version  byte              // needle format of data file, for size of tombstones.
+	data_start    uint64            // offset of the first needle in data file.
+}
+
+// **************** gcStats ****************
+// GC统计的采样。读取GC统计有运行时的全局开销，不在每个卷的String()中读取，由Store定时
+// 采样，见Store.gcStatsLoop()。
+type gcStats struct {
+	NumGC      int64
+	PauseTotal time.Duration
+	LastPause  time.Duration
+}
+
+var lastGCStats atomic.Value // *gcStats
+
+// -------- sampleGCStats() --------
+func sampleGCStats() *gcStats {
+	var stats debug.GCStats
+	debug.ReadGCStats(&stats)
+	sample := &gcStats{NumGC: stats.NumGC, PauseTotal: stats.PauseTotal}
+	if len(stats.Pause) > 0 {
+		sample.LastPause = stats.Pause[0]
+	}
+	lastGCStats.Store(sample)
+	return sample
+}
+
+// -------- getGCStats() --------
+// The last sample, sampled once if no store samples it.
+func getGCStats() *gcStats {
+	if sample, ok := lastGCStats.Load().(*gcStats); ok {
+		return sample
+	}
+	return sampleGCStats()
 }
 
 // ======== String() ========
 func (this *Index) String() string {
+	gc_stats := getGCStats()
+	memory := this.indices.MemoryUsage()
+	var bytes_per_key float64
+	if n := this.indices.Len(); n > 0 {
+		bytes_per_key = float64(memory) / float64(n)
+	}
+
 	return fmt.Sprintf(`
 -----------------------------
 Index
 
 vid:                  %d
 Dir:                  %s
+disk_mode:            %v
 closed:               %v
 FileSize:             %d
 syncedSize:           %d
-cache_writed          %d
 outdated_keys         %d
 total keys            %d
 outdated_keys%%        %.3f%%
 outdated_size         %d
 total size            %d
 outdated_size%%        %.3f%%
-indices:              %#v
+needle map memory     %d
+needle map bytes/key  %.1f
+GC count              %d
+GC pause total        %v
+GC pause last         %v
 -----------------------------
 `,
 		this.vid,
 		this.Dir,
+		this.disk_mode,
 		this.closed,
 		this.FileSize,
 		this.syncedSize,
-		this.cache_writed,
 		this.outdated_keys,
-		len(this.indices),
+		this.indices.Len(),
 		this.getOutdatedKeysRate()*100,
 		this.outdated_size,
 		this.total_size,
 		this.getOutdatedSizeRate()*100,
-		this.indices,
+		memory,
+		bytes_per_key,
+		gc_stats.NumGC,
+		gc_stats.PauseTotal,
+		gc_stats.LastPause,
 	)
 }
 
@@ -115,12 +197,14 @@ func NewIndex(vid int32, store_dir string) (index *Index) {
 	index = &Index{
 		vid:          vid,
 		Dir:          store_dir,
+		ext:          INDEXFILE_EXT,
+		data_version: needleFormat,
+		data_start:   SUPERBLOCK_SIZE,
 		superblock:   NewSuperBlock(),
 		idxFile:      nil,
-		indices:      make(needle_indices_t),
+		indices:      newSortedNeedleMap(0),
 		closed:       false,
 		FileSize:     0,
-		cache_writed: 0,
 		//outdated_regions: []NeedleRegion{},
 		outdated_keys: 0,
 	}
@@ -151,7 +235,6 @@ func (this *Index) Init() (err error) {
 		if err = this.writeSuperBlock(); err != nil {
 			return
 		}
-		this.FileSize = SUPERBLOCK_SIZE
 		this.syncedSize = this.FileSize
 	} else {
 		if err = this.loadSuperBlock(); err != nil {
@@ -175,9 +258,16 @@ func (this *Index) Init() (err error) {
 func (this *Index) Close() {
 	this.closed = true
 	if this.idxFile != nil {
+		if err := this.flushFile(); err != nil {
+		}
 		this.idxFile.Close()
 		this.idxFile = nil
 	}
+	if this.streaming != nil {
+		this.streaming.abort()
+		this.streaming = nil
+	}
+	this.indices.Close()
 }
 
 // -------- getOutdatedSizeRate() --------
@@ -187,30 +277,93 @@ func (this *Index) getOutdatedSizeRate() float32 {
 
 // -------- getOutdatedKeysRate() --------
 func (this *Index) getOutdatedKeysRate() float32 {
-	return float32(this.outdated_keys) / float32(this.outdated_keys+uint32(len(this.indices)))
+	return float32(this.outdated_keys) / float32(this.outdated_keys+uint32(this.indices.Len()))
 }
 
 // -------- getIndexFileName() --------
 func (this *Index) getIndexFileName() string {
-	return this.Dir + "/" + strconv.Itoa(int(this.vid)) + ".idx"
+	return this.Dir + "/" + strconv.Itoa(int(this.vid)) + this.ext
+}
+
+// -------- remove() --------
+func (this *Index) remove() error {
+	return os.Remove(this.getIndexFileName())
 }
 
 // -------- loadIndices() --------
 func (this *Index) loadIndices() (err error) {
-	this.indices = make(needle_indices_t)
+	if this.disk_mode {
+		return this.loadDiskIndices()
+	}
 
-	this.idxFile.Seek(0, os.SEEK_SET)
-	reader := bufio.NewReaderSize(this.idxFile, 1024*1024)
-	var superblock []byte
-	if superblock, err = reader.Peek(SUPERBLOCK_SIZE); err != nil {
-		return
+	// 先加载检查点，只重放其后追加的索引项。压缩生成的索引文件的检查点在替换后才加载。
+	offset := this.superblock.Size()
+	this.resetIndices()
+	if this.ext == INDEXFILE_EXT {
+		if ckp_offset, e := this.loadCheckpoint(); e == nil {
+			offset = ckp_offset
+			utils.LogInfof("Index.loadIndices() vid:%d loaded checkpoint. %d entries, replay from offset %d.",
+				this.vid, this.indices.Len(), offset)
+		} else {
+			if !os.IsNotExist(e) {
+				utils.LogWarnf(e, "Index.loadIndices() vid:%d checkpoint invalid, replay whole index file.", this.vid)
+			}
+			this.resetIndices()
+		}
+	}
+
+	var replayed int
+	replayed, err = this.replayEntries(offset)
+
+	// 重放的新key在哈希表中，合并进有序数组以节省内存。
+	this.indices.Freeze()
+
+	utils.LogInfof("Index.loadIndices() vid:%d done. %d index entries replayed, %d needles loaded, %d bytes.",
+		this.vid, replayed, this.indices.Len(), this.indices.MemoryUsage())
+
+	return
+}
+
+// -------- replayEntries() --------
+// Apply index entries from file offset to indices and stats.
+func (this *Index) replayEntries(offset uint64) (replayed int, err error) {
+	err = this.walkEntries(offset, func(key int64, region NeedleRegion) error {
+		replayed++
+		this.updateDataEnd(region)
+		if region.IsTombstone() {
+			this.DeleteNeedleRegion(key)
+		} else {
+			this.SetNeedleRegion(key, region)
+			this.total_size += uint64(region.Size)
+		}
+		return nil
+	})
+	return
+}
+
+// -------- resetIndices() --------
+func (this *Index) resetIndices() {
+	if this.indices != nil {
+		this.indices.Close()
 	}
-	// Check superblock head.
-	if len(superblock) != SUPERBLOCK_SIZE {
-		utils.LogErrorf(err, "Readed superblock len = %d, not equal to %d", len(superblock), SUPERBLOCK_SIZE)
+	this.indices = newSortedNeedleMap(0)
+	this.outdated_keys = 0
+	this.outdated_size = 0
+	this.total_size = 0
+	this.data_end = this.data_start
+	this.checkpointed = 0
+}
+
+// -------- walkEntries() --------
+// Call fn for every index entry from file offset to this.FileSize in order.
+// The entries are read through a section reader, so the file offset used by
+// appends is not touched.
+func (this *Index) walkEntries(offset uint64, fn func(key int64, region NeedleRegion) error) (err error) {
+	if offset >= this.FileSize {
 		return
 	}
-	reader.Discard(SUPERBLOCK_SIZE)
+	section := io.NewSectionReader(this.idxFile, int64(offset), int64(this.FileSize-offset))
+	reader := bufio.NewReaderSize(section, 1024*1024)
 
 	for {
 		var buf []byte
@@ -220,21 +373,17 @@ func (this *Index) loadIndices() (err error) {
 		if len(buf) != INDEX_ENTRY_SIZE {
 			break
 		}
-		//utils.LogDebugf("len(buf)=%d %#v", len(buf), buf[0:8])
 		key := utils.BigEndian.Int64(buf[0:8])
 
 		h32 := utils.BigEndian.Uint32(buf[8:12])
 		l32 := utils.BigEndian.Uint32(buf[12:16])
 		v64 := uint64(h32)<<32 + uint64(l32)
-		//utils.LogDebugf("h32:%d l32: %d v64:%d", h32, l32, v64)
-
-		region := NeedleRegion{}
-		region.from_uint64(v64)
 
-		utils.LogDebugf("key: %d region.AlignedOffset: %d region.Size %d", key, region.AlignedOffset, region.Size)
+		region := this.decodeRegion(v64)
 
-		this.SetNeedleRegion(key, region)
-		this.total_size += uint64(region.Size)
+		if err = fn(key, region); err != nil {
+			return
+		}
 
 		if _, err = reader.Discard(INDEX_ENTRY_SIZE); err != nil {
 			break
@@ -245,25 +394,148 @@ func (this *Index) loadIndices() (err error) {
 		err = nil
 	}
 
-	utils.LogInfof("Index.loadIndices() done. %d index entries loaded.", len(this.indices))
+	return
+}
+
+// -------- updateDataEnd() --------
+func (this *Index) updateDataEnd(region NeedleRegion) {
+	end := region.GetOffset() + uint64(region.Size)
+	if region.IsTombstone() {
+		end += needleWriteSize(this.data_version, 0, 0)
+	}
+	if end > this.data_end {
+		this.data_end = end
+	}
+}
 
+// -------- truncate() --------
+// Drop index entries after file size and reload indices.
+func (this *Index) truncate(size uint64) (err error) {
+	if err = this.idxFile.Truncate(int64(size)); err != nil {
+		utils.LogErrorf(err, "Index.truncate() failed. vid:%d size:%d", this.vid, size)
+		return
+	}
+	this.FileSize = size
+	if this.syncedSize > size {
+		this.syncedSize = size
+	}
+	if err = this.loadIndices(); err != nil {
+		return
+	}
+	_, err = this.idxFile.Seek(int64(size), os.SEEK_SET)
+	return
+}
+
+// -------- sortedEntries() --------
+// Live index entries sorted by their offset in data file.
+func (this *Index) sortedEntries() (entries []IndexEntry) {
+	entries = make([]IndexEntry, 0, this.indices.Len())
+	this.indices.Range(func(key int64, value uint64) bool {
+		entries = append(entries, IndexEntry{key, this.decodeRegion(value)})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Region.AlignedOffset < entries[j].Region.AlignedOffset
+	})
+	return
+}
+
+// -------- snapshotEntries() --------
+// Live entries to copy without the volume lock. 磁盘索引按key顺序从检查点索引表
+// 逐个读出，不把key全部读入内存；内存索引按数据文件偏移排序，顺序读数据文件。
+// Caller holds the volume lock while taking the snapshot, and the checkpoint
+// lock until the entries are iterated, so that the table is not unmapped.
+func (this *Index) snapshotEntries() func(fn func(entry IndexEntry) bool) {
+	if this.disk_mode {
+		snapshot := this.indices.Snapshot()
+		return func(fn func(entry IndexEntry) bool) {
+			snapshot(func(key int64, value uint64) bool {
+				return fn(IndexEntry{key, this.decodeRegion(value)})
+			})
+		}
+	}
+	entries := this.sortedEntries()
+	return func(fn func(entry IndexEntry) bool) {
+		for _, entry := range entries {
+			if !fn(entry) {
+				return
+			}
+		}
+	}
+}
+
+// -------- streamCheckpoint() --------
+// 压缩或重写磁盘索引卷时，按key升序追加的索引项直接写入新的检查点，不进入内存，
+// finishCheckpoint()提交后映射为indices。
+func (this *Index) streamCheckpoint() (err error) {
+	this.streaming, err = this.newCheckpointWriter()
+	return
+}
+
+// -------- finishCheckpoint() --------
+func (this *Index) finishCheckpoint() (err error) {
+	ckp := this.streaming
+	this.streaming = nil
+	if err = this.flushFile(); err != nil {
+		ckp.abort()
+		return
+	}
+	var header []byte
+	if header, err = this.checkpointHeader(); err != nil {
+		ckp.abort()
+		return
+	}
+	if err = ckp.commit(header); err != nil {
+		return
+	}
+	return this.loadIndices()
+}
+
+// -------- wideRegion() --------
+// Index file of version3 or later encodes regions in the wide format.
+func (this *Index) wideRegion() bool {
+	return this.superblock.Version >= version3
+}
+
+// -------- maxRegionSize() --------
+// Largest needle the index entry format can address.
+func (this *Index) maxRegionSize() uint64 {
+	if this.wideRegion() {
+		return REGION_WIDE_MAXSIZE
+	}
+	return REGION_MAXSIZE
+}
+
+// -------- encodeRegion() --------
+func (this *Index) encodeRegion(region NeedleRegion) uint64 {
+	if this.wideRegion() {
+		return region.to_uint64_wide()
+	}
+	return region.to_uint64()
+}
+
+// -------- decodeRegion() --------
+func (this *Index) decodeRegion(v64 uint64) (region NeedleRegion) {
+	if this.wideRegion() {
+		region.from_uint64_wide(v64)
+	} else {
+		region.from_uint64(v64)
+	}
 	return
 }
 
 // -------- hasNeedle() --------
 func (this *Index) hasNeedle(key int64) bool {
-	_, ok := this.indices[key]
+	_, ok := this.indices.Get(key)
 	return ok
 }
 
 // ======== SetNeedleRegion() ========
 func (this *Index) SetNeedleRegion(key int64, region NeedleRegion) error {
-	old_value, key_exist := this.indices[key]
-	this.indices[key] = region.to_uint64()
+	old_value, key_exist := this.indices.Set(key, this.encodeRegion(region))
 
 	if key_exist {
-		old_region := NeedleRegion{}
-		old_region.from_uint64(old_value)
+		old_region := this.decodeRegion(old_value)
 		//this.outdated_regions = append(this.outdated_regions, old_region)
 		atomic.AddUint32(&this.outdated_keys, 1)
 		atomic.AddUint64(&this.outdated_size, uint64(old_region.Size))
@@ -272,32 +544,40 @@ func (this *Index) SetNeedleRegion(key int64, region NeedleRegion) error {
 	return nil
 }
 
+// ======== DeleteNeedleRegion() ========
+// Remove key from indices, the region it pointed to becomes outdated.
+func (this *Index) DeleteNeedleRegion(key int64) bool {
+	old_value, key_exist := this.indices.Delete(key)
+	if !key_exist {
+		return false
+	}
+
+	old_region := this.decodeRegion(old_value)
+	atomic.AddUint32(&this.outdated_keys, 1)
+	atomic.AddUint64(&this.outdated_size, uint64(old_region.Size))
+
+	return true
+}
+
 // ======== GetNeedleRegion() ========
 func (this *Index) GetNeedleRegion(key int64) (NeedleRegion, bool) {
-	if value, ok := this.indices[key]; ok {
-		region := NeedleRegion{}
-		region.from_uint64(value)
-		return region, true
+	if value, ok := this.indices.Get(key); ok {
+		return this.decodeRegion(value), true
 	} else {
 		return NeedleRegion{}, false
 	}
 }
 
 // -------- flushFile() --------
-// Change
-//    this.cache_writed
-//    this.syncedSize
+// Sync entries appended since last flush to disk. Change
 //
-func (this *Index) flushFile(force bool) (err error) {
+//    this.syncedSize
+func (this *Index) flushFile() (err error) {
 	var (
 		fd     uintptr
 		offset uint64
 		size   uint64
 	)
-	if this.cache_writed++; !force && this.cache_writed < INDEXFILE_MAX_CACHEWRITE {
-		return
-	}
-	this.cache_writed = 0
 	offset = this.syncedSize
 	size = this.FileSize - this.syncedSize
 	if size == 0 {
@@ -333,43 +613,65 @@ func (this *Index) writeSuperBlock() (err error) {
 }
 
 // -------- AppendIndexEntry() --------
+// The file is not synced, see flushFile().
 func (this *Index) AppendIndexEntry(entry IndexEntry) (err error) {
-	key := entry.Key
-	region := entry.Region
+	return this.appendEntries([]IndexEntry{entry})
+}
 
-	if uint64(INDEXFILE_MAXSIZE)-uint64(region.Size) < this.FileSize {
+// -------- appendEntry() --------
+// Append entry to the end of index file without flushing, and apply it to indices.
+func (this *Index) appendEntry(entry IndexEntry) (err error) {
+	return this.appendEntries([]IndexEntry{entry})
+}
+
+// -------- appendEntries() --------
+// Append entries with a single write without flushing, and apply them to indices.
+func (this *Index) appendEntries(entries []IndexEntry) (err error) {
+	size := uint64(len(entries)) * INDEX_ENTRY_SIZE
+	if uint64(INDEXFILE_MAXSIZE)-size < this.FileSize {
 		err = errors.ErrIndexNomoreSpace
 		utils.LogErrorf(err, "vid:%d, Dir:%s", this.vid, this.Dir)
 		return
 	}
 
-	buf := make([]byte, INDEX_ENTRY_SIZE)
+	buf := make([]byte, size)
 	pos := 0
-	utils.BigEndian.PutInt64(buf[pos:], key)
-	pos += int(unsafe.Sizeof(key))
-
-	v64 := region.to_uint64()
-	h32 := uint32(v64 >> 32)
-	l32 := uint32(v64)
-	//utils.LogDebugf("h32:%x l32: %x v64:%x", h32, l32, v64)
-
-	utils.BigEndian.PutUint32(buf[pos:], h32)
-	pos += int(unsafe.Sizeof(h32))
-	utils.BigEndian.PutUint32(buf[pos:], l32)
-	//pos += int(unsafe.Sizeof(l32))
-
-	if _, err = this.idxFile.Write(buf); err == nil {
-		this.FileSize += INDEX_ENTRY_SIZE
-		if err = this.flushFile(false); err != nil {
-			this.FileSize -= INDEX_ENTRY_SIZE
-			return
-		}
-	} else {
-		return
+	for _, entry := range entries {
+		utils.BigEndian.PutInt64(buf[pos:], entry.Key)
+		pos += int(unsafe.Sizeof(entry.Key))
+
+		v64 := this.encodeRegion(entry.Region)
+		h32 := uint32(v64 >> 32)
+		l32 := uint32(v64)
+		//utils.LogDebugf("h32:%x l32: %x v64:%x", h32, l32, v64)
+
+		utils.BigEndian.PutUint32(buf[pos:], h32)
+		pos += int(unsafe.Sizeof(h32))
+		utils.BigEndian.PutUint32(buf[pos:], l32)
+		pos += int(unsafe.Sizeof(l32))
 	}
 
-	this.total_size += uint64(region.Size)
-	this.SetNeedleRegion(key, region)
+	if _, err = this.idxFile.Write(buf); err != nil {
+		this.truncate(this.FileSize)
+		return
+	}
+	this.FileSize += size
+
+	for _, entry := range entries {
+		this.updateDataEnd(entry.Region)
+		if entry.Region.IsTombstone() {
+			this.DeleteNeedleRegion(entry.Key)
+		} else {
+			this.total_size += uint64(entry.Region.Size)
+			if this.streaming != nil {
+				if err = this.streaming.add(entry.Key, this.encodeRegion(entry.Region)); err != nil {
+					return
+				}
+				continue
+			}
+			this.SetNeedleRegion(entry.Key, entry.Region)
+		}
+	}
 
 	return
 }
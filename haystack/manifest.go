@@ -0,0 +1,454 @@
+package haystack
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 大对象拆分为若干chunk needle，另写一个manifest needle（Flags带flagNeedleManifest）
+// 按顺序记录各chunk的位置。manifest needle使用对象的key/cookie和元数据，
+// 数据格式（大端）：
+//
+//	version(1) padding(3) count(4) size(8)
+//	count * (vid(4) key(8) cookie(4) size(4))
+const (
+	MANIFEST_VERSION     = 1
+	MANIFEST_HEADER_SIZE = 16
+	MANIFEST_CHUNK_SIZE  = 20
+)
+
+// **************** ManifestChunk ****************
+type ManifestChunk struct {
+	Vid    int32
+	Key    int64
+	Cookie int32
+	Size   uint32
+}
+
+// **************** Manifest ****************
+type Manifest struct {
+	Size   uint64 // object size, sum of chunk sizes.
+	Chunks []ManifestChunk
+}
+
+// ======== Marshal() ========
+func (this *Manifest) Marshal() []byte {
+	buf := make([]byte, MANIFEST_HEADER_SIZE+len(this.Chunks)*MANIFEST_CHUNK_SIZE)
+	buf[0] = MANIFEST_VERSION
+	utils.BigEndian.PutUint32(buf[4:8], uint32(len(this.Chunks)))
+	utils.BigEndian.PutUint64(buf[8:16], this.Size)
+	pos := MANIFEST_HEADER_SIZE
+	for _, chunk := range this.Chunks {
+		utils.BigEndian.PutInt32(buf[pos:], chunk.Vid)
+		utils.BigEndian.PutInt64(buf[pos+4:], chunk.Key)
+		utils.BigEndian.PutInt32(buf[pos+12:], chunk.Cookie)
+		utils.BigEndian.PutUint32(buf[pos+16:], chunk.Size)
+		pos += MANIFEST_CHUNK_SIZE
+	}
+	return buf
+}
+
+// ======== UnmarshalManifest() ========
+func UnmarshalManifest(buf []byte) (manifest *Manifest, err error) {
+	if len(buf) < MANIFEST_HEADER_SIZE || buf[0] != MANIFEST_VERSION {
+		return nil, fmt.Errorf("Manifest version not match.")
+	}
+	count := int(utils.BigEndian.Uint32(buf[4:8]))
+	if len(buf) != MANIFEST_HEADER_SIZE+count*MANIFEST_CHUNK_SIZE {
+		return nil, fmt.Errorf("Manifest of %d chunks has %d bytes.", count, len(buf))
+	}
+
+	manifest = &Manifest{
+		Size:   utils.BigEndian.Uint64(buf[8:16]),
+		Chunks: make([]ManifestChunk, count),
+	}
+	var total uint64
+	pos := MANIFEST_HEADER_SIZE
+	for i := range manifest.Chunks {
+		manifest.Chunks[i] = ManifestChunk{
+			Vid:    utils.BigEndian.Int32(buf[pos:]),
+			Key:    utils.BigEndian.Int64(buf[pos+4:]),
+			Cookie: utils.BigEndian.Int32(buf[pos+12:]),
+			Size:   utils.BigEndian.Uint32(buf[pos+16:]),
+		}
+		total += uint64(manifest.Chunks[i].Size)
+		pos += MANIFEST_CHUNK_SIZE
+	}
+	if total != manifest.Size {
+		return nil, fmt.Errorf("Manifest size %d, chunks sum up to %d.", manifest.Size, total)
+	}
+	return
+}
+
+// -------- readManifest() --------
+// Read and verify the manifest from a manifest needle.
+func readManifest(reader *NeedleReader) (manifest *Manifest, err error) {
+	if _, err = reader.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	var buf []byte
+	if buf, err = ioutil.ReadAll(reader); err != nil {
+		return
+	}
+	if manifest, err = UnmarshalManifest(buf); err != nil {
+		utils.LogErrorf(err, "Manifest of needle %d is invalid.", reader.Needle.Key)
+		err = errors.ErrNeedleCorrupted
+	}
+	return
+}
+
+// -------- readChunkNeedle() --------
+// Read up to size bytes as a chunk needle with a random key and cookie.
+// Needle size less than size means the reader is drained.
+func readChunkNeedle(reader io.Reader, size uint64) (*Needle, error) {
+	return NewNeedleFromReader(RandomKey(), RandomCookie(), io.LimitReader(reader, int64(size)), uint32(size))
+}
+
+// ======== WriteObject() ========
+// 写入reader中的对象数据。不超过Config.ChunkSize时与WriteNeedle()相同，写成单个
+// needle；否则按Config.ChunkSize拆分写入chunk needle，最后写入manifest needle。
+// needle提供对象的key、cookie和元数据。返回manifest needle所在的卷id，单个needle
+// 时manifest为nil，并按CompressNeedle()压缩、按WriteDedupNeedle()去重。
+func (this *Store) WriteObject(vid int32, needle *Needle, reader io.Reader) (used int32, manifest *Manifest, err error) {
+	chunk_size := this.Config.ChunkSize
+
+	var chunk, next *Needle
+	if chunk, err = readChunkNeedle(reader, chunk_size); err != nil {
+		return
+	}
+	if uint64(chunk.Size) == chunk_size {
+		if next, err = readChunkNeedle(reader, chunk_size); err != nil {
+			return
+		}
+	}
+	if next == nil || next.Size == 0 {
+		needle.Renew(chunk.Size)
+		needle.Data = chunk.Data
+		needle.Checksum = chunk.Checksum
+		if err = this.CompressNeedle(vid, needle); err != nil {
+			return
+		}
+		used, _, err = this.WriteDedupNeedle(vid, needle)
+		return
+	}
+
+	manifest = &Manifest{}
+	chunk_vid := vid
+	defer func() {
+		if err != nil {
+			this.deleteChunks(manifest)
+			manifest = nil
+		}
+	}()
+	for chunk.Size > 0 {
+		if manifest.Size+uint64(chunk.Size) > this.Config.ObjectMaxSize {
+			err = errors.ErrNeedleTooLarge
+			return
+		}
+		// chunk与对象一起过期。卷写满换卷后，后续chunk写入新卷。
+		chunk.TTL = needle.TTL
+		if chunk_vid, err = this.WriteNeedle(chunk_vid, chunk); err != nil {
+			return
+		}
+		manifest.Chunks = append(manifest.Chunks, ManifestChunk{chunk_vid, chunk.Key, chunk.Cookie, chunk.Size})
+		manifest.Size += uint64(chunk.Size)
+
+		if next != nil {
+			chunk, next = next, nil
+		} else if uint64(chunk.Size) < chunk_size {
+			break
+		} else if chunk, err = readChunkNeedle(reader, chunk_size); err != nil {
+			return
+		}
+	}
+
+	data := manifest.Marshal()
+	needle.Renew(uint32(len(data)))
+	needle.Flags = flagNeedleManifest
+	if _, err = needle.ReadFrom(bytes.NewReader(data)); err != nil {
+		return
+	}
+	used, err = this.replaceNeedle(vid, needle.Key, func() (int32, error) {
+		return this.WriteNeedle(vid, needle)
+	})
+	return
+}
+
+// ======== DeleteObject() ========
+// Delete the needle, and its chunks if it is a manifest needle.
+func (this *Store) DeleteObject(vid int32, key int64, cookie int32) (err error) {
+	volume, ok := this.GetVolume(vid)
+	if !ok {
+		return this.volumeErr(vid)
+	}
+	lock := this.keyLock(vid, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// 先删除manifest使对象不可见，再删除chunk。cookie不匹配等错误由DeleteNeedle()返回。
+	// 引用needle删除后释放对数据needle的引用。
+	var manifest *Manifest
+	var ref *Reference
+	if reader, e := volume.OpenNeedle(key, cookie); e == nil {
+		if reader.Needle.IsManifest() {
+			manifest, err = readManifest(reader)
+		} else if reader.Needle.IsReference() {
+			ref, err = readReference(reader)
+		}
+		reader.Close()
+		if err != nil {
+			return
+		}
+	}
+	if err = volume.DeleteNeedle(key, cookie); err != nil {
+		return
+	}
+	if manifest != nil {
+		this.deleteChunks(manifest)
+	}
+	if ref != nil {
+		this.releaseReference(ref)
+	}
+	return
+}
+
+// -------- keyLock() --------
+// Lock serializing writes and deletes of the key in volume vid.
+func (this *Store) keyLock(vid int32, key int64) *sync.Mutex {
+	return &this.keys[(uint64(key)*31+uint64(uint32(vid)))%STORE_KEY_LOCKS]
+}
+
+// -------- replaceNeedle() --------
+// Write a needle of key to volume vid by write, then delete chunks of the
+// manifest or release the reference of the needle it replaces. 同一key的写入
+// 按key串行，旧needle按索引查找，与cookie无关。换卷写入时原卷中的旧needle
+// 没有被覆盖，chunk和引用保留。
+func (this *Store) replaceNeedle(vid int32, key int64, write func() (int32, error)) (used int32, err error) {
+	lock := this.keyLock(vid, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var ref *Reference
+	var manifest *Manifest
+	if ref, manifest, err = this.replacedObject(vid, key); err == errors.ErrNeedleCorrupted {
+		// 损坏的旧needle仍可覆盖，它的chunk或数据needle保留。
+		utils.LogWarnf(err, "Needle to replace is corrupted, its data is kept. vid:%d key:%d", vid, key)
+		err = nil
+	} else if err != nil {
+		utils.LogErrorf(err, "Read needle to replace failed. vid:%d key:%d", vid, key)
+		return
+	}
+	if used, err = write(); err != nil || used != vid {
+		return
+	}
+	if manifest != nil {
+		this.deleteChunks(manifest)
+	}
+	if ref != nil {
+		this.releaseReference(ref)
+	}
+	return
+}
+
+// -------- replacedObject() --------
+// The reference or manifest of the needle of key in volume vid whatever its
+// cookie, both nil if there is no such needle or it is a plain needle.
+func (this *Store) replacedObject(vid int32, key int64) (ref *Reference, manifest *Manifest, err error) {
+	volume, ok := this.GetVolume(vid)
+	if !ok {
+		return
+	}
+	var needle *Needle
+	volume.rwlock.RLock()
+	region, exist := volume.index.GetNeedleRegion(key)
+	if exist {
+		needle, err = volume.data.GetNeedleHeader(region)
+	}
+	volume.rwlock.RUnlock()
+	if !exist || err != nil || needle.IsDeleted() || !needle.IsManifest() && !needle.IsReference() {
+		return
+	}
+
+	var reader *NeedleReader
+	if reader, err = volume.OpenNeedle(key, needle.Cookie); err != nil {
+		if err == errors.ErrNeedleNotExist {
+			err = nil
+		}
+		return
+	}
+	defer reader.Close()
+	if reader.Needle.IsManifest() {
+		manifest, err = readManifest(reader)
+	} else {
+		ref, err = readReference(reader)
+	}
+	return
+}
+
+// -------- deleteChunks() --------
+func (this *Store) deleteChunks(manifest *Manifest) {
+	for _, chunk := range manifest.Chunks {
+		volume, ok := this.GetVolume(chunk.Vid)
+		if !ok {
+			continue
+		}
+		if err := volume.DeleteNeedle(chunk.Key, chunk.Cookie); err != nil {
+			utils.LogWarnf(err, "Delete chunk needle failed. vid:%d key:%d", chunk.Vid, chunk.Key)
+		}
+	}
+}
+
+// ======== OpenManifest() ========
+// Open the object of a manifest needle for streaming. reader is not closed.
+func (this *Store) OpenManifest(reader *NeedleReader) (object *ManifestReader, err error) {
+	var manifest *Manifest
+	if manifest, err = readManifest(reader); err != nil {
+		return
+	}
+	object = &ManifestReader{
+		Needle:   reader.Needle,
+		manifest: manifest,
+		store:    this,
+		offsets:  make([]int64, len(manifest.Chunks)+1),
+		current:  -1,
+	}
+	for i, chunk := range manifest.Chunks {
+		object.offsets[i+1] = object.offsets[i] + int64(chunk.Size)
+	}
+	return
+}
+
+// **************** ManifestReader ****************
+// ManifestReader streams the chunks of a manifest needle in order as one
+// object. Seek makes Range requests across chunks possible. Every chunk is
+// verified by its NeedleReader when read sequentially from its beginning.
+type ManifestReader struct {
+	Needle *Needle // The manifest needle.
+
+	manifest *Manifest
+	store    *Store
+	offsets  []int64 // object offset of every chunk, and the object size.
+	offset   int64
+	current  int // chunk of reader, -1 if none.
+	reader   *NeedleReader
+}
+
+// ======== Read() ========
+func (this *ManifestReader) Read(p []byte) (n int, err error) {
+	for n == 0 {
+		if this.offset >= this.Size() {
+			return 0, io.EOF
+		}
+		if err = this.openChunk(); err != nil {
+			return
+		}
+		n, err = this.reader.Read(p)
+		this.offset += int64(n)
+		if err == io.EOF {
+			err = nil
+			this.closeChunk()
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// -------- openChunk() --------
+// Open the chunk containing this.offset and seek to it.
+func (this *ManifestReader) openChunk() (err error) {
+	i := sort.Search(len(this.manifest.Chunks), func(i int) bool {
+		return this.offsets[i+1] > this.offset
+	})
+	if i == this.current {
+		return
+	}
+	this.closeChunk()
+
+	chunk := this.manifest.Chunks[i]
+	volume, ok := this.store.GetVolume(chunk.Vid)
+	if !ok {
+		utils.LogErrorf(errors.ErrVolumeNotExist, "Chunk %d of needle %d lost. vid:%d", i, this.Needle.Key, chunk.Vid)
+		return errors.ErrNeedleCorrupted
+	}
+	if this.reader, err = volume.OpenNeedle(chunk.Key, chunk.Cookie); err != nil {
+		utils.LogErrorf(err, "Open chunk %d of needle %d failed. vid:%d key:%d", i, this.Needle.Key, chunk.Vid, chunk.Key)
+		if err == errors.ErrNeedleNotExist || err == errors.ErrNeedleCookieNotMatch {
+			err = errors.ErrNeedleCorrupted
+		}
+		return
+	}
+	if this.reader.Size() != int64(chunk.Size) {
+		this.closeChunk()
+		return errors.ErrNeedleCorrupted
+	}
+	this.current = i
+	_, err = this.reader.Seek(this.offset-this.offsets[i], io.SeekStart)
+	return
+}
+
+// -------- closeChunk() --------
+func (this *ManifestReader) closeChunk() {
+	if this.reader != nil {
+		this.reader.Close()
+		this.reader = nil
+	}
+	this.current = -1
+}
+
+// ======== Seek() ========
+func (this *ManifestReader) Seek(offset int64, whence int) (abs int64, err error) {
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = this.offset + offset
+	case io.SeekEnd:
+		abs = this.Size() + offset
+	default:
+		return 0, fmt.Errorf("ManifestReader.Seek() invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("ManifestReader.Seek() negative position %d", abs)
+	}
+	if abs != this.offset && this.reader != nil {
+		// 仍在当前chunk内时只移动chunk内的位置。
+		i := this.current
+		if abs >= this.offsets[i] && abs < this.offsets[i+1] {
+			if _, err = this.reader.Seek(abs-this.offsets[i], io.SeekStart); err != nil {
+				return 0, err
+			}
+		} else {
+			this.closeChunk()
+		}
+	}
+	this.offset = abs
+	return
+}
+
+// ======== Size() ========
+func (this *ManifestReader) Size() int64 {
+	return this.offsets[len(this.offsets)-1]
+}
+
+// ======== ModTime() ========
+func (this *ManifestReader) ModTime() time.Time {
+	if this.Needle.MTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(this.Needle.MTime, 0)
+}
+
+// ======== Close() ========
+func (this *ManifestReader) Close() error {
+	this.closeChunk()
+	return nil
+}
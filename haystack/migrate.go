@@ -0,0 +1,248 @@
+package haystack
+
+import (
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// ======== Migrate() ========
+// 把卷升级到最新格式：有效needle按当前needle格式重新写入新的数据和索引文件，
+// 超级块沿用卷的标志和元数据。dest_dir为空或与卷目录相同时原地替换，新文件先
+// 写为压缩文件，中断后由recoverCompaction()处理；否则写到dest_dir，原卷不变。
+func (this *Volume) Migrate(dest_dir string) (err error) {
+	this.rwlock.RLock()
+	old_version := this.data.superblock.Version
+	old_size := this.data.FileSize
+	superblock := migrateSuperBlock(this.data)
+	this.rwlock.RUnlock()
+	if this.isInPlace(dest_dir) && old_version == blockVersion {
+		utils.LogInfof("Volume %d is already version %d.", this.Id, blockVersion)
+		return
+	}
+
+	start := time.Now()
+	var needles int
+	var size uint64
+	if needles, size, err = this.rewrite(dest_dir, superblock, nil); err == nil {
+		utils.LogInfof("Volume %d migrated from version %d to %d in %v. %d needles, data file %d -> %d bytes.",
+			this.Id, old_version, blockVersion, time.Since(start), needles, old_size, size)
+	}
+	return
+}
+
+// -------- isInPlace() --------
+func (this *Volume) isInPlace(dest_dir string) bool {
+	return dest_dir == "" || filepath.Clean(dest_dir) == filepath.Clean(this.Dir)
+}
+
+// -------- rewrite() --------
+// 把有效needle重新写入使用superblock的新数据和索引文件，convert非空时写入
+// convert返回的needle。与压缩相同，复制期间写入照常进行，最后在锁内补齐复制
+// 期间追加的索引项；原地替换时在写锁内替换原文件并重新打开卷。返回needle数和
+// 新数据文件大小。
+func (this *Volume) rewrite(dest_dir string, superblock *SuperBlock, convert func(*Needle) (*Needle, error)) (needles int, size uint64, err error) {
+	if !atomic.CompareAndSwapInt32(&this.compacting, 0, 1) {
+		err = errors.ErrVolumeCompacting
+		return
+	}
+	defer atomic.StoreInt32(&this.compacting, 0)
+
+	in_place := this.isInPlace(dest_dir)
+	if in_place && this.IsErasureCoded() {
+		err = fmt.Errorf("Volume %d is erasure coded, decode it first.", this.Id)
+		return
+	}
+
+	var data *Data
+	var index *Index
+	if in_place {
+		data = newCompactData(this.Id, this.Dir)
+		index = newCompactIndex(this.Id, this.Dir)
+		data.remove()
+		index.remove()
+	} else {
+		data = NewData(this.Id, dest_dir)
+		index = NewIndex(this.Id, dest_dir)
+		if utils.FileExist(data.getDataFileName()) || utils.FileExist(index.getIndexFileName()) {
+			err = fmt.Errorf("Volume %d already exists in %s.", this.Id, dest_dir)
+			return
+		}
+	}
+
+	// 与压缩相同，复制期间持有检查点锁，旧的磁盘索引不会被重新映射。
+	this.ckpLock.Lock()
+	defer this.ckpLock.Unlock()
+
+	done := false
+	defer func() {
+		if !done {
+			data.Close()
+			index.Close()
+			data.remove()
+			index.remove()
+			os.Remove(index.getCheckpointFileName())
+		}
+	}()
+
+	data.superblock = superblock
+	index.data_version = data.superblock.needleVersion()
+	index.data_start = data.superblock.Size()
+	index.disk_mode = data.superblock.IsDiskIndex()
+	if err = data.Init(); err != nil {
+		return
+	}
+	if err = index.Init(); err != nil {
+		return
+	}
+
+	// Snapshot live needles. Later writes are appended after idx_offset.
+	this.rwlock.RLock()
+	old_data := this.data
+	old_index := this.index
+	entries := old_index.snapshotEntries()
+	idx_offset := old_index.FileSize
+	this.rwlock.RUnlock()
+
+	// 与压缩相同，磁盘索引按key顺序重写，索引项直接写入新的检查点。
+	if index.disk_mode {
+		if err = index.streamCheckpoint(); err != nil {
+			return
+		}
+	}
+	entries(func(entry IndexEntry) bool {
+		if err = rewriteNeedle(old_data, data, index, entry, convert); err != nil {
+			utils.LogErrorf(err, "Volume %d rewrite needle failed. key:%d", this.Id, entry.Key)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return
+	}
+	if err = data.flushFile(); err != nil {
+		return
+	}
+	if index.disk_mode {
+		err = index.finishCheckpoint()
+	} else {
+		err = index.flushFile()
+	}
+	if err != nil {
+		return
+	}
+
+	// 原地替换时在写锁内补齐并替换，复制到其它目录时读锁内补齐即可。
+	if in_place {
+		this.rwlock.Lock()
+		defer this.rwlock.Unlock()
+	} else {
+		this.rwlock.RLock()
+		defer this.rwlock.RUnlock()
+	}
+
+	// Replay index entries appended while rewriting.
+	err = old_index.walkEntries(idx_offset, func(key int64, region NeedleRegion) error {
+		if region.IsTombstone() {
+			if _, exist := index.GetNeedleRegion(key); !exist {
+				return nil
+			}
+			return appendTombstone(data, index, key)
+		}
+		return rewriteNeedle(old_data, data, index, IndexEntry{key, region}, convert)
+	})
+	if err != nil {
+		utils.LogErrorf(err, "Volume %d rewrite replay index tail failed.", this.Id)
+		return
+	}
+	// 重写期间封存的卷保持封存。
+	if old_data.superblock.IsSealed() && !data.superblock.IsSealed() {
+		if err = data.seal(); err != nil {
+			return
+		}
+	}
+	if err = data.flushFile(); err != nil {
+		return
+	}
+	if err = index.flushFile(); err != nil {
+		return
+	}
+	needles = index.indices.Len()
+	size = data.FileSize
+	data.Close()
+	index.Close()
+	done = true
+
+	if !in_place {
+		return
+	}
+
+	// 与压缩相同，先替换数据文件再替换索引文件。
+	old_data.Close()
+	old_index.Close()
+	old_index.removeCheckpoint()
+	if err = os.Rename(data.getDataFileName(), old_data.getDataFileName()); err != nil {
+		utils.LogErrorf(err, "Volume %d rewrite rename data file failed.", this.Id)
+		data.remove()
+		index.remove()
+		os.Remove(index.getCheckpointFileName())
+	} else {
+		// 新数据文件在卷目录，冷存储中原来的数据文件不再使用。
+		if old_data.cold != "" {
+			os.Remove(old_data.cold)
+		}
+		if err = os.Rename(index.getIndexFileName(), old_index.getIndexFileName()); err != nil {
+			utils.LogErrorf(err, "Volume %d rewrite rename index file failed.", this.Id)
+		} else if index.disk_mode {
+			renameCompactCheckpoint(index, old_index)
+		}
+	}
+
+	if e := this.reopen(); e != nil && err == nil {
+		err = e
+	}
+	return
+}
+
+// -------- rewriteNeedle() --------
+// Read the needle in entry.Region from src, and append it converted by
+// convert to dst data and index.
+func rewriteNeedle(src *Data, dst *Data, dst_index *Index, entry IndexEntry, convert func(*Needle) (*Needle, error)) (err error) {
+	var needle *Needle
+	if needle, err = src.GetNeedle(entry.Key, entry.Region); err != nil {
+		return
+	}
+	if convert != nil {
+		if needle, err = convert(needle); err != nil {
+			return
+		}
+	}
+	var region NeedleRegion
+	if region, err = dst.AppendNeedle(needle); err != nil {
+		return
+	}
+	return dst_index.appendEntry(IndexEntry{entry.Key, region})
+}
+
+// -------- migrateSuperBlock() --------
+// Superblock of the latest version with flags and metadata of data. Volumes
+// before version4 have no creation time, the data file mtime is used.
+func migrateSuperBlock(data *Data) (superblock *SuperBlock) {
+	old := data.superblock
+	superblock = NewSuperBlock()
+	superblock.Flags = old.Flags
+	superblock.Replication = old.Replication
+	superblock.TTL = old.TTL
+	superblock.Collection = old.Collection
+	superblock.Codec = old.Codec
+	superblock.DataKey = old.DataKey
+	if old.CreatedAt != 0 {
+		superblock.CreatedAt = old.CreatedAt
+	} else if stat, err := os.Stat(data.getDataFileName()); err == nil {
+		superblock.CreatedAt = stat.ModTime().Unix()
+	}
+	return
+}
@@ -3,11 +3,14 @@ package haystack
 import (
 	"io"
 	"bytes"
+	"crypto/rand"
 	"fmt"
+	"github.com/uukuguy/kds/store/errors"
 	"github.com/uukuguy/kds/utils"
 	"sync"
 	"syscall"
 	"hash/crc32"
+	"math"
 	"time"
 )
 
@@ -33,21 +36,39 @@ const (
 	NEEDLE_FLAGS_OFFSET  = NEEDLE_KEY_OFFSET + NEEDLE_KEY_SIZE
 	NEEDLE_SIZE_OFFSET   = NEEDLE_FLAGS_OFFSET + NEEDLE_FLAGS_SIZE
 
+	// v1 needle数据的偏移，v2在头部之后还有元数据段，见Needle.DataOffset()。
 	NEEDLE_DATA_OFFSET = NEEDLE_SIZE_OFFSET + NEEDLE_SIZE_SIZE
 
+	// v2头部在size之后增加元数据段的字节数。constant 25
+	NEEDLE_META_SIZE_SIZE   = 4
+	NEEDLE_META_SIZE_OFFSET = NEEDLE_SIZE_OFFSET + NEEDLE_SIZE_SIZE
+	NEEDLE_V2_HEADER_SIZE   = NEEDLE_HEADER_SIZE + NEEDLE_META_SIZE_SIZE
+
 	NEEDLE_CHECKSUM_OFFSET = NEEDLE_MAGIC_OFFSET + NEEDLE_MAGIC_SIZE
 	NEEDLE_PADDING_OFFSET  = NEEDLE_CHECKSUM_OFFSET + NEEDLE_CHECKSUM_SIZE
+
+	// ReadFrom()每次读取并累计checksum的块大小。
+	NEEDLE_READ_CHUNKSIZE = 64 * 1024
 )
 
 // **************** Needle ****************
 type Needle struct {
+	Version     byte // needle format, the superblock version of the volume.
 	HeaderMagic []byte
 	Cookie      int32
 	Key         int64
 	MTime       int64
 	Flags       byte
 	Size        uint32
+	MetaSize    uint32 // bytes of encoded metadata section, v2 only.
 	Data        []byte
+
+	// Metadata persisted by v2 needles.
+	Name string
+	Mime string
+	Meta map[string]string
+	TTL  uint32 // seconds after MTime, 0 for never.
+
 	//DataReader  *io.Reader
 	FooterMagic []byte
 	Checksum    uint32
@@ -60,7 +81,8 @@ type Needle struct {
 
 	//IncrOffset uint32
 
-	buffer []byte
+	buffer  []byte
+	metaBuf []byte
 }
 
 var (
@@ -68,6 +90,8 @@ var (
 	footerMagic       = []byte{0x35, 0x89, 0x79, 0x32}
 	flagNeedleOK      = byte(0)
 	flagNeedleDeleted = byte(1)
+	// 数据是Manifest，对象由其中列出的chunk needle组成。
+	flagNeedleManifest = byte(2)
 	// crc32 checksum table, goroutine safe
 	crc32Table = crc32.MakeTable(crc32.Koopman)
 
@@ -93,6 +117,7 @@ func init() {
 // ======== NewNeedle() ========
 func NewNeedle(key int64, cookie int32, size uint32) *Needle {
 	needle := new(Needle)
+	needle.Version = blockVersion
 	needle.Cookie = cookie
 	needle.Key = key
 	needle.Size = size
@@ -102,6 +127,87 @@ func NewNeedle(key int64, cookie int32, size uint32) *Needle {
 	return needle
 }
 
+// ======== NewTombstoneNeedle() ========
+// 删除标记needle，不含数据，追加到数据文件末尾表示key已被删除。
+func NewTombstoneNeedle(key int64, cookie int32) *Needle {
+	needle := NewNeedle(key, cookie, 0)
+	needle.Flags = flagNeedleDeleted
+
+	return needle
+}
+
+// ======== RandomCookie() ========
+// 生成随机的非零cookie，客户端上传时未指定cookie时使用。
+func RandomCookie() (cookie int32) {
+	buf := make([]byte, NEEDLE_COOKIE_SIZE)
+	for cookie == 0 {
+		if _, err := rand.Read(buf); err != nil {
+			utils.LogErrorf(err, "RandomCookie() rand.Read() failed.")
+			cookie = int32(time.Now().UnixNano())
+			continue
+		}
+		cookie = utils.BigEndian.Int32(buf)
+	}
+	return
+}
+
+// ======== RandomKey() ========
+// 生成随机的非负key，用于大对象的chunk needle。
+func RandomKey() (key int64) {
+	buf := make([]byte, NEEDLE_KEY_SIZE)
+	if _, err := rand.Read(buf); err != nil {
+		utils.LogErrorf(err, "RandomKey() rand.Read() failed.")
+		return time.Now().UnixNano() & math.MaxInt64
+	}
+	return utils.BigEndian.Int64(buf) & math.MaxInt64
+}
+
+// ======== IsDeleted() ========
+func (needle *Needle) IsDeleted() bool {
+	return needle.Flags&flagNeedleDeleted != 0
+}
+
+// ======== IsManifest() ========
+func (needle *Needle) IsManifest() bool {
+	return needle.Flags&flagNeedleManifest != 0
+}
+
+// ======== SetVersion() ========
+// Set needle format of the volume to write to. The metadata is encoded for
+// v2 and not stored by v1.
+func (needle *Needle) SetVersion(version byte) (err error) {
+	needle.Version = version
+	needle.metaBuf = nil
+	if version >= version2 {
+		if needle.metaBuf, err = needle.encodeMeta(); err != nil {
+			utils.LogErrorf(err, "Needle.SetVersion() encode metadata failed. key:%d", needle.Key)
+		}
+	}
+	needle.MetaSize = uint32(len(needle.metaBuf))
+	needle.adjustSize()
+	needle.Padding = padding[needle.PaddingSize]
+	return
+}
+
+// ======== HeaderSize() ========
+func (needle *Needle) HeaderSize() uint32 {
+	return needleHeaderSize(needle.Version)
+}
+
+// ======== DataOffset() ========
+// Offset of data from the beginning of needle.
+func (needle *Needle) DataOffset() uint32 {
+	return needle.HeaderSize() + needle.MetaSize
+}
+
+// -------- needleHeaderSize() --------
+func needleHeaderSize(version byte) uint32 {
+	if version >= version2 {
+		return NEEDLE_V2_HEADER_SIZE
+	}
+	return NEEDLE_HEADER_SIZE
+}
+
 // -------- init() --------
 func (needle *Needle) init() {
 	needle.HeaderMagic = headerMagic
@@ -126,19 +232,59 @@ func (needle *Needle) Renew(size uint32) {
 
 // ======== DataBuffer() ========
 func (needle *Needle) DataBuffer() []byte {
-	return needle.buffer[NEEDLE_DATA_OFFSET : NEEDLE_DATA_OFFSET+needle.Size]
+	offset := needle.DataOffset()
+	return needle.buffer[offset : offset+needle.Size]
 }
 
 func (needle *Needle) Close() {
 	needle.freeBuffer()
 }
 
-func (needle *Needle) ReadFrom(file io.Reader) (err error){
+// ======== ReadFrom() ========
+func (needle *Needle) ReadFrom(reader io.Reader) (n int64, err error) {
+	// 按块读满needle.Size字节，边读边累计checksum，避免单次Read返回不足。
 	needle.Data = make([]byte, needle.Size)
-	if _, err = file.Read(needle.Data); err != nil {
+	needle.Checksum = 0
+	size := int64(needle.Size)
+	for n < size {
+		end := n + NEEDLE_READ_CHUNKSIZE
+		if end > size {
+			end = size
+		}
+		var m int
+		m, err = io.ReadFull(reader, needle.Data[n:end])
+		needle.Checksum = crc32.Update(needle.Checksum, crc32Table, needle.Data[n:n+int64(m)])
+		n += int64(m)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	return
+}
+
+// ======== NewNeedleFromReader() ========
+// 从长度未知的reader（如chunked请求体）读取needle数据，边读边计算checksum。
+// 读取超过maxSize字节时返回errors.ErrNeedleTooLarge。
+func NewNeedleFromReader(key int64, cookie int32, reader io.Reader, maxSize uint32) (needle *Needle, err error) {
+	hash := crc32.New(crc32Table)
+	buf := new(bytes.Buffer)
+	limited := io.LimitReader(reader, int64(maxSize)+1)
+
+	var n int64
+	if n, err = io.Copy(buf, io.TeeReader(limited, hash)); err != nil {
+		return
+	}
+	if n > int64(maxSize) {
+		err = errors.ErrNeedleTooLarge
 		return
 	}
-	needle.Checksum = crc32.Update(0, crc32Table, needle.Data)
+
+	needle = NewNeedle(key, cookie, uint32(n))
+	needle.Data = buf.Bytes()
+	needle.Checksum = hash.Sum32()
 	return
 }
 
@@ -175,7 +321,7 @@ func Size(n uint32) uint32 {
 
 // -------- adjustSize() --------
 func (needle *Needle) adjustSize() {
-	needle.WriteSize = uint32(NEEDLE_HEADER_SIZE + needle.Size + NEEDLE_FOOTER_SIZE)
+	needle.WriteSize = needle.DataOffset() + needle.Size + NEEDLE_FOOTER_SIZE
 	//needle.PaddingSize = align(needle.WriteSize) - needle.WriteSize
 	needle.PaddingSize = paddingSize(needle.WriteSize)
 	needle.WriteSize += needle.PaddingSize
@@ -202,9 +348,11 @@ func (needle *Needle) freeBuffer() {
 // ======== FillBuffer() ========
 func (this *Needle) FillBuffer() (err error) {
 	this.newBuffer()
-	this.fillHeaderBuffer(this.buffer[NEEDLE_MAGIC_OFFSET:NEEDLE_DATA_OFFSET])
-	footerOffset := NEEDLE_DATA_OFFSET + this.Size
-	this.fillDataBuffer(this.buffer[NEEDLE_DATA_OFFSET:footerOffset])
+	this.fillHeaderBuffer(this.buffer[NEEDLE_MAGIC_OFFSET:this.HeaderSize()])
+	dataOffset := this.DataOffset()
+	copy(this.buffer[this.HeaderSize():dataOffset], this.metaBuf)
+	footerOffset := dataOffset + this.Size
+	this.fillDataBuffer(this.buffer[dataOffset:footerOffset])
 	this.fillFooterBuffer(this.buffer[footerOffset : footerOffset+this.FooterSize])
 	return
 }
@@ -227,7 +375,7 @@ func (needle *Needle) fillDataBuffer(buf []byte) (err error) {
 
 // -------- fillHeaderBuffer() --------
 func (needle *Needle) fillHeaderBuffer(buf []byte) (err error) {
-	if len(buf) != int(NEEDLE_HEADER_SIZE) {
+	if len(buf) != int(needle.HeaderSize()) {
 		err = fmt.Errorf("Wrong buffer size for needle header")
 		return
 	}
@@ -241,6 +389,10 @@ func (needle *Needle) fillHeaderBuffer(buf []byte) (err error) {
 	buf[NEEDLE_FLAGS_OFFSET] = needle.Flags
 	// size
 	utils.BigEndian.PutUint32(buf[NEEDLE_SIZE_OFFSET:NEEDLE_DATA_OFFSET], needle.Size)
+	// metadata size
+	if needle.Version >= version2 {
+		utils.BigEndian.PutUint32(buf[NEEDLE_META_SIZE_OFFSET:NEEDLE_V2_HEADER_SIZE], needle.MetaSize)
+	}
 	return
 }
 
@@ -260,23 +412,37 @@ func (needle *Needle) fillFooterBuffer(buf []byte) (err error) {
 }
 
 // ======== BuildFrom() ========
-func (this *Needle) BuildFrom(buf []byte) (err error) {
+// Build needle of format version from buffer read from disk. Header magic,
+// metadata, footer magic and data checksum are verified,
+// errors.ErrNeedleCorrupted is returned on mismatch.
+func (this *Needle) BuildFrom(version byte, buf []byte) (err error) {
 
-	if !bytes.Equal(buf[NEEDLE_MAGIC_OFFSET:NEEDLE_COOKIE_OfFSET], headerMagic) {
-		err = fmt.Errorf("Needle header magic is wrong.")
-		utils.LogErrorf(err, "BuildFrom()")
+	if err = this.buildHeaderFrom(version, buf); err != nil {
 		return
 	}
 
-	this.Cookie = utils.BigEndian.Int32(buf[NEEDLE_COOKIE_OfFSET:NEEDLE_KEY_OFFSET])
-	this.Key = utils.BigEndian.Int64(buf[NEEDLE_KEY_OFFSET:NEEDLE_FLAGS_OFFSET])
-	this.Size = utils.BigEndian.Uint32(buf[NEEDLE_SIZE_OFFSET:NEEDLE_DATA_OFFSET])
-	this.init()
+	if uint64(len(buf)) < needleWriteSize(version, this.MetaSize, this.Size) {
+		err = errors.ErrNeedleCorrupted
+		utils.LogErrorf(err, "BuildFrom() Needle buffer too short. key:%d len:%d size:%d", this.Key, len(buf), this.Size)
+		return
+	}
+
+	dataOffset := this.DataOffset()
+	if err = this.decodeMeta(buf[this.HeaderSize():dataOffset]); err != nil {
+		return
+	}
 
-	this.Flags = buf[NEEDLE_FLAGS_OFFSET]
-	this.Checksum = utils.BigEndian.Uint32(buf[NEEDLE_CHECKSUM_OFFSET:NEEDLE_PADDING_OFFSET])
 	this.Data = make([]byte, this.Size)
-	copy(this.Data, buf[NEEDLE_DATA_OFFSET:NEEDLE_DATA_OFFSET+this.Size])
+	copy(this.Data, buf[dataOffset:dataOffset+this.Size])
+
+	footer := buf[dataOffset+this.Size : dataOffset+this.Size+this.FooterSize]
+	this.FooterMagic = make([]byte, NEEDLE_MAGIC_SIZE)
+	copy(this.FooterMagic, footer[NEEDLE_MAGIC_OFFSET:NEEDLE_CHECKSUM_OFFSET])
+	this.Checksum = utils.BigEndian.Uint32(footer[NEEDLE_CHECKSUM_OFFSET:NEEDLE_PADDING_OFFSET])
+
+	if err = this.Verify(); err != nil {
+		return
+	}
 	//utils.LogDebugf("copy Data(offset=%d size=%d) into needle. %s", NEEDLE_DATA_OFFSET, this.Size, this.Data)
 	//utils.LogDebugf("buf: %#v", buf[NEEDLE_DATA_OFFSET:NEEDLE_DATA_OFFSET+this.Size])
 	//utils.LogDebugf("needle: %#v", *this)
@@ -284,6 +450,64 @@ func (this *Needle) BuildFrom(buf []byte) (err error) {
 	return
 }
 
+// -------- buildHeaderFrom() --------
+// Parse the fixed size header only, metadata is decoded by decodeMeta().
+func (this *Needle) buildHeaderFrom(version byte, buf []byte) (err error) {
+	header_size := needleHeaderSize(version)
+	if len(buf) < int(header_size) || !bytes.Equal(buf[NEEDLE_MAGIC_OFFSET:NEEDLE_COOKIE_OfFSET], headerMagic) {
+		err = errors.ErrNeedleCorrupted
+		utils.LogErrorf(err, "BuildFrom() Needle header magic is wrong.")
+		return
+	}
+
+	this.Version = version
+	this.Cookie = utils.BigEndian.Int32(buf[NEEDLE_COOKIE_OfFSET:NEEDLE_KEY_OFFSET])
+	this.Key = utils.BigEndian.Int64(buf[NEEDLE_KEY_OFFSET:NEEDLE_FLAGS_OFFSET])
+	this.Size = utils.BigEndian.Uint32(buf[NEEDLE_SIZE_OFFSET:NEEDLE_DATA_OFFSET])
+	this.MetaSize = 0
+	if version >= version2 {
+		this.MetaSize = utils.BigEndian.Uint32(buf[NEEDLE_META_SIZE_OFFSET:NEEDLE_V2_HEADER_SIZE])
+		if this.MetaSize > NEEDLE_META_MAXSIZE {
+			err = errors.ErrNeedleCorrupted
+			utils.LogErrorf(err, "BuildFrom() Needle metadata size %d is wrong. key:%d", this.MetaSize, this.Key)
+			return
+		}
+	}
+	this.init()
+	this.Flags = buf[NEEDLE_FLAGS_OFFSET]
+	// v1 does not persist mtime, unknown. v2 reads it from metadata.
+	this.MTime = 0
+
+	return
+}
+
+// ======== Verify() ========
+// Check footer magic and data checksum of a needle built from disk.
+func (this *Needle) Verify() (err error) {
+	if !bytes.Equal(this.FooterMagic, footerMagic) {
+		err = errors.ErrNeedleCorrupted
+		utils.LogErrorf(err, "Needle footer magic is wrong. key:%d", this.Key)
+		return
+	}
+	if checksum := crc32.Update(0, crc32Table, this.Data); checksum != this.Checksum {
+		err = errors.ErrNeedleCorrupted
+		utils.LogErrorf(err, "Needle checksum not match. key:%d checksum:%d stored:%d", this.Key, checksum, this.Checksum)
+		return
+	}
+	return
+}
+
+// -------- needleWriteSize() --------
+// Aligned bytes on disk of a needle with metadata and data size, computed in
+// 64 bits so a corrupted size field can not overflow.
+func needleWriteSize(version byte, meta_size uint32, size uint32) uint64 {
+	n := uint64(needleHeaderSize(version)) + uint64(meta_size) + uint64(size) + uint64(NEEDLE_FOOTER_SIZE)
+	if a := n % NEEDLE_PADDINGSIZE; a > 0 {
+		n += NEEDLE_PADDINGSIZE - a
+	}
+	return n
+}
+
 func (needle *Needle) String() string {
 	var dn = 16
 	if len(needle.Data) < dn {
@@ -294,6 +518,7 @@ func (needle *Needle) String() string {
 WriteSize:      %d
 
 ---- head
+Version:        %d
 HeaderSize:     %d
 HeaderMagic:    %#v
 Cookie:         %d
@@ -301,6 +526,14 @@ Key:            %d
 Flags:          %d
 Size:           %d
 
+---- meta
+MetaSize:       %d
+MTime:          %d
+Name:           %s
+Mime:           %s
+Meta:           %v
+TTL:            %d
+
 ---- data
 Data:           %#v...
 
@@ -310,6 +543,7 @@ FooterMagic:    %#v
 Checksum:       %d
 Padding:        %v
 -----------------------------
-`, needle.WriteSize, NEEDLE_HEADER_SIZE, needle.HeaderMagic, needle.Cookie, needle.Key, needle.Flags, needle.Size,
+`, needle.WriteSize, needle.Version, needle.HeaderSize(), needle.HeaderMagic, needle.Cookie, needle.Key, needle.Flags, needle.Size,
+		needle.MetaSize, needle.MTime, needle.Name, needle.Mime, needle.Meta, needle.TTL,
 		needle.Data[:dn], needle.FooterSize, needle.FooterMagic, needle.Checksum, needle.Padding)
 }
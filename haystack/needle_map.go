@@ -0,0 +1,366 @@
+package haystack
+
+import (
+	"sort"
+)
+
+const (
+	// 开放寻址哈希表的最小容量与最大装载率（3/4）。
+	NEEDLEMAP_MIN_CAPACITY = 64
+
+	// diskNeedleMap的哈希表中标记磁盘表里的key已删除。
+	needleMapDeleted = ^uint64(0)
+)
+
+// **************** NeedleMap ****************
+// 内存中needle key到Index.encodeRegion()的映射。任何needle都不在数据文件
+// 偏移0处（超级块），所以值0不会出现，实现可以用0表示空位或已删除。
+type NeedleMap interface {
+	Get(key int64) (value uint64, ok bool)
+	// Set returns the replaced value if key exists.
+	Set(key int64, value uint64) (old uint64, ok bool)
+	Delete(key int64) (old uint64, ok bool)
+	Len() int
+	// Range calls fn for every key until fn returns false.
+	Range(fn func(key int64, value uint64) bool)
+	// Freeze compacts the map for mostly-read access, e.g. after the volume is
+	// loaded or sealed.
+	Freeze()
+	// Snapshot is taken under the volume lock. The returned function iterates
+	// the snapshot in ascending key order without the lock.
+	Snapshot() func(fn func(key int64, value uint64) bool)
+	// Bytes of memory held by the map.
+	MemoryUsage() uint64
+	Close()
+}
+
+// -------- sortedSnapshot() --------
+// Iterate n base entries given by at(i) and entries of tail in ascending key
+// order. Both are sorted by key, tail overrides base on equal keys and
+// needleMapDeleted values in tail are skipped.
+func sortedSnapshot(n int, at func(i int) needleMapEntry, tail []needleMapEntry) func(fn func(key int64, value uint64) bool) {
+	return func(fn func(key int64, value uint64) bool) {
+		i, j := 0, 0
+		for i < n || j < len(tail) {
+			var entry needleMapEntry
+			if i < n {
+				entry = at(i)
+			}
+			if j == len(tail) || (i < n && entry.key < tail[j].key) {
+				i++
+			} else {
+				if i < n && entry.key == tail[j].key {
+					i++
+				}
+				entry = tail[j]
+				j++
+				if entry.value == needleMapDeleted {
+					continue
+				}
+			}
+			if !fn(entry.key, entry.value) {
+				return
+			}
+		}
+	}
+}
+
+// -------- hashKey() --------
+// splitmix64 finalizer, spread sequential keys over slots.
+func hashKey(key int64) uint64 {
+	h := uint64(key)
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// **************** hashNeedleMap ****************
+// 线性探测的开放寻址哈希表，key和值分别存放在两个数组中，值为0表示空位。
+// 删除时后移填补空位，不留删除标记。每个key约占16/装载率字节。
+type hashNeedleMap struct {
+	keys   []int64
+	values []uint64
+	count  int
+	mask   uint64
+}
+
+// -------- newHashNeedleMap() --------
+func newHashNeedleMap(capacity int) *hashNeedleMap {
+	size := NEEDLEMAP_MIN_CAPACITY
+	for size*3/4 < capacity {
+		size <<= 1
+	}
+	return &hashNeedleMap{
+		keys:   make([]int64, size),
+		values: make([]uint64, size),
+		mask:   uint64(size - 1),
+	}
+}
+
+// -------- find() --------
+// Slot of key, or the empty slot where key would be inserted.
+func (this *hashNeedleMap) find(key int64) (i uint64, ok bool) {
+	i = hashKey(key) & this.mask
+	for this.values[i] != 0 {
+		if this.keys[i] == key {
+			return i, true
+		}
+		i = (i + 1) & this.mask
+	}
+	return i, false
+}
+
+func (this *hashNeedleMap) Get(key int64) (value uint64, ok bool) {
+	var i uint64
+	if i, ok = this.find(key); ok {
+		value = this.values[i]
+	}
+	return
+}
+
+func (this *hashNeedleMap) Set(key int64, value uint64) (old uint64, ok bool) {
+	if (this.count+1)*4 > len(this.values)*3 {
+		this.grow()
+	}
+	var i uint64
+	if i, ok = this.find(key); ok {
+		old = this.values[i]
+	} else {
+		this.keys[i] = key
+		this.count++
+	}
+	this.values[i] = value
+	return
+}
+
+func (this *hashNeedleMap) Delete(key int64) (old uint64, ok bool) {
+	var i uint64
+	if i, ok = this.find(key); !ok {
+		return
+	}
+	old = this.values[i]
+	this.count--
+
+	// 把探测链上后续的项前移到空位，保证查找不会提前遇到空位结束。
+	j := i
+	for {
+		j = (j + 1) & this.mask
+		if this.values[j] == 0 {
+			break
+		}
+		k := hashKey(this.keys[j]) & this.mask
+		if (j > i && (k <= i || k > j)) || (j < i && k <= i && k > j) {
+			this.keys[i] = this.keys[j]
+			this.values[i] = this.values[j]
+			i = j
+		}
+	}
+	this.keys[i] = 0
+	this.values[i] = 0
+	return
+}
+
+func (this *hashNeedleMap) Len() int {
+	return this.count
+}
+
+func (this *hashNeedleMap) Range(fn func(key int64, value uint64) bool) {
+	for i, value := range this.values {
+		if value != 0 && !fn(this.keys[i], value) {
+			return
+		}
+	}
+}
+
+func (this *hashNeedleMap) Freeze() {
+}
+
+func (this *hashNeedleMap) Snapshot() func(fn func(key int64, value uint64) bool) {
+	return sortedSnapshot(0, nil, this.sortedEntries())
+}
+
+// -------- sortedEntries() --------
+func (this *hashNeedleMap) sortedEntries() []needleMapEntry {
+	entries := make([]needleMapEntry, 0, this.count)
+	this.Range(func(key int64, value uint64) bool {
+		entries = append(entries, needleMapEntry{key, value})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
+
+func (this *hashNeedleMap) Close() {
+}
+
+func (this *hashNeedleMap) MemoryUsage() uint64 {
+	return uint64(cap(this.keys))*8 + uint64(cap(this.values))*8
+}
+
+// -------- grow() --------
+func (this *hashNeedleMap) grow() {
+	old_keys, old_values := this.keys, this.values
+	size := len(old_values) * 2
+	this.keys = make([]int64, size)
+	this.values = make([]uint64, size)
+	this.mask = uint64(size - 1)
+	for i, value := range old_values {
+		if value != 0 {
+			j, _ := this.find(old_keys[i])
+			this.keys[j] = old_keys[i]
+			this.values[j] = value
+		}
+	}
+}
+
+type needleMapEntry struct {
+	key   int64
+	value uint64
+}
+
+// **************** sortedNeedleMap ****************
+// 按key排序的数组（每个key 16字节）加一个存放新增key的哈希表。
+// 已在数组中的key原地更新，删除时值置0；Freeze()把哈希表合并进数组并去掉已删除的项。
+// 封存的卷不再新增key，合并后全部在数组中。
+type sortedNeedleMap struct {
+	keys   []int64
+	values []uint64
+	live   int // keys in arrays whose value is not 0.
+	tail   *hashNeedleMap
+}
+
+// -------- newSortedNeedleMap() --------
+// capacity is the number of keys to be added by appendSorted().
+func newSortedNeedleMap(capacity int) *sortedNeedleMap {
+	return &sortedNeedleMap{
+		keys:   make([]int64, 0, capacity),
+		values: make([]uint64, 0, capacity),
+		tail:   newHashNeedleMap(0),
+	}
+}
+
+// -------- appendSorted() --------
+// Add keys in ascending order, e.g. loaded from a checkpoint.
+func (this *sortedNeedleMap) appendSorted(key int64, value uint64) {
+	if n := len(this.keys); n > 0 && this.keys[n-1] >= key {
+		this.Set(key, value)
+		return
+	}
+	if _, ok := this.tail.Get(key); ok {
+		this.Set(key, value)
+		return
+	}
+	this.keys = append(this.keys, key)
+	this.values = append(this.values, value)
+	this.live++
+}
+
+// -------- search() --------
+func (this *sortedNeedleMap) search(key int64) (int, bool) {
+	i := sort.Search(len(this.keys), func(i int) bool {
+		return this.keys[i] >= key
+	})
+	return i, i < len(this.keys) && this.keys[i] == key
+}
+
+func (this *sortedNeedleMap) Get(key int64) (value uint64, ok bool) {
+	if i, found := this.search(key); found {
+		value = this.values[i]
+		return value, value != 0
+	}
+	return this.tail.Get(key)
+}
+
+func (this *sortedNeedleMap) Set(key int64, value uint64) (old uint64, ok bool) {
+	if i, found := this.search(key); found {
+		old = this.values[i]
+		if old == 0 {
+			this.live++
+		}
+		this.values[i] = value
+		return old, old != 0
+	}
+	return this.tail.Set(key, value)
+}
+
+func (this *sortedNeedleMap) Delete(key int64) (old uint64, ok bool) {
+	if i, found := this.search(key); found {
+		old = this.values[i]
+		if old != 0 {
+			this.values[i] = 0
+			this.live--
+		}
+		return old, old != 0
+	}
+	return this.tail.Delete(key)
+}
+
+func (this *sortedNeedleMap) Len() int {
+	return this.live + this.tail.Len()
+}
+
+func (this *sortedNeedleMap) Range(fn func(key int64, value uint64) bool) {
+	for i, value := range this.values {
+		if value != 0 && !fn(this.keys[i], value) {
+			return
+		}
+	}
+	this.tail.Range(fn)
+}
+
+func (this *sortedNeedleMap) Freeze() {
+	if this.tail.Len() == 0 && this.live == len(this.keys) && cap(this.keys) == len(this.keys) {
+		return
+	}
+
+	tail := this.tail.sortedEntries()
+
+	// 合并两个有序序列。
+	n := this.live + len(tail)
+	keys := make([]int64, 0, n)
+	values := make([]uint64, 0, n)
+	j := 0
+	for i, key := range this.keys {
+		for j < len(tail) && tail[j].key < key {
+			keys = append(keys, tail[j].key)
+			values = append(values, tail[j].value)
+			j++
+		}
+		if this.values[i] != 0 {
+			keys = append(keys, key)
+			values = append(values, this.values[i])
+		}
+	}
+	for ; j < len(tail); j++ {
+		keys = append(keys, tail[j].key)
+		values = append(values, tail[j].value)
+	}
+
+	this.keys = keys
+	this.values = values
+	this.live = len(keys)
+	this.tail = newHashNeedleMap(0)
+}
+
+func (this *sortedNeedleMap) Snapshot() func(fn func(key int64, value uint64) bool) {
+	// 数组中的值会被原地更新，需要复制。
+	base := make([]needleMapEntry, 0, this.live)
+	for i, value := range this.values {
+		if value != 0 {
+			base = append(base, needleMapEntry{this.keys[i], value})
+		}
+	}
+	return sortedSnapshot(len(base), func(i int) needleMapEntry { return base[i] }, this.tail.sortedEntries())
+}
+
+func (this *sortedNeedleMap) Close() {
+}
+
+func (this *sortedNeedleMap) MemoryUsage() uint64 {
+	return uint64(cap(this.keys))*8 + uint64(cap(this.values))*8 + this.tail.MemoryUsage()
+}
@@ -0,0 +1,208 @@
+package haystack
+
+import (
+	"fmt"
+	"github.com/uukuguy/kds/utils"
+	"hash/crc32"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// **************** diskNeedleMap ****************
+// 磁盘索引：检查点文件mmap后作为按key排序的只读索引表，内存中只有布隆过滤器
+// （每个key约BLOOM_BITS_PER_KEY位）和检查点之后变化的key。检查点之后删除的
+// 表中key在哈希表中记为needleMapDeleted。每次写检查点后重新打开新的索引表，
+// 哈希表随之清空。
+type diskNeedleMap struct {
+	mmap  []byte // whole checkpoint file.
+	table []byte // count * (key(8) value(8)), sorted by key.
+	count int
+	bloom *bloomFilter
+	tail  *hashNeedleMap
+	live  int
+}
+
+// -------- openCheckpointMap() --------
+// Map the checkpoint file as a disk needle map, return the index file offset
+// covered by it. Stats of the checkpoint are applied on success.
+func (this *Index) openCheckpointMap() (indices *diskNeedleMap, offset uint64, err error) {
+	var file *os.File
+	if file, err = os.Open(this.getCheckpointFileName()); err != nil {
+		return
+	}
+	defer file.Close()
+
+	var header []byte
+	var count uint64
+	if header, offset, count, err = this.readCheckpointHeader(file); err != nil {
+		return
+	}
+	size := CHECKPOINT_HEADER_SIZE + count*INDEX_ENTRY_SIZE
+	var filesize uint64
+	if filesize, err = utils.GetFileSize(file); err != nil {
+		return
+	}
+	if filesize != size {
+		err = fmt.Errorf("Checkpoint file size %d, expect %d.", filesize, size)
+		return
+	}
+
+	var mmap []byte
+	if mmap, err = syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+		utils.LogErrorf(err, "Index.openCheckpointMap() mmap failed. vid:%d", this.vid)
+		return
+	}
+	indices = &diskNeedleMap{
+		mmap:  mmap,
+		table: mmap[CHECKPOINT_HEADER_SIZE:],
+		count: int(count),
+		live:  int(count),
+		bloom: newBloomFilter(int(count)),
+		tail:  newHashNeedleMap(0),
+	}
+
+	// 一遍读完索引表：校验checksum和排序，同时构建布隆过滤器。
+	checksum := crc32.Update(0, crc32Table, indices.table)
+	for i := 0; i < indices.count; i++ {
+		key := indices.entry(i).key
+		if i > 0 && indices.entry(i-1).key >= key {
+			err = fmt.Errorf("Checkpoint entries not sorted at %d.", i)
+			break
+		}
+		indices.bloom.add(key)
+	}
+	if err == nil && checkpointChecksum(checksum, header) != utils.BigEndian.Uint32(header[checkpointChecksumOffset:]) {
+		err = fmt.Errorf("Checkpoint checksum not match.")
+	}
+	if err != nil {
+		indices.Close()
+		indices = nil
+		return
+	}
+
+	this.applyCheckpointHeader(header)
+
+	return
+}
+
+// -------- loadDiskIndices() --------
+// 没有可用的检查点时按索引文件外部排序重建检查点（见rebuildCheckpoint()），
+// 不在内存中重放整个索引文件，再打开检查点。
+func (this *Index) loadDiskIndices() (err error) {
+	this.resetIndices()
+	indices, offset, e := this.openCheckpointMap()
+	if e != nil {
+		if !os.IsNotExist(e) {
+			utils.LogWarnf(e, "Index.loadDiskIndices() vid:%d checkpoint invalid, rebuild it from index file.", this.vid)
+		}
+		this.resetIndices()
+		if err = this.flushFile(); err != nil {
+			return
+		}
+		if _, err = this.rebuildCheckpoint(CHECKPOINT_SORT_RUN_KEYS); err != nil {
+			utils.LogErrorf(err, "Index.loadDiskIndices() vid:%d rebuild checkpoint failed.", this.vid)
+			return
+		}
+		this.resetIndices()
+		if indices, offset, err = this.openCheckpointMap(); err != nil {
+			utils.LogErrorf(err, "Index.loadDiskIndices() vid:%d open checkpoint failed.", this.vid)
+			return
+		}
+	}
+	this.indices = indices
+
+	var replayed int
+	if replayed, err = this.replayEntries(offset); err != nil {
+		return
+	}
+
+	utils.LogInfof("Index.loadDiskIndices() vid:%d done. %d index entries replayed, %d needles, %d bytes in memory.",
+		this.vid, replayed, this.indices.Len(), this.indices.MemoryUsage())
+
+	return
+}
+
+// -------- entry() --------
+func (this *diskNeedleMap) entry(i int) needleMapEntry {
+	buf := this.table[i*INDEX_ENTRY_SIZE : (i+1)*INDEX_ENTRY_SIZE]
+	return needleMapEntry{utils.BigEndian.Int64(buf[0:8]), utils.BigEndian.Uint64(buf[8:16])}
+}
+
+// -------- search() --------
+// Value of key in the table.
+func (this *diskNeedleMap) search(key int64) (value uint64, ok bool) {
+	if !this.bloom.mayContain(key) {
+		return
+	}
+	i := sort.Search(this.count, func(i int) bool {
+		return this.entry(i).key >= key
+	})
+	if i < this.count {
+		if entry := this.entry(i); entry.key == key {
+			return entry.value, true
+		}
+	}
+	return
+}
+
+func (this *diskNeedleMap) Get(key int64) (value uint64, ok bool) {
+	if value, ok = this.tail.Get(key); ok {
+		if value == needleMapDeleted {
+			return 0, false
+		}
+		return
+	}
+	return this.search(key)
+}
+
+func (this *diskNeedleMap) Set(key int64, value uint64) (old uint64, ok bool) {
+	if old, ok = this.Get(key); !ok {
+		this.live++
+	}
+	this.tail.Set(key, value)
+	return
+}
+
+func (this *diskNeedleMap) Delete(key int64) (old uint64, ok bool) {
+	if old, ok = this.Get(key); !ok {
+		return
+	}
+	this.live--
+	if _, in_table := this.search(key); in_table {
+		this.tail.Set(key, needleMapDeleted)
+	} else {
+		this.tail.Delete(key)
+	}
+	return
+}
+
+func (this *diskNeedleMap) Len() int {
+	return this.live
+}
+
+func (this *diskNeedleMap) Range(fn func(key int64, value uint64) bool) {
+	this.Snapshot()(fn)
+}
+
+func (this *diskNeedleMap) Freeze() {
+}
+
+// The table is read-only, only the tail is copied. The returned function
+// has to be called before the map is closed.
+func (this *diskNeedleMap) Snapshot() func(fn func(key int64, value uint64) bool) {
+	return sortedSnapshot(this.count, this.entry, this.tail.sortedEntries())
+}
+
+func (this *diskNeedleMap) MemoryUsage() uint64 {
+	return this.bloom.memoryUsage() + this.tail.MemoryUsage()
+}
+
+func (this *diskNeedleMap) Close() {
+	if this.mmap != nil {
+		syscall.Munmap(this.mmap)
+		this.mmap = nil
+		this.table = nil
+		this.count = 0
+	}
+}
@@ -0,0 +1,71 @@
+package haystack
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// -------- checkNeedleMap() --------
+// Apply random operations to m and a Go map, and compare them.
+func checkNeedleMap(t *testing.T, name string, m NeedleMap) {
+	expected := make(map[int64]uint64)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		key := rnd.Int63n(20000) - 10000
+		switch op := rnd.Intn(10); {
+		case op < 6:
+			value := uint64(rnd.Int63n(1<<40)) + 1
+			old, ok := m.Set(key, value)
+			if want, exist := expected[key]; ok != exist || old != want {
+				t.Fatalf("%s Set(%d) = %d,%v want %d,%v", name, key, old, ok, want, exist)
+			}
+			expected[key] = value
+		case op < 9:
+			old, ok := m.Delete(key)
+			if want, exist := expected[key]; ok != exist || old != want {
+				t.Fatalf("%s Delete(%d) = %d,%v want %d,%v", name, key, old, ok, want, exist)
+			}
+			delete(expected, key)
+		default:
+			m.Freeze()
+		}
+	}
+
+	if m.Len() != len(expected) {
+		t.Errorf("%s Len()=%d, want %d", name, m.Len(), len(expected))
+	}
+	for key, want := range expected {
+		if value, ok := m.Get(key); !ok || value != want {
+			t.Errorf("%s Get(%d) = %d,%v want %d", name, key, value, ok, want)
+		}
+	}
+	n := 0
+	m.Range(func(key int64, value uint64) bool {
+		if expected[key] != value {
+			t.Errorf("%s Range() key %d value %d, want %d", name, key, value, expected[key])
+		}
+		n++
+		return true
+	})
+	if n != len(expected) {
+		t.Errorf("%s Range() visited %d keys, want %d", name, n, len(expected))
+	}
+}
+
+func TestNeedleMap(t *testing.T) {
+	checkNeedleMap(t, "hashNeedleMap", newHashNeedleMap(0))
+	checkNeedleMap(t, "sortedNeedleMap", newSortedNeedleMap(0))
+
+	// A frozen map keeps 16 bytes per key.
+	m := newSortedNeedleMap(0)
+	for key := int64(0); key < 100000; key++ {
+		m.Set(key*7, uint64(key)+1)
+	}
+	m.Freeze()
+	if usage := m.MemoryUsage() - m.tail.MemoryUsage(); usage != 16*100000 {
+		t.Errorf("frozen map uses %d bytes, want %d", usage, 16*100000)
+	}
+	if value, ok := m.Get(7 * 500); !ok || value != 501 {
+		t.Errorf("Get() after Freeze() = %d,%v", value, ok)
+	}
+}
@@ -0,0 +1,151 @@
+package haystack
+
+import (
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"hash/crc32"
+	"sort"
+)
+
+// needle格式v2在头部之后、数据之前有一段元数据，由若干TLV项和crc32组成：
+//
+//	type(1) length(2) value(length) ... checksum(4)
+//
+// 读取时跳过不认识的type，以后可以增加新的元数据项而不改变needle格式。
+const (
+	NEEDLE_META_MTIME = 1 // int64 unix time in seconds.
+	NEEDLE_META_NAME  = 2 // Upload filename.
+	NEEDLE_META_MIME  = 3 // Content-Type.
+	NEEDLE_META_USER  = 4 // key_length(1) key value.
+	NEEDLE_META_TTL   = 5 // uint32 seconds after mtime.
+
+	NEEDLE_META_ITEM_HEADER_SIZE = 3
+	NEEDLE_META_MAXSIZE          = 64 * 1024
+	NEEDLE_META_USER_KEY_MAXSIZE = 255
+)
+
+// -------- encodeMeta() --------
+// Tombstones carry no metadata.
+func (needle *Needle) encodeMeta() (buf []byte, err error) {
+	if needle.IsDeleted() {
+		return
+	}
+
+	buf = make([]byte, 0, 64)
+	item := func(t byte, values ...[]byte) {
+		var n int
+		for _, value := range values {
+			n += len(value)
+		}
+		if n > 0xffff {
+			err = errors.ErrNeedleMetaTooLarge
+			return
+		}
+		buf = append(buf, t, byte(n>>8), byte(n))
+		for _, value := range values {
+			buf = append(buf, value...)
+		}
+	}
+
+	mtime := make([]byte, 8)
+	utils.BigEndian.PutInt64(mtime, needle.MTime)
+	item(NEEDLE_META_MTIME, mtime)
+	if needle.Name != "" {
+		item(NEEDLE_META_NAME, []byte(needle.Name))
+	}
+	if needle.Mime != "" {
+		item(NEEDLE_META_MIME, []byte(needle.Mime))
+	}
+	if needle.TTL != 0 {
+		ttl := make([]byte, 4)
+		utils.BigEndian.PutUint32(ttl, needle.TTL)
+		item(NEEDLE_META_TTL, ttl)
+	}
+	// 按key排序，相同的元数据编码结果相同。
+	keys := make([]string, 0, len(needle.Meta))
+	for key := range needle.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(key) == 0 || len(key) > NEEDLE_META_USER_KEY_MAXSIZE {
+			err = errors.ErrNeedleMetaTooLarge
+			break
+		}
+		item(NEEDLE_META_USER, []byte{byte(len(key))}, []byte(key), []byte(needle.Meta[key]))
+	}
+	if err != nil {
+		buf = nil
+		return
+	}
+
+	checksum := make([]byte, 4)
+	utils.BigEndian.PutUint32(checksum, crc32.Checksum(buf, crc32Table))
+	buf = append(buf, checksum...)
+	if len(buf) > NEEDLE_META_MAXSIZE {
+		buf = nil
+		err = errors.ErrNeedleMetaTooLarge
+	}
+	return
+}
+
+// -------- decodeMeta() --------
+func (needle *Needle) decodeMeta(buf []byte) (err error) {
+	needle.Name = ""
+	needle.Mime = ""
+	needle.Meta = nil
+	needle.TTL = 0
+	if len(buf) == 0 {
+		return
+	}
+	if len(buf) < 4 {
+		err = errors.ErrNeedleCorrupted
+		utils.LogErrorf(err, "Needle metadata too short. key:%d", needle.Key)
+		return
+	}
+	items := buf[:len(buf)-4]
+	if crc32.Checksum(items, crc32Table) != utils.BigEndian.Uint32(buf[len(items):]) {
+		err = errors.ErrNeedleCorrupted
+		utils.LogErrorf(err, "Needle metadata checksum not match. key:%d", needle.Key)
+		return
+	}
+
+	for len(items) > 0 {
+		if len(items) < NEEDLE_META_ITEM_HEADER_SIZE {
+			return errors.ErrNeedleCorrupted
+		}
+		t := items[0]
+		n := int(items[1])<<8 | int(items[2])
+		items = items[NEEDLE_META_ITEM_HEADER_SIZE:]
+		if len(items) < n {
+			return errors.ErrNeedleCorrupted
+		}
+		value := items[:n]
+		items = items[n:]
+
+		switch t {
+		case NEEDLE_META_MTIME:
+			if n == 8 {
+				needle.MTime = utils.BigEndian.Int64(value)
+			}
+		case NEEDLE_META_NAME:
+			needle.Name = string(value)
+		case NEEDLE_META_MIME:
+			needle.Mime = string(value)
+		case NEEDLE_META_TTL:
+			if n == 4 {
+				needle.TTL = utils.BigEndian.Uint32(value)
+			}
+		case NEEDLE_META_USER:
+			if n == 0 || int(value[0]) >= n {
+				return errors.ErrNeedleCorrupted
+			}
+			if needle.Meta == nil {
+				needle.Meta = make(map[string]string)
+			}
+			key_len := int(value[0])
+			needle.Meta[string(value[1:1+key_len])] = string(value[1+key_len:])
+		}
+	}
+	return
+}
@@ -0,0 +1,290 @@
+package haystack
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// **************** NeedleReader ****************
+// NeedleReader streams needle data as a section of the data file, so the
+// data is not loaded into memory. The data passes through Read to be
+// verified; OpenFileSection() gives the data for sending by sendfile instead.
+//
+// A read that goes through the whole data from offset 0 sequentially is
+// verified against the stored checksum: the last chunk is held back and
+// errors.ErrNeedleCorrupted returned when it does not match. Reads that start
+// elsewhere (e.g. byte ranges) are not verified.
+type NeedleReader struct {
+	Needle *Needle // Header and footer only, Needle.Data is nil unless read from memory.
+
+	section  *io.SectionReader
+	data     *Data
+	offset   int64 // offset of the data in the data file, -1 if read from memory.
+	checksum uint32
+	verified int64 // bytes read sequentially from offset 0.
+	verify   bool
+}
+
+// -------- newNeedleReader() --------
+// data has been acquired by caller.
+func newNeedleReader(data *Data, region NeedleRegion, needle *Needle) *NeedleReader {
+	offset := int64(region.GetOffset()) + int64(needle.DataOffset())
+	return &NeedleReader{
+		Needle:  needle,
+		section: io.NewSectionReader(data.reader, offset, int64(needle.Size)),
+		data:    data,
+		offset:  offset,
+		verify:  true,
+	}
+}
+
+// -------- newMemoryNeedleReader() --------
+// Reader of needle data already in memory, e.g. decrypted.
+func newMemoryNeedleReader(needle *Needle) *NeedleReader {
+	return &NeedleReader{
+		Needle:  needle,
+		section: io.NewSectionReader(bytes.NewReader(needle.Data), 0, int64(len(needle.Data))),
+		offset:  -1,
+		verify:  true,
+	}
+}
+
+// ======== Read() ========
+func (this *NeedleReader) Read(p []byte) (n int, err error) {
+	var pos int64
+	if pos, err = this.section.Seek(0, io.SeekCurrent); err != nil {
+		return
+	}
+	if pos != this.verified {
+		this.verify = false
+	}
+
+	if n, err = this.section.Read(p); n > 0 && this.verify {
+		this.checksum = crc32.Update(this.checksum, crc32Table, p[:n])
+		this.verified += int64(n)
+		if this.verified == this.Size() && this.checksum != this.Needle.Checksum {
+			err = errors.ErrNeedleCorrupted
+			n = 0
+		}
+	}
+	return
+}
+
+// ======== Seek() ========
+func (this *NeedleReader) Seek(offset int64, whence int) (abs int64, err error) {
+	if abs, err = this.section.Seek(offset, whence); err == nil && abs == 0 {
+		this.checksum = 0
+		this.verified = 0
+		this.verify = true
+	}
+	return
+}
+
+// ======== ReadAt() ========
+// ReadAt is not verified.
+func (this *NeedleReader) ReadAt(p []byte, off int64) (n int, err error) {
+	return this.section.ReadAt(p, off)
+}
+
+// ======== Verify() ========
+// Read the whole needle data and check the checksum, then rewind.
+func (this *NeedleReader) Verify() (err error) {
+	if _, err = this.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	buf := getReadBuffer(cacheBufferSize)
+	defer putReadBuffer(buf)
+	for err == nil {
+		_, err = this.Read(buf)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if this.verified != this.Size() {
+		err = errors.ErrNeedleCorrupted
+	}
+	if err == nil {
+		_, err = this.Seek(0, io.SeekStart)
+	}
+	return
+}
+
+// ======== Load() ========
+// Read the whole needle data into memory and check the checksum. Later reads
+// are served from memory, so a small needle verified before sending is read
+// from the data file only once.
+func (this *NeedleReader) Load() (err error) {
+	if _, err = this.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	buf := make([]byte, this.Size())
+	if _, err = io.ReadFull(this, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.ErrNeedleCorrupted
+	}
+	if err != nil {
+		return
+	}
+	if this.verified != this.Size() {
+		return errors.ErrNeedleCorrupted
+	}
+	this.section = io.NewSectionReader(bytes.NewReader(buf), 0, int64(len(buf)))
+	this.offset = -1
+	_, err = this.Seek(0, io.SeekStart)
+	return
+}
+
+// ======== OpenFileSection() ========
+// Open the needle data as a section of the data file with a file handle of
+// its own. nil if the data is not read from a data file, e.g. decrypted,
+// loaded or erasure coded. Reads of the section are not verified.
+func (this *NeedleReader) OpenFileSection() (section *FileSection, err error) {
+	if this.data == nil || this.offset < 0 {
+		return
+	}
+	file, ok := this.data.reader.(*os.File)
+	if !ok {
+		return
+	}
+	var own *os.File
+	if own, err = os.OpenFile(file.Name(), os.O_RDONLY|O_NOATIME, 0); err != nil {
+		return
+	}
+	// 数据文件可能已被压缩或分层迁移替换，只使用同一个文件。
+	own_stat, err1 := own.Stat()
+	stat, err2 := file.Stat()
+	if err1 != nil || err2 != nil || !os.SameFile(own_stat, stat) {
+		own.Close()
+		return
+	}
+	section = &FileSection{file: own, offset: this.offset, size: this.Size()}
+	if _, err = section.Seek(0, io.SeekStart); err != nil {
+		section.Close()
+		return nil, err
+	}
+	return
+}
+
+// ======== Size() ========
+func (this *NeedleReader) Size() int64 {
+	return this.section.Size()
+}
+
+// ======== ETag() ========
+// Strong entity tag from needle checksum.
+func (this *NeedleReader) ETag() string {
+	return fmt.Sprintf("\"%08x\"", this.Needle.Checksum)
+}
+
+// ======== ModTime() ========
+// Zero time if needle mtime is unknown.
+func (this *NeedleReader) ModTime() time.Time {
+	if this.Needle.MTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(this.Needle.MTime, 0)
+}
+
+// ======== Close() ========
+func (this *NeedleReader) Close() error {
+	if this.data != nil {
+		this.data.release()
+		this.data = nil
+	}
+	return nil
+}
+
+// **************** FileSection ****************
+// FileSection reads a section of a file through a file handle of its own,
+// positioned at the section offset. It implements syscall.Conn, so when
+// net/http copies it to a TCP connection with a limit, as http.ServeContent
+// does, the kernel sends the data with sendfile from the current position.
+type FileSection struct {
+	file   *os.File
+	offset int64
+	size   int64
+}
+
+// ======== Read() ========
+func (this *FileSection) Read(p []byte) (n int, err error) {
+	var pos int64
+	if pos, err = this.Seek(0, io.SeekCurrent); err != nil {
+		return
+	}
+	if pos >= this.size {
+		return 0, io.EOF
+	}
+	if remain := this.size - pos; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+	return this.file.Read(p)
+}
+
+// ======== Seek() ========
+func (this *FileSection) Seek(offset int64, whence int) (abs int64, err error) {
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		if abs, err = this.file.Seek(0, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		abs += offset - this.offset
+	case io.SeekEnd:
+		abs = this.size + offset
+	default:
+		return 0, fmt.Errorf("FileSection.Seek() invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("FileSection.Seek() negative position %d", abs)
+	}
+	if _, err = this.file.Seek(this.offset+abs, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return
+}
+
+// ======== WriteTo() ========
+// Copy the rest of the section, never beyond it, also when w sends the
+// file with sendfile.
+func (this *FileSection) WriteTo(w io.Writer) (n int64, err error) {
+	var pos int64
+	if pos, err = this.Seek(0, io.SeekCurrent); err != nil || pos >= this.size {
+		return
+	}
+	return io.Copy(w, &io.LimitedReader{R: fileSectionConn{this}, N: this.size - pos})
+}
+
+// ======== SyscallConn() ========
+func (this *FileSection) SyscallConn() (syscall.RawConn, error) {
+	return this.file.SyscallConn()
+}
+
+// ======== Size() ========
+func (this *FileSection) Size() int64 {
+	return this.size
+}
+
+// ======== Close() ========
+func (this *FileSection) Close() error {
+	return this.file.Close()
+}
+
+// **************** fileSectionConn ****************
+// FileSection without WriteTo, so io.Copy does not recurse into it.
+type fileSectionConn struct {
+	section *FileSection
+}
+
+func (this fileSectionConn) Read(p []byte) (int, error) {
+	return this.section.Read(p)
+}
+
+func (this fileSectionConn) SyscallConn() (syscall.RawConn, error) {
+	return this.section.SyscallConn()
+}
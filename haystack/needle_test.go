@@ -0,0 +1,150 @@
+package haystack
+
+import (
+	"bytes"
+	"github.com/uukuguy/kds/store/errors"
+	"hash/crc32"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// ======== TestNeedleReadFrom() ========
+func TestNeedleReadFrom(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	checksum := crc32.Checksum(data, crc32Table)
+
+	// 每次Read只返回部分数据时仍需读满needle.Size。
+	needle := NewNeedle(1, 11, uint32(len(data)))
+	n, err := needle.ReadFrom(iotest.HalfReader(bytes.NewReader(data)))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Needle.ReadFrom() n=%d err=%v", n, err)
+	}
+	if !bytes.Equal(needle.Data, data) || needle.Checksum != checksum {
+		t.Errorf("Needle.ReadFrom() data or checksum mismatch.")
+	}
+
+	needle = NewNeedle(1, 11, uint32(len(data))+1)
+	if _, err = needle.ReadFrom(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Needle.ReadFrom() short body err=%v, want io.ErrUnexpectedEOF", err)
+	}
+
+	if needle, err = NewNeedleFromReader(2, 22, iotest.OneByteReader(bytes.NewReader(data[:1000])), 1000); err != nil {
+		t.Fatalf("NewNeedleFromReader() failed. %v", err)
+	}
+	if needle.Size != 1000 || needle.Checksum != crc32.Checksum(data[:1000], crc32Table) {
+		t.Errorf("NewNeedleFromReader() size=%d checksum=%08x", needle.Size, needle.Checksum)
+	}
+	if _, err = NewNeedleFromReader(2, 22, bytes.NewReader(data), 1000); err != errors.ErrNeedleTooLarge {
+		t.Errorf("NewNeedleFromReader() err=%v, want ErrNeedleTooLarge", err)
+	}
+}
+
+// ======== TestNeedleMeta() ========
+func TestNeedleMeta(t *testing.T) {
+	data := []byte("needle with metadata")
+	build := func(version byte) *Needle {
+		needle := NewNeedle(1, 11, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		needle.MTime = 1500000000
+		needle.Name = "photo.jpg"
+		needle.Mime = "image/jpeg"
+		needle.Meta = map[string]string{"camera": "x100", "album": ""}
+		if err := needle.SetVersion(version); err != nil {
+			t.Fatalf("Needle.SetVersion(%d) failed. %v", version, err)
+		}
+		needle.FillBuffer()
+		defer needle.Close()
+
+		built := new(Needle)
+		if err := built.BuildFrom(version, needle.Buffer()); err != nil {
+			t.Fatalf("Needle.BuildFrom(%d) failed. %v", version, err)
+		}
+		if !bytes.Equal(built.Data, data) || built.WriteSize != needle.WriteSize {
+			t.Errorf("v%d data %q write size %d, want %q %d", version, built.Data, built.WriteSize, data, needle.WriteSize)
+		}
+		return built
+	}
+
+	built := build(version2)
+	if built.MTime != 1500000000 || built.Name != "photo.jpg" || built.Mime != "image/jpeg" ||
+		len(built.Meta) != 2 || built.Meta["camera"] != "x100" {
+		t.Errorf("v2 metadata mtime=%d name=%s mime=%s meta=%v", built.MTime, built.Name, built.Mime, built.Meta)
+	}
+
+	// v1 does not store metadata.
+	built = build(version1)
+	if built.MTime != 0 || built.Name != "" || built.Meta != nil {
+		t.Errorf("v1 metadata mtime=%d name=%s meta=%v, want none", built.MTime, built.Name, built.Meta)
+	}
+
+	// Corrupted metadata is detected by its checksum.
+	needle := NewNeedle(2, 22, 0)
+	needle.Name = "a.txt"
+	needle.SetVersion(version2)
+	needle.FillBuffer()
+	buf := needle.Buffer()
+	buf[NEEDLE_V2_HEADER_SIZE+NEEDLE_META_ITEM_HEADER_SIZE]++
+	if err := new(Needle).BuildFrom(version2, buf); err != errors.ErrNeedleCorrupted {
+		t.Errorf("BuildFrom() corrupted metadata err=%v, want ErrNeedleCorrupted", err)
+	}
+
+	needle.Meta = map[string]string{"big": string(make([]byte, NEEDLE_META_MAXSIZE))}
+	if err := needle.SetVersion(version2); err != errors.ErrNeedleMetaTooLarge {
+		t.Errorf("SetVersion() err=%v, want ErrNeedleMetaTooLarge", err)
+	}
+}
+
+// ======== TestParseTTL() ========
+func TestParseTTL(t *testing.T) {
+	for s, want := range map[string]uint32{"": 0, "3600": 3600, "30s": 30, "90m": 5400, "12h": 43200, "7d": 604800, "2w": 1209600} {
+		if ttl, err := ParseTTL(s); err != nil || ttl != want {
+			t.Errorf("ParseTTL(%q)=%d err=%v, want %d", s, ttl, err, want)
+		}
+	}
+	for _, s := range []string{"d", "-1h", "1.5h", "10y", "100000w"} {
+		if _, err := ParseTTL(s); err == nil {
+			t.Errorf("ParseTTL(%q) succeeded.", s)
+		}
+	}
+}
+
+func TestNeedleCompress(t *testing.T) {
+	text := bytes.Repeat([]byte("{\"name\": \"kds\", \"value\": 12345}\n"), 64)
+	needle := NewNeedle(1, 1, uint32(len(text)))
+	needle.ReadFrom(bytes.NewReader(text))
+	if compressed, err := needle.Compress(CODEC_GZIP); err != nil || !compressed {
+		t.Fatalf("Needle.Compress() compressed=%v err=%v", compressed, err)
+	}
+	if needle.Codec() != CODEC_GZIP || needle.IsDeleted() || int(needle.Size) != len(needle.Data) || needle.Size >= uint32(len(text)) {
+		t.Errorf("codec %d, size %d, data %d bytes after compression.", needle.Codec(), needle.Size, len(needle.Data))
+	}
+	if data, err := needle.Decompressed(); err != nil || !bytes.Equal(data, text) {
+		t.Errorf("Needle.Decompressed() err=%v, data not match.", err)
+	}
+
+	// Small or incompressible data is kept as is.
+	for _, data := range [][]byte{[]byte("hello"), bytes.Repeat([]byte{0xff, 0x13, 0x7a, 0x01}, 16)} {
+		needle := NewNeedle(2, 1, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		if compressed, _ := needle.Compress(CODEC_GZIP); compressed || needle.Codec() != CODEC_NONE {
+			t.Errorf("%d bytes compressed.", len(data))
+		}
+	}
+
+	for codec, name := range map[byte]string{CODEC_NONE: "", CODEC_GZIP: "gzip"} {
+		if c, err := ParseCodec(name); err != nil || c != codec {
+			t.Errorf("ParseCodec(%q)=%d err=%v", name, c, err)
+		}
+	}
+	if _, err := ParseCodec("lz4"); err == nil {
+		t.Errorf("ParseCodec(\"lz4\") succeeded.")
+	}
+
+	types := []string{"text/", "application/json"}
+	for content_type, want := range map[string]bool{"text/plain": true, "Text/HTML; charset=utf-8": true, "application/json": true, "application/jsonp": false, "image/png": false, "": false} {
+		if matchContentType(content_type, types) != want {
+			t.Errorf("matchContentType(%q) != %v", content_type, want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package haystack
+
+import (
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"os"
+)
+
+const (
+	REINDEX_BACKUP_EXT = ".idx.old"
+)
+
+// -------- recoverIndex() --------
+// 进程在Data.AppendNeedle()和Index.AppendIndexEntry()之间退出时，索引文件会缺少
+// 数据文件末尾的needle，数据文件末尾也可能留有写了一半的needle。
+// 以索引最后一项对应的数据偏移与数据文件大小对照：
+//   索引指向数据文件之外的项被丢弃；
+//   从最后索引位置开始扫描数据文件，补齐缺失的索引项；
+//   只有末尾写了一半的needle被截断；数据损坏的needle被跳过，
+//   头部损坏时停止扫描但不截断，避免丢弃其后的needle。
+func (this *Volume) recoverIndex() (err error) {
+	data := this.data
+	index := this.index
+
+	// 索引文件末尾不完整的索引项。
+	if tail := (index.FileSize - index.superblock.Size()) % INDEX_ENTRY_SIZE; tail != 0 {
+		utils.LogWarnf(nil, "Volume %d index file has %d torn bytes, truncate.", this.Id, tail)
+		if err = index.truncate(index.FileSize - tail); err != nil {
+			return
+		}
+	}
+
+	// 指向数据文件之外的索引项。
+	if index.data_end > data.FileSize {
+		valid_size := index.superblock.Size()
+		err = index.walkEntries(valid_size, func(key int64, region NeedleRegion) error {
+			end := region.GetOffset() + uint64(region.Size)
+			if region.IsTombstone() {
+				end += needleWriteSize(data.superblock.needleVersion(), 0, 0)
+			}
+			if end > data.FileSize {
+				return errStopWalk
+			}
+			valid_size += INDEX_ENTRY_SIZE
+			return nil
+		})
+		if err != nil && err != errStopWalk {
+			return
+		}
+		utils.LogWarnf(nil, "Volume %d index refers beyond data file size %d, truncate index to %d.",
+			this.Id, data.FileSize, valid_size)
+		if err = index.truncate(valid_size); err != nil {
+			return
+		}
+	}
+
+	if index.data_end == data.FileSize {
+		return
+	}
+
+	// 扫描未索引的needle。
+	recovered := 0
+	var end uint64
+	var torn bool
+	end, torn, err = data.scanNeedles(index.data_end, func(needle *Needle, region NeedleRegion) error {
+		if needle.IsDeleted() {
+			region.Size = 0
+		}
+		recovered++
+		return index.appendEntry(IndexEntry{needle.Key, region})
+	})
+	if err != nil {
+		utils.LogErrorf(err, "Volume %d scan needles from %d failed.", this.Id, index.data_end)
+		return
+	}
+	if err = index.flushFile(); err != nil {
+		return
+	}
+	if recovered > 0 {
+		utils.LogInfof("Volume %d recovered %d index entries from data file.", this.Id, recovered)
+	}
+
+	if torn {
+		utils.LogWarnf(nil, "Volume %d data file has %d torn bytes at %d, truncate.", this.Id, data.FileSize-end, end)
+		if err = data.truncate(end); err != nil {
+			return
+		}
+	} else if end < data.FileSize {
+		utils.LogErrorf(errors.ErrNeedleCorrupted, "Volume %d data file is corrupted at %d, %d bytes after it are not indexed.",
+			this.Id, end, data.FileSize-end)
+	}
+
+	return
+}
+
+// ======== Reindex() ========
+// 根据数据文件完整重建索引文件。卷不能处于打开状态，重建完成后卷已打开。
+func (this *Volume) Reindex() (err error) {
+	indexFileName := this.index.getIndexFileName()
+	backupFileName := this.Dir + "/" + fmt.Sprintf("%d", this.Id) + REINDEX_BACKUP_EXT
+
+	this.index.removeCheckpoint()
+	if utils.FileExist(indexFileName) {
+		if err = os.Rename(indexFileName, backupFileName); err != nil {
+			utils.LogErrorf(err, "Volume %d backup index file failed.", this.Id)
+			return
+		}
+	}
+
+	if err = this.Init(); err != nil {
+		utils.LogErrorf(err, "Volume %d reindex failed, restore index file.", this.Id)
+		this.Close()
+		os.Remove(indexFileName)
+		if utils.FileExist(backupFileName) {
+			os.Rename(backupFileName, indexFileName)
+		}
+		return
+	}
+
+	os.Remove(backupFileName)
+	utils.LogInfof("Volume %d reindex done. %d needles.", this.Id, this.index.indices.Len())
+
+	return
+}
@@ -1,24 +1,78 @@
 package haystack
 
 import (
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
 	"github.com/uukuguy/kds/utils"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 一次写入最多连续换卷的次数。
+	STORE_MAX_ROLLOVER = 8
+
+	// 检查并删除过期卷的间隔。
+	STORE_EXPIRE_INTERVAL = time.Minute
+
+	// 按读取频率在冷热存储间迁移卷的间隔。
+	STORE_TIER_INTERVAL = 10 * time.Minute
+
+	// 串行化同一key写入和删除的锁个数。
+	STORE_KEY_LOCKS = 64
+
+	// 采样GC统计的间隔，Index.String()打印最近一次采样。
+	STORE_GC_STATS_INTERVAL = time.Minute
 )
 
 // **************** Store ****************
 type Store struct {
 	Volumes map[int32]*Volume
-	Dir     string
+	Dir     string // Dir of the first disk.
+	Disks   []*Disk
+	Config  *Config
+	lock    sync.RWMutex // 保护Volumes和faulty。
+	faulty  map[int32]*FaultyVolume
+	done    chan struct{}
+
+	// Largest vid ever created, kept on every disk. Volumes not loaded with id
+	// up to it may be on a failed disk that can not be listed (unlisted).
+	vid_mark int32
+	unlisted bool
+
+	tierLock sync.Mutex // 保护tiers。
+	tiers    map[int32]*tierState
+
+	dedup *dedupTable // nil unless Config.Dedup.
+
+	keys [STORE_KEY_LOCKS]sync.Mutex // 按key串行化对象的覆盖写入和删除，见Store.replaceNeedle()。
 }
 
 // ======== NewStore() ========
-func NewStore(store_dir string) (store *Store) {
+// config为nil时使用默认配置。
+func NewStore(store_dir string, config *Config) (store *Store) {
+	return NewDiskStore([]*Disk{NewDisk(store_dir, 0)}, config)
+}
+
+// ======== NewDiskStore() ========
+// Store with volumes on several disks. config为nil时使用默认配置。
+func NewDiskStore(disks []*Disk, config *Config) (store *Store) {
+	if config == nil {
+		config = NewConfig()
+	}
 	store = &Store{
 		Volumes: make(map[int32]*Volume),
-		Dir:     store_dir,
+		faulty:  make(map[int32]*FaultyVolume),
+		Disks:   disks,
+		Config:  config,
+		tiers:   make(map[int32]*tierState),
+	}
+	if len(disks) > 0 {
+		store.Dir = disks[0].Dir
 	}
 
 	return
@@ -26,69 +80,334 @@ func NewStore(store_dir string) (store *Store) {
 
 // ======== Init() ========
 func (this *Store) Init() (err error) {
-	utils.LogInfof("Init kds store in %s", this.Dir)
+	if err = this.Config.Validate(); err != nil {
+		utils.LogErrorf(err, "Invalid store config.")
+		return
+	}
+	if len(this.Disks) == 0 {
+		return fmt.Errorf("No disk for kds store.")
+	}
+	if this.Config.ColdDir != "" {
+		if err = os.MkdirAll(this.Config.ColdDir, os.ModeDir|0755); err != nil {
+			utils.LogErrorf(err, "os.MkdirAll() failed. dir=%s", this.Config.ColdDir)
+			return
+		}
+	}
+
+	sampleGCStats()
 
-	if err = os.MkdirAll(this.Dir, os.ModeDir|0755); err != nil {
-		utils.LogErrorf(err, "os.MkdirAll() failed. dir=%s err=%v", this.Dir, err)
+	// 磁盘故障时只有该磁盘上的卷下线，全部磁盘故障时Store才无法初始化。
+	healthy := 0
+	for _, disk := range this.Disks {
+		utils.LogInfof("Init kds store in %s", disk.Dir)
+		if vid := disk.readVidMark(); vid > this.vid_mark {
+			this.vid_mark = vid
+		}
+		if err = disk.init(); err != nil {
+			continue
+		}
+		if err = this.loadVolumes(disk); err != nil {
+			disk.fail(err)
+			continue
+		}
+		healthy++
+	}
+	if healthy == 0 {
+		utils.LogErrorf(err, "All %d disks of kds store failed.", len(this.Disks))
+		this.Close()
 		return
 	}
+	err = nil
+	// 故障磁盘上的卷不能在其它磁盘上以同一id新建。
+	for _, disk := range this.Disks {
+		if disk.Err() != nil {
+			this.offlineVolumes(disk)
+		}
+	}
+	if vid := this.maxVid(); vid > this.vid_mark {
+		this.updateVidMark(vid)
+	}
+	utils.LogInfof("%d volumes loaded on %d of %d disks.", len(this.Volumes), healthy, len(this.Disks))
 
-	this.loadVolumes()
+	// 去重表在第一个磁盘上，该磁盘故障时关闭去重，其它磁盘照常服务。
+	// 已有的引用needle照常读取，删除或覆盖时保留其数据needle。
+	if this.Config.Dedup {
+		if err = this.Disks[0].Err(); err == nil {
+			this.dedup, err = openDedupTable(this.Dir)
+		}
+		if err != nil {
+			utils.LogWarnf(err, "Open dedup table in %s failed, dedup disabled.", this.Dir)
+			this.dedup, err = nil, nil
+		} else {
+			utils.LogInfof("Dedup table loaded, %d contents.", len(this.dedup.entries))
+		}
+	}
+
+	this.done = make(chan struct{})
+	go this.expireLoop(this.done)
+	go this.gcStatsLoop(this.done)
+	if this.Config.ColdDir != "" {
+		go this.tierLoop(this.done)
+	}
 
 	return
 }
 
 // ======== Close() ========
 func (this *Store) Close() {
+	// 去重表锁内不取Store的锁，关闭去重表后写入去重表返回错误。
+	if this.dedup != nil {
+		this.dedup.close()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.done != nil {
+		close(this.done)
+		this.done = nil
+	}
+
 	for _, volume := range this.Volumes {
 		if volume != nil {
 			volume.Close()
 		}
 	}
 	this.Volumes = make(map[int32]*Volume)
+	this.faulty = make(map[int32]*FaultyVolume)
 }
 
-// -------- loadVolumes() --------
-func (this *Store) loadVolumes() (err error) {
-	fileInfos, err := ioutil.ReadDir(this.Dir)
-	for i, fi := range fileInfos {
-		basename := fi.Name()
-		if ext := filepath.Ext(basename); ext == ".dat" {
-			var vid int64
-			var volume *Volume
-			if vid, err = strconv.ParseInt(basename[:len(basename)-4], 10, 64); err == nil {
-				utils.LogDebugf("i=%d Loading volume %d from %s", i, vid, basename)
-				volume = NewVolume(int32(vid), this.Dir)
-				if err = volume.Init(); err != nil {
-					// 初始化失败一个卷，整个Store就无法初始化。
-					utils.LogErrorf(err, "volume %d in %s Init() failed. %v", vid, this.Dir, err)
-					return err
-				}
-			}
-			this.Volumes[int32(vid)] = volume
-			utils.LogDebugf("Loaded volume info. %s", volume.String())
+// -------- gcStatsLoop() --------
+func (this *Store) gcStatsLoop(done chan struct{}) {
+	ticker := time.NewTicker(STORE_GC_STATS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sampleGCStats()
 		}
+	}
+}
 
+// -------- loadVolumes() --------
+// Load volumes on disk. A volume failed to init is offline, other volumes
+// are still loaded. Fail only if the disk can not be read.
+func (this *Store) loadVolumes(disk *Disk) (err error) {
+	var vids []int32
+	if vids, err = listVolumes(disk.Dir); err != nil {
+		utils.LogErrorf(err, "Read disk %s failed.", disk.Dir)
+		return
 	}
+	loaded := 0
+	for _, vid := range vids {
+		if dir, ok := this.volumeDir(vid); ok {
+			utils.LogWarnf(nil, "Volume %d in %s is also in %s, ignored.", vid, disk.Dir, dir)
+			continue
+		}
+		utils.LogDebugf("Loading volume %d from %s", vid, disk.Dir)
+		volume := NewVolume(vid, disk.Dir, this.Config)
+		if err := volume.Init(); err != nil {
+			// 初始化失败的卷标记为故障，不影响其它卷。
+			volume.Close()
+			this.setFaulty(vid, disk.Dir, err)
+			continue
+		}
+		this.Volumes[vid] = volume
+		loaded++
+		utils.LogDebugf("Loaded volume info. %s", volume.String())
+	}
+
+	utils.LogInfof("%d volumes loaded from %s.", loaded, disk.Dir)
+
+	return
+}
 
-	utils.LogInfof("%d volumes loaded.", len(this.Volumes))
+// -------- offlineVolumes() --------
+// Mark volumes on the failed disk faulty, so that they are not created
+// again on other disks. If the disk can not even be listed, volumes not
+// proved new by the vid mark can not be created, see createVolume().
+func (this *Store) offlineVolumes(disk *Disk) {
+	vids, err := listVolumes(disk.Dir)
+	if err != nil {
+		utils.LogErrorf(err, "Volumes on disk %s are unknown, only volumes after the vid mark can be created.", disk.Dir)
+		this.unlisted = true
+		return
+	}
+	for _, vid := range vids {
+		if _, ok := this.volumeDir(vid); !ok {
+			this.setFaulty(vid, disk.Dir, disk.Err())
+		}
+	}
+}
 
+// -------- listVolumes() --------
+// Ids of volumes in dir.
+func listVolumes(dir string) (vids []int32, err error) {
+	var fileInfos []os.FileInfo
+	if fileInfos, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	for _, fi := range fileInfos {
+		basename := fi.Name()
+		ext := filepath.Ext(basename)
+		if ext == ECMETA_EXT && utils.FileExist(dir+"/"+basename[:len(basename)-len(ext)]+DATAFILE_EXT) {
+			// 纠删码中断或解码后的残留，卷使用数据文件。
+			continue
+		}
+		if ext != DATAFILE_EXT && ext != ECMETA_EXT {
+			continue
+		}
+		vid, e := strconv.ParseInt(basename[:len(basename)-len(ext)], 10, 32)
+		if e != nil {
+			continue
+		}
+		vids = append(vids, int32(vid))
+	}
 	return
 }
 
 // ======== GetVolume() ========
 func (store *Store) GetVolume(vid int32) (*Volume, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
 	volume, ok := store.Volumes[vid]
 	return volume, ok
 }
 
 // ======== CreateVolume() ========
+// Return the existing volume if vid is already in store. A new volume uses
+// the index mode of Config.IndexMode, which is recorded in its superblock.
 func (this *Store) CreateVolume(vid int32) (volume *Volume, err error) {
-	volume = NewVolume(vid, this.Dir)
-	if err = volume.Init(); err != nil {
-		utils.LogErrorf(err, "Store.CreateVolume() failed. vid:%d %v", vid, err)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.createVolume(vid)
+}
+
+// -------- createVolume() --------
+// Caller holds the lock.
+func (this *Store) createVolume(vid int32) (volume *Volume, err error) {
+	if v, ok := this.Volumes[vid]; ok {
+		return v, nil
+	}
+	if _, ok := this.faulty[vid]; ok {
+		return nil, errors.ErrVolumeFaulty
+	}
+	if this.unlisted && vid <= this.vid_mark {
+		utils.LogWarnf(errors.ErrVolumeFaulty, "Volume %d may be on a failed disk, not created.", vid)
+		return nil, errors.ErrVolumeFaulty
+	}
+	// 按剩余空间从多到少尝试，初始化失败且探测写入失败的磁盘标记为故障。
+	err = errors.ErrDataNomoreSpace
+	for _, disk := range this.placeDisks() {
+		volume = NewVolume(vid, disk.Dir, this.Config)
+		if err = volume.Init(); err == nil {
+			this.Volumes[vid] = volume
+			if vid > this.vid_mark {
+				this.updateVidMark(vid)
+			}
+			return
+		}
+		utils.LogErrorf(err, "Store.CreateVolume() failed. vid:%d dir:%s %v", vid, disk.Dir, err)
+		volume.Close()
+		volume.remove()
+		if e := disk.check(); e != nil {
+			disk.fail(e)
+		}
+	}
+	return nil, err
+}
+
+// ======== WriteNeedle() ========
+// 写入vid指定的卷，卷不存在时创建。卷已封存或写满时自动换到新的可写卷，
+// 返回实际写入的卷id。换卷写入不覆盖其它客户端写在该卷中的同一key。
+func (this *Store) WriteNeedle(vid int32, needle *Needle) (used int32, err error) {
+	var volume *Volume
+	if volume, err = this.CreateVolume(vid); err != nil {
 		return
 	}
-	this.Volumes[vid] = volume
+
+	exclusive := false
+	for i := 0; i < STORE_MAX_ROLLOVER; i++ {
+		err = volume.writeNeedle(needle, exclusive)
+		if err == errors.ErrNeedleExist {
+			utils.LogInfof("Volume %d already has needle %d, roll over to the next volume.", volume.Id, needle.Key)
+		} else if isVolumeFull(err) {
+			utils.LogInfof("Volume %d is full, roll over to a new volume.", volume.Id)
+		} else {
+			used = volume.Id
+			return
+		}
+		if volume, err = this.writableVolume(volume.Id); err != nil {
+			return
+		}
+		exclusive = true
+	}
+
+	return
+}
+
+// -------- isVolumeFull() --------
+func isVolumeFull(err error) bool {
+	return err == errors.ErrVolumeReadOnly || err == errors.ErrDataNomoreSpace || err == errors.ErrIndexNomoreSpace
+}
+
+// -------- writableVolume() --------
+// The unsealed volume with the smallest id greater than vid. Create a new
+// volume after the largest id ever created if there is none.
+func (this *Store) writableVolume(vid int32) (volume *Volume, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for id, v := range this.Volumes {
+		if id > vid && !v.IsSealed() && (volume == nil || id < volume.Id) {
+			volume = v
+		}
+	}
+	if volume != nil {
+		return
+	}
+
+	max_vid := this.maxVid()
+	if this.vid_mark > max_vid {
+		max_vid = this.vid_mark
+	}
+	if vid > max_vid {
+		max_vid = vid
+	}
+	return this.createVolume(max_vid + 1)
+}
+
+// -------- maxVid() --------
+// The largest id of loaded and faulty volumes. Caller holds the lock.
+func (this *Store) maxVid() (max_vid int32) {
+	for id := range this.Volumes {
+		if id > max_vid {
+			max_vid = id
+		}
+	}
+	for id := range this.faulty {
+		if id > max_vid {
+			max_vid = id
+		}
+	}
 	return
 }
+
+// -------- updateVidMark() --------
+// Persist vid as the largest vid ever created on every healthy disk.
+// Caller holds the lock.
+func (this *Store) updateVidMark(vid int32) {
+	this.vid_mark = vid
+	for _, disk := range this.Disks {
+		if disk.Err() != nil {
+			continue
+		}
+		if err := disk.writeVidMark(vid); err != nil {
+			utils.LogWarnf(err, "Write vid mark %d to disk %s failed.", vid, disk.Dir)
+		}
+	}
+}
@@ -0,0 +1,806 @@
+package haystack
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreRollover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.VolumeMaxSize = 1024
+	store := NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+
+	data := bytes.Repeat([]byte("x"), 200)
+	vids := make(map[int64]int32)
+	for key := int64(1); key <= 6; key++ {
+		needle := NewNeedle(key, 1, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		if vids[key], err = store.WriteNeedle(1, needle); err != nil {
+			t.Fatalf("Store.WriteNeedle() failed. key=%d %v", key, err)
+		}
+	}
+	if vids[1] != 1 || vids[6] != 2 {
+		t.Errorf("needles written to volumes %v, want rollover from 1 to 2", vids)
+	}
+	volume, _ := store.GetVolume(1)
+	if !volume.IsSealed() {
+		t.Errorf("volume 1 is not sealed. %s", volume.String())
+	}
+	// Volumes print the GC stats sampled by the store instead of reading them.
+	sample, _ := lastGCStats.Load().(*gcStats)
+	runtime.GC()
+	if sample == nil || !strings.Contains(volume.String(), fmt.Sprintf("GC count              %d\n", sample.NumGC)) {
+		t.Errorf("volume 1 GC stats not the store sample %+v. %s", sample, volume.String())
+	}
+	if err = volume.WriteNeedle(NewNeedle(100, 1, 0)); err != errors.ErrVolumeReadOnly {
+		t.Errorf("Volume.WriteNeedle() to sealed volume err=%v, want ErrVolumeReadOnly", err)
+	}
+	// Sealed volumes still serve reads and deletes.
+	if err = volume.DeleteNeedle(1, 1); err != nil {
+		t.Errorf("Volume.DeleteNeedle() on sealed volume failed. %v", err)
+	}
+	store.Close()
+
+	// Sealed flag is persisted.
+	store = NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+	if volume, _ = store.GetVolume(1); !volume.IsSealed() {
+		t.Errorf("volume 1 is not sealed after reload.")
+	}
+	for key, vid := range vids {
+		volume, _ = store.GetVolume(vid)
+		if _, err = volume.ReadNeedle(key, 1); err != nil && key != 1 {
+			t.Errorf("ReadNeedle(%d) from volume %d failed. %v", key, vid, err)
+		}
+	}
+	needle := NewNeedle(7, 1, uint32(len(data)))
+	needle.ReadFrom(bytes.NewReader(data))
+	if vid, err := store.WriteNeedle(1, needle); err != nil || vid != 2 {
+		t.Errorf("Store.WriteNeedle() to sealed volume vid=%d err=%v, want 2", vid, err)
+	}
+}
+
+func TestStoreObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.ChunkSize = 1000
+	store := NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+
+	data := make([]byte, 3500)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	needle := NewNeedle(1, 11, 0)
+	needle.Name = "large.bin"
+	used, manifest, err := store.WriteObject(1, needle, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Store.WriteObject() failed. %v", err)
+	}
+	if manifest == nil || len(manifest.Chunks) != 4 || manifest.Size != uint64(len(data)) {
+		t.Fatalf("manifest %+v, want 4 chunks of %d bytes", manifest, len(data))
+	}
+
+	volume, _ := store.GetVolume(used)
+	reader, err := volume.OpenNeedle(1, 11)
+	if err != nil {
+		t.Fatalf("Volume.OpenNeedle() failed. %v", err)
+	}
+	defer reader.Close()
+	if !reader.Needle.IsManifest() || reader.Needle.Name != "large.bin" {
+		t.Errorf("needle is not a manifest or lost its metadata. %s", reader.Needle.String())
+	}
+	object, err := store.OpenManifest(reader)
+	if err != nil {
+		t.Fatalf("Store.OpenManifest() failed. %v", err)
+	}
+	defer object.Close()
+	if buf, err := ioutil.ReadAll(object); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("read object of %d bytes, err=%v", len(buf), err)
+	}
+	// Range across chunks.
+	if _, err = object.Seek(900, io.SeekStart); err != nil {
+		t.Fatalf("ManifestReader.Seek() failed. %v", err)
+	}
+	buf := make([]byte, 1300)
+	if _, err = io.ReadFull(object, buf); err != nil || !bytes.Equal(buf, data[900:2200]) {
+		t.Errorf("read range [900, 2200) failed. err=%v", err)
+	}
+	if size, _ := object.Seek(0, io.SeekEnd); size != int64(len(data)) {
+		t.Errorf("object size %d, want %d", size, len(data))
+	}
+
+	// Deleting the manifest deletes its chunks.
+	if err = store.DeleteObject(used, 1, 11); err != nil {
+		t.Fatalf("Store.DeleteObject() failed. %v", err)
+	}
+	for _, chunk := range manifest.Chunks {
+		v, _ := store.GetVolume(chunk.Vid)
+		if _, err = v.ReadNeedle(chunk.Key, chunk.Cookie); err != errors.ErrNeedleNotExist {
+			t.Errorf("chunk %d not deleted. err=%v", chunk.Key, err)
+		}
+	}
+
+	// Objects up to ChunkSize are written as a single needle.
+	needle = NewNeedle(2, 12, 0)
+	if _, manifest, err = store.WriteObject(1, needle, bytes.NewReader(data[:1000])); err != nil || manifest != nil {
+		t.Fatalf("Store.WriteObject() of one chunk manifest=%v err=%v", manifest, err)
+	}
+	if needle, err = volume.ReadNeedle(2, 12); err != nil || needle.IsManifest() || !bytes.Equal(needle.Data, data[:1000]) {
+		t.Errorf("read single needle object failed. err=%v", err)
+	}
+
+	// Overwriting a chunked object deletes the chunks it replaces, whatever
+	// the new object is.
+	assertDeleted := func(manifest *Manifest) {
+		for _, chunk := range manifest.Chunks {
+			v, _ := store.GetVolume(chunk.Vid)
+			if _, err := v.ReadNeedle(chunk.Key, chunk.Cookie); err != errors.ErrNeedleNotExist {
+				t.Errorf("replaced chunk %d not deleted. err=%v", chunk.Key, err)
+			}
+		}
+	}
+	var old *Manifest
+	if _, old, err = store.WriteObject(1, NewNeedle(4, 14, 0), bytes.NewReader(data)); err != nil || old == nil {
+		t.Fatalf("Store.WriteObject() manifest=%v err=%v", old, err)
+	}
+	if _, manifest, err = store.WriteObject(1, NewNeedle(4, 15, 0), bytes.NewReader(data[:2500])); err != nil || manifest == nil {
+		t.Fatalf("Store.WriteObject() overwrite manifest=%v err=%v", manifest, err)
+	}
+	assertDeleted(old)
+	reader, err = volume.OpenNeedle(4, 15)
+	if err != nil {
+		t.Fatalf("Volume.OpenNeedle() failed. %v", err)
+	}
+	object, err = store.OpenManifest(reader)
+	if err != nil {
+		t.Fatalf("Store.OpenManifest() failed. %v", err)
+	}
+	if buf, err := ioutil.ReadAll(object); err != nil || !bytes.Equal(buf, data[:2500]) {
+		t.Errorf("read overwritten object of %d bytes, err=%v", len(buf), err)
+	}
+	object.Close()
+	reader.Close()
+	if _, old, err = store.WriteObject(1, NewNeedle(4, 16, 0), bytes.NewReader(data[:10])); err != nil || old != nil {
+		t.Fatalf("Store.WriteObject() overwrite by single needle manifest=%v err=%v", old, err)
+	}
+	assertDeleted(manifest)
+	if needle, err = volume.ReadNeedle(4, 16); err != nil || !bytes.Equal(needle.Data, data[:10]) {
+		t.Errorf("read single needle object failed. err=%v", err)
+	}
+
+	config.ObjectMaxSize = 3000
+	if _, _, err = store.WriteObject(1, NewNeedle(3, 13, 0), bytes.NewReader(data)); err != errors.ErrNeedleTooLarge {
+		t.Errorf("Store.WriteObject() beyond ObjectMaxSize err=%v, want ErrNeedleTooLarge", err)
+	}
+}
+
+func TestStoreTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.VolumeTTL = time.Hour
+	store := NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+
+	write := func(key int64, mtime int64, ttl uint32) {
+		needle := NewNeedle(key, 1, 5)
+		needle.ReadFrom(bytes.NewReader([]byte("hello")))
+		needle.MTime = mtime
+		needle.TTL = ttl
+		if _, err := store.WriteNeedle(1, needle); err != nil {
+			t.Fatalf("Store.WriteNeedle() failed. key=%d %v", key, err)
+		}
+	}
+	now := time.Now().Unix()
+	write(1, now, 0)
+	write(2, now-100, 10)   // own TTL expired.
+	write(3, now-7200, 0)   // volume TTL expired.
+	write(4, now-100, 7200) // capped by volume TTL, alive.
+
+	volume, _ := store.GetVolume(1)
+	if volume.data.superblock.TTL != 3600 {
+		t.Errorf("volume TTL %d, want 3600", volume.data.superblock.TTL)
+	}
+	for key, alive := range map[int64]bool{1: true, 2: false, 3: false, 4: true} {
+		_, err = volume.ReadNeedle(key, 1)
+		if reader, e := volume.OpenNeedle(key, 1); e == nil {
+			reader.Close()
+		} else if alive {
+			t.Errorf("OpenNeedle(%d) failed. %v", key, e)
+		}
+		if alive && err != nil || !alive && err != errors.ErrNeedleNotExist {
+			t.Errorf("ReadNeedle(%d) err=%v, alive %v", key, err, alive)
+		}
+	}
+
+	// Compaction reclaims expired needles.
+	if err = volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	if n := volume.index.indices.Len(); n != 2 {
+		t.Errorf("%d needles after compaction, want 2", n)
+	}
+
+	// The volume expires as a whole an hour after the last write.
+	if volume.IsExpired() || len(store.DropExpiredVolumes()) != 0 {
+		t.Errorf("volume expired right after writes.")
+	}
+	modified := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(volume.data.getDataFileName(), modified, modified)
+	if dropped := store.DropExpiredVolumes(); len(dropped) != 1 || dropped[0] != 1 {
+		t.Fatalf("Store.DropExpiredVolumes() dropped %v, want [1]", dropped)
+	}
+	if _, ok := store.GetVolume(1); ok {
+		t.Errorf("expired volume still in store.")
+	}
+	for _, ext := range []string{DATAFILE_EXT, INDEXFILE_EXT} {
+		if utils.FileExist(dir + "/1" + ext) {
+			t.Errorf("file of expired volume %s not removed.", ext)
+		}
+	}
+}
+
+func TestStoreCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.CompressTypes = []string{"text/", "application/json"}
+	store := NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+
+	text := bytes.Repeat([]byte("kleine dateien stack\n"), 100)
+	write := func(vid int32, key int64, mime string) *Needle {
+		needle := NewNeedle(key, 1, uint32(len(text)))
+		needle.ReadFrom(bytes.NewReader(text))
+		needle.Mime = mime
+		if err := store.CompressNeedle(vid, needle); err != nil {
+			t.Fatalf("Store.CompressNeedle() failed. key=%d %v", key, err)
+		}
+		if _, err := store.WriteNeedle(vid, needle); err != nil {
+			t.Fatalf("Store.WriteNeedle() failed. key=%d %v", key, err)
+		}
+		return needle
+	}
+	read := func(vid int32, key int64, codec byte) {
+		volume, _ := store.GetVolume(vid)
+		needle, err := volume.ReadNeedle(key, 1)
+		if err != nil {
+			t.Fatalf("ReadNeedle(%d) failed. %v", key, err)
+		}
+		if needle.Codec() != codec {
+			t.Errorf("needle %d codec %d, want %d", key, needle.Codec(), codec)
+		}
+		if data, err := needle.Decompressed(); err != nil || !bytes.Equal(data, text) {
+			t.Errorf("needle %d data not match. %v", key, err)
+		}
+	}
+
+	// Content type policy.
+	write(1, 1, "text/plain; charset=utf-8")
+	write(1, 2, "image/png")
+	read(1, 1, CODEC_GZIP)
+	read(1, 2, CODEC_NONE)
+	volume, _ := store.GetVolume(1)
+	if err = volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	read(1, 1, CODEC_GZIP)
+
+	// A small object of unknown length is compressed as a single needle.
+	object := NewNeedle(4, 1, 0)
+	object.Mime = "text/plain"
+	if _, manifest, err := store.WriteObject(1, object, bytes.NewReader(text)); err != nil || manifest != nil {
+		t.Fatalf("Store.WriteObject() manifest=%v err=%v", manifest, err)
+	}
+	read(1, 4, CODEC_GZIP)
+
+	// Volume policy, recorded in the superblock of new volumes.
+	store.Config.VolumeCodec = "gzip"
+	write(2, 3, "image/png")
+	read(2, 3, CODEC_GZIP)
+	store.Config.VolumeCodec = ""
+	if volume, _ = store.GetVolume(2); volume.Codec() != CODEC_GZIP {
+		t.Errorf("volume codec %d, want gzip.", volume.Codec())
+	}
+}
+
+func TestStoreDisks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if disk, err := ParseDisk(dir + "/a:1M"); err != nil || disk.Dir != dir+"/a" || disk.Capacity != 1<<20 {
+		t.Errorf("ParseDisk() = %v, %v", disk, err)
+	}
+	for _, spec := range []string{"", ":1M", dir + ":0", dir + ":1X"} {
+		if _, err := ParseDisk(spec); err == nil {
+			t.Errorf("ParseDisk(\"%s\") should fail.", spec)
+		}
+	}
+
+	config := NewConfig()
+	config.VolumeMaxSize = 1024
+	disks := []*Disk{NewDisk(dir+"/a", 1<<20), NewDisk(dir+"/b", 1<<20)}
+	store := NewDiskStore(disks, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	// The least loaded disk is used.
+	for _, c := range []struct {
+		vid  int32
+		want string
+	}{{1, dir + "/a"}, {2, dir + "/b"}} {
+		volume, err := store.CreateVolume(c.vid)
+		if err != nil {
+			t.Fatalf("Store.CreateVolume(%d) failed. %v", c.vid, err)
+		}
+		if volume.Dir != c.want {
+			t.Errorf("volume %d placed in %s, want %s", c.vid, volume.Dir, c.want)
+		}
+	}
+	for _, stat := range store.DiskStats() {
+		if stat.Volumes != 1 || stat.Error != "" || stat.Free+stat.Used+stat.Reserved != 1<<20 {
+			t.Errorf("disk stat %+v", stat)
+		}
+	}
+	store.Close()
+
+	// A volume failed to load is faulty and is not replaced.
+	if err = ioutil.WriteFile(dir+"/a/5"+DATAFILE_EXT, bytes.Repeat([]byte{0xff}, 64), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile() failed. %v", err)
+	}
+	// Disk b fails, only its volumes are offline.
+	os.RemoveAll(dir + "/b")
+	if err = ioutil.WriteFile(dir+"/b", nil, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile() failed. %v", err)
+	}
+	store = NewDiskStore([]*Disk{NewDisk(dir+"/a", 1<<20), NewDisk(dir+"/b", 1<<20)}, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() with a failed disk failed. %v", err)
+	}
+	defer store.Close()
+	if _, ok := store.GetVolume(1); !ok {
+		t.Errorf("volume 1 on healthy disk is not loaded.")
+	}
+	if _, ok := store.GetVolume(2); ok {
+		t.Errorf("volume 2 on failed disk is loaded.")
+	}
+	if _, err = store.CreateVolume(5); err != errors.ErrVolumeFaulty {
+		t.Errorf("Store.CreateVolume() of faulty volume 5 err=%v, want ErrVolumeFaulty", err)
+	}
+	// Volume 2 may be on the failed disk, it is not created on disk a.
+	if _, err = store.CreateVolume(2); err != errors.ErrVolumeFaulty {
+		t.Errorf("Store.CreateVolume() of volume 2 on failed disk err=%v, want ErrVolumeFaulty", err)
+	}
+	stats := store.DiskStats()
+	if stats[0].Faulty != 1 || stats[0].Error != "" || stats[1].Error == "" {
+		t.Errorf("disk stats %+v", stats)
+	}
+	// Volumes after all known ones are new.
+	volume, err := store.CreateVolume(6)
+	if err != nil || volume.Dir != dir+"/a" {
+		t.Errorf("Store.CreateVolume(6) = %v, %v, want in %s/a", volume, err, dir)
+	}
+
+	// Store fails only if all disks failed.
+	all := NewDiskStore([]*Disk{NewDisk(dir+"/b", 0)}, config)
+	if err = all.Init(); err == nil {
+		all.Close()
+		t.Errorf("Store.Init() with all disks failed should fail.")
+	}
+}
+
+func TestStoreFaultyVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.CheckpointEntries = 0
+	store := NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	data := []byte("faulty volume")
+	for key := int64(1); key <= 3; key++ {
+		needle := NewNeedle(key, 1, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		if _, err = store.WriteNeedle(1, needle); err != nil {
+			t.Fatalf("Store.WriteNeedle() failed. key=%d %v", key, err)
+		}
+	}
+	store.Close()
+
+	// The index file can not be opened, volume 1 is faulty but the store starts.
+	index := NewIndex(1, dir).getIndexFileName()
+	os.Remove(index)
+	if err = os.Mkdir(index, 0755); err != nil {
+		t.Fatalf("os.Mkdir() failed. %v", err)
+	}
+	if err = ioutil.WriteFile(dir+"/x"+DATAFILE_EXT, nil, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile() failed. %v", err)
+	}
+	store = NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() with a faulty volume failed. %v", err)
+	}
+	defer store.Close()
+	if len(store.Volumes) != 0 {
+		t.Errorf("%d volumes loaded, want none", len(store.Volumes))
+	}
+	faulty := store.FaultyVolumes()
+	if len(faulty) != 1 || faulty[0].Id != 1 || faulty[0].Dir != dir || faulty[0].Error == "" {
+		t.Fatalf("faulty volumes %+v", faulty)
+	}
+	if err = store.DeleteObject(1, 1, 1); err != errors.ErrVolumeFaulty {
+		t.Errorf("Store.DeleteObject() on faulty volume err=%v, want ErrVolumeFaulty", err)
+	}
+	if _, err = store.WriteNeedle(1, NewNeedle(4, 1, 0)); err != errors.ErrVolumeFaulty {
+		t.Errorf("Store.WriteNeedle() on faulty volume err=%v, want ErrVolumeFaulty", err)
+	}
+
+	// Retry fails until the problem is fixed.
+	if _, err = store.RetryVolume(1); err == nil {
+		t.Errorf("Store.RetryVolume() should fail.")
+	}
+	if faulty = store.FaultyVolumes(); len(faulty) != 1 || faulty[0].Retries != 1 {
+		t.Errorf("faulty volumes %+v after retry", faulty)
+	}
+	if _, err = store.RetryVolume(2); err != errors.ErrVolumeNotExist {
+		t.Errorf("Store.RetryVolume() of unknown volume err=%v, want ErrVolumeNotExist", err)
+	}
+
+	// Repair rebuilds the index from the data file.
+	volume, err := store.RepairVolume(1)
+	if err != nil {
+		t.Fatalf("Store.RepairVolume() failed. %v", err)
+	}
+	if len(store.FaultyVolumes()) != 0 || store.IsFaulty(1) {
+		t.Errorf("volume 1 is still faulty after repair.")
+	}
+	if v, ok := store.GetVolume(1); !ok || v != volume {
+		t.Errorf("volume 1 is not in service after repair.")
+	}
+	for key := int64(1); key <= 3; key++ {
+		needle, err := volume.ReadNeedle(key, 1)
+		if err != nil || !bytes.Equal(needle.Data, data) {
+			t.Errorf("Volume.ReadNeedle() after repair failed. key=%d %v", key, err)
+		}
+	}
+}
+
+func TestStoreTiering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.ColdDir = dir + "/cold"
+	config.TierDemoteRate = 1
+	config.TierPromoteRate = 5
+	config.TierColdAfter = 0
+	store := NewStore(dir+"/hot", config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	data := []byte("tiered volume")
+	for key := int64(1); key <= 3; key++ {
+		needle := NewNeedle(key, 1, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		if _, err = store.WriteNeedle(1, needle); err != nil {
+			t.Fatalf("Store.WriteNeedle() failed. key=%d %v", key, err)
+		}
+	}
+	volume, _ := store.GetVolume(1)
+	readAll := func(keys ...int64) {
+		for _, key := range keys {
+			needle, err := volume.ReadNeedle(key, 1)
+			if err != nil || !bytes.Equal(needle.Data, data) {
+				t.Errorf("Volume.ReadNeedle() failed. key=%d %v", key, err)
+			}
+		}
+	}
+	hot_file := dir + "/hot/1" + DATAFILE_EXT
+	cold_file := dir + "/cold/1" + DATAFILE_EXT
+
+	// Unsealed volumes stay hot.
+	store.TierVolumes()
+	if demoted, _ := store.TierVolumes(); len(demoted) != 0 {
+		t.Errorf("unsealed volume demoted.")
+	}
+	if err = volume.Seal(); err != nil {
+		t.Fatalf("Volume.Seal() failed. %v", err)
+	}
+	if demoted, _ := store.TierVolumes(); len(demoted) != 1 || demoted[0] != 1 {
+		t.Fatalf("demoted volumes %v, want [1]", demoted)
+	}
+	if stat, err := os.Lstat(hot_file); err != nil || stat.Mode()&os.ModeSymlink == 0 || !volume.IsCold() {
+		t.Errorf("data file of demoted volume is not a link to the cold tier. %v", err)
+	}
+	if !utils.FileExist(cold_file) {
+		t.Errorf("data file not in the cold tier.")
+	}
+	readAll(1, 2, 3)
+	if err = volume.EcEncode(nil, 2, 1); err == nil || volume.IsErasureCoded() || !utils.FileExist(cold_file) {
+		t.Errorf("Volume.EcEncode() of cold volume err=%v, want rejected.", err)
+	}
+	if err = volume.DeleteNeedle(3, 1); err != nil {
+		t.Errorf("Volume.DeleteNeedle() on cold volume failed. %v", err)
+	}
+	if stats := store.DiskStats(); stats[0].Cold != 1 || stats[0].Used != 0 {
+		t.Errorf("disk stat %+v", stats[0])
+	}
+
+	// Hot again.
+	for i := 0; i < 20; i++ {
+		readAll(1)
+	}
+	if _, promoted := store.TierVolumes(); len(promoted) != 1 || promoted[0] != 1 {
+		t.Fatalf("promoted volumes %v, want [1]", promoted)
+	}
+	if stat, err := os.Lstat(hot_file); err != nil || stat.Mode()&os.ModeSymlink != 0 || volume.IsCold() {
+		t.Errorf("data file of promoted volume is not in the volume dir. %v", err)
+	}
+	if utils.FileExist(cold_file) {
+		t.Errorf("data file left in the cold tier.")
+	}
+	readAll(1, 2)
+	if _, err = volume.ReadNeedle(3, 1); err != errors.ErrNeedleNotExist {
+		t.Errorf("deleted needle read after promotion. err=%v", err)
+	}
+
+	// The cold tier survives restart.
+	if err = store.DemoteVolume(1); err != nil {
+		t.Fatalf("Store.DemoteVolume() failed. %v", err)
+	}
+	store.Close()
+	store = NewStore(dir+"/hot", config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+	volume, _ = store.GetVolume(1)
+	if !volume.IsCold() {
+		t.Errorf("volume 1 is not cold after reload.")
+	}
+	readAll(1, 2)
+
+	// Compaction brings the volume back to the volume dir.
+	if err = volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	if volume.IsCold() || utils.FileExist(cold_file) {
+		t.Errorf("compacted volume is still in the cold tier.")
+	}
+	readAll(1, 2)
+}
+
+func TestStoreDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.Dedup = true
+	store := NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	avatar := bytes.Repeat([]byte("avatar"), 200)
+	other := bytes.Repeat([]byte("other"), 200)
+	write := func(key int64, data []byte, mime string, want_dup bool) {
+		needle := NewNeedle(key, 1, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		needle.Mime = mime
+		if _, dup, err := store.WriteDedupNeedle(1, needle); err != nil || dup != want_dup {
+			t.Fatalf("Store.WriteDedupNeedle() key=%d dup=%v, want %v. %v", key, dup, want_dup, err)
+		}
+	}
+	read := func(key int64, data []byte, mime string) {
+		volume, _ := store.GetVolume(1)
+		reader, err := volume.OpenNeedle(key, 1)
+		if err != nil {
+			t.Fatalf("Volume.OpenNeedle() failed. key=%d %v", key, err)
+		}
+		defer reader.Close()
+		if !reader.Needle.IsReference() {
+			t.Fatalf("needle %d is not a reference.", key)
+		}
+		blob, err := store.OpenReference(reader)
+		if err != nil {
+			t.Fatalf("Store.OpenReference() failed. key=%d %v", key, err)
+		}
+		defer blob.Close()
+		got, err := ioutil.ReadAll(blob)
+		if err != nil || !bytes.Equal(got, data) || blob.Needle.Mime != mime {
+			t.Errorf("read reference %d mime=%s err=%v, want %s", key, blob.Needle.Mime, err, mime)
+		}
+	}
+	refs := func(data []byte) uint32 {
+		needle := NewNeedle(0, 0, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		if entry, ok := store.dedup.entries[dedupHash(needle)]; ok {
+			return entry.Refs
+		}
+		return 0
+	}
+
+	write(1, avatar, "image/png", false)
+	write(2, avatar, "image/jpeg", true)
+	write(3, other, "", false)
+	read(1, avatar, "image/png")
+	read(2, avatar, "image/jpeg")
+	if refs(avatar) != 2 || refs(other) != 1 {
+		t.Errorf("refs %d %d, want 2 1", refs(avatar), refs(other))
+	}
+	// Small needles are stored as they are.
+	small := NewNeedle(9, 1, 10)
+	small.ReadFrom(bytes.NewReader(avatar[:10]))
+	if _, dup, err := store.WriteDedupNeedle(1, small); err != nil || dup {
+		t.Errorf("Store.WriteDedupNeedle() small needle dup=%v %v", dup, err)
+	}
+
+	// The data needle is deleted with the last reference.
+	if err = store.DeleteObject(1, 1, 1); err != nil {
+		t.Fatalf("Store.DeleteObject() failed. %v", err)
+	}
+	read(2, avatar, "image/jpeg")
+	if err = store.DeleteObject(1, 2, 1); err != nil {
+		t.Fatalf("Store.DeleteObject() failed. %v", err)
+	}
+	if refs(avatar) != 0 || len(store.dedup.entries) != 1 {
+		t.Errorf("dedup table has %d entries after deleting all references of avatar.", len(store.dedup.entries))
+	}
+	store.Close()
+
+	// The table survives restart, a torn record is dropped.
+	file, _ := os.OpenFile(dir+"/"+DEDUP_TABLE_FILE, os.O_WRONLY|os.O_APPEND, 0664)
+	file.Write([]byte("torn"))
+	file.Close()
+	store = NewStore(dir, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+	if refs(other) != 1 || len(store.dedup.entries) != 1 {
+		t.Errorf("dedup table after reload has %d entries, refs of other %d", len(store.dedup.entries), refs(other))
+	}
+	write(4, other, "", true)
+	if err = store.DeleteObject(1, 3, 1); err != nil {
+		t.Fatalf("Store.DeleteObject() failed. %v", err)
+	}
+
+	// Compaction keeps the referenced data needle.
+	volume, _ := store.GetVolume(1)
+	if err = volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	read(4, other, "")
+	// Overwriting a reference releases it.
+	write(4, avatar, "", false)
+	if refs(other) != 0 {
+		t.Errorf("refs of other %d after overwrite, want 0", refs(other))
+	}
+	// So does overwriting with a needle not deduped, or with another cookie.
+	write(5, other, "", false)
+	small = NewNeedle(5, 1, 10)
+	small.ReadFrom(bytes.NewReader(other[:10]))
+	if _, _, err := store.WriteDedupNeedle(1, small); err != nil {
+		t.Fatalf("Store.WriteDedupNeedle() failed. %v", err)
+	}
+	if refs(other) != 0 {
+		t.Errorf("refs of other %d after overwrite by a small needle, want 0", refs(other))
+	}
+	needle := NewNeedle(4, 2, uint32(len(other)))
+	needle.ReadFrom(bytes.NewReader(other))
+	if _, _, err := store.WriteDedupNeedle(1, needle); err != nil {
+		t.Fatalf("Store.WriteDedupNeedle() failed. %v", err)
+	}
+	if refs(avatar) != 0 || refs(other) != 1 {
+		t.Errorf("refs %d %d after overwrite with another cookie, want 0 1", refs(avatar), refs(other))
+	}
+
+	// Concurrent writes of the same content share one data needle.
+	var wg sync.WaitGroup
+	for key := int64(10); key < 20; key++ {
+		wg.Add(1)
+		go func(key int64) {
+			defer wg.Done()
+			needle := NewNeedle(key, 1, uint32(len(avatar)))
+			needle.ReadFrom(bytes.NewReader(avatar))
+			if _, _, err := store.WriteDedupNeedle(1, needle); err != nil {
+				t.Errorf("Store.WriteDedupNeedle() failed. key=%d %v", key, err)
+			}
+		}(key)
+	}
+	wg.Wait()
+	if refs(avatar) != 10 {
+		t.Errorf("refs of avatar %d after concurrent writes, want 10", refs(avatar))
+	}
+}
+
+func TestStoreDedupDiskFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_store_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The first disk holding the dedup table fails, dedup is disabled.
+	if err = ioutil.WriteFile(dir+"/a", nil, 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile() failed. %v", err)
+	}
+	config := NewConfig()
+	config.Dedup = true
+	store := NewDiskStore([]*Disk{NewDisk(dir+"/a", 0), NewDisk(dir+"/b", 0)}, config)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+	if store.dedup != nil {
+		t.Errorf("dedup enabled with the table on a failed disk.")
+	}
+	data := bytes.Repeat([]byte("avatar"), 200)
+	needle := NewNeedle(1, 1, uint32(len(data)))
+	needle.ReadFrom(bytes.NewReader(data))
+	if _, dup, err := store.WriteDedupNeedle(1, needle); err != nil || dup {
+		t.Fatalf("Store.WriteDedupNeedle() dup=%v %v", dup, err)
+	}
+	volume, _ := store.GetVolume(1)
+	if got, err := volume.ReadNeedle(1, 1); err != nil || got.IsReference() || !bytes.Equal(got.Data, data) {
+		t.Errorf("Volume.ReadNeedle() err=%v", err)
+	}
+}
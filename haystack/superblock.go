@@ -3,7 +3,11 @@ package haystack
 import (
 	"bytes"
 	"fmt"
+	"github.com/uukuguy/kds/utils"
+	"hash/crc32"
+	"io"
 	"os"
+	"time"
 )
 
 const (
@@ -12,13 +16,52 @@ const (
 	SUPERBLOCK_MAGIC_SIZE     = 4
 	SUPERBLOCK_VERSION_OFFSET = SUPERBLOCK_MAGIC_OFFSET + SUPERBLOCK_MAGIC_SIZE
 	SUPERBLOCK_VERSION_SIZE   = 1
-	SUPERBLOCK_PADDING_OFFSET = SUPERBLOCK_VERSION_OFFSET + SUPERBLOCK_VERSION_SIZE
+	SUPERBLOCK_FLAGS_OFFSET   = SUPERBLOCK_VERSION_OFFSET + SUPERBLOCK_VERSION_SIZE
+	SUPERBLOCK_FLAGS_SIZE     = 1
+	SUPERBLOCK_PADDING_OFFSET = SUPERBLOCK_FLAGS_OFFSET + SUPERBLOCK_FLAGS_SIZE
 	SUPERBLOCK_PADDING_SIZE   = SUPERBLOCK_SIZE - SUPERBLOCK_PADDING_OFFSET
+
+	// version4起超级块在前8字节之后扩展为：
+	//
+	//	size(4) items_size(4) item ... checksum(4) padding
+	//
+	// size为整个超级块的字节数（按NEEDLE_PADDINGSIZE对齐），第一个needle或索引项
+	// 从size处开始。item与needle元数据相同，为type(1) length(2) value，读取时跳过
+	// 不认识的type，以后增加卷的元数据不必改变格式。checksum为各item的crc32。
+	SUPERBLOCK_EXT_SIZE_OFFSET  = SUPERBLOCK_SIZE
+	SUPERBLOCK_EXT_SIZE_SIZE    = 4
+	SUPERBLOCK_EXT_ITEMS_OFFSET = SUPERBLOCK_EXT_SIZE_OFFSET + SUPERBLOCK_EXT_SIZE_SIZE
+	SUPERBLOCK_EXT_ITEMS_SIZE   = 4
+	SUPERBLOCK_EXT_HEADER_SIZE  = SUPERBLOCK_EXT_ITEMS_OFFSET + SUPERBLOCK_EXT_ITEMS_SIZE
+	SUPERBLOCK_MAXSIZE          = 64 * 1024
+
+	SUPERBLOCK_ITEM_CREATED       = 1 // int64 unix time in seconds.
+	SUPERBLOCK_ITEM_REPLICATION   = 2
+	SUPERBLOCK_ITEM_TTL           = 3 // uint32 seconds.
+	SUPERBLOCK_ITEM_COLLECTION    = 4
+	SUPERBLOCK_ITEM_NEEDLE_FORMAT = 5 // byte.
+	SUPERBLOCK_ITEM_CODEC         = 6 // byte, CODEC_*.
+	SUPERBLOCK_ITEM_DATA_KEY      = 7 // data key wrapped by the master key.
+
+	// 卷已封存（只读），不再写入新的needle。原填充字节为0，旧卷默认可写。
+	superblockFlagSealed = 0x01
+	// 卷使用磁盘索引（见diskNeedleMap），创建卷时按Config.IndexMode设置。
+	superblockFlagDiskIndex = 0x02
 )
 
 var (
-	version1     = byte(1)
-	blockVersion = version1
+	version1 = byte(1)
+	// needle格式v2，needle头部之后有元数据段。
+	version2 = byte(2)
+	// 索引项使用宽格式（见NeedleRegion.to_uint64_wide()），数据文件可超过32GB。
+	version3 = byte(3)
+	// 超级块扩展为带长度的头部，记录卷的元数据。
+	// 新建的卷使用最新版本，已有的卷保持原来的格式，可用kds volume migrate升级。
+	version4     = byte(4)
+	blockVersion = version4
+
+	// 新写入needle的格式。
+	needleFormat = version2
 
 	superblockMagic   = []byte{0x83, 0x84, 0x77, 0x55}
 	superblockVersion = []byte{blockVersion}
@@ -29,62 +72,266 @@ var (
 type SuperBlock struct {
 	Magic   []byte
 	Version byte
+	Flags   byte
 	Padding []byte
+
+	// Volume metadata of version4 or later.
+	CreatedAt    int64 // unix time in seconds.
+	Replication  string
+	TTL          uint32 // seconds, 0 for never.
+	Collection   string
+	NeedleFormat byte
+	Codec        byte   // codec of needles uploaded to the volume, CODEC_NONE for by content type.
+	DataKey      []byte // wrapped data key of encrypted volumes, nil for plaintext.
+
+	size uint64 // encoded size, fixed once written or read.
 }
 
 // ======== NewSuperBlock() ========
 func NewSuperBlock() *SuperBlock {
 	superblock := &SuperBlock{
-		Magic:   superblockMagic,
-		Version: blockVersion,
-		Padding: superblockPadding,
+		Magic:        superblockMagic,
+		Version:      blockVersion,
+		Padding:      superblockPadding,
+		CreatedAt:    time.Now().Unix(),
+		NeedleFormat: needleFormat,
 	}
 
 	return superblock
 }
 
-// ======== WriteToFile() ========
-func (this *SuperBlock) WriteToFile(writer *os.File) (writedSize uint64, err error) {
-	writedSize = 0
+// ======== String() ========
+func (this *SuperBlock) String() string {
+	return fmt.Sprintf("version:%d flags:%#x size:%d created:%s collection:%q replication:%q ttl:%ds needle format:%d codec:%d encrypted:%v",
+		this.Version, this.Flags, this.Size(), time.Unix(this.CreatedAt, 0).Format("2006-01-02 15:04:05"),
+		this.Collection, this.Replication, this.TTL, this.needleVersion(), this.Codec, this.DataKey != nil)
+}
 
-	// Write Super Block Magic
-	if _, err = writer.Write(this.Magic); err != nil {
-		return
+// ======== Size() ========
+// Bytes of the superblock in file. Needles or index entries follow it.
+func (this *SuperBlock) Size() uint64 {
+	if this.Version < version4 {
+		return SUPERBLOCK_SIZE
 	}
-	writedSize += uint64(len(this.Magic))
+	if this.size == 0 {
+		if buf, err := this.encode(); err == nil {
+			this.size = uint64(len(buf))
+		}
+	}
+	return this.size
+}
+
+// -------- needleVersion() --------
+// Needle format of the data file.
+func (this *SuperBlock) needleVersion() byte {
+	switch {
+	case this.Version == version1:
+		return version1
+	case this.Version < version4:
+		return version2
+	}
+	return this.NeedleFormat
+}
 
-	// Write Super Block Version
-	if _, err = writer.Write([]byte{this.Version}); err != nil {
+// -------- encode() --------
+func (this *SuperBlock) encode() (buf []byte, err error) {
+	buf = make([]byte, SUPERBLOCK_SIZE, SUPERBLOCK_EXT_HEADER_SIZE+64)
+	copy(buf[SUPERBLOCK_MAGIC_OFFSET:], this.Magic)
+	buf[SUPERBLOCK_VERSION_OFFSET] = this.Version
+	buf[SUPERBLOCK_FLAGS_OFFSET] = this.Flags
+	copy(buf[SUPERBLOCK_PADDING_OFFSET:], this.Padding)
+	if this.Version < version4 {
 		return
 	}
-	writedSize += SUPERBLOCK_VERSION_SIZE
 
-	// Write Super Block Padding
-	if _, err = writer.Write(this.Padding); err != nil {
+	buf = buf[:SUPERBLOCK_EXT_HEADER_SIZE]
+	item := func(t byte, value []byte) {
+		if len(value) > 0xffff {
+			err = fmt.Errorf("SuperBlock item %d too large.", t)
+			return
+		}
+		buf = append(buf, t, byte(len(value)>>8), byte(len(value)))
+		buf = append(buf, value...)
+	}
+	created := make([]byte, 8)
+	utils.BigEndian.PutInt64(created, this.CreatedAt)
+	item(SUPERBLOCK_ITEM_CREATED, created)
+	if this.Replication != "" {
+		item(SUPERBLOCK_ITEM_REPLICATION, []byte(this.Replication))
+	}
+	if this.TTL != 0 {
+		ttl := make([]byte, 4)
+		utils.BigEndian.PutUint32(ttl, this.TTL)
+		item(SUPERBLOCK_ITEM_TTL, ttl)
+	}
+	if this.Collection != "" {
+		item(SUPERBLOCK_ITEM_COLLECTION, []byte(this.Collection))
+	}
+	item(SUPERBLOCK_ITEM_NEEDLE_FORMAT, []byte{this.NeedleFormat})
+	if this.Codec != CODEC_NONE {
+		item(SUPERBLOCK_ITEM_CODEC, []byte{this.Codec})
+	}
+	if this.DataKey != nil {
+		item(SUPERBLOCK_ITEM_DATA_KEY, this.DataKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	utils.BigEndian.PutUint32(buf[SUPERBLOCK_EXT_ITEMS_OFFSET:], uint32(len(buf)-SUPERBLOCK_EXT_HEADER_SIZE))
+	checksum := make([]byte, 4)
+	utils.BigEndian.PutUint32(checksum, crc32.Checksum(buf[SUPERBLOCK_EXT_HEADER_SIZE:], crc32Table))
+	buf = append(buf, checksum...)
+	if tail := len(buf) % NEEDLE_PADDINGSIZE; tail != 0 {
+		buf = append(buf, padding[NEEDLE_PADDINGSIZE-tail]...)
+	}
+	if len(buf) > SUPERBLOCK_MAXSIZE {
+		return nil, fmt.Errorf("SuperBlock too large.")
+	}
+	utils.BigEndian.PutUint32(buf[SUPERBLOCK_EXT_SIZE_OFFSET:], uint32(len(buf)))
+	return
+}
+
+// -------- decode() --------
+// Decode metadata items of version4 superblock buf.
+func (this *SuperBlock) decode(buf []byte) (err error) {
+	items := buf[SUPERBLOCK_EXT_HEADER_SIZE:]
+	end := int(utils.BigEndian.Uint32(buf[SUPERBLOCK_EXT_ITEMS_OFFSET:]))
+	if end+4 > len(items) {
+		return fmt.Errorf("SuperBlock items size %d invalid.", end)
+	}
+	if crc32.Checksum(items[:end], crc32Table) != utils.BigEndian.Uint32(items[end:]) {
+		return fmt.Errorf("SuperBlock checksum not match.")
+	}
+
+	this.resetMeta()
+	this.NeedleFormat = needleFormat
+	for pos := 0; pos < end; {
+		if pos+NEEDLE_META_ITEM_HEADER_SIZE > end {
+			return fmt.Errorf("SuperBlock items corrupted.")
+		}
+		t := items[pos]
+		n := int(items[pos+1])<<8 | int(items[pos+2])
+		pos += NEEDLE_META_ITEM_HEADER_SIZE
+		if pos+n > end {
+			return fmt.Errorf("SuperBlock items corrupted.")
+		}
+		value := items[pos : pos+n]
+		pos += n
+
+		switch t {
+		case SUPERBLOCK_ITEM_CREATED:
+			if n == 8 {
+				this.CreatedAt = utils.BigEndian.Int64(value)
+			}
+		case SUPERBLOCK_ITEM_REPLICATION:
+			this.Replication = string(value)
+		case SUPERBLOCK_ITEM_TTL:
+			if n == 4 {
+				this.TTL = utils.BigEndian.Uint32(value)
+			}
+		case SUPERBLOCK_ITEM_COLLECTION:
+			this.Collection = string(value)
+		case SUPERBLOCK_ITEM_NEEDLE_FORMAT:
+			if n == 1 {
+				this.NeedleFormat = value[0]
+			}
+		case SUPERBLOCK_ITEM_CODEC:
+			if n == 1 {
+				this.Codec = value[0]
+			}
+		case SUPERBLOCK_ITEM_DATA_KEY:
+			this.DataKey = append([]byte(nil), value...)
+		}
+	}
+	if this.NeedleFormat < version1 || this.NeedleFormat > needleFormat {
+		return fmt.Errorf("SuperBlock needle format %d not supported.", this.NeedleFormat)
+	}
+	return
+}
+
+// ======== WriteToFile() ========
+func (this *SuperBlock) WriteToFile(writer *os.File) (writedSize uint64, err error) {
+	var buf []byte
+	if buf, err = this.encode(); err != nil {
+		return
+	}
+	if _, err = writer.Write(buf); err != nil {
 		return
 	}
-	writedSize += uint64(len(this.Padding))
+	writedSize = uint64(len(buf))
+	this.size = writedSize
 
 	return
 }
 
 // ======== ReadFromFile() ========
-func (this *SuperBlock) ReadFromFile(reader *os.File) (err error) {
-	var buf = make([]byte, SUPERBLOCK_SIZE)
-	if _, err = reader.Read(buf[:SUPERBLOCK_SIZE]); err != nil {
+func (this *SuperBlock) ReadFromFile(reader io.Reader) (err error) {
+	var buf = make([]byte, SUPERBLOCK_EXT_HEADER_SIZE)
+	if _, err = io.ReadFull(reader, buf[:SUPERBLOCK_SIZE]); err != nil {
 		return
 	}
 
 	this.Magic = buf[SUPERBLOCK_MAGIC_OFFSET : SUPERBLOCK_MAGIC_OFFSET+SUPERBLOCK_MAGIC_SIZE]
 	this.Version = buf[SUPERBLOCK_VERSION_OFFSET : SUPERBLOCK_VERSION_OFFSET+SUPERBLOCK_VERSION_SIZE][0]
+	this.Flags = buf[SUPERBLOCK_FLAGS_OFFSET]
 	this.Padding = buf[SUPERBLOCK_PADDING_OFFSET : SUPERBLOCK_PADDING_OFFSET+SUPERBLOCK_PADDING_SIZE]
 
 	if !bytes.Equal(this.Magic, superblockMagic) {
 		return fmt.Errorf("SuperBlock magic number not match.")
 	}
-	if this.Version != superblockVersion[0] {
+	if this.Version < version1 || this.Version > superblockVersion[0] {
 		return fmt.Errorf("SuperBlock Version not match.")
 	}
+	if this.Version < version4 {
+		this.resetMeta()
+		this.NeedleFormat = this.needleVersion()
+		this.size = SUPERBLOCK_SIZE
+		return
+	}
+
+	if _, err = io.ReadFull(reader, buf[SUPERBLOCK_SIZE:]); err != nil {
+		return
+	}
+	size := uint64(utils.BigEndian.Uint32(buf[SUPERBLOCK_EXT_SIZE_OFFSET:]))
+	if size < SUPERBLOCK_EXT_HEADER_SIZE+4 || size > SUPERBLOCK_MAXSIZE || size%NEEDLE_PADDINGSIZE != 0 {
+		return fmt.Errorf("SuperBlock size %d invalid.", size)
+	}
+	buf = append(buf, make([]byte, size-SUPERBLOCK_EXT_HEADER_SIZE)...)
+	if _, err = io.ReadFull(reader, buf[SUPERBLOCK_EXT_HEADER_SIZE:]); err != nil {
+		return
+	}
+	if err = this.decode(buf); err != nil {
+		return
+	}
+	this.size = size
 
 	return
 }
+
+// -------- resetMeta() --------
+// Clear metadata before reading, items absent from file are zero.
+func (this *SuperBlock) resetMeta() {
+	this.CreatedAt = 0
+	this.Replication = ""
+	this.TTL = 0
+	this.Collection = ""
+	this.Codec = CODEC_NONE
+	this.DataKey = nil
+}
+
+// -------- clone() --------
+func (this *SuperBlock) clone() *SuperBlock {
+	superblock := *this
+	return &superblock
+}
+
+// ======== IsSealed() ========
+func (this *SuperBlock) IsSealed() bool {
+	return this.Flags&superblockFlagSealed != 0
+}
+
+// ======== IsDiskIndex() ========
+func (this *SuperBlock) IsDiskIndex() bool {
+	return this.Flags&superblockFlagDiskIndex != 0
+}
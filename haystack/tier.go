@@ -0,0 +1,289 @@
+package haystack
+
+import (
+	"fmt"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// 分层存储：读取频率持续低于Config.TierDemoteRate的封存卷，数据文件移到冷存储
+// 目录（较慢的磁盘或本地归档挂载点），卷目录中的数据文件换成指向它的符号链接；
+// 索引文件留在卷目录，内存中的索引不变，读取透明地转到冷存储。冷存储卷的读取
+// 频率超过Config.TierPromoteRate时数据文件移回卷目录。
+const (
+	// 迁移数据文件时的临时文件和临时符号链接。
+	TIER_TMP_EXT = ".tiering"
+
+	TIER_DEFAULT_DEMOTE_RATE  = 0.01
+	TIER_DEFAULT_PROMOTE_RATE = 1.0
+	TIER_DEFAULT_COLD_AFTER   = 24 * time.Hour
+)
+
+// **************** tierState ****************
+// Read rate sampling of a volume.
+type tierState struct {
+	reads      uint64
+	at         time.Time
+	cold_since time.Time // read rate below the demote rate since.
+}
+
+// ======== IsCold() ========
+// Data file of the volume is in the cold tier.
+func (this *Volume) IsCold() bool {
+	this.rwlock.RLock()
+	defer this.rwlock.RUnlock()
+
+	return this.data.cold != ""
+}
+
+// ======== Demote() ========
+// Move data file of the sealed volume to cold_dir.
+func (this *Volume) Demote(cold_dir string) (err error) {
+	if this.IsCold() {
+		return
+	}
+	dest, err := filepath.Abs(filepath.Join(cold_dir, filepath.Base(this.data.getDataFileName())))
+	if err != nil {
+		return
+	}
+	if err = this.moveData(dest); err == nil {
+		utils.LogInfof("Volume %d demoted to %s.", this.Id, dest)
+	}
+	return
+}
+
+// ======== Promote() ========
+// Move data file of the cold volume back to the volume dir.
+func (this *Volume) Promote() (err error) {
+	if !this.IsCold() {
+		return
+	}
+	if err = this.moveData(""); err == nil {
+		utils.LogInfof("Volume %d promoted to %s.", this.Id, this.Dir)
+	}
+	return
+}
+
+// -------- moveData() --------
+// 把数据文件复制到dest，dest为空时复制回卷目录。复制期间读取照常进行，
+// 复制完成后在写锁内补齐期间追加的墓碑，替换卷目录中的数据文件（或符号链接），
+// 再以新文件打开数据，索引保持不变。
+func (this *Volume) moveData(dest string) (err error) {
+	if !atomic.CompareAndSwapInt32(&this.compacting, 0, 1) {
+		return errors.ErrVolumeCompacting
+	}
+	defer atomic.StoreInt32(&this.compacting, 0)
+
+	this.rwlock.RLock()
+	old_data := this.data
+	sealed := old_data.superblock.IsSealed()
+	size := old_data.FileSize
+	this.rwlock.RUnlock()
+	if old_data.shards != nil {
+		return fmt.Errorf("Volume %d is erasure coded, decode it first.", this.Id)
+	}
+	if !sealed {
+		return fmt.Errorf("Volume %d is not sealed.", this.Id)
+	}
+
+	name := old_data.getDataFileName()
+	src := name
+	if old_data.cold != "" {
+		src = old_data.cold
+	}
+	tmp := dest + TIER_TMP_EXT
+	if dest == "" {
+		tmp = name + TIER_TMP_EXT
+	}
+	var file *os.File
+	if file, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		return
+	}
+	done := false
+	defer func() {
+		file.Close()
+		if !done {
+			os.Remove(tmp)
+		}
+	}()
+	if err = copyFileRange(file, src, 0, size); err != nil {
+		utils.LogErrorf(err, "Volume %d copy data file to %s failed.", this.Id, tmp)
+		return
+	}
+
+	this.rwlock.Lock()
+	defer this.rwlock.Unlock()
+
+	if this.data != old_data {
+		return fmt.Errorf("Volume %d data file changed while moving.", this.Id)
+	}
+	// 补齐复制期间追加的墓碑。
+	if err = this.syncFiles(); err != nil {
+		return
+	}
+	if err = copyFileRange(file, src, size, this.data.FileSize-size); err != nil {
+		return
+	}
+	if err = file.Sync(); err != nil {
+		return
+	}
+	// 卷按数据文件最后写入时间整体过期，迁移不改变该时间。
+	if modified, e := old_data.modTime(); e == nil {
+		os.Chtimes(tmp, modified, modified)
+	}
+
+	if dest == "" {
+		err = os.Rename(tmp, name)
+	} else if err = os.Rename(tmp, dest); err == nil {
+		// 以符号链接原子地替换卷目录中的数据文件。
+		link := name + TIER_TMP_EXT
+		os.Remove(link)
+		if err = os.Symlink(dest, link); err == nil {
+			if err = os.Rename(link, name); err != nil {
+				os.Remove(link)
+			}
+		}
+		if err != nil {
+			os.Remove(dest)
+		}
+	}
+	if err != nil {
+		utils.LogErrorf(err, "Volume %d replace data file failed.", this.Id)
+		return
+	}
+	done = true
+
+	data := NewData(this.Id, this.Dir)
+	if err = data.Init(); err != nil {
+		// 原数据文件仍然打开，卷继续使用它，重新打开卷时使用新文件。
+		utils.LogErrorf(err, "Volume %d open moved data file failed.", this.Id)
+		data.Close()
+		return
+	}
+	this.data = data
+	old_data.Close()
+	if old_data.cold != "" && old_data.cold != data.cold {
+		os.Remove(old_data.cold)
+	}
+	return
+}
+
+// -------- copyFileRange() --------
+func copyFileRange(dst *os.File, src string, offset uint64, size uint64) (err error) {
+	if size == 0 {
+		return
+	}
+	var file *os.File
+	if file, err = os.Open(src); err != nil {
+		return
+	}
+	defer file.Close()
+	if _, err = dst.Seek(int64(offset), io.SeekStart); err != nil {
+		return
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(file, int64(offset), int64(size)))
+	return
+}
+
+// ======== TierVolumes() ========
+// 按读取频率迁移卷：封存的热存储卷读取频率持续低于Config.TierDemoteRate
+// 超过Config.TierColdAfter时降级，冷存储卷读取频率超过Config.TierPromoteRate
+// 时升级。读取频率按相邻两次调用之间的读取次数计算。Return ids of the
+// demoted and promoted volumes.
+func (this *Store) TierVolumes() (demoted []int32, promoted []int32) {
+	if this.Config.ColdDir == "" {
+		return
+	}
+	this.tierLock.Lock()
+	defer this.tierLock.Unlock()
+
+	now := time.Now()
+	volumes := make(map[int32]*Volume)
+	this.lock.RLock()
+	for vid, volume := range this.Volumes {
+		volumes[vid] = volume
+	}
+	this.lock.RUnlock()
+
+	for vid := range this.tiers {
+		if _, ok := volumes[vid]; !ok {
+			delete(this.tiers, vid)
+		}
+	}
+	for vid, volume := range volumes {
+		reads := atomic.LoadUint64(&volume.metrics.ReadCount)
+		state, ok := this.tiers[vid]
+		if !ok {
+			this.tiers[vid] = &tierState{reads: reads, at: now, cold_since: now}
+			continue
+		}
+		elapsed := now.Sub(state.at).Seconds()
+		if elapsed <= 0 {
+			continue
+		}
+		rate := float64(reads-state.reads) / elapsed
+		state.reads, state.at = reads, now
+		if rate >= this.Config.TierDemoteRate {
+			state.cold_since = now
+		}
+
+		if volume.IsCold() {
+			if rate > this.Config.TierPromoteRate {
+				if err := volume.Promote(); err != nil {
+					utils.LogErrorf(err, "Promote volume %d failed.", vid)
+					continue
+				}
+				promoted = append(promoted, vid)
+			}
+		} else if volume.IsSealed() && !volume.IsErasureCoded() && now.Sub(state.cold_since) >= this.Config.TierColdAfter {
+			if err := volume.Demote(this.Config.ColdDir); err != nil {
+				utils.LogErrorf(err, "Demote volume %d failed.", vid)
+				continue
+			}
+			demoted = append(demoted, vid)
+		}
+	}
+	return
+}
+
+// ======== DemoteVolume() ========
+// Move data file of the volume to Config.ColdDir on demand.
+func (this *Store) DemoteVolume(vid int32) error {
+	if this.Config.ColdDir == "" {
+		return fmt.Errorf("No cold dir for tiering.")
+	}
+	volume, ok := this.GetVolume(vid)
+	if !ok {
+		return this.volumeErr(vid)
+	}
+	return volume.Demote(this.Config.ColdDir)
+}
+
+// ======== PromoteVolume() ========
+// Move data file of the volume back from the cold tier on demand.
+func (this *Store) PromoteVolume(vid int32) error {
+	volume, ok := this.GetVolume(vid)
+	if !ok {
+		return this.volumeErr(vid)
+	}
+	return volume.Promote()
+}
+
+// -------- tierLoop() --------
+func (this *Store) tierLoop(done chan struct{}) {
+	ticker := time.NewTicker(STORE_TIER_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			this.TierVolumes()
+		}
+	}
+}
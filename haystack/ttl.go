@@ -0,0 +1,118 @@
+package haystack
+
+import (
+	"fmt"
+	"github.com/uukuguy/kds/utils"
+	"math"
+	"strconv"
+	"time"
+)
+
+// TTL以秒计。needle的TTL保存在元数据中（仅v2），从needle的mtime起算；卷的TTL
+// 保存在超级块中（仅version4），是卷内needle的默认TTL，同时也是上限，
+// 这样卷最后一次写入之后经过卷的TTL，卷内needle全部过期，可以整卷删除。
+
+// ======== ParseTTL() ========
+// Parse TTL in seconds, or a number with unit s, m, h, d or w, e.g. "90m", "7d".
+func ParseTTL(s string) (ttl uint32, err error) {
+	if s == "" {
+		return
+	}
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 24 * 3600, 'w': 7 * 24 * 3600}
+	number, unit := s, uint64(1)
+	if u, ok := units[s[len(s)-1]]; ok {
+		number, unit = s[:len(s)-1], u
+	}
+	var n uint64
+	if n, err = strconv.ParseUint(number, 10, 32); err != nil || n*unit > math.MaxUint32 {
+		return 0, fmt.Errorf("Invalid TTL \"%s\".", s)
+	}
+	return uint32(n * unit), nil
+}
+
+// ======== ExpiresAt() ========
+// Unix time the needle expires at in a volume of volume_ttl, 0 for never.
+// Needles of unknown mtime (v1) never expire.
+func (needle *Needle) ExpiresAt(volume_ttl uint32) int64 {
+	ttl := needle.TTL
+	if volume_ttl > 0 && (ttl == 0 || ttl > volume_ttl) {
+		ttl = volume_ttl
+	}
+	if ttl == 0 || needle.MTime == 0 {
+		return 0
+	}
+	return needle.MTime + int64(ttl)
+}
+
+// -------- isExpired() --------
+func (needle *Needle) isExpired(volume_ttl uint32, now int64) bool {
+	expires_at := needle.ExpiresAt(volume_ttl)
+	return expires_at != 0 && expires_at <= now
+}
+
+// -------- needleExpired() --------
+// Whether the raw needle in buf has expired. Unparsable needles are kept.
+func (this *Data) needleExpired(buf []byte, now int64) bool {
+	version := this.superblock.needleVersion()
+	needle := new(Needle)
+	if needle.buildHeaderFrom(version, buf) != nil || uint64(len(buf)) < uint64(needle.DataOffset()) {
+		return false
+	}
+	if needle.decodeMeta(buf[needle.HeaderSize():needle.DataOffset()]) != nil {
+		return false
+	}
+	return needle.isExpired(this.superblock.TTL, now)
+}
+
+// ======== IsExpired() ========
+// A volume with TTL expires as a whole when nothing has been written to it
+// for the TTL, so that all needles in it have expired.
+func (this *Volume) IsExpired() bool {
+	this.rwlock.RLock()
+	defer this.rwlock.RUnlock()
+
+	ttl := this.data.superblock.TTL
+	if ttl == 0 {
+		return false
+	}
+	modified, err := this.data.modTime()
+	if err != nil {
+		return false
+	}
+	return time.Since(modified) >= time.Duration(ttl)*time.Second
+}
+
+// ======== DropExpiredVolumes() ========
+// Close expired volumes and delete their files. Return ids of the dropped volumes.
+func (this *Store) DropExpiredVolumes() (dropped []int32) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for vid, volume := range this.Volumes {
+		if !volume.IsExpired() {
+			continue
+		}
+		delete(this.Volumes, vid)
+		volume.Close()
+		if err := volume.remove(); err != nil {
+			utils.LogErrorf(err, "Remove expired volume %d failed.", vid)
+		}
+		utils.LogInfof("Volume %d expired and dropped.", vid)
+		dropped = append(dropped, vid)
+	}
+	return
+}
+
+// -------- expireLoop() --------
+func (this *Store) expireLoop(done chan struct{}) {
+	ticker := time.NewTicker(STORE_EXPIRE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			this.DropExpiredVolumes()
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/uukuguy/kds/store/errors"
 	"github.com/uukuguy/kds/utils"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -66,10 +67,25 @@ DeleteTime:           %d
 // **************** Volume ****************
 type Volume struct {
 	Id      int32
+	Dir     string
 	data    *Data
 	index   *Index
+	config  *Config
 	rwlock  sync.RWMutex
 	metrics Metrics
+	writer  *volumeWriter
+	// syncLock串行化数据和索引文件的fsync；ckpLock保证检查点写入时索引文件不被压缩替换。
+	syncLock sync.Mutex
+	ckpLock  sync.Mutex
+
+	checkpointing int32
+
+	compacting   int32
+	compacted_at int64 // unix time of the last compaction
+
+	// 加密卷的数据密钥，master_keys用于解开超级块中的数据密钥，第一个用于新建的卷。
+	cipher      *needleCipher
+	master_keys [][]byte
 }
 
 // ======== String() ========
@@ -79,12 +95,22 @@ func (this *Volume) String() string {
 Volume
 
 Id:                   %d
+Dir:                  %s
+sealed:               %v
+superblock:           %s
+index mode:           %s
+compacting:           %d
 data:                 %s
 index:                %s
 Metrics:              %s
 -----------------------------
 `,
 		this.Id,
+		this.Dir,
+		this.data.superblock.IsSealed(),
+		this.data.superblock.String(),
+		this.IndexMode(),
+		atomic.LoadInt32(&this.compacting),
 		this.data.String(),
 		this.index.String(),
 		this.metrics.String(),
@@ -92,11 +118,20 @@ Metrics:              %s
 }
 
 // ======== NewVolume() ========
-func NewVolume(vid int32, store_dir string) (volume *Volume) {
+// config为nil时使用默认配置。
+func NewVolume(vid int32, store_dir string, config *Config) (volume *Volume) {
+	if config == nil {
+		config = NewConfig()
+	}
 	volume = &Volume{
-		Id:    vid,
-		data:  NewData(vid, store_dir),
-		index: NewIndex(vid, store_dir),
+		Id:     vid,
+		Dir:    store_dir,
+		data:   NewData(vid, store_dir),
+		index:  NewIndex(vid, store_dir),
+		config: config,
+	}
+	if len(config.MasterKey) > 0 {
+		volume.master_keys = [][]byte{config.MasterKey}
 	}
 
 	return
@@ -104,25 +139,81 @@ func NewVolume(vid int32, store_dir string) (volume *Volume) {
 
 // ======== Init() ========
 func (this *Volume) Init() (err error) {
+	if err = this.recoverCompaction(); err != nil {
+		return
+	}
+
 	if this.data == nil {
 		return fmt.Errorf("Volume.data == nil")
 	}
+	// 只对新建的数据文件生效，已有的卷使用超级块中记录的索引模式和元数据。
+	if this.config.IndexMode == INDEX_MODE_DISK {
+		this.data.superblock.Flags |= superblockFlagDiskIndex
+	}
+	this.data.superblock.Collection = this.config.Collection
+	this.data.superblock.Replication = this.config.Replication
+	this.data.superblock.TTL = uint32(this.config.VolumeTTL / time.Second)
+	this.data.superblock.Codec, _ = ParseCodec(this.config.VolumeCodec)
+	this.data.superblock.DataKey = nil
+	if len(this.master_keys) > 0 {
+		if _, this.data.superblock.DataKey, err = newDataKey(this.master_keys[0]); err != nil {
+			return
+		}
+	}
+	if this.data.shards == nil && isEcVolume(this.Dir, this.Id) {
+		if this.data.shards, err = openEcShards(this.Id, this.Dir, this.config.EcDirs); err != nil {
+			return
+		}
+	}
 	if err = this.data.Init(); err != nil {
 		return
 	}
+	if this.cipher, err = this.openCipher(); err != nil {
+		this.data.Close()
+		return
+	}
 
 	if this.index == nil {
 		return fmt.Errorf("Volume.index == nil")
 	}
+	this.index.disk_mode = this.data.superblock.IsDiskIndex()
+	this.index.data_version = this.data.superblock.needleVersion()
+	this.index.data_start = this.data.superblock.Size()
 	if err = this.index.Init(); err != nil {
 		return
 	}
 
+	if err = this.recoverIndex(); err != nil {
+		utils.LogErrorf(err, "Volume %d recover index failed.", this.Id)
+		return
+	}
+
+	// 压缩后重新打开文件时沿用原来的写goroutine。
+	if this.writer == nil {
+		this.writer = newVolumeWriter(this, this.config)
+		this.writer.start()
+	}
+
 	return
 }
 
 // ======== Close() ========
 func (volume *Volume) Close() {
+	// 写goroutine提交时要取写锁，在锁外等它退出。
+	volume.rwlock.Lock()
+	writer := volume.writer
+	volume.writer = nil
+	volume.rwlock.Unlock()
+	if writer != nil {
+		writer.stop()
+	}
+	// 正常关闭时写检查点，下次启动无需重放索引。
+	if volume.data != nil && volume.data.writer != nil && volume.index != nil && volume.checkpointEntries() > 0 {
+		volume.checkpoint()
+	}
+	// 压缩复制期间在检查点锁内读取磁盘索引，等它结束再关闭。
+	volume.ckpLock.Lock()
+	defer volume.ckpLock.Unlock()
 	if volume.data != nil {
 		volume.data.Close()
 	}
@@ -131,34 +222,223 @@ func (volume *Volume) Close() {
 	}
 }
 
+// -------- remove() --------
+// Delete files of the closed volume.
+func (this *Volume) remove() (err error) {
+	this.index.removeCheckpoint()
+	if err = this.index.remove(); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err = this.data.remove(); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
 // ======== WriteNeedle() ========
+// Needles written concurrently are committed in batch by the volume writer.
+// Return after the needle reaches durability of Config.SyncPolicy.
 func (this *Volume) WriteNeedle(needle *Needle) (err error) {
+	return this.writeNeedle(needle, false)
+}
+
+// -------- writeNeedle() --------
+// exclusive为true时不覆盖卷中已有的同一key，返回errors.ErrNeedleExist。
+func (this *Volume) writeNeedle(needle *Needle, exclusive bool) (err error) {
 	// Just append new needle to the end of data file.
 
 	now := time.Now().UnixNano()
 
-	this.rwlock.Lock()
-	var region NeedleRegion
-	if region, err = this.data.AppendNeedle(needle); err == nil {
-		if err = this.index.AppendIndexEntry(IndexEntry{needle.Key, region}); err != nil {
-			utils.LogErrorf(err, "Volume.WriteNeedle() this.index.AppendIndexEntry() failed.")
-		}
-	} else {
-		utils.LogErrorf(err, "Volume.WriteNeedle() this.data.AppendNeedle() failed.")
+	this.rwlock.RLock()
+	writer := this.writer
+	this.rwlock.RUnlock()
+	if writer == nil {
+		return errors.ErrVolumeNotExist
 	}
-	this.rwlock.Unlock()
-
-	if err == nil {
+	req := &writeRequest{needle: needle, exclusive: exclusive}
+	if err = writer.submit(req); err == nil {
 		atomic.AddUint64(&this.metrics.WriteCount, 1)
-		atomic.AddUint64(&this.metrics.WriteBytes, uint64(region.Size))
+		atomic.AddUint64(&this.metrics.WriteBytes, uint64(req.region.Size))
 		atomic.AddUint64(&this.metrics.WriteTime, uint64(time.Now().UnixNano()-now))
 	}
 
 	return
 }
 
+// -------- appendNeedles() --------
+// Append needles of the batch to data and index files with one write each.
+// Set region or error of every request, return bytes appended. Caller holds
+// the write lock.
+func (this *Volume) appendNeedles(batch []*writeRequest) (appended uint64) {
+	needles := make([]*Needle, 0, len(batch))
+	reqs := make([]*writeRequest, 0, len(batch))
+
+	// 数据或索引文件写满、或数据文件超过Config.VolumeMaxSize时封存卷，
+	// 之后的写入返回errors.ErrVolumeReadOnly，由Store换到新卷。
+	sealed := this.data.superblock.IsSealed()
+	need_seal := false
+	used := this.data.FileSize
+	free_entries := (uint64(INDEXFILE_MAXSIZE) - this.index.FileSize) / INDEX_ENTRY_SIZE
+	for _, req := range batch {
+		if req.needle == nil {
+			appended += req.size
+			continue
+		}
+		if sealed {
+			req.err = errors.ErrVolumeReadOnly
+			continue
+		}
+		if req.exclusive && this.hasNeedle(req.needle.Key, needles) {
+			req.err = errors.ErrNeedleExist
+			continue
+		}
+		// 加密写入needle的副本，写入失败由Store换卷重试时调用者的needle仍是明文。
+		needle := req.needle
+		if this.cipher != nil && !needle.IsDeleted() {
+			if needle, req.err = this.cipher.seal(needle); req.err != nil {
+				continue
+			}
+		}
+		if req.err = needle.SetVersion(this.data.superblock.needleVersion()); req.err != nil {
+			continue
+		}
+		size := uint64(needle.WriteSize)
+		if size > this.index.maxRegionSize() {
+			// 旧格式索引的卷不能写入超过16MB的needle。
+			req.err = errors.ErrNeedleTooLarge
+			utils.LogWarnf(req.err, "Volume %d index format can not hold %d bytes. key:%d", this.Id, size, needle.Key)
+			continue
+		}
+		if size > this.data.maxSize()-used {
+			req.err = errors.ErrDataNomoreSpace
+		} else if free_entries == 0 {
+			req.err = errors.ErrIndexNomoreSpace
+		}
+		if req.err != nil {
+			utils.LogWarnf(req.err, "Volume %d is full. key:%d", this.Id, needle.Key)
+			sealed, need_seal = true, true
+			continue
+		}
+		used += size
+		free_entries--
+		needles = append(needles, needle)
+		reqs = append(reqs, req)
+		if used >= this.config.VolumeMaxSize {
+			sealed, need_seal = true, true
+		}
+	}
+
+	if len(needles) > 0 {
+		regions, err := this.data.appendNeedles(needles)
+		if err != nil {
+			utils.LogErrorf(err, "Volume.WriteNeedle() this.data.appendNeedles() failed.")
+		} else {
+			entries := make([]IndexEntry, len(needles))
+			for i, needle := range needles {
+				entries[i] = IndexEntry{needle.Key, regions[i]}
+				appended += uint64(regions[i].Size)
+			}
+			if err = this.index.appendEntries(entries); err != nil {
+				utils.LogErrorf(err, "Volume.WriteNeedle() this.index.appendEntries() failed.")
+			}
+		}
+
+		for i, req := range reqs {
+			if err != nil {
+				req.err = err
+			} else {
+				req.region = regions[i]
+			}
+		}
+	}
+
+	if need_seal {
+		if err := this.data.seal(); err == nil {
+			this.index.indices.Freeze()
+			utils.LogInfof("Volume %d sealed. data file %d bytes.", this.Id, this.data.FileSize)
+		}
+	}
+
+	return
+}
+
+// -------- hasNeedle() --------
+// The key is indexed or in needles to append. Caller holds the write lock.
+func (this *Volume) hasNeedle(key int64, needles []*Needle) bool {
+	for i := len(needles) - 1; i >= 0; i-- {
+		if needles[i].Key == key {
+			return !needles[i].IsDeleted()
+		}
+	}
+	return this.index.hasNeedle(key)
+}
+
+// ======== Seal() ========
+// Mark the volume read-only persistently. Needles can still be read and deleted.
+func (this *Volume) Seal() (err error) {
+	this.rwlock.Lock()
+	defer this.rwlock.Unlock()
+
+	if this.data.superblock.IsSealed() {
+		return
+	}
+	if err = this.data.seal(); err == nil {
+		this.index.indices.Freeze()
+	}
+	return
+}
+
+// ======== IndexMode() ========
+// INDEX_MODE_MEMORY or INDEX_MODE_DISK, recorded in superblock of data file.
+func (this *Volume) IndexMode() string {
+	if this.data.superblock.IsDiskIndex() {
+		return INDEX_MODE_DISK
+	}
+	return INDEX_MODE_MEMORY
+}
+
+// ======== IsSealed() ========
+func (this *Volume) IsSealed() bool {
+	this.rwlock.RLock()
+	defer this.rwlock.RUnlock()
+
+	return this.data.superblock.IsSealed()
+}
+
+// ======== Codec() ========
+// Codec of needles uploaded to the volume, recorded in the superblock.
+func (this *Volume) Codec() byte {
+	this.rwlock.RLock()
+	defer this.rwlock.RUnlock()
+
+	return this.data.superblock.Codec
+}
+
+// ======== DataSize() ========
+// Bytes of the data file.
+func (this *Volume) DataSize() uint64 {
+	this.rwlock.RLock()
+	defer this.rwlock.RUnlock()
+
+	return this.data.FileSize
+}
+
+// -------- syncFiles() --------
+// Sync data and index files. Caller holds the read lock at least.
+func (this *Volume) syncFiles() (err error) {
+	this.syncLock.Lock()
+	defer this.syncLock.Unlock()
+
+	if err = this.data.flushFile(); err != nil {
+		return
+	}
+	return this.index.flushFile()
+}
+
 // ======== ReadNeedle() ========
-func (this *Volume) ReadNeedle(key int64) (needle *Needle, err error) {
+// The cookie has to match the one stored in needle, otherwise
+// errors.ErrNeedleCookieNotMatch is returned.
+func (this *Volume) ReadNeedle(key int64, cookie int32) (needle *Needle, err error) {
 	now := time.Now().UnixNano()
 
 	this.rwlock.RLock()
@@ -171,6 +451,119 @@ func (this *Volume) ReadNeedle(key int64) (needle *Needle, err error) {
 	} else {
 		if needle, err = this.data.GetNeedle(key, region); err != nil {
 			utils.LogErrorf(err, "")
+		} else if needle.Cookie != cookie {
+			needle = nil
+			err = errors.ErrNeedleCookieNotMatch
+			utils.LogErrorf(err, "vid=%d key=%d cookie=%d", this.Id, key, cookie)
+		} else if needle.isExpired(this.data.superblock.TTL, time.Now().Unix()) {
+			// 过期needle在压缩时回收。
+			needle = nil
+			err = errors.ErrNeedleNotExist
+		} else if err = this.decryptNeedle(needle); err != nil {
+			needle = nil
+		}
+	}
+
+	this.rwlock.RUnlock()
+
+	if err == nil {
+		atomic.AddUint64(&this.metrics.ReadCount, 1)
+		atomic.AddUint64(&this.metrics.ReadBytes, uint64(region.Size))
+		atomic.AddUint64(&this.metrics.ReadTime, uint64(time.Now().UnixNano()-now))
+	}
+
+	return
+}
+
+// ======== DeleteNeedle() ========
+// The cookie has to match the one stored in needle as ReadNeedle().
+func (this *Volume) DeleteNeedle(key int64, cookie int32) (err error) {
+	// Append a tombstone needle and a tombstone index entry, so the key is
+	// still deleted after the index is reloaded.
+
+	now := time.Now().UnixNano()
+
+	this.rwlock.Lock()
+	if this.data.shards != nil {
+		this.rwlock.Unlock()
+		return errors.ErrVolumeReadOnly
+	}
+	var region, tombstone_region NeedleRegion
+	var exist bool
+	var header *Needle
+	var appended uint64
+	if region, exist = this.index.GetNeedleRegion(key); !exist {
+		err = errors.ErrNeedleNotExist
+	} else if header, err = this.data.GetNeedleHeader(region); err != nil {
+		utils.LogErrorf(err, "Volume.DeleteNeedle() this.data.GetNeedleHeader() failed.")
+	} else if header.Key != key || header.Cookie != cookie {
+		err = errors.ErrNeedleCookieNotMatch
+		utils.LogErrorf(err, "vid=%d key=%d cookie=%d", this.Id, key, cookie)
+	} else {
+		tombstone := NewTombstoneNeedle(key, cookie)
+		if tombstone_region, err = this.data.DeleteNeedle(tombstone); err == nil {
+			appended = uint64(tombstone_region.Size)
+			tombstone_region.Size = 0
+			if err = this.index.AppendIndexEntry(IndexEntry{key, tombstone_region}); err != nil {
+				utils.LogErrorf(err, "Volume.DeleteNeedle() this.index.AppendIndexEntry() failed.")
+			}
+		} else {
+			utils.LogErrorf(err, "Volume.DeleteNeedle() this.data.DeleteNeedle() failed.")
+		}
+		tombstone.Close()
+	}
+	need_compact := this.needCompaction()
+	writer := this.writer
+	this.rwlock.Unlock()
+
+	// 墓碑同样按SyncPolicy持久化后才应答。
+	if appended > 0 && writer != nil {
+		if e := writer.submit(&writeRequest{size: appended}); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if err == nil {
+		atomic.AddUint64(&this.metrics.DeleteCount, 1)
+		atomic.AddUint64(&this.metrics.DeleteBytes, uint64(region.Size))
+		atomic.AddUint64(&this.metrics.DeleteTime, uint64(time.Now().UnixNano()-now))
+	}
+	if need_compact {
+		this.compactBackground()
+	}
+
+	return
+}
+
+// ======== OpenNeedle() ========
+// Open needle data for streaming without loading it into memory. Cookie is
+// checked as ReadNeedle(). Close the reader when done.
+func (this *Volume) OpenNeedle(key int64, cookie int32) (reader *NeedleReader, err error) {
+	now := time.Now().UnixNano()
+
+	this.rwlock.RLock()
+
+	var region NeedleRegion
+	var exist bool
+	var needle *Needle
+	if region, exist = this.index.GetNeedleRegion(key); !exist {
+		err = errors.ErrNeedleNotExist
+	} else if needle, err = this.data.GetNeedleHeader(region); err != nil {
+		utils.LogErrorf(err, "Volume.OpenNeedle() this.data.GetNeedleHeader() failed.")
+	} else if needle.IsDeleted() || needle.Key != key {
+		err = errors.ErrNeedleNotExist
+	} else if needle.Cookie != cookie {
+		err = errors.ErrNeedleCookieNotMatch
+		utils.LogErrorf(err, "vid=%d key=%d cookie=%d", this.Id, key, cookie)
+	} else if needle.isExpired(this.data.superblock.TTL, time.Now().Unix()) {
+		err = errors.ErrNeedleNotExist
+	} else if err = this.data.getNeedleFooter(region, needle); err == nil {
+		if needle.IsEncrypted() {
+			reader, err = this.openEncryptedNeedle(region, needle)
+		} else if this.data.acquire() {
+			reader = newNeedleReader(this.data, region, needle)
+		} else {
+			err = errors.ErrVolumeNotExist
 		}
 	}
 
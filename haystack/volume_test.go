@@ -0,0 +1,1393 @@
+package haystack
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// -------- newTestVolume() --------
+func newTestVolume(t *testing.T, vid int32) (volume *Volume, dir string) {
+	var err error
+	if dir, err = ioutil.TempDir("", "kds_volume_test"); err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	volume = NewVolume(vid, dir, nil)
+	if err = volume.Init(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	return
+}
+
+// -------- writeTestNeedle() --------
+func writeTestNeedle(t *testing.T, volume *Volume, key int64, cookie int32, data []byte) {
+	needle := NewNeedle(key, cookie, uint32(len(data)))
+	if _, err := needle.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Needle.ReadFrom() failed. %v", err)
+	}
+	if err := volume.WriteNeedle(needle); err != nil {
+		t.Fatalf("Volume.WriteNeedle() failed. key=%d %v", key, err)
+	}
+}
+
+// -------- testDataOffset() --------
+// File offset of needle data in region.
+func testDataOffset(t *testing.T, volume *Volume, region NeedleRegion) int64 {
+	needle, err := volume.data.GetNeedleHeader(region)
+	if err != nil {
+		t.Fatalf("Data.GetNeedleHeader() failed. %v", err)
+	}
+	return int64(region.GetOffset()) + int64(needle.DataOffset())
+}
+
+func TestVolumeDeleteNeedle(t *testing.T) {
+	volume, dir := newTestVolume(t, 1)
+	defer os.RemoveAll(dir)
+
+	writeTestNeedle(t, volume, 1, 11, []byte("needle one"))
+	writeTestNeedle(t, volume, 2, 22, []byte("needle two"))
+
+	if err := volume.DeleteNeedle(1, 11); err != nil {
+		t.Fatalf("Volume.DeleteNeedle() failed. %v", err)
+	}
+	if _, err := volume.ReadNeedle(1, 11); err != errors.ErrNeedleNotExist {
+		t.Errorf("ReadNeedle() after delete, err=%v, want ErrNeedleNotExist", err)
+	}
+	if err := volume.DeleteNeedle(1, 11); err != errors.ErrNeedleNotExist {
+		t.Errorf("DeleteNeedle() twice, err=%v, want ErrNeedleNotExist", err)
+	}
+	if volume.metrics.DeleteCount != 1 {
+		t.Errorf("metrics.DeleteCount=%d, want 1", volume.metrics.DeleteCount)
+	}
+	volume.Close()
+
+	// The tombstone index entry keeps the key deleted after reload.
+	volume = NewVolume(1, dir, nil)
+	if err := volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() reload failed. %v", err)
+	}
+	defer volume.Close()
+	if _, err := volume.ReadNeedle(1, 11); err != errors.ErrNeedleNotExist {
+		t.Errorf("ReadNeedle() after reload, err=%v, want ErrNeedleNotExist", err)
+	}
+	if needle, err := volume.ReadNeedle(2, 22); err != nil || string(needle.Data) != "needle two" {
+		t.Errorf("ReadNeedle(2) after reload failed. err=%v", err)
+	}
+}
+
+func TestVolumeCompact(t *testing.T) {
+	volume, dir := newTestVolume(t, 2)
+	defer os.RemoveAll(dir)
+
+	for key := int64(1); key <= 10; key++ {
+		writeTestNeedle(t, volume, key, int32(key), []byte("first version"))
+	}
+	for key := int64(1); key <= 5; key++ {
+		writeTestNeedle(t, volume, key, int32(key), []byte("second version"))
+	}
+	for key := int64(6); key <= 8; key++ {
+		if err := volume.DeleteNeedle(key, int32(key)); err != nil {
+			t.Fatalf("Volume.DeleteNeedle() failed. %v", err)
+		}
+	}
+
+	old_size := volume.data.FileSize
+	if err := volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	if volume.data.FileSize >= old_size {
+		t.Errorf("data file size %d not reduced from %d", volume.data.FileSize, old_size)
+	}
+	if volume.index.outdated_size != 0 {
+		t.Errorf("outdated_size=%d after compaction, want 0", volume.index.outdated_size)
+	}
+
+	check := func() {
+		for key := int64(1); key <= 10; key++ {
+			needle, err := volume.ReadNeedle(key, int32(key))
+			switch {
+			case key <= 5:
+				if err != nil || string(needle.Data) != "second version" {
+					t.Errorf("ReadNeedle(%d) err=%v", key, err)
+				}
+			case key <= 8:
+				if err != errors.ErrNeedleNotExist {
+					t.Errorf("ReadNeedle(%d) err=%v, want ErrNeedleNotExist", key, err)
+				}
+			default:
+				if err != nil || string(needle.Data) != "first version" {
+					t.Errorf("ReadNeedle(%d) err=%v", key, err)
+				}
+			}
+		}
+	}
+	check()
+	volume.Close()
+
+	volume = NewVolume(2, dir, nil)
+	if err := volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() reload failed. %v", err)
+	}
+	defer volume.Close()
+	check()
+}
+
+func TestVolumeRecoverIndex(t *testing.T) {
+	volume, dir := newTestVolume(t, 3)
+	defer os.RemoveAll(dir)
+
+	writeTestNeedle(t, volume, 1, 11, []byte("indexed needle"))
+	index_size := volume.index.FileSize
+	writeTestNeedle(t, volume, 2, 22, []byte("lost index entry"))
+	if err := volume.DeleteNeedle(1, 11); err != nil {
+		t.Fatalf("Volume.DeleteNeedle() failed. %v", err)
+	}
+	data_size := volume.data.FileSize
+	volume.Close()
+
+	// Drop the last two index entries and append a torn needle.
+	if err := os.Truncate(dir+"/3.idx", int64(index_size)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(dir+"/3.dat", os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(append([]byte{}, headerMagic...))
+	f.Write([]byte{1, 2, 3, 4, 5})
+	f.Close()
+
+	volume = NewVolume(3, dir, nil)
+	if err := volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	if volume.data.FileSize != data_size {
+		t.Errorf("data file size %d, want %d after truncating torn tail", volume.data.FileSize, data_size)
+	}
+	if needle, err := volume.ReadNeedle(2, 22); err != nil || string(needle.Data) != "lost index entry" {
+		t.Errorf("ReadNeedle(2) err=%v", err)
+	}
+	if _, err := volume.ReadNeedle(1, 11); err != errors.ErrNeedleNotExist {
+		t.Errorf("ReadNeedle(1) err=%v, want ErrNeedleNotExist", err)
+	}
+	volume.Close()
+
+	volume = NewVolume(3, dir, nil)
+	if err := volume.Reindex(); err != nil {
+		t.Fatalf("Volume.Reindex() failed. %v", err)
+	}
+	defer volume.Close()
+	if volume.index.indices.Len() != 1 {
+		t.Errorf("%d keys after reindex, want 1", volume.index.indices.Len())
+	}
+}
+
+func TestVolumeReadCorruptedNeedle(t *testing.T) {
+	volume, dir := newTestVolume(t, 4)
+	defer os.RemoveAll(dir)
+	defer volume.Close()
+
+	writeTestNeedle(t, volume, 1, 11, []byte("bit rot happens"))
+	region, _ := volume.index.GetNeedleRegion(1)
+
+	// Flip one byte in the needle data.
+	f, err := os.OpenFile(dir+"/4.dat", os.O_WRONLY, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'B'}, testDataOffset(t, volume, region))
+	f.Close()
+
+	if _, err := volume.ReadNeedle(1, 11); err != errors.ErrNeedleCorrupted {
+		t.Errorf("ReadNeedle() err=%v, want ErrNeedleCorrupted", err)
+	}
+}
+
+func TestVolumeReindexCorruptedNeedle(t *testing.T) {
+	volume, dir := newTestVolume(t, 4)
+	defer os.RemoveAll(dir)
+
+	for key := int64(1); key <= 4; key++ {
+		writeTestNeedle(t, volume, key, 11, []byte("bit rot happens"))
+	}
+	region2, _ := volume.index.GetNeedleRegion(2)
+	region3, _ := volume.index.GetNeedleRegion(3)
+	data_offset := testDataOffset(t, volume, region2)
+	data_size := volume.data.FileSize
+	volume.Close()
+
+	// Flip one data byte of needle 2 and the header magic of needle 3.
+	f, err := os.OpenFile(dir+"/4.dat", os.O_WRONLY, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'B'}, data_offset)
+	f.WriteAt([]byte{0}, int64(region3.GetOffset()))
+	f.Close()
+
+	volume = NewVolume(4, dir, nil)
+	if err := volume.Reindex(); err != nil {
+		t.Fatalf("Volume.Reindex() failed. %v", err)
+	}
+	if volume.data.FileSize != data_size {
+		t.Errorf("data file size %d after reindex, want %d", volume.data.FileSize, data_size)
+	}
+	if _, err := volume.ReadNeedle(1, 11); err != nil {
+		t.Errorf("ReadNeedle(1) err=%v", err)
+	}
+	if _, err := volume.ReadNeedle(2, 11); err != errors.ErrNeedleNotExist {
+		t.Errorf("ReadNeedle(2) err=%v, want ErrNeedleNotExist", err)
+	}
+	// Scanning stops at the broken header, the needles after it are kept.
+	f, _ = os.OpenFile(dir+"/4.dat", os.O_WRONLY, 0664)
+	f.WriteAt(headerMagic[:1], int64(region3.GetOffset()))
+	f.Close()
+	volume.Close()
+	volume = NewVolume(4, dir, nil)
+	if err := volume.Reindex(); err != nil {
+		t.Fatalf("Volume.Reindex() failed. %v", err)
+	}
+	defer volume.Close()
+	for _, key := range []int64{1, 3, 4} {
+		if _, err := volume.ReadNeedle(key, 11); err != nil {
+			t.Errorf("ReadNeedle(%d) after repairing header err=%v", key, err)
+		}
+	}
+}
+
+func TestVolumeCookieNotMatch(t *testing.T) {
+	volume, dir := newTestVolume(t, 5)
+	defer os.RemoveAll(dir)
+	defer volume.Close()
+
+	writeTestNeedle(t, volume, 1, 11, []byte("guess my cookie"))
+
+	if _, err := volume.ReadNeedle(1, 12); err != errors.ErrNeedleCookieNotMatch {
+		t.Errorf("ReadNeedle() err=%v, want ErrNeedleCookieNotMatch", err)
+	}
+	if err := volume.DeleteNeedle(1, 12); err != errors.ErrNeedleCookieNotMatch {
+		t.Errorf("DeleteNeedle() err=%v, want ErrNeedleCookieNotMatch", err)
+	}
+	if _, err := volume.ReadNeedle(1, 11); err != nil {
+		t.Errorf("ReadNeedle() err=%v", err)
+	}
+}
+
+func TestVolumeExclusiveWrite(t *testing.T) {
+	volume, dir := newTestVolume(t, 5)
+	defer os.RemoveAll(dir)
+	defer volume.Close()
+
+	writeTestNeedle(t, volume, 1, 11, []byte("first writer"))
+
+	needle := NewNeedle(1, 12, 0)
+	if err := volume.writeNeedle(needle, true); err != errors.ErrNeedleExist {
+		t.Errorf("exclusive writeNeedle() err=%v, want ErrNeedleExist", err)
+	}
+	if _, err := volume.ReadNeedle(1, 11); err != nil {
+		t.Errorf("ReadNeedle() after exclusive write err=%v", err)
+	}
+	if err := volume.DeleteNeedle(1, 11); err != nil {
+		t.Fatalf("DeleteNeedle() failed. %v", err)
+	}
+	if err := volume.writeNeedle(needle, true); err != nil {
+		t.Errorf("exclusive writeNeedle() of deleted key err=%v", err)
+	}
+	if _, err := volume.ReadNeedle(1, 12); err != nil {
+		t.Errorf("ReadNeedle() err=%v", err)
+	}
+}
+
+func TestVolumeWriteClose(t *testing.T) {
+	volume, dir := newTestVolume(t, 1)
+	defer os.RemoveAll(dir)
+
+	// Writes racing with Close either succeed or fail with ErrVolumeNotExist.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				data := []byte(fmt.Sprintf("needle %d-%d", i, j))
+				needle := NewNeedle(int64(i*100+j), 1, uint32(len(data)))
+				needle.ReadFrom(bytes.NewReader(data))
+				if err := volume.WriteNeedle(needle); err != nil && err != errors.ErrVolumeNotExist {
+					t.Errorf("Volume.WriteNeedle() failed. %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(time.Millisecond)
+	volume.Close()
+	wg.Wait()
+
+	needle := NewNeedle(1000, 1, 5)
+	needle.ReadFrom(bytes.NewReader([]byte("hello")))
+	if err := volume.WriteNeedle(needle); err != errors.ErrVolumeNotExist {
+		t.Errorf("Volume.WriteNeedle() after Close err=%v, want ErrVolumeNotExist", err)
+	}
+}
+
+func TestVolumeConcurrentRead(t *testing.T) {
+	volume, dir := newTestVolume(t, 6)
+	defer os.RemoveAll(dir)
+	defer volume.Close()
+
+	const keys = 64
+	for key := int64(0); key < keys; key++ {
+		writeTestNeedle(t, volume, key, int32(key), []byte(fmt.Sprintf("needle %d %s", key, bytes.Repeat([]byte{'x'}, int(key)*97))))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 500; n++ {
+				key := int64((i*31 + n) % keys)
+				needle, err := volume.ReadNeedle(key, int32(key))
+				if err != nil {
+					t.Errorf("ReadNeedle(%d) err=%v", key, err)
+					return
+				}
+				if want := fmt.Sprintf("needle %d ", key); !bytes.HasPrefix(needle.Data, []byte(want)) {
+					t.Errorf("ReadNeedle(%d) got wrong needle %q", key, needle.Data[:len(want)])
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestVolumeOpenNeedle(t *testing.T) {
+	volume, dir := newTestVolume(t, 7)
+	defer os.RemoveAll(dir)
+	defer volume.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	writeTestNeedle(t, volume, 1, 11, data)
+
+	reader, err := volume.OpenNeedle(1, 11)
+	if err != nil {
+		t.Fatalf("Volume.OpenNeedle() failed. %v", err)
+	}
+	// Compaction swaps the data file while the reader is still open.
+	writeTestNeedle(t, volume, 2, 22, data)
+	volume.DeleteNeedle(2, 22)
+	if err = volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+
+	got, err := ioutil.ReadAll(reader)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read whole needle err=%v len=%d", err, len(got))
+	}
+	part := make([]byte, 10)
+	if _, err = reader.ReadAt(part, 5005); err != nil || string(part) != "5678901234" {
+		t.Errorf("ReadAt() err=%v got %q", err, part)
+	}
+	// The data file has been replaced, sections of it are not opened.
+	if section, err := reader.OpenFileSection(); section != nil || err != nil {
+		t.Errorf("OpenFileSection() of replaced data file section=%v err=%v, want nil", section, err)
+	}
+	reader.Close()
+
+	// The file section covers the needle data only.
+	if reader, err = volume.OpenNeedle(1, 11); err != nil {
+		t.Fatalf("Volume.OpenNeedle() failed. %v", err)
+	}
+	section, err := reader.OpenFileSection()
+	reader.Close()
+	if err != nil || section == nil {
+		t.Fatalf("NeedleReader.OpenFileSection() section=%v err=%v", section, err)
+	}
+	if got, err = ioutil.ReadAll(section); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read file section err=%v len=%d", err, len(got))
+	}
+	if _, err = section.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatalf("FileSection.Seek() failed. %v", err)
+	}
+	var buf bytes.Buffer
+	if n, err := section.WriteTo(&buf); err != nil || n != 10 || buf.String() != "0123456789" {
+		t.Errorf("FileSection.WriteTo() n=%d err=%v got %q", n, err, buf.String())
+	}
+	section.Close()
+
+	if _, err = volume.OpenNeedle(1, 12); err != errors.ErrNeedleCookieNotMatch {
+		t.Errorf("OpenNeedle() err=%v, want ErrNeedleCookieNotMatch", err)
+	}
+
+	// A loaded reader is served from memory.
+	loaded, err := volume.OpenNeedle(1, 11)
+	if err != nil {
+		t.Fatalf("Volume.OpenNeedle() failed. %v", err)
+	}
+	defer loaded.Close()
+	if err = loaded.Load(); err != nil {
+		t.Fatalf("NeedleReader.Load() failed. %v", err)
+	}
+	if section, err := loaded.OpenFileSection(); section != nil || err != nil {
+		t.Errorf("OpenFileSection() of loaded needle section=%v err=%v, want nil", section, err)
+	}
+
+	// Corrupt the data, a sequential read must not return the last chunk.
+	region, _ := volume.index.GetNeedleRegion(1)
+	f, _ := os.OpenFile(dir+"/7.dat", os.O_WRONLY, 0664)
+	f.WriteAt([]byte{'X'}, testDataOffset(t, volume, region)+100)
+	f.Close()
+	if got, err = ioutil.ReadAll(loaded); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read loaded needle err=%v len=%d", err, len(got))
+	}
+	if reader, err = volume.OpenNeedle(1, 11); err != nil {
+		t.Fatalf("Volume.OpenNeedle() failed. %v", err)
+	}
+	defer reader.Close()
+	if _, err = ioutil.ReadAll(reader); err != errors.ErrNeedleCorrupted {
+		t.Errorf("read corrupted needle err=%v, want ErrNeedleCorrupted", err)
+	}
+	if err = reader.Verify(); err != errors.ErrNeedleCorrupted {
+		t.Errorf("Verify() err=%v, want ErrNeedleCorrupted", err)
+	}
+	if err = reader.Load(); err != errors.ErrNeedleCorrupted {
+		t.Errorf("Load() err=%v, want ErrNeedleCorrupted", err)
+	}
+}
+
+func TestVolumeGroupCommit(t *testing.T) {
+	for _, policy := range []string{SYNC_POLICY_ALWAYS, SYNC_POLICY_INTERVAL, SYNC_POLICY_BYTES} {
+		testGroupCommit(t, policy)
+	}
+}
+
+// -------- testGroupCommit() --------
+func testGroupCommit(t *testing.T, policy string) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.SyncPolicy = policy
+	config.SyncInterval = 10 * time.Millisecond
+	config.SyncBytes = 1024
+	volume := NewVolume(8, dir, config)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(key int64) {
+			defer wg.Done()
+			writeTestNeedle(t, volume, key, int32(key), []byte(fmt.Sprintf("needle %d", key)))
+		}(int64(i + 1))
+	}
+	wg.Wait()
+	if err = volume.DeleteNeedle(1, 1); err != nil {
+		t.Fatalf("policy %s Volume.DeleteNeedle() failed. %v", policy, err)
+	}
+	if volume.metrics.WriteCount != 64 {
+		t.Errorf("policy %s metrics.WriteCount=%d, want 64", policy, volume.metrics.WriteCount)
+	}
+	volume.Close()
+
+	// Close() syncs all acked writes.
+	volume = NewVolume(8, dir, config)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	if _, err = volume.ReadNeedle(1, 1); err != errors.ErrNeedleNotExist {
+		t.Errorf("policy %s ReadNeedle() deleted err=%v", policy, err)
+	}
+	for key := int64(2); key <= 64; key++ {
+		needle, err := volume.ReadNeedle(key, int32(key))
+		if err != nil || string(needle.Data) != fmt.Sprintf("needle %d", key) {
+			t.Errorf("policy %s ReadNeedle(%d) err=%v", policy, key, err)
+		}
+	}
+	volume.Close()
+	if err = volume.WriteNeedle(NewNeedle(100, 100, 0)); err != errors.ErrVolumeNotExist {
+		t.Errorf("WriteNeedle() after Close() err=%v, want ErrVolumeNotExist", err)
+	}
+}
+
+func TestVolumeSeal(t *testing.T) {
+	volume, dir := newTestVolume(t, 9)
+	defer os.RemoveAll(dir)
+
+	writeTestNeedle(t, volume, 1, 11, []byte("needle one"))
+	writeTestNeedle(t, volume, 2, 22, []byte("needle two"))
+	if err := volume.Seal(); err != nil {
+		t.Fatalf("Volume.Seal() failed. %v", err)
+	}
+	if err := volume.WriteNeedle(NewNeedle(3, 33, 0)); err != errors.ErrVolumeReadOnly {
+		t.Errorf("WriteNeedle() to sealed volume err=%v, want ErrVolumeReadOnly", err)
+	}
+	if err := volume.DeleteNeedle(1, 11); err != nil {
+		t.Errorf("DeleteNeedle() on sealed volume failed. %v", err)
+	}
+
+	// Compaction keeps the volume sealed.
+	if err := volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	volume.Close()
+
+	volume = NewVolume(9, dir, nil)
+	if err := volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	defer volume.Close()
+	if !volume.IsSealed() {
+		t.Errorf("volume is not sealed after compaction and reload.")
+	}
+	if _, err := volume.ReadNeedle(2, 22); err != nil {
+		t.Errorf("ReadNeedle() from sealed volume failed. %v", err)
+	}
+}
+
+func TestVolumeCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.CheckpointEntries = 1000
+	volume := NewVolume(10, dir, config)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	for key := int64(1); key <= 10; key++ {
+		writeTestNeedle(t, volume, key, int32(key), []byte(fmt.Sprintf("needle %d", key)))
+	}
+	writeTestNeedle(t, volume, 2, 2, []byte("needle 2 again"))
+	volume.DeleteNeedle(3, 3)
+	if err = volume.checkpoint(); err != nil {
+		t.Fatalf("Volume.checkpoint() failed. %v", err)
+	}
+
+	// Entries after the checkpoint are replayed from index file.
+	writeTestNeedle(t, volume, 11, 11, []byte("needle 11"))
+	writeTestNeedle(t, volume, 4, 4, []byte("needle 4 again"))
+	volume.DeleteNeedle(5, 5)
+
+	reload := func(want_checkpointed bool) {
+		index := volume.index
+		indices := index.indices.Len()
+		stats := []uint64{uint64(index.outdated_keys), index.outdated_size, index.total_size, index.data_end}
+		if err := index.loadIndices(); err != nil {
+			t.Fatalf("Index.loadIndices() failed. %v", err)
+		}
+		if (index.checkpointed != 0) != want_checkpointed {
+			t.Errorf("checkpointed=%d, want checkpoint loaded %v", index.checkpointed, want_checkpointed)
+		}
+		got := []uint64{uint64(index.outdated_keys), index.outdated_size, index.total_size, index.data_end}
+		if index.indices.Len() != indices || fmt.Sprint(got) != fmt.Sprint(stats) {
+			t.Errorf("reload %d needles stats %v, want %d needles stats %v", index.indices.Len(), got, indices, stats)
+		}
+		if needle, err := volume.ReadNeedle(4, 4); err != nil || string(needle.Data) != "needle 4 again" {
+			t.Errorf("ReadNeedle(4) after reload err=%v", err)
+		}
+		for _, key := range []int64{3, 5} {
+			if _, err := volume.ReadNeedle(key, int32(key)); err != errors.ErrNeedleNotExist {
+				t.Errorf("ReadNeedle(%d) deleted err=%v", key, err)
+			}
+		}
+	}
+	reload(true)
+
+	// A corrupted checkpoint falls back to full replay.
+	f, _ := os.OpenFile(volume.index.getCheckpointFileName(), os.O_WRONLY, 0664)
+	f.WriteAt([]byte{0xff}, CHECKPOINT_HEADER_SIZE+3)
+	f.Close()
+	reload(false)
+
+	// Compaction replaces the checkpoint along with the index file.
+	if err = volume.checkpoint(); err != nil {
+		t.Fatalf("Volume.checkpoint() failed. %v", err)
+	}
+	if err = volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	if utils.FileExist(newCompactIndex(volume.Id, dir).getCheckpointFileName()) {
+		t.Errorf("compacted checkpoint file left after compaction.")
+	}
+	if volume.index.checkpointed == 0 {
+		t.Errorf("checkpoint not loaded after compaction.")
+	}
+	reload(true)
+
+	// Close writes a checkpoint for the next startup.
+	volume.Close()
+	volume = NewVolume(10, dir, config)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	defer volume.Close()
+	if volume.index.checkpointed != volume.index.FileSize {
+		t.Errorf("checkpointed=%d, want %d", volume.index.checkpointed, volume.index.FileSize)
+	}
+	if volume.index.indices.Len() != 9 {
+		t.Errorf("%d needles loaded, want 9", volume.index.indices.Len())
+	}
+}
+
+func TestVolumeDiskIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := NewConfig()
+	config.IndexMode = INDEX_MODE_DISK
+	config.CheckpointEntries = 0
+	volume := NewVolume(11, dir, config)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	if volume.IndexMode() != INDEX_MODE_DISK {
+		t.Fatalf("IndexMode()=%s, want %s", volume.IndexMode(), INDEX_MODE_DISK)
+	}
+	for key := int64(1); key <= 10; key++ {
+		writeTestNeedle(t, volume, key, int32(key), []byte(fmt.Sprintf("needle %d", key)))
+	}
+	writeTestNeedle(t, volume, 2, 2, []byte("needle 2 again"))
+	volume.DeleteNeedle(3, 3)
+	if err = volume.checkpoint(); err != nil {
+		t.Fatalf("Volume.checkpoint() failed. %v", err)
+	}
+	indices, ok := volume.index.indices.(*diskNeedleMap)
+	if !ok || indices.count != 9 || indices.tail.Len() != 0 {
+		t.Fatalf("indices %T after checkpoint, want diskNeedleMap of 9 entries and empty tail", volume.index.indices)
+	}
+
+	// Changes after the checkpoint stay in memory until the next one.
+	writeTestNeedle(t, volume, 11, 11, []byte("needle 11"))
+	volume.DeleteNeedle(5, 5)
+	check := func() {
+		if needle, err := volume.ReadNeedle(2, 2); err != nil || string(needle.Data) != "needle 2 again" {
+			t.Errorf("ReadNeedle(2) err=%v", err)
+		}
+		if needle, err := volume.ReadNeedle(11, 11); err != nil || string(needle.Data) != "needle 11" {
+			t.Errorf("ReadNeedle(11) err=%v", err)
+		}
+		for _, key := range []int64{3, 5, 12} {
+			if _, err := volume.ReadNeedle(key, int32(key)); err != errors.ErrNeedleNotExist {
+				t.Errorf("ReadNeedle(%d) err=%v, want ErrNeedleNotExist", key, err)
+			}
+		}
+		if n := volume.index.indices.Len(); n != 9 {
+			t.Errorf("%d needles, want 9", n)
+		}
+	}
+	check()
+
+	// The index mode is recorded in superblock, not taken from config on reopen.
+	volume.Close()
+	volume = NewVolume(11, dir, nil)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	defer volume.Close()
+	if !volume.index.disk_mode || volume.index.checkpointed != volume.index.FileSize {
+		t.Errorf("disk_mode=%v checkpointed=%d after reopen, want disk index checkpointed to %d",
+			volume.index.disk_mode, volume.index.checkpointed, volume.index.FileSize)
+	}
+	check()
+
+	// Most missing keys are rejected by the bloom filter.
+	indices = volume.index.indices.(*diskNeedleMap)
+	false_positives := 0
+	for key := int64(1000); key < 11000; key++ {
+		if indices.bloom.mayContain(key) {
+			false_positives++
+		}
+	}
+	if false_positives > 500 {
+		t.Errorf("bloom filter %d false positives of 10000 missing keys", false_positives)
+	}
+
+	// A missing checkpoint is rebuilt from index file, compaction keeps the mode.
+	volume.index.removeCheckpoint()
+	if err = volume.index.loadIndices(); err != nil {
+		t.Fatalf("Index.loadIndices() failed. %v", err)
+	}
+	check()
+	if err = volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	if volume.IndexMode() != INDEX_MODE_DISK || !volume.index.disk_mode {
+		t.Errorf("IndexMode()=%s after compaction, want %s", volume.IndexMode(), INDEX_MODE_DISK)
+	}
+	check()
+	// Compaction streams the copied entries into the new checkpoint.
+	indices, ok = volume.index.indices.(*diskNeedleMap)
+	if !ok || indices.count != 9 || indices.tail.Len() != 0 || volume.index.checkpointed != volume.index.FileSize {
+		t.Errorf("indices %T checkpointed=%d after compaction, want checkpoint of 9 entries to %d",
+			volume.index.indices, volume.index.checkpointed, volume.index.FileSize)
+	}
+	if utils.FileExist(newCompactIndex(11, dir).getCheckpointFileName()) {
+		t.Errorf("compacted checkpoint left after compaction")
+	}
+
+	// Rebuild merges sorted runs of index file, stats are the same as replay.
+	for round := 0; round < 3; round++ {
+		for key := int64(20); key < 25; key++ {
+			writeTestNeedle(t, volume, key, int32(key), []byte(fmt.Sprintf("needle %d round %d", key, round)))
+		}
+		volume.DeleteNeedle(21+int64(round), 21+int32(round))
+	}
+	index := volume.index
+	index.resetIndices()
+	if _, err = index.replayEntries(index.superblock.Size()); err != nil {
+		t.Fatalf("Index.replayEntries() failed. %v", err)
+	}
+	stats := func() []uint64 {
+		return []uint64{uint64(index.outdated_keys), index.outdated_size, index.total_size, index.data_end}
+	}
+	want := stats()
+	var want_entries []needleMapEntry
+	index.indices.Snapshot()(func(key int64, value uint64) bool {
+		want_entries = append(want_entries, needleMapEntry{key, value})
+		return true
+	})
+	index.resetIndices()
+	if _, err = index.rebuildCheckpoint(2); err != nil {
+		t.Fatalf("Index.rebuildCheckpoint() failed. %v", err)
+	}
+	index.resetIndices()
+	if indices, _, err = index.openCheckpointMap(); err != nil {
+		t.Fatalf("Index.openCheckpointMap() failed. %v", err)
+	}
+	index.indices = indices
+	var entries []needleMapEntry
+	indices.Range(func(key int64, value uint64) bool {
+		entries = append(entries, needleMapEntry{key, value})
+		return true
+	})
+	if got := stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("rebuilt outdated_keys, outdated_size, total_size, data_end %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(entries, want_entries) {
+		t.Errorf("rebuilt entries %v, want %v", entries, want_entries)
+	}
+	if matches, _ := filepath.Glob(index.getCheckpointFileName() + CHECKPOINT_RUN_EXT + "*"); len(matches) != 0 {
+		t.Errorf("sorted runs %v left after rebuild", matches)
+	}
+	if needle, err := volume.ReadNeedle(24, 24); err != nil || string(needle.Data) != "needle 24 round 2" {
+		t.Errorf("ReadNeedle(24) after rebuild err=%v", err)
+	}
+
+	// Migration writes the checkpoint of the copy directly.
+	dest := dir + "/dest"
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatalf("os.Mkdir() failed. %v", err)
+	}
+	if err = volume.Migrate(dest); err != nil {
+		t.Fatalf("Volume.Migrate() to %s failed. %v", dest, err)
+	}
+	copied := NewVolume(11, dest, nil)
+	if err = copied.Init(); err != nil {
+		t.Fatalf("Volume.Init() copied volume failed. %v", err)
+	}
+	if !copied.index.disk_mode || copied.index.checkpointed != copied.index.FileSize {
+		t.Errorf("disk_mode=%v checkpointed=%d of copied volume, want disk index checkpointed to %d",
+			copied.index.disk_mode, copied.index.checkpointed, copied.index.FileSize)
+	}
+	if n := copied.index.indices.Len(); n != volume.index.indices.Len() {
+		t.Errorf("copied volume %d needles, want %d", n, volume.index.indices.Len())
+	}
+	copied.Close()
+	os.RemoveAll(dest)
+}
+
+func TestVolumeNeedleMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Volumes created before v2 keep writing v1 needles without metadata.
+	for _, version := range []byte{version1, version2} {
+		vid := int32(11 + version)
+		volume := NewVolume(vid, dir, nil)
+		volume.data.superblock.Version = version
+		if err = volume.Init(); err != nil {
+			t.Fatalf("Volume.Init() failed. %v", err)
+		}
+		needle := NewNeedle(1, 11, 5)
+		needle.ReadFrom(bytes.NewReader([]byte("hello")))
+		needle.Name = "hello.txt"
+		needle.Mime = "text/plain"
+		needle.Meta = map[string]string{"owner": "kds"}
+		if err = volume.WriteNeedle(needle); err != nil {
+			t.Fatalf("Volume.WriteNeedle() failed. %v", err)
+		}
+		mtime := needle.MTime
+		writeTestNeedle(t, volume, 2, 22, []byte("world"))
+		volume.DeleteNeedle(2, 22)
+		volume.Close()
+
+		volume = NewVolume(vid, dir, nil)
+		if err = volume.Init(); err != nil {
+			t.Fatalf("Volume.Init() v%d failed. %v", version, err)
+		}
+		if volume.data.superblock.Version != version {
+			t.Errorf("superblock version %d, want %d", volume.data.superblock.Version, version)
+		}
+		if _, err = volume.ReadNeedle(2, 22); err != errors.ErrNeedleNotExist {
+			t.Errorf("v%d ReadNeedle(2) deleted err=%v", version, err)
+		}
+		if needle, err = volume.ReadNeedle(1, 11); err != nil || string(needle.Data) != "hello" {
+			t.Fatalf("v%d ReadNeedle() err=%v", version, err)
+		}
+		reader, err := volume.OpenNeedle(1, 11)
+		if err != nil {
+			t.Fatalf("v%d OpenNeedle() failed. %v", version, err)
+		}
+		if data, err := ioutil.ReadAll(reader); err != nil || string(data) != "hello" {
+			t.Errorf("v%d NeedleReader data %q err=%v", version, data, err)
+		}
+		reader.Close()
+
+		for _, got := range []*Needle{needle, reader.Needle} {
+			if version == version1 {
+				if got.MTime != 0 || got.Name != "" || got.Meta != nil {
+					t.Errorf("v1 needle has metadata. %s", got.String())
+				}
+			} else if got.MTime != mtime || got.Name != "hello.txt" || got.Mime != "text/plain" || got.Meta["owner"] != "kds" {
+				t.Errorf("v2 needle metadata lost. %s", got.String())
+			}
+		}
+		volume.Close()
+	}
+}
+
+func TestVolumeLargeNeedle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20*1024*1024/16)
+	for _, version := range []byte{version2, version3} {
+		vid := int32(20 + version)
+		volume := NewVolume(vid, dir, nil)
+		volume.data.superblock.Version = version
+		volume.index.superblock.Version = version
+		if err = volume.Init(); err != nil {
+			t.Fatalf("Volume.Init() failed. %v", err)
+		}
+
+		needle := NewNeedle(1, 11, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		err = volume.WriteNeedle(needle)
+		if version < version3 {
+			// Volumes with the old index format still take small needles.
+			if err != errors.ErrNeedleTooLarge {
+				t.Errorf("v%d WriteNeedle() %d bytes err=%v, want ErrNeedleTooLarge", version, len(data), err)
+			}
+			writeTestNeedle(t, volume, 2, 22, []byte("small"))
+		} else if err != nil {
+			t.Fatalf("v%d WriteNeedle() %d bytes failed. %v", version, len(data), err)
+		}
+		volume.Close()
+
+		volume = NewVolume(vid, dir, nil)
+		if err = volume.Init(); err != nil {
+			t.Fatalf("Volume.Init() v%d failed. %v", version, err)
+		}
+		if version < version3 {
+			if needle, err = volume.ReadNeedle(2, 22); err != nil || string(needle.Data) != "small" {
+				t.Errorf("v%d ReadNeedle() err=%v", version, err)
+			}
+		} else if needle, err = volume.ReadNeedle(1, 11); err != nil || !bytes.Equal(needle.Data, data) {
+			t.Errorf("v%d ReadNeedle() %d bytes err=%v", version, len(data), err)
+		}
+		volume.Close()
+	}
+}
+
+func TestVolumeMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dest := dir + "/dest"
+	if err = os.Mkdir(dest, 0755); err != nil {
+		t.Fatalf("os.Mkdir() failed. %v", err)
+	}
+
+	volume := NewVolume(1, dir, nil)
+	volume.data.superblock.Version = version1
+	volume.index.superblock.Version = version1
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	writeTestNeedle(t, volume, 1, 11, []byte("hello"))
+	writeTestNeedle(t, volume, 2, 22, []byte("world"))
+	volume.DeleteNeedle(2, 22)
+	volume.Close()
+
+	check := func(volume *Volume) {
+		if needle, err := volume.ReadNeedle(1, 11); err != nil || string(needle.Data) != "hello" {
+			t.Errorf("ReadNeedle(1) err=%v", err)
+		}
+		if _, err := volume.ReadNeedle(2, 22); err != errors.ErrNeedleNotExist {
+			t.Errorf("ReadNeedle(2) deleted err=%v", err)
+		}
+	}
+
+	// Copy to another dir, the original is unchanged.
+	volume = NewVolume(1, dir, nil)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	if err = volume.Migrate(dest); err != nil {
+		t.Fatalf("Volume.Migrate() to %s failed. %v", dest, err)
+	}
+	if volume.data.superblock.Version != version1 {
+		t.Errorf("source superblock version %d after copy, want 1", volume.data.superblock.Version)
+	}
+	if err = volume.Migrate(dest); err == nil {
+		t.Errorf("Volume.Migrate() over an existing volume succeeded.")
+	}
+	volume.Close()
+
+	copied := NewVolume(1, dest, nil)
+	if err = copied.Init(); err != nil {
+		t.Fatalf("Volume.Init() copied volume failed. %v", err)
+	}
+	if copied.data.superblock.Version != blockVersion || copied.data.superblock.CreatedAt == 0 {
+		t.Errorf("copied superblock %s", copied.data.superblock.String())
+	}
+	check(copied)
+	copied.Close()
+	// Every volume preallocates its data file.
+	os.RemoveAll(dest)
+
+	// In place, then new needles carry metadata.
+	config := NewConfig()
+	config.Collection = "photos"
+	volume = NewVolume(1, dir, config)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	if err = volume.Migrate(""); err != nil {
+		t.Fatalf("Volume.Migrate() in place failed. %v", err)
+	}
+	check(volume)
+	needle := NewNeedle(3, 33, 3)
+	needle.ReadFrom(bytes.NewReader([]byte("new")))
+	needle.Name = "new.txt"
+	if err = volume.WriteNeedle(needle); err != nil {
+		t.Fatalf("Volume.WriteNeedle() failed. %v", err)
+	}
+	volume.Close()
+
+	volume = NewVolume(1, dir, config)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() migrated volume failed. %v", err)
+	}
+	defer volume.Close()
+	superblock := volume.data.superblock
+	if superblock.Version != blockVersion || superblock.NeedleFormat != needleFormat || superblock.Collection != "" {
+		t.Errorf("migrated superblock %s", superblock.String())
+	}
+	check(volume)
+	if needle, err = volume.ReadNeedle(3, 33); err != nil || needle.Name != "new.txt" {
+		t.Errorf("ReadNeedle(3) after migration err=%v", err)
+	}
+}
+
+func TestVolumeRewriteWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	volume := NewVolume(1, dir, nil)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	defer volume.Close()
+	for key := int64(1); key <= 3; key++ {
+		writeTestNeedle(t, volume, key, int32(key), []byte(fmt.Sprintf("needle %d", key)))
+	}
+
+	// Writes and deletes go on while needles are rewritten, and are replayed
+	// to the new files before the swap.
+	converted := 0
+	_, _, err = volume.rewrite("", volume.data.superblock.clone(), func(needle *Needle) (*Needle, error) {
+		if converted++; converted == 1 {
+			writeTestNeedle(t, volume, 4, 4, []byte("needle 4"))
+			writeTestNeedle(t, volume, 1, 1, []byte("needle 1 again"))
+			if err := volume.DeleteNeedle(2, 2); err != nil {
+				t.Errorf("Volume.DeleteNeedle() while rewriting failed. %v", err)
+			}
+			if err := volume.Compact(); err != errors.ErrVolumeCompacting {
+				t.Errorf("Volume.Compact() while rewriting err=%v, want ErrVolumeCompacting", err)
+			}
+		}
+		return needle, nil
+	})
+	if err != nil {
+		t.Fatalf("Volume.rewrite() failed. %v", err)
+	}
+	if needle, err := volume.ReadNeedle(1, 1); err != nil || string(needle.Data) != "needle 1 again" {
+		t.Errorf("ReadNeedle(1) after rewrite err=%v", err)
+	}
+	if _, err := volume.ReadNeedle(2, 2); err != errors.ErrNeedleNotExist {
+		t.Errorf("ReadNeedle(2) after rewrite err=%v, want ErrNeedleNotExist", err)
+	}
+	for _, key := range []int64{3, 4} {
+		if needle, err := volume.ReadNeedle(key, int32(key)); err != nil || string(needle.Data) != fmt.Sprintf("needle %d", key) {
+			t.Errorf("ReadNeedle(%d) after rewrite err=%v", key, err)
+		}
+	}
+	if n := volume.index.indices.Len(); n != 3 {
+		t.Errorf("%d needles after rewrite, want 3", n)
+	}
+}
+
+func TestSuperBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	superblock := NewSuperBlock()
+	superblock.Flags = superblockFlagDiskIndex
+	superblock.Collection = "photos"
+	superblock.Replication = "001"
+	superblock.TTL = 3600
+	superblock.Codec = CODEC_GZIP
+	file, err := os.Create(dir + "/superblock")
+	if err != nil {
+		t.Fatalf("os.Create() failed. %v", err)
+	}
+	defer file.Close()
+	size, err := superblock.WriteToFile(file)
+	if err != nil || size != superblock.Size() || size%NEEDLE_PADDINGSIZE != 0 {
+		t.Fatalf("SuperBlock.WriteToFile() size=%d err=%v", size, err)
+	}
+
+	file.Seek(0, io.SeekStart)
+	read := new(SuperBlock)
+	if err = read.ReadFromFile(file); err != nil {
+		t.Fatalf("SuperBlock.ReadFromFile() failed. %v", err)
+	}
+	if read.String() != superblock.String() {
+		t.Errorf("read superblock %s, want %s", read.String(), superblock.String())
+	}
+
+	// Corrupted metadata is rejected.
+	file.WriteAt([]byte{'x'}, int64(size)-8)
+	file.Seek(0, io.SeekStart)
+	if err = new(SuperBlock).ReadFromFile(file); err == nil {
+		t.Errorf("SuperBlock.ReadFromFile() of corrupted superblock succeeded.")
+	}
+}
+
+func TestVolumeEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_volume_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	master := bytes.Repeat([]byte{0x5a}, MASTER_KEY_SIZE)
+	open := func(master []byte) (*Volume, error) {
+		config := NewConfig()
+		config.MasterKey = master
+		volume := NewVolume(1, dir, config)
+		return volume, volume.Init()
+	}
+	volume, err := open(master)
+	if err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	if volume.data.superblock.DataKey == nil {
+		t.Fatalf("new volume has no data key.")
+	}
+	secret := bytes.Repeat([]byte("top secret "), 100)
+	writeTestNeedle(t, volume, 1, 11, secret)
+	writeTestNeedle(t, volume, 2, 22, []byte("deleted"))
+	volume.DeleteNeedle(2, 22)
+
+	check := func(volume *Volume) {
+		if needle, err := volume.ReadNeedle(1, 11); err != nil || !bytes.Equal(needle.Data, secret) || needle.IsEncrypted() {
+			t.Errorf("ReadNeedle(1) err=%v", err)
+		}
+		reader, err := volume.OpenNeedle(1, 11)
+		if err != nil {
+			t.Fatalf("OpenNeedle(1) failed. %v", err)
+		}
+		defer reader.Close()
+		if data, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(data, secret) {
+			t.Errorf("OpenNeedle(1) read err=%v", err)
+		}
+		if _, err := volume.ReadNeedle(2, 22); err != errors.ErrNeedleNotExist {
+			t.Errorf("ReadNeedle(2) deleted err=%v", err)
+		}
+	}
+	check(volume)
+
+	// Only headers are plaintext on disk, compaction needs no key.
+	if err = volume.Compact(); err != nil {
+		t.Fatalf("Volume.Compact() failed. %v", err)
+	}
+	check(volume)
+	volume.Close()
+	content, _ := ioutil.ReadFile(volume.data.getDataFileName())
+	if bytes.Contains(content, []byte("top secret")) {
+		t.Errorf("plaintext found in data file.")
+	}
+
+	if volume, err = open(nil); err == nil {
+		volume.Close()
+		t.Errorf("encrypted volume opened without master key.")
+	}
+	wrong := bytes.Repeat([]byte{0x01}, MASTER_KEY_SIZE)
+	if volume, err = open(wrong); err == nil {
+		volume.Close()
+		t.Errorf("encrypted volume opened with a wrong master key.")
+	}
+
+	// Rotate both data key and master key.
+	if volume, err = open(master); err != nil {
+		t.Fatalf("Volume.Init() failed. %v", err)
+	}
+	old_key := volume.data.superblock.DataKey
+	if err = volume.Rekey(wrong); err != nil {
+		t.Fatalf("Volume.Rekey() failed. %v", err)
+	}
+	if bytes.Equal(volume.data.superblock.DataKey, old_key) {
+		t.Errorf("data key unchanged after rekey.")
+	}
+	check(volume)
+	volume.Close()
+
+	if volume, err = open(master); err == nil {
+		volume.Close()
+		t.Errorf("rekeyed volume opened with the old master key.")
+	}
+	if volume, err = open(wrong); err != nil {
+		t.Fatalf("Volume.Init() with new master key failed. %v", err)
+	}
+	defer volume.Close()
+	check(volume)
+}
+
+func TestVolumeErasureCoding(t *testing.T) {
+	volume, dir := newTestVolume(t, 1)
+	defer os.RemoveAll(dir)
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		d := fmt.Sprintf("%s/ec%d", dir, i)
+		os.Mkdir(d, 0755)
+		dirs = append(dirs, d)
+	}
+
+	large := make([]byte, 3*EC_BLOCK_SIZE+12345)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+	writeTestNeedle(t, volume, 1, 11, []byte("hello"))
+	writeTestNeedle(t, volume, 2, 22, large)
+	writeTestNeedle(t, volume, 3, 33, []byte("world"))
+
+	if err := volume.EcEncode(dirs, 2, 2); err == nil {
+		t.Errorf("Volume.EcEncode() of unsealed volume succeeded.")
+	}
+	volume.Seal()
+	if err := volume.EcEncode(dirs, 2, 2); err != nil {
+		t.Fatalf("Volume.EcEncode() failed. %v", err)
+	}
+	if !volume.IsErasureCoded() || utils.FileExist(volume.data.getDataFileName()) {
+		t.Errorf("volume not erasure coded.")
+	}
+
+	check := func(volume *Volume) {
+		for key, data := range map[int64][]byte{1: []byte("hello"), 2: large, 3: []byte("world")} {
+			if needle, err := volume.ReadNeedle(key, int32(key*11)); err != nil || !bytes.Equal(needle.Data, data) {
+				t.Errorf("ReadNeedle(%d) err=%v", key, err)
+			}
+		}
+		reader, err := volume.OpenNeedle(2, 22)
+		if err != nil {
+			t.Fatalf("OpenNeedle(2) failed. %v", err)
+		}
+		defer reader.Close()
+		if data, err := ioutil.ReadAll(reader); err != nil || !bytes.Equal(data, large) {
+			t.Errorf("OpenNeedle(2) read err=%v", err)
+		}
+	}
+	check(volume)
+	if err := volume.DeleteNeedle(1, 11); err != errors.ErrVolumeReadOnly {
+		t.Errorf("DeleteNeedle() on erasure coded volume err=%v", err)
+	}
+	volume.Close()
+
+	// Up to m shards missing are reconstructed on read.
+	config := NewConfig()
+	config.EcDirs = dirs
+	open := func() (*Volume, error) {
+		volume := NewVolume(1, dir, config)
+		return volume, volume.Init()
+	}
+	os.Remove(ecShardFileName(dirs[0], 1, 0))
+	os.Remove(ecShardFileName(dirs[1], 1, 1))
+	volume, err := open()
+	if err != nil {
+		t.Fatalf("Volume.Init() with 2 shards missing failed. %v", err)
+	}
+	check(volume)
+
+	if err = volume.EcDecode(); err != nil {
+		t.Fatalf("Volume.EcDecode() failed. %v", err)
+	}
+	if volume.IsErasureCoded() || utils.FileExist(ecMetaFileName(dir, 1)) || utils.FileExist(ecShardFileName(dirs[2], 1, 2)) {
+		t.Errorf("shards remain after decoding.")
+	}
+	check(volume)
+	volume.Close()
+
+	if volume, err = open(); err != nil {
+		t.Fatalf("Volume.Init() decoded volume failed. %v", err)
+	}
+	defer volume.Close()
+	check(volume)
+	if !volume.IsSealed() {
+		t.Errorf("decoded volume not sealed.")
+	}
+}
+
+func TestVolumeErasureCodingDelete(t *testing.T) {
+	volume, dir := newTestVolume(t, 1)
+	defer os.RemoveAll(dir)
+	const needles = 200
+	for key := int64(1); key <= needles; key++ {
+		writeTestNeedle(t, volume, key, int32(key), bytes.Repeat([]byte{byte(key)}, 100000))
+	}
+	volume.Seal()
+
+	// Deletes go on while encoding, until the volume turns read only.
+	deleted := make(map[int64]bool)
+	encoded := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for key := int64(1); key <= needles; key++ {
+			select {
+			case <-encoded:
+				return
+			default:
+			}
+			if err := volume.DeleteNeedle(key, int32(key)); err == nil {
+				deleted[key] = true
+			} else if err != errors.ErrVolumeReadOnly {
+				t.Errorf("DeleteNeedle(%d) while encoding err=%v", key, err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	err := volume.EcEncode(nil, 2, 1)
+	close(encoded)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Volume.EcEncode() failed. %v", err)
+	}
+
+	check := func(volume *Volume) {
+		for key := int64(1); key <= needles; key++ {
+			needle, err := volume.ReadNeedle(key, int32(key))
+			if deleted[key] && err != errors.ErrNeedleNotExist {
+				t.Errorf("ReadNeedle(%d) deleted while encoding err=%v", key, err)
+			} else if !deleted[key] && (err != nil || !bytes.Equal(needle.Data, bytes.Repeat([]byte{byte(key)}, 100000))) {
+				t.Errorf("ReadNeedle(%d) err=%v", key, err)
+			}
+		}
+	}
+	check(volume)
+	volume.Close()
+	volume = NewVolume(1, dir, nil)
+	if err = volume.Init(); err != nil {
+		t.Fatalf("Volume.Init() erasure coded volume failed. %v", err)
+	}
+	defer volume.Close()
+	check(volume)
+}
+
+func TestEcShardsEncodeTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_ec_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 90)
+	for i := range data {
+		data[i] = byte(i*13 + 1)
+	}
+	newShards := func(vid int32, size int64) *ecShards {
+		shards := &ecShards{vid: vid, dir: dir, k: 2, m: 2, block_size: 16, size: size, files: make([]*os.File, 4)}
+		if shards.encoder, err = reedsolomon.New(2, 2); err != nil {
+			t.Fatalf("reedsolomon.New() failed. %v", err)
+		}
+		for i := range shards.files {
+			if shards.files[i], err = os.Create(ecShardFileName(dir, vid, i)); err != nil {
+				t.Fatalf("os.Create() failed. %v", err)
+			}
+		}
+		return shards
+	}
+
+	// Rows grown after encoding are encoded again from the last partial row.
+	whole := newShards(1, int64(len(data)))
+	defer whole.Close()
+	if err = whole.encode(bytes.NewReader(data), 0); err != nil {
+		t.Fatalf("ecShards.encode() failed. %v", err)
+	}
+	grown := newShards(2, 50)
+	defer grown.Close()
+	if err = grown.encode(bytes.NewReader(data[:50]), 0); err != nil {
+		t.Fatalf("ecShards.encode() failed. %v", err)
+	}
+	grown.size = int64(len(data))
+	if err = grown.encode(bytes.NewReader(data), 50/32); err != nil {
+		t.Fatalf("ecShards.encode() tail failed. %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		want, _ := ioutil.ReadFile(ecShardFileName(dir, 1, i))
+		got, _ := ioutil.ReadFile(ecShardFileName(dir, 2, i))
+		if len(want) != 48 || !bytes.Equal(got, want) {
+			t.Errorf("shard %d after encoding tail %x, want %x", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package haystack
+
+import (
+	"github.com/uukuguy/kds/store/errors"
+	"github.com/uukuguy/kds/utils"
+	"sync"
+	"time"
+)
+
+const (
+	// 一批最多合并的写请求数与字节数。
+	WRITER_MAX_BATCH      = 128
+	WRITER_MAX_BATCHSIZE  = 8 * 1024 * 1024
+	WRITER_REQUEST_BUFFER = 1024
+)
+
+// **************** writeRequest ****************
+type writeRequest struct {
+	// needle为nil时只等待之前追加的size字节达到持久化要求（如删除时追加的墓碑）。
+	needle *Needle
+	size   uint64
+	// 为true时卷中已有同一key的needle则返回errors.ErrNeedleExist，不覆盖。
+	exclusive bool
+	region    NeedleRegion
+	err       error
+	done      chan struct{}
+}
+
+// **************** volumeWriter ****************
+// 每个卷一个写goroutine，把并发的写请求合并成一次追加和一次fsync（group commit），
+// 按Config.SyncPolicy达到持久化要求后才应答。
+type volumeWriter struct {
+	volume   *Volume
+	config   *Config
+	requests chan *writeRequest
+	quit     chan struct{}
+	done     chan struct{}
+	lock     sync.RWMutex // 保护closed，停止时等待正在提交的请求进入队列。
+	closed   bool
+	unsynced uint64 // 自上次fsync后追加的字节数，只在写goroutine中访问。
+}
+
+// -------- newVolumeWriter() --------
+func newVolumeWriter(volume *Volume, config *Config) *volumeWriter {
+	return &volumeWriter{
+		volume:   volume,
+		config:   config,
+		requests: make(chan *writeRequest, WRITER_REQUEST_BUFFER),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// -------- start() --------
+func (this *volumeWriter) start() {
+	go this.run()
+}
+
+// -------- stop() --------
+// Commit pending requests, sync and wait the writer goroutine to exit.
+func (this *volumeWriter) stop() {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return
+	}
+	this.closed = true
+	close(this.quit)
+	this.lock.Unlock()
+
+	<-this.done
+}
+
+// -------- submit() --------
+// Queue the request and wait until it is committed.
+func (this *volumeWriter) submit(req *writeRequest) error {
+	req.done = make(chan struct{})
+
+	this.lock.RLock()
+	if this.closed {
+		this.lock.RUnlock()
+		return errors.ErrVolumeNotExist
+	}
+	this.requests <- req
+	this.lock.RUnlock()
+
+	<-req.done
+	return req.err
+}
+
+// -------- run() --------
+func (this *volumeWriter) run() {
+	defer close(this.done)
+
+	var tick <-chan time.Time
+	if this.config.SyncPolicy == SYNC_POLICY_INTERVAL {
+		ticker := time.NewTicker(this.config.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := make([]*writeRequest, 0, WRITER_MAX_BATCH)
+	for {
+		select {
+		case req := <-this.requests:
+			this.commit(this.collect(append(batch[:0], req)))
+		case <-tick:
+			if this.unsynced > 0 {
+				this.sync()
+			}
+		case <-this.quit:
+			this.drain(batch)
+			return
+		}
+	}
+}
+
+// -------- drain() --------
+// submit()在关闭后不再入队，提交剩余请求并同步后即可退出。
+func (this *volumeWriter) drain(batch []*writeRequest) {
+	for {
+		select {
+		case req := <-this.requests:
+			this.commit(this.collect(append(batch[:0], req)))
+		default:
+			if this.unsynced > 0 {
+				this.sync()
+			}
+			return
+		}
+	}
+}
+
+// -------- collect() --------
+// Take more queued requests without waiting, up to the batch limits.
+func (this *volumeWriter) collect(batch []*writeRequest) []*writeRequest {
+	var size uint64
+	for _, req := range batch {
+		size += this.requestSize(req)
+	}
+	for len(batch) < WRITER_MAX_BATCH && size < WRITER_MAX_BATCHSIZE {
+		select {
+		case req := <-this.requests:
+			batch = append(batch, req)
+			size += this.requestSize(req)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// -------- requestSize() --------
+func (this *volumeWriter) requestSize(req *writeRequest) uint64 {
+	if req.needle == nil {
+		return req.size
+	}
+	// 元数据在追加时才编码，这里只是估计值。
+	return needleWriteSize(req.needle.Version, 0, req.needle.Size)
+}
+
+// -------- commit() --------
+func (this *volumeWriter) commit(batch []*writeRequest) {
+	volume := this.volume
+
+	volume.rwlock.Lock()
+	this.unsynced += volume.appendNeedles(batch)
+	need_compact := volume.needCompaction()
+	need_checkpoint := volume.needCheckpoint()
+	volume.rwlock.Unlock()
+
+	var err error
+	switch this.config.SyncPolicy {
+	case SYNC_POLICY_ALWAYS:
+		err = this.sync()
+	case SYNC_POLICY_BYTES:
+		if this.unsynced >= this.config.SyncBytes {
+			err = this.sync()
+		}
+	}
+
+	for _, req := range batch {
+		if req.err == nil {
+			req.err = err
+		}
+		close(req.done)
+	}
+
+	if need_compact {
+		volume.compactBackground()
+	} else if need_checkpoint {
+		volume.checkpointBackground()
+	}
+}
+
+// -------- sync() --------
+func (this *volumeWriter) sync() (err error) {
+	// 追加都在写锁内进行，同步时持有读锁即可与追加及压缩替换文件互斥，不阻塞读取。
+	volume := this.volume
+	volume.rwlock.RLock()
+	err = volume.syncFiles()
+	volume.rwlock.RUnlock()
+
+	if err != nil {
+		utils.LogErrorf(err, "Volume %d sync failed.", volume.Id)
+		return
+	}
+	this.unsynced = 0
+	return
+}
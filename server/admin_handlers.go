@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/subtle"
+	"github.com/labstack/echo"
+	"github.com/uukuguy/kds/haystack"
+	"github.com/uukuguy/kds/store/errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// 管理接口的路径前缀，不能用作bucket名。
+	ADMIN_PATH_PREFIX = "/_admin"
+
+	// 管理接口请求须在该请求头中带上配置的管理令牌。
+	ADMIN_TOKEN_HEADER = "X-Kds-Admin-Token"
+)
+
+// **************** AdminStatus ****************
+type AdminStatus struct {
+	Volumes int                     `json:"volumes"`
+	Faulty  []haystack.FaultyVolume `json:"faulty"`
+	Disks   []haystack.DiskStat     `json:"disks"`
+}
+
+// **************** RecoverResult ****************
+type RecoverResult struct {
+	Vid       int32  `json:"vid,omitempty"`
+	Recovered int    `json:"recovered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// -------- registerAdminHandlers() --------
+//
+//	GET  /_admin/status                 卷数、故障卷和磁盘状态
+//	POST /_admin/faulty/retry           重试加载全部故障卷
+//	POST /_admin/faulty/:vid/retry      重试加载故障卷
+//	POST /_admin/faulty/:vid/repair     重建索引修复故障卷
+//	POST /_admin/volumes/:vid/demote    卷数据文件移到冷存储
+//	POST /_admin/volumes/:vid/promote   卷数据文件移回热存储
+//
+// 管理接口与数据接口共用端口，请求头ADMIN_TOKEN_HEADER须与SetAdminToken()
+// 设置的令牌一致，未设置令牌时管理接口关闭。
+func (this *StackServer) registerAdminHandlers() {
+	this.mux.Get(ADMIN_PATH_PREFIX+"/status", this.adminOnly(this.StatusHandler))
+	this.mux.Post(ADMIN_PATH_PREFIX+"/faulty/retry", this.adminOnly(this.RetryAllHandler))
+	this.mux.Post(ADMIN_PATH_PREFIX+"/faulty/:vid/retry", this.adminOnly(this.RetryHandler))
+	this.mux.Post(ADMIN_PATH_PREFIX+"/faulty/:vid/repair", this.adminOnly(this.RepairHandler))
+	this.mux.Post(ADMIN_PATH_PREFIX+"/volumes/:vid/demote", this.adminOnly(this.DemoteHandler))
+	this.mux.Post(ADMIN_PATH_PREFIX+"/volumes/:vid/promote", this.adminOnly(this.PromoteHandler))
+}
+
+// ======== SetAdminToken() ========
+// Token required by the admin API, empty to disable it.
+func (this *StackServer) SetAdminToken(token string) {
+	this.admin_token = token
+}
+
+// -------- adminOnly() --------
+func (this *StackServer) adminOnly(handler echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if this.admin_token == "" {
+			return ctx.HTML(http.StatusForbidden, "Admin API disabled.\n")
+		}
+		r, _ := httpRequestResponse(ctx)
+		token := r.Header.Get(ADMIN_TOKEN_HEADER)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(this.admin_token)) != 1 {
+			return ctx.HTML(http.StatusUnauthorized, "Invalid admin token.\n")
+		}
+		return handler(ctx)
+	}
+}
+
+// ======== StatusHandler() ========
+func (this *StackServer) StatusHandler(ctx echo.Context) (err error) {
+	status := AdminStatus{
+		Faulty: this.store.FaultyVolumes(),
+		Disks:  this.store.DiskStats(),
+	}
+	for _, disk := range status.Disks {
+		status.Volumes += disk.Volumes
+	}
+	return ctx.JSON(http.StatusOK, status)
+}
+
+// ======== RetryAllHandler() ========
+func (this *StackServer) RetryAllHandler(ctx echo.Context) (err error) {
+	result := RecoverResult{Recovered: this.store.RetryFaultyVolumes()}
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// ======== RetryHandler() ========
+func (this *StackServer) RetryHandler(ctx echo.Context) (err error) {
+	return this.recoverVolume(ctx, this.store.RetryVolume)
+}
+
+// ======== RepairHandler() ========
+func (this *StackServer) RepairHandler(ctx echo.Context) (err error) {
+	return this.recoverVolume(ctx, this.store.RepairVolume)
+}
+
+// ======== DemoteHandler() ========
+func (this *StackServer) DemoteHandler(ctx echo.Context) (err error) {
+	return this.tierVolume(ctx, this.store.DemoteVolume)
+}
+
+// ======== PromoteHandler() ========
+func (this *StackServer) PromoteHandler(ctx echo.Context) (err error) {
+	return this.tierVolume(ctx, this.store.PromoteVolume)
+}
+
+// -------- tierVolume() --------
+func (this *StackServer) tierVolume(ctx echo.Context, move func(int32) error) (err error) {
+	var vid int64
+	if vid, err = strconv.ParseInt(ctx.Param("vid"), 10, 32); err != nil {
+		return ctx.HTML(http.StatusBadRequest, "Invalid vid.\n")
+	}
+	if err = move(int32(vid)); err != nil {
+		switch err {
+		case errors.ErrVolumeNotExist:
+			return ctx.HTML(http.StatusNotFound, "Volume not exist.\n")
+		case errors.ErrVolumeFaulty, errors.ErrVolumeCompacting:
+			return ctx.HTML(http.StatusServiceUnavailable, err.Error()+"\n")
+		}
+		return ctx.HTML(http.StatusBadRequest, err.Error()+"\n")
+	}
+	return ctx.HTML(http.StatusOK, "Volume moved.\n")
+}
+
+// -------- recoverVolume() --------
+func (this *StackServer) recoverVolume(ctx echo.Context, open func(int32) (*haystack.Volume, error)) (err error) {
+	var vid int64
+	if vid, err = strconv.ParseInt(ctx.Param("vid"), 10, 32); err != nil {
+		return ctx.HTML(http.StatusBadRequest, "Invalid vid.\n")
+	}
+
+	result := RecoverResult{Vid: int32(vid)}
+	if _, err = open(int32(vid)); err != nil {
+		if err == errors.ErrVolumeNotExist {
+			return ctx.HTML(http.StatusNotFound, "Volume not exist.\n")
+		}
+		result.Error = err.Error()
+		return ctx.JSON(http.StatusServiceUnavailable, result)
+	}
+	result.Recovered = 1
+	return ctx.JSON(http.StatusOK, result)
+}
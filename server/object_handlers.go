@@ -29,11 +29,15 @@ package server
 import (
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/uukuguy/kds/haystack"
+	"github.com/uukuguy/kds/store/errors"
 	"net/http"
+	"strconv"
 )
 
 // **************** ObjectHandlers ****************
 type ObjectHandlers struct {
+	Store *haystack.Store
 }
 
 // ======== Handle_DeleteObject ========
@@ -62,5 +66,40 @@ func (oh ObjectHandlers) Handle_PutObject(w http.ResponseWriter, r *http.Request
 
 // ======== Handle_DeleteObject ========
 func (oh ObjectHandlers) Handle_DeleteObject(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	vid, err := strconv.ParseInt(query.Get("vid"), 10, 32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := strconv.ParseInt(query.Get("key"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cookie, err := strconv.ParseInt(query.Get("cookie"), 10, 32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	if oh.Store == nil {
+		http.Error(w, "Store not ready.", http.StatusServiceUnavailable)
+		return
+	}
+	// 与StackServer.DeleteHandler()相同，chunk和去重的数据needle一并处理。
+	if err = oh.Store.DeleteObject(int32(vid), key, int32(cookie)); err != nil {
+		switch err {
+		case errors.ErrVolumeNotExist:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.ErrVolumeFaulty:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case errors.ErrNeedleNotExist, errors.ErrNeedleCookieNotMatch:
+			http.Error(w, errors.ErrNeedleNotExist.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
@@ -2,20 +2,36 @@ package server
 
 import (
 	//"github.com/AsynkronIT/gam/actor"
+	"bytes"
 	"fmt"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/engine/standard"
 	"github.com/uukuguy/kds/haystack"
 	"github.com/uukuguy/kds/store/errors"
 	"github.com/uukuguy/kds/utils"
+	"io"
+	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	UPLOADFILE_MAXSIZE = 1024 * 1024 * 16
+	// 不大于该值的needle在下载前先整体读入内存校验checksum。
+	DOWNLOAD_VERIFY_MAXSIZE = 1024 * 1024
+	// 客户端不接受压缩编码时，解压后不大于该值的needle在内存中解压，支持Range；
+	// 更大的needle边读边解压，忽略Range。
+	DOWNLOAD_DECOMPRESS_MAXSIZE = 16 * 1024 * 1024
+
+	// 上传时以该前缀开头的请求头保存为needle的用户元数据，下载时原样返回。
+	HEADER_META_PREFIX = "X-Kds-Meta-"
+	// 上传时指定needle的TTL，也可用表单字段或URL参数ttl，如3600、90m、7d。
+	HEADER_TTL = "X-Kds-Ttl"
 )
 
 // **************** StackServer ****************
@@ -26,16 +42,19 @@ type StackServer struct {
 	mux    *echo.Echo
 	store  *haystack.Store
 	closed bool
+
+	admin_token string // empty if the admin API is disabled.
 }
 
 // ======== NewStackServer() ========
-func NewStackServer(ip string, port int, store_dir string) (ss *StackServer, err error) {
+// Volumes are placed on the disks, each of a store dir.
+func NewStackServer(ip string, port int, disks []*haystack.Disk, config *haystack.Config) (ss *StackServer, err error) {
 	ss = &StackServer{
 		Name:   "Default",
 		ip:     ip,
 		port:   port,
 		mux:    echo.New(),
-		store:  haystack.NewStore(store_dir),
+		store:  haystack.NewDiskStore(disks, config),
 		closed: false,
 	}
 
@@ -43,6 +62,7 @@ func NewStackServer(ip string, port int, store_dir string) (ss *StackServer, err
 		return
 	}
 
+	ss.registerAdminHandlers()
 	ss.mux.Get("/:bucket/*object", ss.DownloadHandler)
 	ss.mux.Put("/:bucket/*object", ss.UploadHandler)
 	ss.mux.Delete("/:bucket/*object", ss.DeleteHandler)
@@ -79,7 +99,7 @@ func (this *StackServer) DownloadHandler(ctx echo.Context) (err error) {
 	if key, err = strconv.ParseInt(ctx.QueryParam("key"), 10, 64); err != nil {
 		return
 	}
-	if cookie, err = strconv.ParseInt(ctx.QueryParam("cookie"), 10, 64); err != nil {
+	if cookie, err = strconv.ParseInt(ctx.QueryParam("cookie"), 10, 32); err != nil {
 		return
 	}
 
@@ -88,20 +108,290 @@ func (this *StackServer) DownloadHandler(ctx echo.Context) (err error) {
 	var volume *haystack.Volume
 	var ok bool
 	if volume, ok = this.store.GetVolume(int32(vid)); !ok {
+		if this.store.IsFaulty(int32(vid)) {
+			return ctx.HTML(http.StatusServiceUnavailable, "Volume is faulty.\n")
+		}
 		err = fmt.Errorf("Volume not exist. vid=%d", vid)
 		utils.LogErrorf(err, "DownloadHandler()")
 		return
 	}
 
-	var needle *haystack.Needle
-	if needle, err = volume.ReadNeedle(key); err != nil {
-		if err == errors.ErrNeedleNotExist {
+	var reader *haystack.NeedleReader
+	if reader, err = volume.OpenNeedle(key, int32(cookie)); err != nil {
+		// 不区分key不存在与cookie不匹配，避免泄露哪些key存在。
+		if err == errors.ErrNeedleNotExist || err == errors.ErrNeedleCookieNotMatch {
 			return ctx.HTML(http.StatusNotFound, "Needle not exist.\n")
 		}
+		if err == errors.ErrNeedleCorrupted {
+			return ctx.HTML(http.StatusInternalServerError, "Needle data corrupted.\n")
+		}
+		return
+	}
+	defer reader.Close()
+
+	// 去重的引用needle从共享的数据needle读取，元数据沿用引用needle。
+	if reader.Needle.IsReference() {
+		var blob *haystack.NeedleReader
+		if blob, err = this.store.OpenReference(reader); err != nil {
+			if err == errors.ErrNeedleCorrupted {
+				return ctx.HTML(http.StatusInternalServerError, "Needle data corrupted.\n")
+			}
+			return
+		}
+		defer blob.Close()
+		reader = blob
+	}
+
+	r, w := httpRequestResponse(ctx)
+
+	// manifest needle按顺序读出各chunk，Range可以跨越chunk。
+	if reader.Needle.IsManifest() {
+		var object *haystack.ManifestReader
+		if object, err = this.store.OpenManifest(reader); err != nil {
+			if err == errors.ErrNeedleCorrupted {
+				return ctx.HTML(http.StatusInternalServerError, "Needle data corrupted.\n")
+			}
+			return
+		}
+		defer object.Close()
+		w.Header().Set("ETag", reader.ETag())
+		setMetaHeaders(w.Header(), reader.Needle)
+		http.ServeContent(w, r, ctx.Param("object"), object.ModTime(), object)
+		return nil
+	}
+
+	// 压缩保存的needle：客户端接受该编码时原样发送压缩数据，Range按压缩数据计；
+	// 否则发送解压后的数据，见serveCompressed()。
+	if codec := haystack.GetCodec(reader.Needle.Codec()); codec != nil {
+		return this.serveCompressed(ctx, reader, codec)
+	}
+
+	return serveNeedle(w, r, ctx.Param("object"), reader)
+}
+
+// -------- serveNeedle() --------
+// Send plaintext data of the needle.
+func serveNeedle(w http.ResponseWriter, r *http.Request, name string, reader *haystack.NeedleReader) (err error) {
+	var content io.ReadSeeker
+	if content, err = needleContent(r, reader); err != nil {
+		if err == errors.ErrNeedleCorrupted {
+			http.Error(w, "Needle data corrupted.", http.StatusInternalServerError)
+			return nil
+		}
+		return
+	}
+	if section, ok := content.(*haystack.FileSection); ok {
+		defer section.Close()
+	}
+
+	// ServeContent handles Range, If-None-Match and If-Modified-Since, and
+	// sets Content-Type from the object name or by sniffing the data unless
+	// the needle has its own.
+	w.Header().Set("ETag", reader.ETag())
+	setMetaHeaders(w.Header(), reader.Needle)
+	http.ServeContent(w, r, name, reader.ModTime(), content)
+	return nil
+}
+
+// -------- needleContent() --------
+// 不带Range的小文件先整体读入内存校验，校验失败返回5xx而不是错误的数据，之后
+// 从内存发送。Range和大文件直接从数据文件的FileSection发送，net/http把它复制到
+// TCP连接时使用sendfile，数据不经过校验。解密后或纠删码卷的needle没有FileSection，
+// 由NeedleReader边发送边校验，失败时最后一段数据不发送，连接被中断。
+func needleContent(r *http.Request, reader *haystack.NeedleReader) (content io.ReadSeeker, err error) {
+	if r.Header.Get("Range") == "" && reader.Size() <= DOWNLOAD_VERIFY_MAXSIZE {
+		if err = reader.Load(); err != nil {
+			return
+		}
+		return reader, nil
+	}
+	section, e := reader.OpenFileSection()
+	if e != nil {
+		utils.LogWarnf(e, "Open data file section of needle %d failed.", reader.Needle.Key)
+	}
+	if section == nil {
+		return reader, nil
+	}
+	return section, nil
+}
+
+// -------- serveCompressed() --------
+func (this *StackServer) serveCompressed(ctx echo.Context, reader *haystack.NeedleReader, codec haystack.Codec) (err error) {
+	r, w := httpRequestResponse(ctx)
+	header := w.Header()
+	header.Set("Vary", "Accept-Encoding")
+	// 数据已压缩，不能由ServeContent按内容猜测Content-Type。
+	content_type := reader.Needle.Mime
+	if content_type == "" {
+		content_type = mime.TypeByExtension(path.Ext(ctx.Param("object")))
+	}
+	if content_type == "" {
+		content_type = "application/octet-stream"
+	}
+	header.Set("Content-Type", content_type)
+	setMetaHeaders(header, reader.Needle)
+
+	if acceptEncoding(r.Header.Get("Accept-Encoding"), codec.Name()) {
+		header.Set("Content-Encoding", codec.Name())
+		// 与解压后的表示区分。
+		header.Set("ETag", strings.TrimSuffix(reader.ETag(), "\"")+"-"+codec.Name()+"\"")
+		http.ServeContent(w, r, ctx.Param("object"), reader.ModTime(), reader)
+		return nil
+	}
+
+	return serveDecompressed(w, r, ctx.Param("object"), reader, codec)
+}
+
+// -------- serveDecompressed() --------
+// Send decompressed data of the needle to a client not accepting its codec.
+// 解压后不大的needle在内存中解压，由ServeContent处理Range和条件请求；
+// 否则边读边解压，忽略Range返回完整数据。
+func serveDecompressed(w http.ResponseWriter, r *http.Request, name string, reader *haystack.NeedleReader, codec haystack.Codec) (err error) {
+	header := w.Header()
+	header.Set("ETag", reader.ETag())
+	if reader.Size() <= DOWNLOAD_VERIFY_MAXSIZE {
+		if err = reader.Load(); err != nil {
+			if err == errors.ErrNeedleCorrupted {
+				http.Error(w, "Needle data corrupted.", http.StatusInternalServerError)
+				return nil
+			}
+			return
+		}
+		var data []byte
+		if data, err = decompress(codec, reader, DOWNLOAD_DECOMPRESS_MAXSIZE+1); err != nil {
+			utils.LogErrorf(err, "Decompress needle failed. key:%d", reader.Needle.Key)
+			http.Error(w, "Needle data corrupted.", http.StatusInternalServerError)
+			return nil
+		}
+		if len(data) <= DOWNLOAD_DECOMPRESS_MAXSIZE {
+			http.ServeContent(w, r, name, reader.ModTime(), bytes.NewReader(data))
+			return nil
+		}
+		if _, err = reader.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+	}
+
+	header.Set("Accept-Ranges", "none")
+	modtime := reader.ModTime()
+	if !modtime.IsZero() {
+		header.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, reader.ETag(), modtime) {
+		header.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	var data io.ReadCloser
+	if data, err = codec.NewReader(reader); err != nil {
+		utils.LogErrorf(err, "Decompress needle failed. key:%d", reader.Needle.Key)
+		http.Error(w, "Needle data corrupted.", http.StatusInternalServerError)
+		return nil
+	}
+	defer data.Close()
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		if _, err = io.Copy(w, data); err != nil {
+			utils.LogErrorf(err, "Send decompressed needle failed. key:%d", reader.Needle.Key)
+		}
+	}
+	return nil
+}
+
+// -------- decompress() --------
+// Decompress up to limit bytes of data from reader.
+func decompress(codec haystack.Codec, reader io.Reader, limit int64) (data []byte, err error) {
+	var decompressed io.ReadCloser
+	if decompressed, err = codec.NewReader(reader); err != nil {
 		return
 	}
+	defer decompressed.Close()
+	return ioutil.ReadAll(io.LimitReader(decompressed, limit))
+}
 
-	return ctx.HTML(http.StatusOK, fmt.Sprintf("%s\n", string(needle.Data)))
+// -------- notModified() --------
+// Conditional GET or HEAD request is satisfied by the cached representation.
+// If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return match == etag
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modtime.IsZero() {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(since)
+}
+
+// -------- acceptEncoding() --------
+// Whether Accept-Encoding header accepts coding.
+func acceptEncoding(accept string, coding string) bool {
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		if strings.ToLower(strings.TrimSpace(params[0])) != coding {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.Replace(param, " ", "", -1); q == "q=0" || strings.HasPrefix(q, "q=0.0") && strings.Trim(q[5:], "0") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// -------- setMetaHeaders() --------
+// Content-Type, Content-Disposition and user metadata headers of needle.
+func setMetaHeaders(header http.Header, needle *haystack.Needle) {
+	if needle.Mime != "" {
+		header.Set("Content-Type", needle.Mime)
+	}
+	if needle.Name != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": needle.Name}))
+	}
+	for key, value := range needle.Meta {
+		header.Set(HEADER_META_PREFIX+key, value)
+	}
+}
+
+// -------- readMetaHeaders() --------
+// User metadata from request headers with HEADER_META_PREFIX.
+func readMetaHeaders(header http.Header) (meta map[string]string) {
+	for key, values := range header {
+		key = http.CanonicalHeaderKey(key)
+		if !strings.HasPrefix(key, HEADER_META_PREFIX) || len(key) == len(HEADER_META_PREFIX) || len(values) == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[key[len(HEADER_META_PREFIX):]] = values[0]
+	}
+	return
+}
+
+// -------- httpRequestResponse() --------
+// The underlying net/http request and response writer of echo standard engine.
+func httpRequestResponse(ctx echo.Context) (*http.Request, http.ResponseWriter) {
+	return ctx.Request().(*standard.Request).Request, ctx.Response().(*standard.Response).ResponseWriter
+}
+
+// **************** UploadResult ****************
+type UploadResult struct {
+	Vid    int32  `json:"vid"`
+	Key    int64  `json:"key"`
+	Cookie int32  `json:"cookie"`
+	Size   uint64 `json:"size"`
+	Chunks int    `json:"chunks,omitempty"`
+	// Codec the needle is stored with, and the stored bytes.
+	Encoding string `json:"encoding,omitempty"`
+	Stored   uint64 `json:"stored,omitempty"`
+	// Content already stored, the needle references it.
+	Dedup bool `json:"dedup,omitempty"`
 }
 
 type sizer interface {
@@ -130,7 +420,8 @@ func checkFileSize(file multipart.File, maxSize int) (size int64, err error) {
 		size = fi.Size()
 	}
 	if maxSize > 0 && size > int64(maxSize) {
-		err = fmt.Errorf("Upload file size > maxSize(%d)", maxSize)
+		utils.LogWarnf(nil, "Upload file size %d > maxSize(%d)", size, maxSize)
+		err = errors.ErrNeedleTooLarge
 		return
 	}
 	return
@@ -158,6 +449,9 @@ func checkFileSize(file multipart.File, maxSize int) (size int64, err error) {
 //}
 
 // ======== UploadHandler() ========
+// multipart/form-data上传时vid/key/cookie取自表单，其余Content-Type将请求体
+// 整体作为needle数据（支持Content-Length与chunked），vid/key/cookie取自URL参数。
+// 超过Config.ChunkSize或长度未知的数据由Store.WriteObject()按需拆分为chunk。
 func (this *StackServer) UploadHandler(ctx echo.Context) (err error) {
 	//props := actor.FromInstance(&UploadActor{})
 	//pid := actor.Spawn(props)
@@ -171,23 +465,133 @@ func (this *StackServer) UploadHandler(ctx echo.Context) (err error) {
 	object := ctx.Param("object")
 	utils.LogDebugf("UploadHandler() bucket:%s object:%s", bucket, object)
 
-	var (
-		vid    int64
-		key    int64
-		cookie int64
-	)
-	if vid, err = strconv.ParseInt(ctx.FormValue("vid"), 10, 32); err != nil {
+	var needle *haystack.Needle
+	var vid int64
+	var body io.ReadCloser
+	content_type := ctx.Request().Header().Get("Content-Type")
+	var str_ttl string
+	if strings.HasPrefix(content_type, "multipart/form-data") {
+		vid, needle, body, err = this.readMultipartNeedle(ctx)
+		str_ttl = ctx.FormValue("ttl")
+	} else {
+		vid, needle, body, err = this.readRawNeedle(ctx)
+		str_ttl = ctx.QueryParam("ttl")
+	}
+	if body != nil {
+		defer body.Close()
+	}
+	if err == nil {
+		r, _ := httpRequestResponse(ctx)
+		if str_ttl == "" {
+			str_ttl = r.Header.Get(HEADER_TTL)
+		}
+		if needle.TTL, err = haystack.ParseTTL(str_ttl); err != nil {
+			return ctx.HTML(http.StatusBadRequest, err.Error()+"\n")
+		}
+		needle.Meta = readMetaHeaders(r.Header)
+		// 提前编码元数据，过大时直接拒绝。写入卷时按卷的needle格式重新编码。
+		err = needle.SetVersion(needle.Version)
+	}
+	if err != nil {
+		return uploadError(ctx, err)
+	}
+
+	// Save to local store. 卷已满时Store换到新卷，响应中返回实际写入的卷id。
+	var used int32
+	var manifest *haystack.Manifest
+	var dup bool
+	size := uint64(needle.Size)
+	if body != nil {
+		counter := &countReader{reader: body}
+		used, manifest, err = this.store.WriteObject(int32(vid), needle, counter)
+		size = counter.n
+	} else if err = this.store.CompressNeedle(int32(vid), needle); err == nil {
+		used, dup, err = this.store.WriteDedupNeedle(int32(vid), needle)
+	}
+	if err != nil {
+		return uploadError(ctx, err)
+	}
+
+	utils.LogInfof("Upload a needle to volume %d. \n%s\n", used, needle.String())
+
+	//ctx.Data(iris.StatusOK, []byte("Handle_Upload() return OK."))
+
+	result := UploadResult{
+		Vid:    used,
+		Key:    needle.Key,
+		Cookie: needle.Cookie,
+		Size:   size,
+		Dedup:  dup,
+	}
+	if codec := haystack.GetCodec(needle.Codec()); codec != nil {
+		result.Encoding = codec.Name()
+		result.Stored = uint64(needle.Size)
+	}
+	if manifest != nil {
+		result.Size = manifest.Size
+		result.Chunks = len(manifest.Chunks)
+	}
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// **************** countReader ****************
+// Count bytes read from an upload body of unknown length.
+type countReader struct {
+	reader io.Reader
+	n      uint64
+}
+
+// ======== Read() ========
+func (this *countReader) Read(p []byte) (n int, err error) {
+	n, err = this.reader.Read(p)
+	this.n += uint64(n)
+	return
+}
+
+// -------- uploadError() --------
+func uploadError(ctx echo.Context, err error) error {
+	switch err {
+	case errors.ErrNeedleTooLarge:
+		return ctx.HTML(http.StatusRequestEntityTooLarge, "Needle data too large.\n")
+	case errors.ErrNeedleMetaTooLarge:
+		return ctx.HTML(http.StatusRequestHeaderFieldsTooLarge, "Needle metadata too large.\n")
+	case io.ErrUnexpectedEOF:
+		return ctx.HTML(http.StatusBadRequest, "Incomplete request body.\n")
+	case errors.ErrVolumeFaulty:
+		return ctx.HTML(http.StatusServiceUnavailable, "Volume is faulty.\n")
+	case errors.ErrNeedleExist:
+		return ctx.HTML(http.StatusConflict, "Needle already exists in the rolled over volumes.\n")
+	}
+	return err
+}
+
+// -------- parseUploadParams() --------
+// 解析vid/key/cookie，客户端未指定cookie时由服务端生成，在响应中返回。
+func parseUploadParams(value func(name string) string) (vid int64, key int64, cookie int64, err error) {
+	if vid, err = strconv.ParseInt(value("vid"), 10, 32); err != nil {
 		utils.LogErrorf(err, "ParseInt from vid")
 		return
 	}
-	if key, err = strconv.ParseInt(ctx.FormValue("key"), 10, 64); err != nil {
+	if key, err = strconv.ParseInt(value("key"), 10, 64); err != nil {
 		utils.LogErrorf(err, "ParseInt from Key")
 		return
 	}
-	if cookie, err = strconv.ParseInt(ctx.FormValue("cookie"), 10, 64); err != nil {
+	if str_cookie := value("cookie"); str_cookie == "" {
+		cookie = int64(haystack.RandomCookie())
+	} else if cookie, err = strconv.ParseInt(str_cookie, 10, 32); err != nil {
 		utils.LogErrorf(err, "ParseInt from cookie")
 		return
 	}
+	return
+}
+
+// -------- readMultipartNeedle() --------
+// 文件超过Config.ChunkSize时不读取数据，返回的body由调用者读取并关闭。
+func (this *StackServer) readMultipartNeedle(ctx echo.Context) (vid int64, needle *haystack.Needle, body io.ReadCloser, err error) {
+	var key, cookie int64
+	if vid, key, cookie, err = parseUploadParams(ctx.FormValue); err != nil {
+		return
+	}
 	var fh *multipart.FileHeader
 	if fh, err = ctx.FormFile("file"); err != nil {
 		return
@@ -207,48 +611,100 @@ Content-Type:         %s
 		fh.Header.Get("Content-Type"),
 	))
 
-	// Get or create volume in store.
-	var volume *haystack.Volume
-	var ok bool
-	if volume, ok = this.store.GetVolume(int32(vid)); !ok {
-		if volume, err = this.store.CreateVolume(int32(vid)); err != nil {
-			return
-		}
-	}
-
-	file, err := fh.Open()
-	defer file.Close()
-	if err != nil {
+	var file multipart.File
+	if file, err = fh.Open(); err != nil {
 		return
 	}
 
 	var file_len int64
-	if file_len, err = checkFileSize(file, UPLOADFILE_MAXSIZE); err != nil {
+	if file_len, err = checkFileSize(file, int(this.store.Config.ObjectMaxSize)); err != nil {
+		file.Close()
 		return
 	}
 	utils.LogDebugf("checkFileSize(). file_len=%d", file_len)
 
 	// Create new needle and fill the data and metadata.
-	needle := haystack.NewNeedle(key, int32(cookie), uint32(file_len))
+	if uint64(file_len) > this.store.Config.ChunkSize {
+		needle = haystack.NewNeedle(key, int32(cookie), 0)
+		body = file
+	} else {
+		needle = haystack.NewNeedle(key, int32(cookie), uint32(file_len))
+		_, err = needle.ReadFrom(file)
+		file.Close()
+		if err != nil {
+			return
+		}
+	}
+	needle.Name = fh.Filename
+	needle.Mime = fh.Header.Get("Content-Type")
+	return
+}
 
-	if err = needle.ReadFrom(file); err != nil {
+// -------- readRawNeedle() --------
+// 请求体即needle数据。有Content-Length时预先检查大小，不超过Config.ChunkSize
+// 时按长度读满；更大或chunked时返回请求体作为body，由调用者边读边写入。
+func (this *StackServer) readRawNeedle(ctx echo.Context) (vid int64, needle *haystack.Needle, body io.ReadCloser, err error) {
+	var key, cookie int64
+	if vid, key, cookie, err = parseUploadParams(ctx.QueryParam); err != nil {
 		return
 	}
-	//needle.Data = make([]byte, file_len)
-	//if _, err := file.Read(needle.Data); err != nil {
-	//}
-
-	// Save to local store.
-	volume.WriteNeedle(needle)
-
-	utils.LogInfof("Upload a needle to a volume. \n%s\n%s\n", needle.String(), volume.String())
+	r, _ := httpRequestResponse(ctx)
 
-	//ctx.Data(iris.StatusOK, []byte("Handle_Upload() return OK."))
+	utils.LogDebugf("Raw upload. vid=%d key=%d cookie=%d Content-Length=%d Transfer-Encoding=%v",
+		vid, key, cookie, r.ContentLength, r.TransferEncoding)
 
-	return ctx.HTML(http.StatusOK, "Handle_Upload() return OK.\n")
+	if r.ContentLength > int64(this.store.Config.ObjectMaxSize) {
+		err = errors.ErrNeedleTooLarge
+		return
+	}
+	if r.ContentLength >= 0 && uint64(r.ContentLength) <= this.store.Config.ChunkSize {
+		needle = haystack.NewNeedle(key, int32(cookie), uint32(r.ContentLength))
+		_, err = needle.ReadFrom(r.Body)
+	} else {
+		needle = haystack.NewNeedle(key, int32(cookie), 0)
+		body = r.Body
+	}
+	if err == nil {
+		if name := path.Base(ctx.Param("object")); name != "." && name != "/" {
+			needle.Name = name
+		}
+		needle.Mime = r.Header.Get("Content-Type")
+	}
+	return
 }
 
 // ======== DeleteHandler() ========
 func (this *StackServer) DeleteHandler(ctx echo.Context) (err error) {
-	return
+	var (
+		vid    int64
+		key    int64
+		cookie int64
+	)
+	if vid, err = strconv.ParseInt(ctx.QueryParam("vid"), 10, 32); err != nil {
+		return
+	}
+	if key, err = strconv.ParseInt(ctx.QueryParam("key"), 10, 64); err != nil {
+		return
+	}
+	if cookie, err = strconv.ParseInt(ctx.QueryParam("cookie"), 10, 32); err != nil {
+		return
+	}
+
+	utils.LogDebugf("DeleteHandler() vid=%d key=%d cookie=%d", vid, key, cookie)
+
+	// manifest needle的chunk一并删除。
+	if err = this.store.DeleteObject(int32(vid), key, int32(cookie)); err != nil {
+		if err == errors.ErrVolumeNotExist {
+			return ctx.HTML(http.StatusNotFound, "Volume not exist.\n")
+		}
+		if err == errors.ErrVolumeFaulty {
+			return ctx.HTML(http.StatusServiceUnavailable, "Volume is faulty.\n")
+		}
+		if err == errors.ErrNeedleNotExist || err == errors.ErrNeedleCookieNotMatch {
+			return ctx.HTML(http.StatusNotFound, "Needle not exist.\n")
+		}
+		return
+	}
+
+	return ctx.HTML(http.StatusOK, "Needle deleted.\n")
 }
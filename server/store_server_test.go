@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"github.com/uukuguy/kds/haystack"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeNeedle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_server_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := haystack.NewStore(dir, nil)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+	volume, err := store.CreateVolume(1)
+	if err != nil {
+		t.Fatalf("Store.CreateVolume() failed. %v", err)
+	}
+
+	small := bytes.Repeat([]byte("kleine dateien stack\n"), 100)
+	large := make([]byte, DOWNLOAD_VERIFY_MAXSIZE+1)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+	for key, data := range [][]byte{small, large} {
+		needle := haystack.NewNeedle(int64(key), 1, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		if err = volume.WriteNeedle(needle); err != nil {
+			t.Fatalf("Volume.WriteNeedle() failed. %v", err)
+		}
+	}
+
+	// Small whole needles are loaded and verified, Range and large requests
+	// are sent from a section of the data file by sendfile.
+	for _, c := range []struct {
+		key     int64
+		ranges  string
+		section bool
+	}{{0, "", false}, {0, "bytes=10-20", true}, {1, "", true}} {
+		reader, err := volume.OpenNeedle(c.key, 1)
+		if err != nil {
+			t.Fatalf("Volume.OpenNeedle() failed. %v", err)
+		}
+		r := httptest.NewRequest("GET", "/a/b.bin", nil)
+		if c.ranges != "" {
+			r.Header.Set("Range", c.ranges)
+		}
+		content, err := needleContent(r, reader)
+		if err != nil {
+			t.Fatalf("needleContent() failed. %v", err)
+		}
+		section, ok := content.(*haystack.FileSection)
+		if _, conn := content.(syscall.Conn); ok != c.section || conn != c.section {
+			t.Errorf("key %d Range %q content %T, want file section %v", c.key, c.ranges, content, c.section)
+		}
+		if ok {
+			section.Close()
+		}
+		reader.Close()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := volume.OpenNeedle(1, 1)
+		if err != nil {
+			t.Errorf("Volume.OpenNeedle() failed. %v", err)
+			return
+		}
+		defer reader.Close()
+		serveNeedle(w, r, "b.bin", reader)
+	}))
+	defer server.Close()
+	for _, c := range []struct {
+		ranges string
+		code   int
+		want   []byte
+	}{{"", http.StatusOK, large}, {"bytes=1000-200000", http.StatusPartialContent, large[1000:200001]}} {
+		r, _ := http.NewRequest("GET", server.URL, nil)
+		if c.ranges != "" {
+			r.Header.Set("Range", c.ranges)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("GET failed. %v", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != c.code || !bytes.Equal(body, c.want) {
+			t.Errorf("Range %q response %d, %d bytes, err=%v", c.ranges, resp.StatusCode, len(body), err)
+		}
+	}
+}
+
+func TestServeDecompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kds_server_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed. %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := haystack.NewStore(dir, nil)
+	if err = store.Init(); err != nil {
+		t.Fatalf("Store.Init() failed. %v", err)
+	}
+	defer store.Close()
+	volume, err := store.CreateVolume(1)
+	if err != nil {
+		t.Fatalf("Store.CreateVolume() failed. %v", err)
+	}
+
+	small := bytes.Repeat([]byte("kleine dateien stack\n"), 100)
+	large := bytes.Repeat([]byte("x"), DOWNLOAD_DECOMPRESS_MAXSIZE+1)
+	mtime := time.Now().Add(-time.Hour)
+	for key, data := range [][]byte{small, large} {
+		needle := haystack.NewNeedle(int64(key), 1, uint32(len(data)))
+		needle.ReadFrom(bytes.NewReader(data))
+		needle.MTime = mtime.Unix()
+		if compressed, err := needle.Compress(haystack.CODEC_GZIP); err != nil || !compressed {
+			t.Fatalf("Needle.Compress() compressed=%v %v", compressed, err)
+		}
+		if err = volume.WriteNeedle(needle); err != nil {
+			t.Fatalf("Volume.WriteNeedle() failed. %v", err)
+		}
+	}
+	serve := func(key int64, header http.Header) *httptest.ResponseRecorder {
+		reader, err := volume.OpenNeedle(key, 1)
+		if err != nil {
+			t.Fatalf("Volume.OpenNeedle() failed. %v", err)
+		}
+		defer reader.Close()
+		r := httptest.NewRequest("GET", "/a/b.txt", nil)
+		r.Header = header
+		w := httptest.NewRecorder()
+		codec := haystack.GetCodec(haystack.CODEC_GZIP)
+		if err = serveDecompressed(w, r, "b.txt", reader, codec); err != nil {
+			t.Fatalf("serveDecompressed() failed. %v", err)
+		}
+		return w
+	}
+
+	// Range and conditional requests on small needles.
+	w := serve(0, http.Header{"Range": {"bytes=21-40"}})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), small[21:41]) {
+		t.Errorf("Range response %d %q", w.Code, w.Body.Bytes())
+	}
+	w = serve(0, http.Header{"Range": {"bytes=5000-"}})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable Range response %d, want 416", w.Code)
+	}
+	since := mtime.Add(time.Minute).UTC().Format(http.TimeFormat)
+	if w = serve(0, http.Header{"If-Modified-Since": {since}}); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since response %d, want 304", w.Code)
+	}
+	if w = serve(0, nil); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), small) {
+		t.Errorf("response %d, %d bytes", w.Code, w.Body.Len())
+	}
+
+	// Range is ignored on large needles, conditional requests still work.
+	w = serve(1, http.Header{"Range": {"bytes=0-9"}})
+	if w.Code != http.StatusOK || w.Header().Get("Accept-Ranges") != "none" || !bytes.Equal(w.Body.Bytes(), large) {
+		t.Errorf("Range on large needle response %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w = serve(1, http.Header{"If-Modified-Since": {since}}); w.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since on large needle response %d, want 304", w.Code)
+	}
+}
@@ -10,7 +10,10 @@ const (
 	// -------- Store --------
 
 	// -------- Volume --------
-	msgVolumeNotExist = 2001
+	msgVolumeNotExist   = 2001
+	msgVolumeCompacting = 2002
+	msgVolumeReadOnly   = 2003
+	msgVolumeFaulty     = 2004
 
 	// -------- Data --------
 	msgDataNomoreSpace = 3001
@@ -19,7 +22,12 @@ const (
 	msgIndexNomoreSpace = 4001
 
 	// -------- Needle --------
-	msgNeedleNotExist = 5001
+	msgNeedleNotExist       = 5001
+	msgNeedleCorrupted      = 5002
+	msgNeedleCookieNotMatch = 5003
+	msgNeedleTooLarge       = 5004
+	msgNeedleMetaTooLarge   = 5005
+	msgNeedleExist          = 5006
 
 	// -------- StoreServer --------
 
@@ -30,7 +38,10 @@ var (
 		// -------- Store --------
 
 		// -------- Volume --------
-		msgVolumeNotExist: "Volume not exist.",
+		msgVolumeNotExist:   "Volume not exist.",
+		msgVolumeCompacting: "Volume is compacting.",
+		msgVolumeReadOnly:   "Volume is read-only.",
+		msgVolumeFaulty:     "Volume is faulty.",
 
 		// -------- Data --------
 		msgDataNomoreSpace: "No more space in data file",
@@ -39,7 +50,12 @@ var (
 		msgIndexNomoreSpace: "No more space in index file.",
 
 		// -------- Needle --------
-		msgNeedleNotExist: "Needle not exist.",
+		msgNeedleNotExist:       "Needle not exist.",
+		msgNeedleCorrupted:      "Needle data corrupted.",
+		msgNeedleCookieNotMatch: "Needle cookie not match.",
+		msgNeedleTooLarge:       "Needle data too large.",
+		msgNeedleMetaTooLarge:   "Needle metadata too large.",
+		msgNeedleExist:          "Needle already exists.",
 
 		// -------- StoreServer --------
 	}
@@ -49,7 +65,10 @@ var (
 	// -------- Store --------
 
 	// -------- Volume --------
-	ErrVolumeNotExist = Error(msgVolumeNotExist)
+	ErrVolumeNotExist   = Error(msgVolumeNotExist)
+	ErrVolumeCompacting = Error(msgVolumeCompacting)
+	ErrVolumeReadOnly   = Error(msgVolumeReadOnly)
+	ErrVolumeFaulty     = Error(msgVolumeFaulty)
 
 	// -------- Data --------
 	ErrDataNomoreSpace = Error(msgDataNomoreSpace)
@@ -58,7 +77,12 @@ var (
 	ErrIndexNomoreSpace = Error(msgIndexNomoreSpace)
 
 	// -------- Needle --------
-	ErrNeedleNotExist = Error(msgNeedleNotExist)
+	ErrNeedleNotExist       = Error(msgNeedleNotExist)
+	ErrNeedleCorrupted      = Error(msgNeedleCorrupted)
+	ErrNeedleCookieNotMatch = Error(msgNeedleCookieNotMatch)
+	ErrNeedleTooLarge       = Error(msgNeedleTooLarge)
+	ErrNeedleMetaTooLarge   = Error(msgNeedleMetaTooLarge)
+	ErrNeedleExist          = Error(msgNeedleExist)
 
 	// -------- StoreServer --------
 )
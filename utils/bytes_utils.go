@@ -130,6 +130,17 @@ func (bigEndian) PutInt64(b []byte, v int64) {
 	b[7] = byte(v)
 }
 
+func (bigEndian) PutUint64(b []byte, v uint64) {
+	b[0] = byte(v >> 56)
+	b[1] = byte(v >> 48)
+	b[2] = byte(v >> 40)
+	b[3] = byte(v >> 32)
+	b[4] = byte(v >> 24)
+	b[5] = byte(v >> 16)
+	b[6] = byte(v >> 8)
+	b[7] = byte(v)
+}
+
 func (bigEndian) WriteInt64(w *bufio.Writer, v int64) (err error) {
 	if err = w.WriteByte(byte(v >> 56)); err != nil {
 		return